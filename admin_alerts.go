@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/webhook"
+	"github.com/google/uuid"
+)
+
+const adminAlertTimeout = 10 * time.Second
+
+// adminAlerts is where operational alerts go. Alerts are always logged and
+// are also POSTed, signed with the webhook package, when a URL is set.
+type adminAlerts struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+type adminAlert struct {
+	Kind    string         `json:"kind"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+	SentAt  time.Time      `json:"sent_at"`
+}
+
+func newAdminAlerts(url, secret string) *adminAlerts {
+	return &adminAlerts{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: adminAlertTimeout},
+	}
+}
+
+func (a *adminAlerts) send(kind, message string, details map[string]any) {
+	log.Printf("ALERT %s: %s %v", kind, message, details)
+	if a == nil || a.url == "" {
+		return
+	}
+	alert := adminAlert{Kind: kind, Message: message, Details: details, SentAt: time.Now().UTC()}
+	go func() {
+		if err := a.post(alert); err != nil {
+			log.Printf("Couldn't deliver %s alert: %v", kind, err)
+		}
+	}()
+}
+
+func (a *adminAlerts) post(alert adminAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminAlertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	webhook.SignRequest(req, a.secret, uuid.NewString(), body)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert endpoint returned %s", resp.Status)
+	}
+	return nil
+}
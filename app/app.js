@@ -163,16 +163,26 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
-      method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
-      body: formData,
-    });
-    if (!res.ok) {
-      const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+    if (videoFile.type === 'video/mp4') {
+      await uploadVideoToBucket(videoID, videoFile);
+    } else {
+      // transcoding takes a while, so don't hold the request open for it
+      const res = await fetch(`/api/video_upload/${videoID}`, {
+        method: 'POST',
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem('token')}`,
+          Prefer: 'respond-async',
+        },
+        body: formData,
+      });
+      if (!res.ok) {
+        const data = await res.json();
+        throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      }
+      if (res.status === 202) {
+        const job = await res.json();
+        await waitForJob(job.id);
+      }
     }
 
     console.log('Video uploaded!');
@@ -184,6 +194,67 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+// waitForJob polls a processing job until the server is done with it.
+async function waitForJob(jobID) {
+  for (;;) {
+    const res = await fetch(`/api/jobs/${jobID}`, {
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    const job = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to check processing. Error: ${job.error}`);
+    }
+    if (job.status === 'ready') return;
+    if (job.status === 'failed') {
+      throw new Error(`Failed to process video file. Error: ${job.error}`);
+    }
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+  }
+}
+
+// uploadVideoToBucket posts an mp4 straight to S3 with a signed form policy,
+// then asks the server to file it.
+async function uploadVideoToBucket(videoID, videoFile) {
+  const headers = {
+    Authorization: `Bearer ${localStorage.getItem('token')}`,
+  };
+
+  let res = await fetch(`/api/videos/${videoID}/upload/form`, {
+    method: 'POST',
+    headers,
+  });
+  if (!res.ok) {
+    const data = await res.json();
+    throw new Error(`Failed to start upload. Error: ${data.error}`);
+  }
+  const upload = await res.json();
+  if (videoFile.size > upload.max_size) {
+    throw new Error(`File is larger than the ${upload.max_size} bytes you can upload`);
+  }
+
+  // S3 ignores fields after the file, so it goes last
+  const formData = new FormData();
+  for (const [name, value] of Object.entries(upload.fields)) {
+    formData.append(name, value);
+  }
+  formData.append('file', videoFile);
+  res = await fetch(upload.url, { method: 'POST', body: formData });
+  if (!res.ok) {
+    throw new Error(`Failed to upload video file to storage (${res.status})`);
+  }
+
+  res = await fetch(`/api/videos/${videoID}/upload/direct/${upload.upload_id}/confirm`, {
+    method: 'POST',
+    headers,
+  });
+  if (!res.ok) {
+    const data = await res.json();
+    throw new Error(`Failed to upload video file. Error: ${data.error}`);
+  }
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// objectFingerprint turns an S3 ETag into the fingerprint stored on a
+// video. S3 sends them quoted, which is header syntax and not part of the
+// value.
+func objectFingerprint(etag *string) *string {
+	if etag == nil {
+		return nil
+	}
+	fingerprint := strings.Trim(*etag, `"`)
+	return &fingerprint
+}
+
+// quotedETag is the ETag header for a stored fingerprint.
+func quotedETag(fingerprint string) string {
+	return `"` + fingerprint + `"`
+}
+
+// etagMatches reports whether an If-None-Match header names etag. Weak
+// validators match too, as If-None-Match only needs weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified answers a request whose If-None-Match names fingerprint with
+// 304, and otherwise sets the ETag for the response about to be written.
+func notModified(w http.ResponseWriter, r *http.Request, fingerprint *string) bool {
+	if fingerprint == nil {
+		return false
+	}
+	etag := quotedETag(*fingerprint)
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -3,12 +3,27 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
+// how many fresh names saveAssetFile tries before giving up
+const assetNameAttempts = 3
+
+// mediaTypeExts is the one place media types map to file extensions. Types
+// missing from it are stored as .bin.
+var mediaTypeExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+	"video/mp4":  ".mp4",
+}
+
 func (cfg apiConfig) ensureAssetsDir() error {
 	if _, err := os.Stat(cfg.assetsRoot); os.IsNotExist(err) {
 		return os.Mkdir(cfg.assetsRoot, 0755)
@@ -32,18 +47,64 @@ func (cfg apiConfig) getObjectURL(key string) string {
 	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.s3Bucket, cfg.s3Region, key)
 }
 
-func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
-	return filepath.Join(cfg.assetsRoot, assetPath)
+// getAssetDiskPath resolves an asset name inside the assets dir, refusing
+// anything that would land outside it.
+func (cfg apiConfig) getAssetDiskPath(assetPath string) (string, error) {
+	if err := checkPathElem(assetPath); err != nil {
+		return "", err
+	}
+	return filepath.Join(cfg.assetsRoot, assetPath), nil
 }
 
 func (cfg apiConfig) getAssetURL(assetPath string) string {
 	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
 }
 
+// saveAssetFile moves a finished temp file into the assets dir under a new
+// random name and returns that name. It links rather than renames so an
+// existing asset is never overwritten; on a name collision it tries again.
+func (cfg apiConfig) saveAssetFile(tempPath, mediaType string) (string, error) {
+	for range assetNameAttempts {
+		assetPath := getAssetPath(mediaType)
+		diskPath, err := cfg.getAssetDiskPath(assetPath)
+		if err != nil {
+			return "", err
+		}
+		err = os.Link(tempPath, diskPath)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		os.Remove(tempPath)
+		return assetPath, nil
+	}
+	return "", fmt.Errorf("couldn't find a free asset name after %d attempts", assetNameAttempts)
+}
+
 func mediaTypeToExt(mediaType string) string {
-	parts := strings.Split(mediaType, "/")
-	if len(parts) != 2 {
-		return ".bin"
+	if ext, ok := mediaTypeExts[mediaType]; ok {
+		return ext
 	}
-	return "." + parts[1]
+	return ".bin"
+}
+
+// joinKey builds an S3 key from path elements. Keys always use forward
+// slashes whatever the OS, and no element may climb out of its prefix.
+func joinKey(elems ...string) (string, error) {
+	for _, elem := range elems {
+		if err := checkPathElem(elem); err != nil {
+			return "", err
+		}
+	}
+	return path.Join(elems...), nil
+}
+
+// checkPathElem rejects anything that isn't a single, plain path element.
+func checkPathElem(elem string) error {
+	if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, `/\`) {
+		return fmt.Errorf("invalid path element %q", elem)
+	}
+	return nil
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/jobs"
+	"github.com/google/uuid"
+)
+
+// Kinds of background job.
+const (
+	// an async upload's processing, see processUploadJob
+	jobProcessUpload = "process-upload"
+	// deleting what a re-upload replaced, see dropReplacedUploads
+	jobDropReplacedUploads = "drop-replaced-uploads"
+	// telling a user's webhook about one of their videos, see
+	// deliverWebhookJob
+	jobDeliverWebhook = "deliver-webhook"
+	// transcribing an upload, see transcribeVideoJob
+	jobTranscribeVideo = "transcribe-video"
+	// a file dropped over SFTP becoming a video, see ingestSFTPUploadJob
+	jobIngestSFTPUpload = "ingest-sftp-upload"
+)
+
+const (
+	defaultJobWorkers = 2
+	// an upload is only tried again while storage or the scanner is down,
+	// and this many tries span about 15 minutes
+	processUploadAttempts = 6
+	// a retry would make the dropped file a second video
+	ingestSFTPUploadAttempts = 1
+)
+
+type dropReplacedUploadsPayload struct {
+	VideoID uuid.UUID `json:"video_id"`
+}
+
+// newJobQueue returns the queue background work goes through, kept in the
+// database and run by workers in this process.
+func (cfg *apiConfig) newJobQueue(workers int) *jobs.Queue {
+	q := jobs.New(cfg.db.JobBackend(), workers, cfg.now)
+	q.Handle(jobProcessUpload, processUploadAttempts, cfg.processUploadJob)
+	q.Handle(jobDropReplacedUploads, 0, cfg.dropReplacedUploadsJob)
+	q.Handle(jobDeliverWebhook, webhookDeliveryAttempts, cfg.deliverWebhookJob)
+	q.Handle(jobTranscribeVideo, transcribeVideoAttempts, cfg.transcribeVideoJob)
+	q.Handle(jobIngestSFTPUpload, ingestSFTPUploadAttempts, cfg.ingestSFTPUploadJob)
+	return q
+}
+
+func (cfg *apiConfig) dropReplacedUploadsJob(ctx context.Context, job jobs.Job) error {
+	var payload dropReplacedUploadsPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+	// deleting the video left its objects to retention
+	if video.ID == uuid.Nil {
+		return nil
+	}
+	return cfg.dropReplacedUploads(ctx, video)
+}
+
+// queueDropReplacedUploads queues the cleanup after a video was pointed at a
+// new upload. Failing to queue only leaves the old objects behind.
+func (cfg *apiConfig) queueDropReplacedUploads(videoID uuid.UUID) {
+	_, err := cfg.jobs.Enqueue(context.Background(), jobDropReplacedUploads, dropReplacedUploadsPayload{VideoID: videoID})
+	if err != nil {
+		log.Printf("Couldn't queue dropping replaced uploads of video %s: %v", videoID, err)
+	}
+}
+
+// runJobsCommand lists the background jobs that failed for good, with why,
+// and with retry queues them again with fresh attempts.
+func (cfg *apiConfig) runJobsCommand(retry bool) error {
+	if retry {
+		n, err := cfg.db.RequeueFailedJobs(cfg.now())
+		if err != nil {
+			return fmt.Errorf("couldn't requeue failed jobs: %w", err)
+		}
+		fmt.Printf("jobs: %d failed jobs queued again\n", n)
+		return nil
+	}
+	queued, err := cfg.db.GetBackgroundJobs(jobs.StatusQueued)
+	if err != nil {
+		return fmt.Errorf("couldn't get queued jobs: %w", err)
+	}
+	failed, err := cfg.db.GetBackgroundJobs(jobs.StatusFailed)
+	if err != nil {
+		return fmt.Errorf("couldn't get failed jobs: %w", err)
+	}
+	for _, job := range failed {
+		fmt.Printf("%s %s failed after %d attempts: %s\n", job.ID, job.Kind, job.Attempts, job.LastError)
+	}
+	fmt.Printf("jobs: %d queued, %d failed\n", len(queued), len(failed))
+	return nil
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const backupPrefix = "backups/"
+
+type backupObject struct {
+	// a customer's bucket holding the object, empty for ours
+	Bucket       string    `json:"bucket,omitempty"`
+	Key          string    `json:"key"`
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type backupManifest struct {
+	ID        string           `json:"id"`
+	CreatedAt time.Time        `json:"created_at"`
+	Bucket    string           `json:"bucket"`
+	Objects   []backupObject   `json:"objects"`
+	Videos    []database.Video `json:"videos"`
+}
+
+func (cfg *apiConfig) runBackup(ctx context.Context) error {
+	id := time.Now().UTC().Format("20060102T150405Z")
+
+	tempDir, err := os.MkdirTemp(cfg.spoolDir, "tubely-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	snapshotPath := filepath.Join(tempDir, "tubely.db")
+	err = cfg.db.Snapshot(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("couldn't snapshot database: %w", err)
+	}
+
+	objects, err := cfg.listBucketObjects(ctx, cfg.defaultStore())
+	if err != nil {
+		return err
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return fmt.Errorf("couldn't get videos: %w", err)
+	}
+	objects = append(objects, cfg.listCustomerVideoObjects(ctx, videos)...)
+
+	manifest := backupManifest{
+		ID:        id,
+		CreatedAt: time.Now().UTC(),
+		Bucket:    cfg.s3Bucket,
+		Objects:   objects,
+		Videos:    videos,
+	}
+	manifestPath := filepath.Join(tempDir, "manifest.json")
+	dat, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(manifestPath, dat, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.uploadFileToS3(ctx, cfg.defaultStore(), path.Join(backupPrefix, id, "tubely.db"), "application/vnd.sqlite3", snapshotPath)
+	if err != nil {
+		return fmt.Errorf("couldn't upload database snapshot: %w", err)
+	}
+	err = cfg.uploadFileToS3(ctx, cfg.defaultStore(), path.Join(backupPrefix, id, "manifest.json"), "application/json", manifestPath)
+	if err != nil {
+		return fmt.Errorf("couldn't upload manifest: %w", err)
+	}
+
+	fmt.Printf("backup %s: %d objects, %d videos\n", id, len(objects), len(videos))
+	return nil
+}
+
+// listBucketObjects lists every media object in store, skipping earlier
+// backups.
+func (cfg *apiConfig) listBucketObjects(ctx context.Context, store objectStore) ([]backupObject, error) {
+	objects := []backupObject{}
+	paginator := s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(store.bucket),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list bucket: %w", err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if strings.HasPrefix(key, backupPrefix) {
+				continue
+			}
+			objects = append(objects, backupObject{
+				Key:          key,
+				ETag:         aws.ToString(obj.ETag),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// listCustomerVideoObjects lists the uploads of videos kept in their owners'
+// own buckets. The rest of those buckets isn't ours to list, so only the
+// videos' current objects are recorded.
+func (cfg *apiConfig) listCustomerVideoObjects(ctx context.Context, videos []database.Video) []backupObject {
+	objects := []backupObject{}
+	seen := map[string]bool{}
+	for _, video := range videos {
+		store, key, ok, err := cfg.storeForVideo(video)
+		if err != nil {
+			log.Printf("backup: couldn't get storage of video %s: %v", video.ID, err)
+			continue
+		}
+		if !ok || store.bucket == cfg.s3Bucket || seen[store.bucket+"/"+key] {
+			continue
+		}
+		seen[store.bucket+"/"+key] = true
+		head, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:    aws.String(store.bucket),
+			Key:       aws.String(key),
+			VersionId: video.VideoVersionID,
+		})
+		if err != nil {
+			log.Printf("backup: couldn't find upload of video %s in %s: %v", video.ID, store.bucket, err)
+			continue
+		}
+		objects = append(objects, backupObject{
+			Bucket:       store.bucket,
+			Key:          key,
+			ETag:         aws.ToString(head.ETag),
+			Size:         aws.ToInt64(head.ContentLength),
+			LastModified: aws.ToTime(head.LastModified),
+		})
+	}
+	return objects
+}
+
+// runRestore verifies every object in a backup manifest still exists with
+// the same ETag, then rebuilds the video records from the manifest. Videos
+// whose object is missing are restored without a video URL so they can be
+// re-uploaded. With restoreSnapshot the database snapshot is first written
+// to snapshotPath.
+func (cfg *apiConfig) runRestore(ctx context.Context, id string, restoreSnapshot bool, snapshotPath string) error {
+	manifestPath, err := cfg.downloadObjectToTemp(ctx, cfg.defaultStore(), cfg.spoolDir, path.Join(backupPrefix, id, "manifest.json"), "tubely-manifest-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(manifestPath)
+
+	dat, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	manifest := backupManifest{}
+	err = json.Unmarshal(dat, &manifest)
+	if err != nil {
+		return fmt.Errorf("couldn't parse manifest: %w", err)
+	}
+
+	if restoreSnapshot {
+		err = cfg.restoreSnapshot(ctx, id, snapshotPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored database snapshot to %s, restart the server to use it\n", snapshotPath)
+		return nil
+	}
+
+	// objects in customers' buckets are checked through their owners' stores
+	stores := map[string]objectStore{cfg.s3Bucket: cfg.defaultStore()}
+	for _, video := range manifest.Videos {
+		if store, _, ok, err := cfg.storeForVideo(video); err == nil && ok {
+			stores[store.bucket] = store
+		}
+	}
+	missing := map[string]bool{}
+	for _, obj := range manifest.Objects {
+		bucket := obj.Bucket
+		if bucket == "" {
+			bucket = cfg.s3Bucket
+		}
+		store, ok := stores[bucket]
+		if !ok {
+			fmt.Printf("missing: %s/%s (no access to the bucket)\n", bucket, obj.Key)
+			missing[bucket+"/"+obj.Key] = true
+			continue
+		}
+		head, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(obj.Key),
+		})
+		if err != nil {
+			fmt.Printf("missing: %s (%v)\n", obj.Key, err)
+			missing[bucket+"/"+obj.Key] = true
+			continue
+		}
+		if aws.ToString(head.ETag) != obj.ETag {
+			fmt.Printf("changed: %s (etag %s, expected %s)\n", obj.Key, aws.ToString(head.ETag), obj.ETag)
+		}
+	}
+
+	restored := 0
+	for _, video := range manifest.Videos {
+		// manifests from before visibility existed
+		if video.Visibility == "" {
+			video.Visibility = database.VideoVisibilityPublic
+		}
+		// and from before statuses
+		if video.Status == "" {
+			video.Status = database.VideoStatusUploading
+			if video.VideoURL != nil {
+				video.Status = database.VideoStatusReady
+			}
+		}
+		if video.VideoURL != nil {
+			if store, key, ok, err := cfg.storeForVideo(video); err == nil && ok && missing[store.bucket+"/"+key] {
+				video.VideoURL = nil
+				video.Status = database.VideoStatusFailed
+			}
+		}
+		err := cfg.db.RestoreVideo(video)
+		if err != nil {
+			return fmt.Errorf("couldn't restore video %s: %w", video.ID, err)
+		}
+		restored++
+	}
+
+	fmt.Printf("restore %s: %d objects verified, %d missing, %d videos restored\n",
+		id, len(manifest.Objects)-len(missing), len(missing), restored)
+	return nil
+}
+
+func (cfg *apiConfig) restoreSnapshot(ctx context.Context, id, snapshotPath string) error {
+	if _, err := os.Stat(snapshotPath); err == nil {
+		return fmt.Errorf("%s already exists, move it out of the way first", snapshotPath)
+	}
+
+	out, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(cfg.s3Bucket),
+		Key:    aws.String(path.Join(backupPrefix, id, "tubely.db")),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't get database snapshot: %w", err)
+	}
+	defer out.Body.Close()
+
+	f, err := os.OpenFile(snapshotPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, out.Body)
+	return err
+}
+
+// runCommand handles the maintenance subcommands, `tubely backup` and
+// `tubely restore -id <backup id> [-snapshot <path>]`.
+func (cfg *apiConfig) runCommand(args []string) error {
+	ctx := context.Background()
+	switch args[0] {
+	case "backup":
+		return cfg.runBackup(ctx)
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		id := fs.String("id", "", "backup ID to restore")
+		snapshot := fs.String("snapshot", "", "write the database snapshot to this path instead of rebuilding records")
+		fs.Parse(args[1:])
+		if *id == "" {
+			return errors.New("restore requires -id")
+		}
+		return cfg.runRestore(ctx, *id, *snapshot != "", *snapshot)
+	case "probe":
+		return cfg.runProbe(ctx)
+	case "jobs":
+		fs := flag.NewFlagSet("jobs", flag.ExitOnError)
+		retry := fs.Bool("retry-failed", false, "queue failed jobs again with fresh attempts")
+		fs.Parse(args[1:])
+		return cfg.runJobsCommand(*retry)
+	case "regenerate-thumbnails":
+		fs := flag.NewFlagSet("regenerate-thumbnails", flag.ExitOnError)
+		concurrency := fs.Int("concurrency", defaultThumbnailRegenerateConcurrency, "thumbnails to work on at once")
+		force := fs.Bool("force", false, "redo thumbnails already made with the current settings")
+		dry := fs.Bool("dry-run", false, "only list the thumbnails that would be redone")
+		fs.Parse(args[1:])
+		if *concurrency < 1 {
+			return errors.New("regenerate-thumbnails requires a positive -concurrency")
+		}
+		var plan *dryRun
+		if *dry {
+			plan = newDryRun(os.Stdout)
+		}
+		return cfg.runRegenerateThumbnails(ctx, *concurrency, *force, plan)
+	case "set-plan":
+		fs := flag.NewFlagSet("set-plan", flag.ExitOnError)
+		email := fs.String("email", "", "user to change")
+		plan := fs.String("plan", "", "plan to move them to")
+		fs.Parse(args[1:])
+		if *email == "" || *plan == "" {
+			return errors.New("set-plan requires -email and -plan")
+		}
+		return cfg.runSetPlan(*email, *plan)
+	case "set-bucket":
+		fs := flag.NewFlagSet("set-bucket", flag.ExitOnError)
+		email := fs.String("email", "", "user to change")
+		bucket := fs.String("bucket", "", "their bucket")
+		region := fs.String("region", "", "region of their bucket")
+		roleARN := fs.String("role-arn", "", "role in their account that can use the bucket")
+		externalID := fs.String("external-id", "", "external ID their trust policy requires")
+		toDefault := fs.Bool("clear", false, "store their uploads in our bucket again")
+		fs.Parse(args[1:])
+		if *email == "" || (!*toDefault && (*bucket == "" || *region == "" || *roleARN == "")) {
+			return errors.New("set-bucket requires -email and either -bucket, -region and -role-arn or -clear")
+		}
+		return cfg.runSetBucket(ctx, *email, database.UserBucket{
+			Bucket:     *bucket,
+			Region:     *region,
+			RoleARN:    *roleARN,
+			ExternalID: *externalID,
+		}, *toDefault)
+	case "set-analytics":
+		fs := flag.NewFlagSet("set-analytics", flag.ExitOnError)
+		email := fs.String("email", "", "user to change")
+		enabled := fs.Bool("enabled", false, "count views of their videos")
+		minViewers := fs.Int("min-viewers", defaultAnalyticsMinViewers, "leave groups of fewer viewers out of reports")
+		truncateIPs := fs.Bool("truncate-ips", true, "count networks instead of addresses")
+		toDefault := fs.Bool("clear", false, "put them back on the default policy")
+		fs.Parse(args[1:])
+		if *email == "" || *minViewers < 1 {
+			return errors.New("set-analytics requires -email and a positive -min-viewers")
+		}
+		return cfg.runSetAnalytics(*email, database.AnalyticsPolicy{
+			Enabled:     *enabled,
+			MinViewers:  *minViewers,
+			TruncateIPs: *truncateIPs,
+		}, *toDefault)
+	case "retention":
+		return cfg.runRetentionCommand(ctx, args[1:])
+	case "migrate-bucket":
+		fs := flag.NewFlagSet("migrate-bucket", flag.ExitOnError)
+		bucket := fs.String("bucket", "", "bucket to migrate to")
+		region := fs.String("region", "", "region of the new bucket, defaults to S3_REGION")
+		cfDistro := fs.String("cf-distro", "", "CloudFront distribution in front of the new bucket")
+		dry := fs.Bool("dry-run", false, "only list what would be copied and rewritten")
+		fs.Parse(args[1:])
+		if *bucket == "" {
+			return errors.New("migrate-bucket requires -bucket")
+		}
+		var plan *dryRun
+		if *dry {
+			plan = newDryRun(os.Stdout)
+		}
+		return cfg.runMigrateBucket(ctx, *bucket, *region, *cfDistro, plan)
+	case "gc":
+		fs := flag.NewFlagSet("gc", flag.ExitOnError)
+		olderThan := fs.Duration("older-than", staleMultipartUploadMaxAge, "abort multipart uploads started longer ago than this")
+		dry := fs.Bool("dry-run", false, "only list the uploads that would be aborted")
+		fs.Parse(args[1:])
+		var plan *dryRun
+		if *dry {
+			plan = newDryRun(os.Stdout)
+		}
+		cfg.abortStaleMultipartUploads(ctx, *olderThan, plan)
+		if plan != nil {
+			plan.summary()
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+	"github.com/google/uuid"
+)
+
+// meterBandwidth counts size bytes against the monthly bandwidth of
+// userID's plan, or returns a limits.Exceeded without counting them if they
+// would go over it. Bandwidth is metered as URLs are handed out rather than
+// as bytes are read, so each viewer URL counts the whole file once.
+func (cfg *apiConfig) meterBandwidth(userID uuid.UUID, size int64) error {
+	plan, err := cfg.db.GetUserPlan(userID)
+	if err != nil {
+		return fmt.Errorf("couldn't get plan: %w", err)
+	}
+	start, end := uploadWindow(database.UploadPeriodMonth, cfg.now())
+	used, err := cfg.db.GetBandwidth(userID, start)
+	if err != nil {
+		return fmt.Errorf("couldn't get bandwidth used: %w", err)
+	}
+	if plan.MonthlyBandwidth > 0 && used+size > plan.MonthlyBandwidth {
+		exceeded := cfg.planLimitExceeded(limits.MonthlyBandwidth, plan, used, size)
+		exceeded.ResetsAt = &end
+		return exceeded
+	}
+	return cfg.db.AddBandwidth(userID, start, size)
+}
+
+// bandwidthAllowed meters one viewing of video against its owner's plan,
+// writing the error response if the month's bandwidth is used up.
+func (cfg *apiConfig) bandwidthAllowed(w http.ResponseWriter, video database.Video) bool {
+	err := cfg.meterBandwidth(video.UserID, video.VideoSize)
+	var exceeded limits.Exceeded
+	if errors.As(err, &exceeded) {
+		cfg.respondWithLimit(w, exceeded, nil)
+		return false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't meter bandwidth", err)
+		return false
+	}
+	return true
+}
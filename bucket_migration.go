@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// CopyObject tops out at 5GB, anything this big is copied in parts
+	multipartCopyThreshold = 1 << 30
+	multipartCopyPartSize  = 512 << 20
+)
+
+type bucketMigration struct {
+	src       *s3.Client
+	dst       *s3.Client
+	srcBucket string
+	dstBucket string
+	// empty keeps the bucket default
+	storageClass types.StorageClass
+}
+
+// runMigrateBucket copies every object to a new bucket, possibly in another
+// region, and points stored references at it. Objects already in the target
+// with a matching size are skipped, so an interrupted run can simply be
+// started again. The server keeps using the old bucket until S3_BUCKET,
+// S3_REGION and S3_CF_DISTRO are changed. With a plan nothing is copied or
+// rewritten, the objects and videos are only recorded in it.
+func (cfg *apiConfig) runMigrateBucket(ctx context.Context, dstBucket, dstRegion, newCfDistro string, plan *dryRun) error {
+	if dstBucket == cfg.s3Bucket {
+		return errors.New("target bucket is the current bucket")
+	}
+	if dstRegion == "" {
+		dstRegion = cfg.s3Region
+	}
+	m := bucketMigration{
+		src:       cfg.s3Client,
+		dst:       s3.New(cfg.s3Client.Options(), func(o *s3.Options) { o.Region = dstRegion }),
+		srcBucket: cfg.s3Bucket,
+		dstBucket: dstBucket,
+	}
+
+	copied, skipped := 0, 0
+	versions := map[string]*string{}
+	paginator := s3.NewListObjectsV2Paginator(m.src, &s3.ListObjectsV2Input{
+		Bucket: aws.String(m.srcBucket),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't list bucket: %w", err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if plan != nil {
+				if _, ok := m.existingCopy(ctx, key, aws.ToInt64(obj.Size)); ok {
+					skipped++
+				} else {
+					plan.would("copy", fmt.Sprintf("s3://%s/%s to s3://%s", m.srcBucket, key, m.dstBucket), aws.ToInt64(obj.Size))
+				}
+				continue
+			}
+			versionID, didCopy, err := m.migrateObject(ctx, key, aws.ToInt64(obj.Size), aws.ToString(obj.ETag))
+			if err != nil {
+				return fmt.Errorf("stopped at %s after %d copied, run again to resume: %w", key, copied, err)
+			}
+			versions[key] = versionID
+			if didCopy {
+				copied++
+				fmt.Printf("copied %s\n", key)
+			} else {
+				skipped++
+			}
+		}
+	}
+	if plan != nil {
+		if err := cfg.planVideoReferences(plan, newCfDistro); err != nil {
+			return fmt.Errorf("couldn't get video references: %w", err)
+		}
+		plan.summary()
+		fmt.Printf("objects: %d already present\n", skipped)
+		return nil
+	}
+	fmt.Printf("objects: %d copied, %d already present\n", copied, skipped)
+
+	rewritten, err := cfg.rewriteVideoReferences(newCfDistro, versions)
+	if err != nil {
+		return fmt.Errorf("couldn't rewrite video references: %w", err)
+	}
+	fmt.Printf("videos: %d references rewritten\n", rewritten)
+	fmt.Printf("now set S3_BUCKET=%s S3_REGION=%s", dstBucket, dstRegion)
+	if newCfDistro != "" {
+		fmt.Printf(" S3_CF_DISTRO=%s", newCfDistro)
+	}
+	fmt.Println(" and restart")
+	return nil
+}
+
+// migrateObject copies one object unless the target already has it, then
+// checks the copy. It returns the object's version ID in the target bucket.
+func (m bucketMigration) migrateObject(ctx context.Context, key string, size int64, etag string) (*string, bool, error) {
+	if head, ok := m.existingCopy(ctx, key, size); ok {
+		return head.VersionId, false, nil
+	}
+
+	if err := m.copyObject(ctx, key, key, size); err != nil {
+		return nil, false, err
+	}
+
+	head, err := m.dst.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(m.dstBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't verify copy: %w", err)
+	}
+	if aws.ToInt64(head.ContentLength) != size {
+		return nil, false, fmt.Errorf("copy is %d bytes, expected %d", aws.ToInt64(head.ContentLength), size)
+	}
+	// a single part copy keeps the MD5 ETag; multipart ETags depend on the
+	// part sizes so only plain ones can be compared
+	if !strings.Contains(etag, "-") && size <= multipartCopyThreshold && aws.ToString(head.ETag) != etag {
+		return nil, false, fmt.Errorf("copy checksum %s doesn't match %s", aws.ToString(head.ETag), etag)
+	}
+	return head.VersionId, true, nil
+}
+
+// existingCopy returns the target bucket's copy of key if it has one of the
+// right size.
+func (m bucketMigration) existingCopy(ctx context.Context, key string, size int64) (*s3.HeadObjectOutput, bool) {
+	head, err := m.dst.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(m.dstBucket),
+		Key:    aws.String(key),
+	})
+	return head, err == nil && aws.ToInt64(head.ContentLength) == size
+}
+
+func (m bucketMigration) copySource(key string) string {
+	return m.srcBucket + "/" + url.PathEscape(key)
+}
+
+// copyObject copies srcKey to dstKey, in parts when it's too big for a
+// single CopyObject.
+func (m bucketMigration) copyObject(ctx context.Context, srcKey, dstKey string, size int64) error {
+	if size > multipartCopyThreshold {
+		return m.copyMultipart(ctx, srcKey, dstKey, size)
+	}
+	return m.copySingle(ctx, srcKey, dstKey)
+}
+
+func (m bucketMigration) copySingle(ctx context.Context, srcKey, dstKey string) error {
+	_, err := m.dst.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:       aws.String(m.dstBucket),
+		Key:          aws.String(dstKey),
+		CopySource:   aws.String(m.copySource(srcKey)),
+		StorageClass: m.storageClass,
+	})
+	return err
+}
+
+func (m bucketMigration) copyMultipart(ctx context.Context, srcKey, dstKey string, size int64) error {
+	head, err := m.src.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(m.srcBucket),
+		Key:    aws.String(srcKey),
+	})
+	if err != nil {
+		return err
+	}
+	upload, err := m.dst.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(m.dstBucket),
+		Key:          aws.String(dstKey),
+		ContentType:  head.ContentType,
+		StorageClass: m.storageClass,
+	})
+	if err != nil {
+		return err
+	}
+
+	parts := []types.CompletedPart{}
+	for start, partNumber := int64(0), int32(1); start < size; start, partNumber = start+multipartCopyPartSize, partNumber+1 {
+		end := min(start+multipartCopyPartSize, size) - 1
+		part, err := m.dst.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(m.dstBucket),
+			Key:             aws.String(dstKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int32(partNumber),
+			CopySource:      aws.String(m.copySource(srcKey)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			m.dst.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(m.dstBucket),
+				Key:      aws.String(dstKey),
+				UploadId: upload.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       part.CopyPartResult.ETag,
+			PartNumber: aws.Int32(partNumber),
+		})
+	}
+
+	_, err = m.dst.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(m.dstBucket),
+		Key:             aws.String(dstKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// rewriteVideoReferences moves video URLs over to the new CloudFront
+// distribution and replaces S3 version IDs, which don't survive a copy.
+func (cfg *apiConfig) rewriteVideoReferences(newCfDistro string, versions map[string]*string) (int, error) {
+	for key, versionID := range versions {
+		if err := cfg.db.SetVideoVersionS3ID(key, versionID); err != nil {
+			return 0, err
+		}
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for _, video := range videos {
+		if video.VideoURL == nil {
+			continue
+		}
+		key, ok := cfg.videoKeyFromURL(*video.VideoURL)
+		if !ok {
+			continue
+		}
+		video.VideoVersionID = versions[key]
+		if newCfDistro != "" {
+			video.VideoURL = aws.String(newCfDistro + "/" + key)
+		}
+		if err := cfg.db.UpdateVideo(video); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// planVideoReferences records in plan the videos rewriteVideoReferences
+// would update.
+func (cfg *apiConfig) planVideoReferences(plan *dryRun, newCfDistro string) error {
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		if video.VideoURL == nil {
+			continue
+		}
+		key, ok := cfg.videoKeyFromURL(*video.VideoURL)
+		if !ok {
+			continue
+		}
+		target := "its new S3 version"
+		if newCfDistro != "" {
+			target = newCfDistro + "/" + key
+		}
+		plan.would("rewrite video", fmt.Sprintf("%s to %s", video.ID, target), 0)
+	}
+	return nil
+}
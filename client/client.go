@@ -0,0 +1,381 @@
+// Package client is a Go client for the Tubely API. It logs in, manages
+// videos, uploads them in any of the server's upload modes and fetches
+// playback URLs, retrying what is safe to retry.
+//
+// It lives outside internal/ so programs in other modules can import it.
+//
+//	c := client.New("https://tubely.example.com")
+//	if err := c.Login(ctx, email, password); err != nil { ... }
+//	video, err := c.CreateVideo(ctx, "Launch", "")
+//	video, err = c.UploadVideoFile(ctx, video.ID, "launch.mp4")
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultMaxRetries is how many times a failed request is retried when
+	// it's safe to.
+	DefaultMaxRetries = 3
+
+	defaultBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+)
+
+// ErrNotLoggedIn is returned for calls that need a token before Login.
+var ErrNotLoggedIn = errors.New("tubely: not logged in")
+
+// APIError is a response with an error status. Message is the server's
+// error text, Body the raw response for anything more it sent, like upload
+// violations or quota details.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Body       []byte
+	retryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("tubely: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Temporary reports whether the request may succeed if sent again.
+func (e *APIError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	// uploads say so themselves
+	var body struct {
+		Recovery struct {
+			Retryable bool `json:"retryable"`
+		} `json:"recovery"`
+	}
+	return json.Unmarshal(e.Body, &body) == nil && body.Recovery.Retryable
+}
+
+// Limit is a plan or server limit a request ran into. Used is the size of
+// the upload for size limits, and what's already used for the others.
+type Limit struct {
+	Name     string     `json:"name"`
+	Unit     string     `json:"unit"`
+	Used     int64      `json:"used"`
+	Pending  int64      `json:"pending"`
+	Limit    int64      `json:"limit"`
+	ResetsAt *time.Time `json:"resets_at"`
+	// empty for the server's own limits, which no plan lifts
+	Plan    string `json:"plan"`
+	Upgrade *struct {
+		Plan string `json:"plan"`
+		// zero when the plan has no such limit
+		Limit int64 `json:"limit"`
+	} `json:"upgrade"`
+}
+
+// Limit returns the limit behind a 402, 413 or 429 response, if it names
+// one.
+func (e *APIError) Limit() (Limit, bool) {
+	var body struct {
+		Limit *Limit `json:"limit"`
+	}
+	if json.Unmarshal(e.Body, &body) != nil || body.Limit == nil {
+		return Limit{}, false
+	}
+	return *body.Limit, true
+}
+
+// Client talks to one Tubely server. It's safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	maxRetries int
+
+	mu           sync.Mutex
+	token        string
+	refreshToken string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sends requests with hc instead of http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithMaxRetries sets how many times failed requests are retried; zero
+// turns retries off.
+func WithMaxRetries(n int) Option {
+	return func(c *Client) { c.maxRetries = n }
+}
+
+// WithTokens starts the client with tokens from an earlier Login, instead
+// of logging in again.
+func WithTokens(token, refreshToken string) Option {
+	return func(c *Client) {
+		c.token = token
+		c.refreshToken = refreshToken
+	}
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: DefaultMaxRetries,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Tokens returns the current access and refresh tokens, to be saved and
+// passed to WithTokens later.
+func (c *Client) Tokens() (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token, c.refreshToken
+}
+
+// Login exchanges an email and password for tokens, which every later call
+// uses. The access token is refreshed automatically when it expires.
+func (c *Client) Login(ctx context.Context, email, password string) error {
+	var resp struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/login",
+		json:   map[string]string{"email": email, "password": password},
+		noAuth: true,
+		retry:  true,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.token, c.refreshToken = resp.Token, resp.RefreshToken
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) refresh(ctx context.Context) error {
+	_, refreshToken := c.Tokens()
+	if refreshToken == "" {
+		return errors.New("tubely: no refresh token, log in first")
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/refresh",
+		header: http.Header{"Authorization": {"Bearer " + refreshToken}},
+		noAuth: true,
+		retry:  true,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.token = resp.Token
+	c.mu.Unlock()
+	return nil
+}
+
+type request struct {
+	method string
+	// a path on the server, or an absolute URL like a presigned one
+	path   string
+	header http.Header
+	// json is encoded as the body; body is sent as is
+	json        any
+	body        []byte
+	contentType string
+	// openBody returns a fresh reader over a body too big to hold in
+	// memory, of size bytes, for every attempt
+	openBody func() io.Reader
+	size     int64
+	// streamed bodies can't be sent twice, so are never retried
+	stream io.Reader
+	noAuth bool
+	// POSTs are only retried when the endpoint is known to be safe to
+	// repeat
+	retry bool
+	// idempotent POSTs carry an Idempotency-Key, the same on every attempt,
+	// so the server replays its first response to a retry
+	idempotent bool
+}
+
+// do sends req, retrying it if allowed, and decodes a JSON response into
+// out unless it's nil.
+func (c *Client) do(ctx context.Context, req request, out any) error {
+	_, err := c.send(ctx, req, out)
+	return err
+}
+
+// send is do for callers that need the status or headers too. The
+// response body is already consumed.
+func (c *Client) send(ctx context.Context, req request, out any) (*http.Response, error) {
+	if req.json != nil {
+		data, err := json.Marshal(req.json)
+		if err != nil {
+			return nil, err
+		}
+		req.body, req.contentType = data, "application/json"
+	}
+	if req.idempotent {
+		req.header = req.header.Clone()
+		if req.header == nil {
+			req.header = http.Header{}
+		}
+		req.header.Set("Idempotency-Key", uuid.NewString())
+	}
+	retry := req.stream == nil && (req.retry || req.idempotent || req.method != http.MethodPost)
+	refreshed := req.noAuth
+
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.sendOnce(ctx, req)
+		if err == nil {
+			if out != nil && len(body) > 0 {
+				if err := json.Unmarshal(body, out); err != nil {
+					return resp, fmt.Errorf("tubely: couldn't decode %s %s response: %w", req.method, req.path, err)
+				}
+			}
+			return resp, nil
+		}
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized && !refreshed {
+			// the access token only lasts an hour
+			refreshed = true
+			if rerr := c.refresh(ctx); rerr != nil {
+				return resp, err
+			}
+			continue
+		}
+		// anything short of a response is a network problem, worth retrying
+		temporary := !errors.Is(err, ErrNotLoggedIn)
+		if apiErr != nil {
+			temporary = apiErr.Temporary()
+		}
+		if !retry || !temporary || attempt >= c.maxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		wait := backoff(attempt)
+		if apiErr != nil && apiErr.retryAfter > 0 {
+			// a daily upload cap says to come back tomorrow
+			if apiErr.retryAfter > maxBackoff {
+				return resp, err
+			}
+			wait = apiErr.retryAfter
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return resp, err
+		}
+	}
+}
+
+func (c *Client) sendOnce(ctx context.Context, req request) (*http.Response, []byte, error) {
+	url := req.path
+	if strings.HasPrefix(url, "/") {
+		url = c.baseURL + url
+	}
+	var body io.Reader
+	switch {
+	case req.stream != nil:
+		body = req.stream
+	case req.openBody != nil:
+		body = req.openBody()
+	case req.body != nil:
+		body = bytes.NewReader(req.body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, url, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.openBody != nil {
+		// S3 wants a length, not a chunked body
+		httpReq.ContentLength = req.size
+	}
+	for name, values := range req.header {
+		httpReq.Header[name] = values
+	}
+	if req.contentType != "" {
+		httpReq.Header.Set("Content-Type", req.contentType)
+	}
+	if !req.noAuth {
+		token, _ := c.Tokens()
+		if token == "" {
+			return nil, nil, ErrNotLoggedIn
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, data, nil
+	}
+
+	apiErr := &APIError{StatusCode: resp.StatusCode, Body: data}
+	var errBody struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &errBody) == nil && errBody.Error != "" {
+		apiErr.Message = errBody.Error
+	} else {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	apiErr.retryAfter = retryAfter(resp.Header)
+	return resp, data, apiErr
+}
+
+// backoff is exponential with full jitter, so clients that failed together
+// don't retry together.
+func backoff(attempt int) time.Duration {
+	d := min(defaultBackoff<<attempt, maxBackoff)
+	return time.Duration(rand.Int64N(int64(d))) + time.Millisecond
+}
+
+func retryAfter(h http.Header) time.Duration {
+	seconds, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return min(time.Duration(seconds)*time.Second, maxBackoff)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
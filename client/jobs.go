@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// how often WaitForJob polls
+const jobPollInterval = 2 * time.Second
+
+// Job is an upload the server is processing in the background.
+type Job struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	VideoID   uuid.UUID `json:"video_id"`
+	// processing, ready or failed
+	Status    string `json:"status"`
+	Error     string `json:"error"`
+	Retryable bool   `json:"retryable"`
+	// set once the job is ready
+	Video *Video `json:"video"`
+}
+
+func (c *Client) GetJob(ctx context.Context, jobID uuid.UUID) (Job, error) {
+	var job Job
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/jobs/" + jobID.String()}, &job)
+	return job, err
+}
+
+// WaitForJob polls a job until it's done, returning its video if it's
+// ready and an error if it failed.
+func (c *Client) WaitForJob(ctx context.Context, jobID uuid.UUID) (Video, error) {
+	for {
+		job, err := c.GetJob(ctx, jobID)
+		if err != nil {
+			return Video{}, err
+		}
+		switch job.Status {
+		case "ready":
+			if job.Video == nil {
+				return Video{}, fmt.Errorf("tubely: video of job %s was deleted", jobID)
+			}
+			return *job.Video, nil
+		case "failed":
+			return Video{}, fmt.Errorf("tubely: job %s failed: %s", jobID, job.Error)
+		}
+		if err := sleep(ctx, jobPollInterval); err != nil {
+			return Video{}, err
+		}
+	}
+}
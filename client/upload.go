@@ -0,0 +1,245 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadVideo sends a video in a single form upload, streaming it from r.
+// It can't be retried since r is only read once; use UploadVideoFile for
+// large files or unreliable networks.
+func (c *Client) UploadVideo(ctx context.Context, videoID uuid.UUID, filename string, r io.Reader) (Video, error) {
+	var video Video
+	err := c.uploadForm(ctx, videoID, filename, r, nil, &video)
+	return video, err
+}
+
+// UploadVideoAsync is UploadVideo without waiting for the server to process
+// the video. It returns once the file is received, with a job to follow
+// with WaitForJob.
+func (c *Client) UploadVideoAsync(ctx context.Context, videoID uuid.UUID, filename string, r io.Reader) (Job, error) {
+	var job Job
+	err := c.uploadForm(ctx, videoID, filename, r, http.Header{"Prefer": {"respond-async"}}, &job)
+	return job, err
+}
+
+func (c *Client) uploadForm(ctx context.Context, videoID uuid.UUID, filename string, r io.Reader, header http.Header, out any) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+			"name":     "video",
+			"filename": filepath.Base(filename),
+		}))
+		header.Set("Content-Type", videoContentType(filename))
+		part, err := mw.CreatePart(header)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err := c.do(ctx, request{
+		method:      http.MethodPost,
+		path:        "/api/video_upload/" + videoID.String(),
+		header:      header,
+		stream:      pr,
+		contentType: mw.FormDataContentType(),
+	}, out)
+	// unblock the writer if the request gave up early
+	pr.CloseWithError(errors.New("request finished"))
+	return err
+}
+
+// ChunkedUpload is a resumable upload in progress. Save the ID to pick it up
+// with ResumeVideoUpload after a crash, until ExpiresAt.
+type ChunkedUpload struct {
+	ID        uuid.UUID `json:"upload_id"`
+	PartSize  int64     `json:"part_size"`
+	PartCount int32     `json:"part_count"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UploadVideoFile uploads a file in parts, retrying each one that fails,
+// so an interrupted upload only resends what was lost. Only mp4 can be
+// uploaded in parts.
+func (c *Client) UploadVideoFile(ctx context.Context, videoID uuid.UUID, path string) (Video, error) {
+	upload, err := c.StartVideoUpload(ctx, videoID, path)
+	if err != nil {
+		return Video{}, err
+	}
+	return c.ResumeVideoUpload(ctx, videoID, upload, path)
+}
+
+// StartVideoUpload starts a resumable upload of the file at path without
+// sending any of it.
+func (c *Client) StartVideoUpload(ctx context.Context, videoID uuid.UUID, path string) (ChunkedUpload, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ChunkedUpload{}, err
+	}
+	var upload ChunkedUpload
+	err = c.do(ctx, request{
+		method: http.MethodPost,
+		path:   fmt.Sprintf("/api/videos/%s/upload/init", videoID),
+		// a retry after a lost response gets the same upload back
+		idempotent: true,
+		json: map[string]any{
+			"filename":     filepath.Base(path),
+			"content_type": videoContentType(path),
+			"size":         info.Size(),
+		},
+	}, &upload)
+	return upload, err
+}
+
+// ResumeVideoUpload sends whatever parts of the file the server is missing
+// and completes the upload. The server tells which parts it's missing when
+// asked to complete, so there's no local state beyond upload to keep.
+func (c *Client) ResumeVideoUpload(ctx context.Context, videoID uuid.UUID, upload ChunkedUpload, path string) (Video, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Video{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Video{}, err
+	}
+
+	uploadPath := fmt.Sprintf("/api/videos/%s/upload/%s", videoID, upload.ID)
+	for {
+		var video Video
+		err := c.do(ctx, request{
+			method: http.MethodPost,
+			path:   uploadPath + "/complete",
+			// a repeat after a lost response finds the upload gone rather
+			// than filing it twice
+			retry: true,
+		}, &video)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+			return video, err
+		}
+
+		var missing struct {
+			MissingParts []int32 `json:"missing_parts"`
+		}
+		if json.Unmarshal(apiErr.Body, &missing) != nil || len(missing.MissingParts) == 0 {
+			return Video{}, apiErr
+		}
+		for _, partNumber := range missing.MissingParts {
+			offset := int64(partNumber-1) * upload.PartSize
+			length := min(upload.PartSize, info.Size()-offset)
+			err := c.do(ctx, request{
+				method: http.MethodPut,
+				path:   fmt.Sprintf("%s/parts/%d", uploadPath, partNumber),
+				openBody: func() io.Reader {
+					return io.NewSectionReader(f, offset, length)
+				},
+				size:        length,
+				contentType: "application/octet-stream",
+			}, nil)
+			if err != nil {
+				return Video{}, fmt.Errorf("tubely: part %d: %w", partNumber, err)
+			}
+		}
+	}
+}
+
+// DirectUpload is a presigned PUT straight to the bucket.
+type DirectUpload struct {
+	ID        uuid.UUID   `json:"upload_id"`
+	URL       string      `json:"url"`
+	Method    string      `json:"method"`
+	Headers   http.Header `json:"headers"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	ConfirmBy time.Time   `json:"confirm_by"`
+}
+
+// UploadVideoDirect PUTs the file straight to S3 with a presigned URL, so it
+// never passes through the Tubely server, then confirms it. The file's
+// SHA-256 is signed into the URL so S3 rejects a damaged upload. Only mp4
+// can be uploaded directly.
+func (c *Client) UploadVideoDirect(ctx context.Context, videoID uuid.UUID, path string) (Video, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Video{}, err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return Video{}, err
+	}
+
+	var upload DirectUpload
+	err = c.do(ctx, request{
+		method: http.MethodPost,
+		path:   fmt.Sprintf("/api/videos/%s/upload/direct", videoID),
+		// a retry after a lost response gets the same upload back
+		idempotent: true,
+		json: map[string]any{
+			"filename":     filepath.Base(path),
+			"content_type": videoContentType(path),
+			"size":         size,
+			"sha256":       hex.EncodeToString(hasher.Sum(nil)),
+		},
+	}, &upload)
+	if err != nil {
+		return Video{}, err
+	}
+
+	header := upload.Headers.Clone()
+	// set from the body instead
+	header.Del("Content-Length")
+	err = c.do(ctx, request{
+		method: upload.Method,
+		path:   upload.URL,
+		header: header,
+		openBody: func() io.Reader {
+			return io.NewSectionReader(f, 0, size)
+		},
+		size:   size,
+		noAuth: true,
+	}, nil)
+	if err != nil {
+		return Video{}, fmt.Errorf("tubely: couldn't upload to storage: %w", err)
+	}
+
+	var video Video
+	err = c.do(ctx, request{
+		method: http.MethodPost,
+		path:   fmt.Sprintf("/api/videos/%s/upload/direct/%s/confirm", videoID, upload.ID),
+		retry:  true,
+	}, &video)
+	return video, err
+}
+
+func videoContentType(filename string) string {
+	if t := mime.TypeByExtension(filepath.Ext(filename)); t != "" {
+		mediaType, _, err := mime.ParseMediaType(t)
+		if err == nil {
+			return mediaType
+		}
+	}
+	return "video/mp4"
+}
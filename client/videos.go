@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Video struct {
+	ID                  uuid.UUID `json:"id"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+	Title               string    `json:"title"`
+	Description         string    `json:"description"`
+	UserID              uuid.UUID `json:"user_id"`
+	ThumbnailURL        *string   `json:"thumbnail_url"`
+	ThumbnailPreviewURL *string   `json:"thumbnail_preview_url"`
+	ThumbnailBlurhash   *string   `json:"thumbnail_blurhash"`
+	VideoURL            *string   `json:"video_url"`
+	Visibility          string    `json:"visibility"`
+	// uploading, processing, ready or failed; playback waits for ready
+	Status     string     `json:"status"`
+	PremiereAt *time.Time `json:"premiere_at"`
+	ArchivedAt *time.Time `json:"archived_at"`
+	VideoSize  int64      `json:"video_size"`
+	// seconds, nil if the server hasn't recorded it
+	Duration     *float64 `json:"duration"`
+	VideoETag    *string  `json:"video_etag"`
+	UploadSHA256 *string  `json:"upload_sha256"`
+}
+
+func (c *Client) CreateVideo(ctx context.Context, title, description string) (Video, error) {
+	var video Video
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/videos",
+		json:   map[string]string{"title": title, "description": description},
+	}, &video)
+	return video, err
+}
+
+// ListVideos returns the caller's videos, newest first.
+func (c *Client) ListVideos(ctx context.Context) ([]Video, error) {
+	var videos []Video
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/videos"}, &videos)
+	return videos, err
+}
+
+func (c *Client) GetVideo(ctx context.Context, videoID uuid.UUID) (Video, error) {
+	var video Video
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/videos/" + videoID.String()}, &video)
+	return video, err
+}
+
+func (c *Client) DeleteVideo(ctx context.Context, videoID uuid.UUID) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: "/api/videos/" + videoID.String()}, nil)
+}
+
+// PlaybackURL is a presigned URL to play a video from, valid until
+// ExpiresAt.
+type PlaybackURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Region    string    `json:"region"`
+}
+
+// PlaybackURL opens a playback session for deviceID and returns a URL to
+// play the video from. Watermarked videos are rendered for each viewer on
+// first play, which it waits for.
+func (c *Client) PlaybackURL(ctx context.Context, videoID uuid.UUID, deviceID string) (PlaybackURL, error) {
+	var session struct {
+		Token string `json:"token"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   fmt.Sprintf("/api/videos/%s/playback-sessions", videoID),
+		json:   map[string]string{"device_id": deviceID},
+		// an extra session does no harm
+		retry: true,
+	}, &session)
+	if err != nil {
+		return PlaybackURL{}, err
+	}
+
+	for {
+		var playback PlaybackURL
+		resp, err := c.send(ctx, request{
+			method: http.MethodGet,
+			path:   fmt.Sprintf("/api/videos/%s/playback-url", videoID),
+			header: http.Header{
+				"X-Playback-Session": {session.Token},
+				"X-Device-Id":        {deviceID},
+			},
+		}, &playback)
+		if err != nil {
+			return PlaybackURL{}, err
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			return playback, nil
+		}
+		wait := retryAfter(resp.Header)
+		if wait == 0 {
+			wait = defaultBackoff
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return PlaybackURL{}, err
+		}
+	}
+}
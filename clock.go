@@ -0,0 +1,13 @@
+package main
+
+import "time"
+
+// now is the current time as seen by upload quotas, session expiry and the
+// schedulers. Integration tests set cfg.clock to step over days and expiry
+// windows instead of waiting for them.
+func (cfg *apiConfig) now() time.Time {
+	if cfg.clock != nil {
+		return cfg.clock()
+	}
+	return time.Now()
+}
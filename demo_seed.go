@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/google/uuid"
+)
+
+// demoPassword is every demo user's password. Seeding only runs on dev, so
+// it's fine for it to be in the README.
+const demoPassword = "tubely-demo"
+
+// seconds each demo clip runs, enough for a thumbnail and a few segments
+const demoClipSeconds = 6
+
+type demoClip struct {
+	title       string
+	description string
+	// ffmpeg's lavfi test source to draw, and at what size
+	pattern string
+	width   int
+	height  int
+	// pitch of the tone under it
+	tone       int
+	visibility database.VideoVisibility
+	// another demo user it's shared with as a viewer
+	sharedWith string
+}
+
+type demoUser struct {
+	email string
+	clips []demoClip
+}
+
+// demoUsers is what DEMO_SEED creates: an owner with a clip of each shape
+// and visibility, one of them shared, and a second user to log in as.
+var demoUsers = []demoUser{
+	{
+		email: "demo@tubely.dev",
+		clips: []demoClip{
+			{
+				title:       "Colour bars",
+				description: "A landscape test pattern, public.",
+				pattern:     "testsrc2",
+				width:       640,
+				height:      360,
+				tone:        440,
+				visibility:  database.VideoVisibilityPublic,
+			},
+			{
+				title:       "Phone test",
+				description: "A portrait test pattern, unlisted.",
+				pattern:     "testsrc2",
+				width:       360,
+				height:      640,
+				tone:        660,
+				visibility:  database.VideoVisibilityUnlisted,
+			},
+			{
+				title:       "Rough cut",
+				description: "A private video shared with friend@tubely.dev.",
+				pattern:     "smptebars",
+				width:       640,
+				height:      360,
+				tone:        880,
+				visibility:  database.VideoVisibilityPrivate,
+				sharedWith:  "friend@tubely.dev",
+			},
+		},
+	},
+	{
+		email: "friend@tubely.dev",
+		clips: []demoClip{
+			{
+				title:       "Mandelbrot",
+				description: "Someone else's video, public.",
+				pattern:     "mandelbrot",
+				width:       480,
+				height:      480,
+				tone:        330,
+				visibility:  database.VideoVisibilityPublic,
+			},
+		},
+	},
+}
+
+// seedDemo creates the demo users and their videos, running each clip
+// through the same pipeline as an upload so it gets its thumbnail,
+// metadata and whatever renditions are enabled. The bucket is created if
+// it doesn't exist, for a fresh LocalStack or MinIO. It does nothing once
+// the first demo user exists.
+func (cfg *apiConfig) seedDemo(ctx context.Context) error {
+	if cfg.platform != "dev" {
+		return errors.New("demo data is only seeded on dev")
+	}
+	existing, err := cfg.db.GetUserByEmail(demoUsers[0].email)
+	if err != nil {
+		return fmt.Errorf("couldn't get demo user: %w", err)
+	}
+	if existing.Email != "" {
+		log.Printf("demo: %s already exists, not seeding", existing.Email)
+		return nil
+	}
+	if err := cfg.ensureDemoBucket(ctx); err != nil {
+		return err
+	}
+
+	hashedPassword, err := auth.HashPassword(demoPassword)
+	if err != nil {
+		return fmt.Errorf("couldn't hash demo password: %w", err)
+	}
+	userIDs := map[string]uuid.UUID{}
+	for _, u := range demoUsers {
+		user, err := cfg.db.CreateUser(database.CreateUserParams{
+			Email:    u.email,
+			Password: hashedPassword,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't create demo user %s: %w", u.email, err)
+		}
+		userIDs[u.email] = user.ID
+	}
+
+	dir, err := os.MkdirTemp(cfg.spoolDir, "demo-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, u := range demoUsers {
+		for _, clip := range u.clips {
+			video, err := cfg.seedDemoClip(ctx, dir, userIDs[u.email], clip)
+			if err != nil {
+				return fmt.Errorf("couldn't seed %q: %w", clip.title, err)
+			}
+			if clip.sharedWith != "" {
+				err := cfg.db.SetVideoCollaborator(video.ID, userIDs[clip.sharedWith], database.VideoRoleViewer)
+				if err != nil {
+					return fmt.Errorf("couldn't share %q: %w", clip.title, err)
+				}
+			}
+			log.Printf("demo: seeded %q as video %s", clip.title, video.ID)
+		}
+	}
+	log.Printf("demo: log in as %s or %s with password %s", demoUsers[0].email, demoUsers[1].email, demoPassword)
+	return nil
+}
+
+func (cfg *apiConfig) seedDemoClip(ctx context.Context, dir string, userID uuid.UUID, clip demoClip) (database.Video, error) {
+	clipPath := filepath.Join(dir, strings.ReplaceAll(strings.ToLower(clip.title), " ", "-")+".mp4")
+	if err := drawDemoClip(ctx, clip, clipPath); err != nil {
+		return database.Video{}, fmt.Errorf("couldn't draw clip: %w", err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       clip.title,
+		Description: clip.description,
+		UserID:      userID,
+	})
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't create video: %w", err)
+	}
+	video, err = cfg.ingestVideoFile(ctx, video, clipPath, "")
+	if err != nil {
+		return video, err
+	}
+	// set directly, as publish gates are for what users upload
+	return cfg.updateVideo(video.ID, func(video *database.Video) {
+		video.Visibility = clip.visibility
+	})
+}
+
+// drawDemoClip encodes a few seconds of one of ffmpeg's test patterns with
+// a tone to outPath, so the demo needs nothing downloaded.
+func drawDemoClip(ctx context.Context, clip demoClip, outPath string) error {
+	_, err := ffmpeg.FFmpeg().
+		Option("-y").
+		Option("-f", "lavfi").
+		Input(fmt.Sprintf("%s=size=%dx%d:rate=25:duration=%d", clip.pattern, clip.width, clip.height, demoClipSeconds)).
+		Option("-f", "lavfi").
+		Input(fmt.Sprintf("sine=frequency=%d:duration=%d", clip.tone, demoClipSeconds)).
+		Option("-vf", "format=yuv420p").
+		Option("-c:v", "libx264").
+		Option("-preset", "ultrafast").
+		Option("-c:a", "aac").
+		Output(outPath).
+		Run(ctx)
+	return err
+}
+
+func (cfg *apiConfig) ensureDemoBucket(ctx context.Context) error {
+	_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(cfg.s3Bucket)})
+	if err == nil {
+		return nil
+	}
+	input := &s3.CreateBucketInput{Bucket: aws.String(cfg.s3Bucket)}
+	// us-east-1 is the one region that refuses to be named
+	if cfg.s3Region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(cfg.s3Region),
+		}
+	}
+	if _, err := cfg.s3Client.CreateBucket(ctx, input); err != nil {
+		return fmt.Errorf("couldn't create bucket %s: %w", cfg.s3Bucket, err)
+	}
+	log.Printf("demo: created bucket %s", cfg.s3Bucket)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// dryRun collects what a destructive maintenance job would do instead of
+// doing it, so an operator can review the list before running it for real.
+// Jobs take a *dryRun and only touch S3 and the database when it's nil.
+type dryRun struct {
+	out     io.Writer
+	actions []string
+	totals  map[string]*dryRunTotal
+}
+
+type dryRunTotal struct {
+	count int
+	bytes int64
+}
+
+func newDryRun(out io.Writer) *dryRun {
+	return &dryRun{out: out, totals: map[string]*dryRunTotal{}}
+}
+
+// would records that the job would apply action to target, size bytes of
+// it, or 0 for database records.
+func (d *dryRun) would(action, target string, size int64) {
+	total, ok := d.totals[action]
+	if !ok {
+		total = &dryRunTotal{}
+		d.totals[action] = total
+		d.actions = append(d.actions, action)
+	}
+	total.count++
+	total.bytes += size
+	if size > 0 {
+		fmt.Fprintf(d.out, "would %s %s (%d bytes)\n", action, target, size)
+		return
+	}
+	fmt.Fprintf(d.out, "would %s %s\n", action, target)
+}
+
+// summary prints the totals per action, in the order they first came up.
+func (d *dryRun) summary() {
+	if len(d.actions) == 0 {
+		fmt.Fprintln(d.out, "dry run: nothing to do")
+		return
+	}
+	for _, action := range d.actions {
+		total := d.totals[action]
+		if total.bytes > 0 {
+			fmt.Fprintf(d.out, "dry run: would %s %d, %d bytes\n", action, total.count, total.bytes)
+			continue
+		}
+		fmt.Fprintf(d.out, "dry run: would %s %d\n", action, total.count)
+	}
+}
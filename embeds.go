@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const embedURLExpiry = time.Hour
+
+// embedToken is what a third-party site puts in the embed URL: the token's
+// ID and a signature binding it to the video and domain.
+func (cfg *apiConfig) embedToken(token database.EmbedToken) string {
+	return token.ID.String() + "." + cfg.embedSignature(token)
+}
+
+func (cfg *apiConfig) embedSignature(token database.EmbedToken) string {
+	mac := hmac.New(sha256.New, []byte(cfg.urlSigningSecret))
+	mac.Write([]byte("embed\x00" + token.ID.String() + "\x00" + token.VideoID.String() + "\x00" + token.Domain))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cfg apiConfig) embedURL(videoID uuid.UUID, token string) string {
+	return fmt.Sprintf("http://localhost:%s/embed/%s?token=%s", cfg.port, videoID, url.QueryEscape(token))
+}
+
+// normalizeEmbedDomain returns the bare host name of domain, or "" if it
+// isn't one. Schemes and trailing slashes are forgiven.
+func normalizeEmbedDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(strings.TrimPrefix(domain, "https://"), "http://")
+	domain = strings.TrimSuffix(domain, "/")
+	if domain == "" || strings.ContainsAny(domain, "/:?#@* ") {
+		return ""
+	}
+	u, err := url.Parse("https://" + domain)
+	if err != nil || u.Hostname() != domain {
+		return ""
+	}
+	return domain
+}
+
+// embedDomainMatches reports whether host is domain or one of its
+// subdomains.
+func embedDomainMatches(host, domain string) bool {
+	host = strings.ToLower(host)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+type embedTokenResponse struct {
+	database.EmbedToken
+	Token    string `json:"token"`
+	EmbedURL string `json:"embed_url"`
+}
+
+func (cfg *apiConfig) newEmbedTokenResponse(token database.EmbedToken) embedTokenResponse {
+	signed := cfg.embedToken(token)
+	return embedTokenResponse{
+		EmbedToken: token,
+		Token:      signed,
+		EmbedURL:   cfg.embedURL(token.VideoID, signed),
+	}
+}
+
+// handlerEmbedTokenCreate lets a domain embed the video, returning the token
+// and URL for it. Asking again for the same domain returns the same token.
+func (cfg *apiConfig) handlerEmbedTokenCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Domain string `json:"domain"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	domain := normalizeEmbedDomain(params.Domain)
+	if domain == "" {
+		respondWithError(w, http.StatusBadRequest, "domain must be a host name, like example.com", nil)
+		return
+	}
+
+	token, err := cfg.db.CreateEmbedToken(video.ID, domain)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create embed token", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, cfg.newEmbedTokenResponse(token))
+}
+
+// handlerEmbedTokensRetrieve lists the domains allowed to embed the video,
+// with how often each has shown it.
+func (cfg *apiConfig) handlerEmbedTokensRetrieve(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := cfg.db.GetEmbedTokens(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get embed tokens", err)
+		return
+	}
+	resp := make([]embedTokenResponse, 0, len(tokens))
+	for _, token := range tokens {
+		resp = append(resp, cfg.newEmbedTokenResponse(token))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerEmbedTokenDelete(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := uuid.Parse(r.PathValue("tokenID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid token ID", err)
+		return
+	}
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err = cfg.db.DeleteEmbedToken(video.ID, tokenID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke embed token", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// embedFromRequest checks the embed token in the query against the video in
+// the path and, when the browser says, the page embedding it. It writes the
+// error response if they don't match, and counts the view if they do.
+func (cfg *apiConfig) embedFromRequest(w http.ResponseWriter, r *http.Request) (database.Video, database.EmbedToken, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return database.Video{}, database.EmbedToken{}, false
+	}
+	tokenID, signature, _ := strings.Cut(r.URL.Query().Get("token"), ".")
+	id, err := uuid.Parse(tokenID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Embed token required", nil)
+		return database.Video{}, database.EmbedToken{}, false
+	}
+
+	token, err := cfg.db.GetEmbedToken(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get embed token", err)
+		return database.Video{}, database.EmbedToken{}, false
+	}
+	// a revoked token has no row, so it can't match
+	if token.VideoID != videoID || !hmac.Equal([]byte(signature), []byte(cfg.embedSignature(token))) {
+		respondWithError(w, http.StatusForbidden, "Embed token is not valid for this video", nil)
+		return database.Video{}, database.EmbedToken{}, false
+	}
+
+	// browsers send the embedding page's origin, as Origin on fetches and
+	// the Referer by default; when both are stripped, frame-ancestors still
+	// keeps the player off other sites
+	embedder := r.Header.Get("Origin")
+	if embedder == "" {
+		embedder = r.Referer()
+	}
+	if u, err := url.Parse(embedder); err == nil && u.Host != "" {
+		if !embedDomainMatches(u.Hostname(), token.Domain) {
+			log.Printf("embed: token %s for %s used from %s", token.ID, token.Domain, u.Hostname())
+			respondWithError(w, http.StatusForbidden, "This video can't be embedded here", nil)
+			return database.Video{}, database.EmbedToken{}, false
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+	}
+	w.Header().Add("Vary", "Origin")
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, database.EmbedToken{}, false
+	}
+	if video.ID == uuid.Nil || videoHidden(video, videoAccessNone) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, database.EmbedToken{}, false
+	}
+	if premiereLocked(video, videoAccessNone, cfg.now()) {
+		respondWithError(w, http.StatusForbidden, "This video hasn't premiered yet", nil)
+		return database.Video{}, database.EmbedToken{}, false
+	}
+	if watermarkRequired(video, videoAccessNone) {
+		// there's no viewer identity to burn in
+		respondWithError(w, http.StatusForbidden, "Watermarked videos can't be embedded", nil)
+		return database.Video{}, database.EmbedToken{}, false
+	}
+
+	if err := cfg.db.RecordEmbedView(token.ID, cfg.now()); err != nil {
+		log.Printf("embed: couldn't record view through token %s: %v", token.ID, err)
+	}
+	log.Printf("embed: video %s shown on %s", video.ID, token.Domain)
+	return video, token, true
+}
+
+// embedPresigner identifies an embed token.
+func embedPresigner(token database.EmbedToken) presignRequester {
+	return presignRequester{Requester: "embed:" + token.ID.String(), VideoID: &token.VideoID}
+}
+
+// embedPlaybackURL presigns the video's current upload for an embed, writing
+// the error response if it can't.
+func (cfg *apiConfig) embedPlaybackURL(w http.ResponseWriter, r *http.Request, video database.Video, token database.EmbedToken) (string, bool) {
+	if !videoPlayable(w, video) {
+		return "", false
+	}
+	if video.ArchivedAt != nil {
+		respondWithError(w, http.StatusConflict, "Video is archived", nil)
+		return "", false
+	}
+	store, key, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return "", false
+	}
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Video has no upload yet", nil)
+		return "", false
+	}
+	if u := cfg.playbackFallbackURL(r.Context(), store, key, aws.ToString(video.VideoVersionID)); u != "" {
+		return u, true
+	}
+	if !cfg.bandwidthAllowed(w, video) {
+		return "", false
+	}
+	u, err := cfg.presignObjectURL(r.Context(), store, embedPresigner(token), key, aws.ToString(video.VideoVersionID), embedURLExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+		return "", false
+	}
+	return u, true
+}
+
+var embedPage = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>html,body{margin:0;height:100%;background:#000}video{width:100%;height:100%}</style>
+</head>
+<body>
+<video src="{{.URL}}" {{with .Poster}}poster="{{.}}" {{end}}controls playsinline preload="metadata"></video>
+</body>
+</html>
+`))
+
+// handlerEmbedPage serves a bare player for an iframe on the token's domain.
+func (cfg *apiConfig) handlerEmbedPage(w http.ResponseWriter, r *http.Request) {
+	video, token, ok := cfg.embedFromRequest(w, r)
+	if !ok {
+		return
+	}
+	videoURL, ok := cfg.embedPlaybackURL(w, r, video, token)
+	if !ok {
+		return
+	}
+	poster := ""
+	if video.ThumbnailURL != nil {
+		poster = *video.ThumbnailURL
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf("frame-ancestors https://%[1]s https://*.%[1]s http://%[1]s http://*.%[1]s", token.Domain))
+	// the presigned URL in the page expires
+	w.Header().Set("Cache-Control", "private, no-store")
+	err := embedPage.Execute(w, struct {
+		Title  string
+		URL    string
+		Poster string
+	}{video.Title, videoURL, poster})
+	if err != nil {
+		log.Printf("embed: couldn't render page for video %s: %v", video.ID, err)
+	}
+}
+
+// handlerEmbedPlaybackURL is the embed page's video URL, for sites that
+// bring their own player.
+func (cfg *apiConfig) handlerEmbedPlaybackURL(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	video, token, ok := cfg.embedFromRequest(w, r)
+	if !ok {
+		return
+	}
+	expiresAt := cfg.now().UTC().Add(embedURLExpiry)
+	videoURL, ok := cfg.embedPlaybackURL(w, r, video, token)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{URL: videoURL, ExpiresAt: expiresAt})
+}
@@ -0,0 +1,141 @@
+//go:build faults
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+var errInjectedFault = errors.New("injected fault")
+
+// faultRules is parsed from TUBELY_FAULTS, a comma separated list of
+//
+//	s3.<Operation>.error=<probability>  fail with a 500, e.g. s3.PutObject.error=0.5
+//	s3.<Operation>.delay=<duration>     stall before sending, e.g. s3.PutObject.delay=3s
+//	ffmpeg.error=<probability>          fail ffmpeg runs
+//	ffprobe.error=<probability>         fail ffprobe runs
+//
+// where <Operation> may be * to match every S3 call.
+type faultRules struct {
+	s3Errors map[string]float64
+	s3Delays map[string]time.Duration
+	binError map[string]float64
+}
+
+func parseFaultRules(spec string) (faultRules, error) {
+	rules := faultRules{
+		s3Errors: map[string]float64{},
+		s3Delays: map[string]time.Duration{},
+		binError: map[string]float64{},
+	}
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(rule, "=")
+		if !ok {
+			return rules, fmt.Errorf("fault %q has no value", rule)
+		}
+		parts := strings.Split(name, ".")
+		var err error
+		switch {
+		case len(parts) == 3 && parts[0] == "s3" && parts[2] == "error":
+			rules.s3Errors[parts[1]], err = strconv.ParseFloat(value, 64)
+		case len(parts) == 3 && parts[0] == "s3" && parts[2] == "delay":
+			rules.s3Delays[parts[1]], err = time.ParseDuration(value)
+		case len(parts) == 2 && (parts[0] == "ffmpeg" || parts[0] == "ffprobe") && parts[1] == "error":
+			rules.binError[parts[0]], err = strconv.ParseFloat(value, 64)
+		default:
+			return rules, fmt.Errorf("unknown fault %q", name)
+		}
+		if err != nil {
+			return rules, fmt.Errorf("fault %q: %w", rule, err)
+		}
+	}
+	return rules, nil
+}
+
+func lookupRule[T any](rules map[string]T, op string) (T, bool) {
+	if v, ok := rules[op]; ok {
+		return v, true
+	}
+	v, ok := rules["*"]
+	return v, ok
+}
+
+// setupFaultInjection installs the faults configured in TUBELY_FAULTS and
+// returns the options that add them to the S3 client. Only built with the
+// faults tag.
+func setupFaultInjection() []func(*s3.Options) {
+	spec := os.Getenv("TUBELY_FAULTS")
+	if spec == "" {
+		return nil
+	}
+	rules, err := parseFaultRules(spec)
+	if err != nil {
+		log.Fatalf("Invalid TUBELY_FAULTS: %v", err)
+	}
+	log.Printf("fault injection enabled: %s", spec)
+
+	ffmpeg.SetRunHook(func(ctx context.Context, bin string, args []string) error {
+		if p, ok := rules.binError[bin]; ok && rand.Float64() < p {
+			log.Printf("faults: failing %s", bin)
+			return errInjectedFault
+		}
+		return nil
+	})
+
+	return []func(*s3.Options){func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			// after the retry middleware, so every attempt can fail on its own
+			return stack.Finalize.Add(s3FaultMiddleware(rules), middleware.After)
+		})
+	}}
+}
+
+func s3FaultMiddleware(rules faultRules) middleware.FinalizeMiddleware {
+	return middleware.FinalizeMiddlewareFunc("FaultInjection", func(
+		ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+	) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		op := awsmiddleware.GetOperationName(ctx)
+		if delay, ok := lookupRule(rules.s3Delays, op); ok {
+			log.Printf("faults: delaying %s by %s", op, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return middleware.FinalizeOutput{}, middleware.Metadata{}, ctx.Err()
+			}
+		}
+		if p, ok := lookupRule(rules.s3Errors, op); ok && rand.Float64() < p {
+			log.Printf("faults: failing %s with a 500", op)
+			return middleware.FinalizeOutput{}, middleware.Metadata{}, &awshttp.ResponseError{
+				ResponseError: &smithyhttp.ResponseError{
+					Response: &smithyhttp.Response{Response: &http.Response{
+						StatusCode: http.StatusInternalServerError,
+						Header:     http.Header{},
+					}},
+					Err: errInjectedFault,
+				},
+				RequestID: "fault-injection",
+			}
+		}
+		return next.HandleFinalize(ctx, in)
+	})
+}
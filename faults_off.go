@@ -0,0 +1,10 @@
+//go:build !faults
+
+package main
+
+import "github.com/aws/aws-sdk-go-v2/service/s3"
+
+// setupFaultInjection is a no-op unless built with the faults tag.
+func setupFaultInjection() []func(*s3.Options) {
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// channelVideo is what anyone can see of a video on its owner's channel,
+// leaving out storage keys, checksums and the like.
+type channelVideo struct {
+	ID                  uuid.UUID `json:"id"`
+	CreatedAt           time.Time `json:"created_at"`
+	Title               string    `json:"title"`
+	Description         string    `json:"description"`
+	UserID              uuid.UUID `json:"user_id"`
+	ThumbnailURL        *string   `json:"thumbnail_url"`
+	ThumbnailPreviewURL *string   `json:"thumbnail_preview_url"`
+	ThumbnailBlurhash   *string   `json:"thumbnail_blurhash"`
+	// nil until the video premieres, and for watermarked videos, which
+	// have to be played through a playback session
+	VideoURL   *string    `json:"video_url"`
+	PremiereAt *time.Time `json:"premiere_at"`
+	Duration   *float64   `json:"duration"`
+}
+
+func newChannelVideo(video database.Video, viewerID uuid.UUID, now time.Time) channelVideo {
+	public := channelVideo{
+		ID:                  video.ID,
+		CreatedAt:           video.CreatedAt,
+		Title:               video.Title,
+		Description:         video.Description,
+		UserID:              video.UserID,
+		ThumbnailURL:        video.ThumbnailURL,
+		ThumbnailPreviewURL: video.ThumbnailPreviewURL,
+		ThumbnailBlurhash:   video.ThumbnailBlurhash,
+		VideoURL:            video.VideoURL,
+		PremiereAt:          video.PremiereAt,
+		Duration:            video.Duration,
+	}
+	access := ownerAccess(video, viewerID)
+	if premiereLocked(video, access, now) || watermarkRequired(video, access) {
+		public.VideoURL = nil
+	}
+	return public
+}
+
+// handlerChannelGet shows a user's channel and their public videos that
+// are ready to play, to anyone.
+func (cfg *apiConfig) handlerChannelGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.Channel
+		PinnedVideo *channelVideo  `json:"pinned_video"`
+		Videos      []channelVideo `json:"videos"`
+	}
+
+	userIDString := r.PathValue("userID")
+	userID, err := uuid.Parse(userIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, "Channel not found", nil)
+		return
+	}
+
+	channel, err := cfg.db.GetChannel(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get channel", err)
+		return
+	}
+
+	videos, err := cfg.db.GetPublishedVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	viewerID := cfg.optionalUserID(r)
+	now := cfg.now()
+	public := make([]channelVideo, 0, len(videos))
+	var pinnedVideo *channelVideo
+	for _, video := range videos {
+		public = append(public, newChannelVideo(video, viewerID, now))
+		if channel.PinnedVideoID != nil && video.ID == *channel.PinnedVideoID {
+			pinnedVideo = &public[len(public)-1]
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Channel:     channel,
+		PinnedVideo: pinnedVideo,
+		Videos:      public,
+	})
+}
+
+func (cfg *apiConfig) handlerChannelUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Bio           string     `json:"bio"`
+		PinnedVideoID *uuid.UUID `json:"pinned_video_id"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	const maxBioLength = 1000
+	if len(params.Bio) > maxBioLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bio must be at most %d characters", maxBioLength), nil)
+		return
+	}
+
+	if params.PinnedVideoID != nil {
+		video, err := cfg.db.GetVideo(*params.PinnedVideoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if video.UserID != userID {
+			respondWithError(w, http.StatusForbidden, "You can only pin your own videos", nil)
+			return
+		}
+	}
+
+	channel, err := cfg.db.GetChannel(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get channel", err)
+		return
+	}
+	channel.Bio = params.Bio
+	channel.PinnedVideoID = params.PinnedVideoID
+
+	channel, err = cfg.db.UpsertChannel(channel)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update channel", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, channel)
+}
+
+func (cfg *apiConfig) handlerChannelBannerUpload(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	const maxMemory = 10 << 20 // 10MB using bit shifting
+	r.Body = http.MaxBytesReader(w, r.Body, maxMemory)
+	r.ParseMultipartForm(maxMemory)
+
+	file, header, err := r.FormFile("banner")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+		return
+	}
+	if mediaType != "image/jpeg" && mediaType != "image/png" {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+		return
+	}
+
+	bannerFile, err := os.CreateTemp(cfg.assetsRoot, ".banner-*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create banner file", err)
+		return
+	}
+	defer os.Remove(bannerFile.Name())
+	defer bannerFile.Close()
+
+	if _, err := io.Copy(bannerFile, file); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write banner file", err)
+		return
+	}
+	if err := bannerFile.Close(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write banner file", err)
+		return
+	}
+	assetPath, err := cfg.saveAssetFile(bannerFile.Name(), mediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save banner file", err)
+		return
+	}
+
+	channel, err := cfg.db.GetChannel(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get channel", err)
+		return
+	}
+	bannerURL := cfg.getAssetURL(assetPath)
+	channel.BannerURL = &bannerURL
+
+	channel, err = cfg.db.UpsertChannel(channel)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update channel", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, channel)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerLiveStreamCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title string `json:"title"`
+	}
+	type response struct {
+		database.LiveStream
+		IngestURL string `json:"ingest_url"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Title == "" {
+		respondWithError(w, http.StatusBadRequest, "Title is required", nil)
+		return
+	}
+
+	key := make([]byte, 24)
+	_, err = rand.Read(key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate stream key", err)
+		return
+	}
+
+	stream, err := cfg.db.CreateLiveStream(database.CreateLiveStreamParams{
+		Title:     params.Title,
+		UserID:    userID,
+		StreamKey: hex.EncodeToString(key),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create live stream", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		LiveStream: stream,
+		IngestURL:  cfg.rtmpIngestURL,
+	})
+}
+
+func (cfg *apiConfig) handlerLiveStreamsRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	streams, err := cfg.db.GetLiveStreams(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve live streams", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, streams)
+}
+
+// nginx-rtmp callbacks. They are form posts carrying the stream key in
+// "name"; any non-2xx response to on_publish makes nginx drop the stream.
+
+func (cfg *apiConfig) validRTMPCallback(r *http.Request) bool {
+	secret := r.URL.Query().Get("secret")
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.rtmpCallbackSecret)) == 1
+}
+
+func (cfg *apiConfig) handlerRTMPOnPublish(w http.ResponseWriter, r *http.Request) {
+	if !cfg.validRTMPCallback(r) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid callback secret", nil)
+		return
+	}
+
+	stream, err := cfg.db.GetLiveStreamByKey(r.FormValue("name"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get live stream", err)
+		return
+	}
+	if stream.StreamKey == "" || stream.Status != database.LiveStreamStatusIdle {
+		respondWithError(w, http.StatusForbidden, "Stream key is not valid", nil)
+		return
+	}
+
+	stream.Status = database.LiveStreamStatusLive
+	err = cfg.db.UpdateLiveStream(stream)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update live stream", err)
+		return
+	}
+
+	if cfg.liveHLSDir != "" {
+		cfg.startLiveArchive(stream)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerRTMPOnPublishDone(w http.ResponseWriter, r *http.Request) {
+	if !cfg.validRTMPCallback(r) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid callback secret", nil)
+		return
+	}
+
+	stream, err := cfg.db.GetLiveStreamByKey(r.FormValue("name"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get live stream", err)
+		return
+	}
+	if stream.StreamKey == "" {
+		respondWithError(w, http.StatusNotFound, "Live stream not found", nil)
+		return
+	}
+
+	stream.Status = database.LiveStreamStatusEnded
+	err = cfg.db.UpdateLiveStream(stream)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update live stream", err)
+		return
+	}
+
+	if cfg.liveHLSDir != "" {
+		go cfg.finishLiveArchive(stream)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerRTMPOnRecordDone(w http.ResponseWriter, r *http.Request) {
+	if !cfg.validRTMPCallback(r) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid callback secret", nil)
+		return
+	}
+
+	stream, err := cfg.db.GetLiveStreamByKey(r.FormValue("name"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get live stream", err)
+		return
+	}
+	if stream.StreamKey == "" {
+		respondWithError(w, http.StatusNotFound, "Live stream not found", nil)
+		return
+	}
+
+	// only trust the file name, the recording must live in our record dir
+	recordingPath := filepath.Join(cfg.rtmpRecordDir, filepath.Base(r.FormValue("path")))
+	if _, err := os.Stat(recordingPath); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Recording not found", err)
+		return
+	}
+
+	// with HLS archival the VOD is stitched from the archived segments instead
+	if cfg.liveHLSDir != "" {
+		os.Remove(recordingPath)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	go cfg.publishLiveRecording(stream, recordingPath)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// publishLiveRecording ingests the recording of a stream as a new video and
+// links the stream to it, reporting whether it did.
+func (cfg *apiConfig) publishLiveRecording(stream database.LiveStream, recordingPath string) bool {
+	defer os.Remove(recordingPath)
+
+	// a recording counts against the plan like an upload of it would
+	if err := cfg.checkIngestFile(context.Background(), stream.UserID, recordingPath); err != nil {
+		log.Printf("rtmp: recording of stream %s can't be published: %v", stream.ID, err)
+		return false
+	}
+
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:  stream.Title,
+		UserID: stream.UserID,
+	})
+	if err != nil {
+		log.Printf("rtmp: couldn't create video for stream %s: %v", stream.ID, err)
+		return false
+	}
+
+	// the flv recording is transcoded to mp4 like any other container
+	video, err = cfg.ingestVideoFile(context.Background(), video, recordingPath, "")
+	if err != nil {
+		log.Printf("rtmp: couldn't ingest recording for stream %s: %v", stream.ID, err)
+		return false
+	}
+
+	stream.Status = database.LiveStreamStatusEnded
+	stream.VideoID = &video.ID
+	err = cfg.db.UpdateLiveStream(stream)
+	if err != nil {
+		// the video is there all the same
+		log.Printf("rtmp: couldn't link stream %s to video %s: %v", stream.ID, video.ID, err)
+		return true
+	}
+	log.Printf("rtmp: published recording of stream %s as video %s", stream.ID, video.ID)
+	return true
+}
+
+func (cfg *apiConfig) handlerLiveStreamHLS(w http.ResponseWriter, r *http.Request) {
+	streamID, err := uuid.Parse(r.PathValue("streamID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid stream ID", err)
+		return
+	}
+
+	stream, err := cfg.db.GetLiveStream(streamID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get live stream", err)
+		return
+	}
+	if stream.StreamKey == "" {
+		respondWithError(w, http.StatusNotFound, "Live stream not found", nil)
+		return
+	}
+	if stream.Status != database.LiveStreamStatusLive {
+		respondWithError(w, http.StatusNotFound, "Live stream is not live", nil)
+		return
+	}
+
+	file := filepath.Base(r.PathValue("file"))
+	switch filepath.Ext(file) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2t")
+	default:
+		respondWithError(w, http.StatusNotFound, "Not found", nil)
+		return
+	}
+
+	http.ServeFile(w, r, filepath.Join(cfg.liveStreamHLSDir(stream), file))
+}
@@ -42,7 +42,7 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 
 	accessToken, err := auth.MakeJWT(
 		user.ID,
-		cfg.jwtSecret,
+		cfg.jwt,
 		time.Hour*24*30,
 	)
 	if err != nil {
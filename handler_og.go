@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoOGImage(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.Visibility == database.VideoVisibilityPrivate {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	thumbnailURL, videoURL := "", ""
+	if video.ThumbnailURL != nil {
+		thumbnailURL = *video.ThumbnailURL
+	}
+	if video.VideoURL != nil {
+		videoURL = *video.VideoURL
+	}
+
+	// cards are cached per combination of inputs, so a new title, thumbnail or
+	// upload renders a fresh card and stale ones are simply never read again
+	fingerprint := sha256.Sum256([]byte(video.Title + "\x00" + thumbnailURL + "\x00" + videoURL))
+	cacheDir := filepath.Join(cfg.assetsRoot, "og")
+	cachePath := filepath.Join(cacheDir, video.ID.String()+"-"+hex.EncodeToString(fingerprint[:8])+".png")
+
+	if _, err := os.Stat(cachePath); err != nil {
+		err = cfg.renderVideoOGImage(r.Context(), cachePath, video, thumbnailURL)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't render image", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeFile(w, r, cachePath)
+}
+
+func (cfg *apiConfig) renderVideoOGImage(ctx context.Context, cachePath string, video database.Video, thumbnailURL string) error {
+	card := ogCard{title: video.Title}
+
+	// thumbnails are stored in our own assets dir, read them straight from disk
+	assetPrefix := cfg.getAssetURL("")
+	if strings.HasPrefix(thumbnailURL, assetPrefix) {
+		thumbnailPath, err := cfg.getAssetDiskPath(strings.TrimPrefix(thumbnailURL, assetPrefix))
+		if err != nil {
+			log.Printf("og: bad thumbnail URL %s: %v", thumbnailURL, err)
+		} else if thumbnail, err := decodeImageFile(thumbnailPath); err != nil {
+			log.Printf("og: couldn't decode thumbnail %s: %v", thumbnailPath, err)
+		} else {
+			card.thumbnail = thumbnail
+		}
+	}
+
+	if store, key, ok, err := cfg.storeForVideo(video); err != nil {
+		log.Printf("og: couldn't get storage of video %s: %v", video.ID, err)
+	} else if ok {
+		probe, err := cfg.probeStoredVideo(ctx, store, jobPresigner("og", &video.ID), key)
+		if err != nil {
+			log.Printf("og: couldn't probe %s: %v", key, err)
+		} else {
+			card.duration = formatDuration(probe.Duration)
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(cachePath), "og-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	if err := renderOGCard(tempFile, card); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), cachePath)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerUserPlanGet returns the caller's plan along with the larger plans
+// they could move to, for upgrade prompts.
+func (cfg *apiConfig) handlerUserPlanGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Plan     database.Plan   `json:"plan"`
+		Upgrades []database.Plan `json:"upgrades"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	plan, err := cfg.db.GetUserPlan(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	plans, err := cfg.db.GetPlans()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plans", err)
+		return
+	}
+
+	upgrades := []database.Plan{}
+	for _, p := range plans {
+		if p.MaxVideoSize > plan.MaxVideoSize {
+			upgrades = append(upgrades, p)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Plan:     plan,
+		Upgrades: upgrades,
+	})
+}
+
+func (cfg *apiConfig) runSetPlan(email, planName string) error {
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("couldn't get user: %w", err)
+	}
+	if user.Email == "" {
+		return fmt.Errorf("user %s doesn't exist", email)
+	}
+	plan, err := cfg.db.GetPlan(planName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("plan %s doesn't exist", planName)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't get plan: %w", err)
+	}
+	if err := cfg.db.SetUserPlan(user.ID, plan.Name); err != nil {
+		return fmt.Errorf("couldn't set plan: %w", err)
+	}
+	fmt.Printf("%s is now on the %s plan\n", email, plan.Name)
+	return nil
+}
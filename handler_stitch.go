@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func parseStitchClipKind(s string) (database.StitchClipKind, bool) {
+	switch kind := database.StitchClipKind(s); kind {
+	case database.StitchClipIntro, database.StitchClipOutro:
+		return kind, true
+	}
+	return "", false
+}
+
+func (cfg *apiConfig) handlerStitchClipUpload(w http.ResponseWriter, r *http.Request) {
+	kind, ok := parseStitchClipKind(r.PathValue("kind"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Clip kind must be intro or outro", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	const maxClipSize = 100 << 20 // 100MB using bit shifting
+	r.Body = http.MaxBytesReader(w, r.Body, maxClipSize)
+
+	file, header, err := r.FormFile("video")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+		return
+	}
+	if mediaType != "video/mp4" {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+		return
+	}
+
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload directory", err)
+		return
+	}
+	defer os.RemoveAll(uploadDir)
+
+	spool, err := cfg.spoolToTempFile(uploadDir, file, "clip-*.mp4", 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not write file to disk", err)
+		return
+	}
+
+	key, err := joinKey("stitch_clips", userID.String(), getAssetPath(mediaType))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build object key", err)
+		return
+	}
+	err = cfg.uploadFileToS3(r.Context(), cfg.defaultStore(), key, mediaType, spool.Path)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't upload file to S3", err)
+		return
+	}
+
+	err = cfg.db.SetStitchClip(userID, kind, key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save clip", err)
+		return
+	}
+
+	clips, err := cfg.db.GetStitchClips(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve clips", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, clips)
+}
+
+func (cfg *apiConfig) handlerStitchClipsRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	clips, err := cfg.db.GetStitchClips(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve clips", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, clips)
+}
+
+func (cfg *apiConfig) handlerStitchClipDelete(w http.ResponseWriter, r *http.Request) {
+	kind, ok := parseStitchClipKind(r.PathValue("kind"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Clip kind must be intro or outro", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	err = cfg.db.DeleteStitchClip(userID, kind)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete clip", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerVideoStitch(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Intro *bool `json:"intro"`
+		Outro *bool `json:"outro"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// an empty body stitches every configured clip
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !cfg.videoAccessAllowed(w, video, userID, videoAccessEdit) {
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video has not been uploaded yet", nil)
+		return
+	}
+	store, mainKey, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate video in storage", nil)
+		return
+	}
+
+	clips, err := cfg.db.GetStitchClips(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve clips", err)
+		return
+	}
+	clipKeys := map[database.StitchClipKind]string{}
+	for _, clip := range clips {
+		clipKeys[clip.Kind] = clip.Key
+	}
+	introKey, outroKey := clipKeys[database.StitchClipIntro], clipKeys[database.StitchClipOutro]
+	if params.Intro != nil && !*params.Intro {
+		introKey = ""
+	}
+	if params.Outro != nil && !*params.Outro {
+		outroKey = ""
+	}
+	if introKey == "" && outroKey == "" {
+		respondWithError(w, http.StatusBadRequest, "No intro or outro clip configured", nil)
+		return
+	}
+
+	// stitching again starts over from the upload the last stitch was made
+	// from, so the clips aren't added twice
+	source, err := cfg.db.GetStitchSource(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get stitch source", err)
+		return
+	}
+	restitch := source.Key != "" && source.StitchedSHA256 == aws.ToString(video.UploadSHA256)
+	if restitch {
+		mainKey = source.Key
+	}
+
+	workDir, err := cfg.newUploadDir()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create working directory", err)
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	// intros and outros are kept in our bucket, the video wherever its
+	// owner stores uploads
+	inputs := []string{}
+	for _, part := range []struct {
+		store objectStore
+		key   string
+	}{
+		{cfg.defaultStore(), introKey},
+		{store, mainKey},
+		{cfg.defaultStore(), outroKey},
+	} {
+		if part.key == "" {
+			continue
+		}
+		localPath, err := cfg.downloadObjectToTemp(r.Context(), part.store, workDir, part.key, "input-*.mp4")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't download video", err)
+			return
+		}
+		inputs = append(inputs, localPath)
+	}
+
+	mainIndex := 0
+	if introKey != "" {
+		mainIndex = 1
+	}
+	width, height, err := getVideoDimensions(r.Context(), inputs[mainIndex])
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video dimensions", err)
+		return
+	}
+
+	stitchedPath, err := stitchVideos(r.Context(), workDir, inputs, width, height)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't stitch video", err)
+		return
+	}
+	stitchedSHA256, err := fileSHA256(stitchedPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash stitched video", err)
+		return
+	}
+
+	// the upload being replaced is kept apart, as replaced uploads are
+	// dropped once the stitched one is published
+	if !restitch {
+		source.Key, err = joinKey("stitch_sources", video.ID.String()+".mp4")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't build object key", err)
+			return
+		}
+		if err := cfg.uploadFileToS3(r.Context(), store, source.Key, "video/mp4", inputs[mainIndex]); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't keep unstitched video", err)
+			return
+		}
+	}
+
+	video, ingestErr := cfg.ingestVideoFile(r.Context(), video, stitchedPath, stitchedSHA256)
+	if ingestErr != nil && !errors.Is(ingestErr, errPublishQueued) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't process video", ingestErr)
+		return
+	}
+	err = cfg.db.SetStitchSource(database.StitchSource{
+		VideoID:        video.ID,
+		Key:            source.Key,
+		StitchedSHA256: stitchedSHA256,
+	})
+	if err != nil {
+		log.Printf("Couldn't record what video %s was stitched from: %v", video.ID, err)
+	}
+	if ingestErr != nil {
+		respondWithPublishQueued(w)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
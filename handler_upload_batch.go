@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+	"github.com/google/uuid"
+)
+
+const maxBatchFiles = 20
+
+type batchUploadResult struct {
+	Filename   string            `json:"filename"`
+	Accepted   bool              `json:"accepted"`
+	VideoID    *uuid.UUID        `json:"video_id,omitempty"`
+	Violations []uploadViolation `json:"violations,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+type batchUploadFile struct {
+	video     database.Video
+	uploadDir string
+	path      string
+	sha256    string
+	size      int64
+}
+
+// handlerUploadBatch accepts any number of "videos" parts in one multipart
+// request, for creators moving an existing library over. Every file is
+// validated on its own and gets its own video record, titled after the file
+// name. Accepted files are processed in the background after the response.
+// A request that breaks off partway still answers 202 once a file was
+// accepted, with what went wrong as the last result, so the client knows
+// which files go ahead.
+func (cfg *apiConfig) handlerUploadBatch(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	plan, err := cfg.db.GetUserPlan(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchFiles*cfg.maxVideoSize(plan))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Expected multipart form", err)
+		return
+	}
+
+	results := []batchUploadResult{}
+	accepted := []batchUploadFile{}
+	// accepted files count towards upload caps only once processed
+	queued := uploadUsage{}
+	// if the request fails partway the files accepted so far still go ahead
+	slot := keepUploadSlot(r.Context())
+	defer func() {
+		go func() {
+			defer slot.release()
+			cfg.processBatchUploads(userID, accepted)
+		}()
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			results = append(results, batchUploadResult{Error: "Unable to parse form file"})
+			log.Printf("batch: %v", err)
+			break
+		}
+		if part.FormName() != "videos" {
+			continue
+		}
+		if len(results) == maxBatchFiles {
+			results = append(results, batchUploadResult{
+				Filename: part.FileName(),
+				Error:    fmt.Sprintf("A batch can hold at most %d files", maxBatchFiles),
+			})
+			break
+		}
+
+		result, file, err := cfg.receiveBatchFile(userID, plan, queued, part)
+		if err != nil {
+			result.Error = "Couldn't read file"
+			results = append(results, result)
+			log.Printf("batch: couldn't read file %s: %v", part.FileName(), err)
+			break
+		}
+		results = append(results, result)
+		if result.Accepted {
+			accepted = append(accepted, file)
+			queued.Uploads++
+			queued.Bytes += file.size
+		}
+	}
+
+	if len(accepted) == 0 && len(results) > 0 && results[len(results)-1].Error != "" {
+		last := results[len(results)-1]
+		respondWithError(w, http.StatusBadRequest, last.Error, nil)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, results)
+}
+
+// receiveBatchFile validates and spools one part, counting queued against
+// the upload caps along with it. Problems with the file itself go in the
+// result; the error is only for a broken request body.
+func (cfg *apiConfig) receiveBatchFile(userID uuid.UUID, plan database.Plan, queued uploadUsage, part *multipart.Part) (batchUploadResult, batchUploadFile, error) {
+	filename := part.FileName()
+	result := batchUploadResult{Filename: filename}
+
+	mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	result.Violations = cfg.checkVideoUpload(plan, filename, mediaType, 0, 0)
+	if len(result.Violations) > 0 {
+		return result, batchUploadFile{}, nil
+	}
+
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		result.Error = "Couldn't create upload directory"
+		return result, batchUploadFile{}, nil
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			os.RemoveAll(uploadDir)
+		}
+	}()
+
+	// read one byte past the limit so oversized files can be told apart
+	spool, err := cfg.spoolToTempFile(uploadDir, io.LimitReader(part, cfg.maxVideoSize(plan)+1), "upload-*.mp4", 0)
+	if err != nil {
+		return result, batchUploadFile{}, err
+	}
+	container, err := videoContainer(spool.Path)
+	if err != nil {
+		result.Error = "Couldn't read file"
+		return result, batchUploadFile{}, nil
+	}
+	result.Violations = checkVideoContainer(mediaType, container)
+	if len(result.Violations) > 0 {
+		return result, batchUploadFile{}, nil
+	}
+	duration, err := getVideoDuration(context.Background(), spool.Path)
+	if err != nil {
+		result.Error = "Couldn't read video duration"
+		return result, batchUploadFile{}, nil
+	}
+	result.Violations = cfg.checkVideoUpload(plan, filename, mediaType, spool.Size, duration)
+	if len(result.Violations) > 0 {
+		return result, batchUploadFile{}, nil
+	}
+	err = cfg.checkUploadQuota(userID, plan, uploadUsage{Uploads: queued.Uploads + 1, Bytes: queued.Bytes + spool.Size}, cfg.now())
+	var exceeded limits.Exceeded
+	if errors.As(err, &exceeded) {
+		result.Violations = []uploadViolation{limitViolation(exceeded.Name, exceeded)}
+		return result, batchUploadFile{}, nil
+	}
+	if err != nil {
+		result.Error = "Couldn't check upload quota"
+		return result, batchUploadFile{}, nil
+	}
+
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:  strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)),
+		UserID: userID,
+	})
+	if err != nil {
+		result.Error = "Couldn't create video"
+		return result, batchUploadFile{}, nil
+	}
+
+	keep = true
+	result.Accepted = true
+	result.VideoID = &video.ID
+	return result, batchUploadFile{video: video, uploadDir: uploadDir, path: spool.Path, sha256: spool.SHA256, size: spool.Size}, nil
+}
+
+// processBatchUploads ingests the accepted files one at a time. Each is
+// checked against the plan again first: the batch's files were only counted
+// against each other when accepted, and other uploads may have been stored
+// since.
+func (cfg *apiConfig) processBatchUploads(userID uuid.UUID, files []batchUploadFile) {
+	for _, file := range files {
+		cfg.processBatchUpload(userID, file)
+		os.RemoveAll(file.uploadDir)
+	}
+}
+
+func (cfg *apiConfig) processBatchUpload(userID uuid.UUID, file batchUploadFile) {
+	if err := cfg.checkIngestFile(context.Background(), userID, file.path); err != nil {
+		log.Printf("batch: video %s is over the plan's limits: %v", file.video.ID, err)
+		cfg.setVideoStatus(file.video.ID, database.VideoStatusFailed)
+		return
+	}
+	_, err := cfg.ingestVideoFile(context.Background(), file.video, file.path, file.sha256)
+	if err != nil {
+		log.Printf("batch: couldn't ingest video %s: %v", file.video.ID, err)
+	}
+}
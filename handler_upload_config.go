@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type uploadMode struct {
+	Enabled  bool   `json:"enabled"`
+	Endpoint string `json:"endpoint,omitempty"`
+	// for modes that take the file in pieces
+	ChunkSize int64 `json:"chunk_size,omitempty"`
+	// for modes with a lower cap than the plan
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+type uploadConfig struct {
+	Plan              string                `json:"plan"`
+	MaxVideoSize      int64                 `json:"max_video_size"`
+	MaxVideoDuration  int                   `json:"max_video_duration"`
+	VideoContentTypes []string              `json:"video_content_types"`
+	MaxThumbnailSize  int64                 `json:"max_thumbnail_size"`
+	ThumbnailTypes    []string              `json:"thumbnail_content_types"`
+	MaxBatchFiles     int                   `json:"max_batch_files"`
+	ChunkSize         int64                 `json:"chunk_size"`
+	Modes             map[string]uploadMode `json:"modes"`
+}
+
+// handlerUploadConfig describes what the server accepts so client SDKs can
+// configure themselves. Limits are the caller's plan, or the free plan for
+// anonymous callers. Endpoints use {videoID} as a placeholder.
+func (cfg *apiConfig) handlerUploadConfig(w http.ResponseWriter, r *http.Request) {
+	var plan database.Plan
+	var err error
+	if userID := cfg.optionalUserID(r); userID != uuid.Nil {
+		plan, err = cfg.db.GetUserPlan(userID)
+	} else {
+		plan, err = cfg.db.GetPlan(database.PlanFree)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, uploadConfig{
+		Plan:              plan.Name,
+		MaxVideoSize:      cfg.maxVideoSize(plan),
+		MaxVideoDuration:  plan.MaxVideoDuration,
+		VideoContentTypes: videoMediaTypes,
+		MaxThumbnailSize:  maxThumbnailSize,
+		ThumbnailTypes:    thumbnailMediaTypes,
+		MaxBatchFiles:     maxBatchFiles,
+		Modes: map[string]uploadMode{
+			"form": {
+				Enabled:  true,
+				Endpoint: "/api/video_upload/{videoID}",
+			},
+			"base64": {
+				Enabled:  true,
+				Endpoint: "/api/video_upload/{videoID}/base64",
+				MaxSize:  min(cfg.maxVideoSize(plan), maxBase64VideoSize),
+			},
+			"stream": {
+				Enabled:  true,
+				Endpoint: "/api/video_upload/{videoID}/stream",
+			},
+			"batch": {
+				Enabled:  true,
+				Endpoint: "/api/video_upload/batch",
+			},
+			"validate": {
+				Enabled:  true,
+				Endpoint: "/api/videos/{videoID}/validate-upload",
+			},
+			"direct_put": {
+				Enabled:  true,
+				Endpoint: "/api/videos/{videoID}/upload/direct",
+			},
+			"url": {
+				Enabled:  true,
+				Endpoint: "/api/videos/{videoID}/ingest",
+			},
+			"direct_post": {
+				Enabled:  true,
+				Endpoint: "/api/videos/{videoID}/upload/form",
+			},
+			"tus": {
+				Enabled:  true,
+				Endpoint: "/api/tus/",
+			},
+			"multipart": {
+				Enabled:   true,
+				Endpoint:  "/api/videos/{videoID}/upload/init",
+				ChunkSize: streamPartSize,
+			},
+		},
+	})
+}
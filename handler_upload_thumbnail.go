@@ -2,25 +2,21 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
 	"net/http"
 	"os"
-	"path/filepath"
+	"slices"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
-	var contentTypeToExt = map[string]string{
-		"image/jpeg": ".jpg",
-		"image/png":  ".png",
-	}
-
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
@@ -34,7 +30,7 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -42,79 +38,134 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 
 	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
 
-	const maxMemory = 10 << 20 // 10MB using bit shifting
-	r.ParseMultipartForm(maxMemory)
-
-	file, header, err := r.FormFile("thumbnail")
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
 		return
 	}
-	defer file.Close()
 
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
-		return
-	}
-	if mediaType != "image/jpeg" && mediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+	if !cfg.videoAccessAllowed(w, video, userID, videoAccessEdit) {
 		return
 	}
 
-	data, err := io.ReadAll(file)
+	r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailSize)
+
+	// stream the part instead of letting ParseMultipartForm buffer it
+	reader, err := r.MultipartReader()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't read file", err)
+		respondWithError(w, http.StatusBadRequest, "Expected multipart form", err)
 		return
 	}
+	var file io.Reader
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+			return
+		}
+		if part.FormName() == "thumbnail" {
+			file = part
+			break
+		}
+	}
 
-	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Video not found", err)
+	cfg.storeThumbnail(w, r, video, file)
+}
+
+// storeThumbnail checks an uploaded image, saves it as the video's thumbnail
+// and writes the response. Shared by every way a thumbnail can be sent.
+func (cfg *apiConfig) storeThumbnail(w http.ResponseWriter, r *http.Request, video database.Video, file io.Reader) {
+	checksum, ok := expectedSHA256(w, r)
+	if !ok {
 		return
 	}
 
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "No access right to this video", nil)
+	// don't trust the client's Content-Type, sniff the actual bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read file", err)
 		return
 	}
+	head = head[:n]
+	mediaType := http.DetectContentType(head)
 
-	ext, ok := contentTypeToExt[mediaType]
-	if !ok {
+	if !slices.Contains(thumbnailMediaTypes, mediaType) {
 		respondWithError(w, http.StatusBadRequest, "Unsupported image type", nil)
 		return
 	}
 
-	key := make([]byte, 32)
-	_, err = rand.Read(key)
+	// write next to the final path and move it in, so a failed upload never
+	// leaves a truncated thumbnail behind
+	thumbnailFile, err := os.CreateTemp(cfg.assetsRoot, ".thumbnail-*")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random name", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create thumbnail file", err)
 		return
 	}
-	base64Name := base64.RawURLEncoding.EncodeToString(key)
-	filename := fmt.Sprintf("%s%s", base64Name, ext)
-	filepath := filepath.Join(cfg.assetsRoot, filename)
+	defer os.Remove(thumbnailFile.Name())
+	defer thumbnailFile.Close()
 
-	thumbnailFile, err := os.Create(filepath)
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(thumbnailFile, hasher), io.MultiReader(bytes.NewReader(head), file))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create thumbnail file", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't copy thumbnail file", err)
 		return
 	}
-	defer thumbnailFile.Close()
-
-	if _, err := io.Copy(thumbnailFile, bytes.NewReader(data)); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't copy thumbnail file", err)
+	if checksumMismatch(w, checksum, hex.EncodeToString(hasher.Sum(nil)), size) {
 		return
 	}
+	if err := thumbnailFile.Close(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write thumbnail file", err)
+		return
+	}
+
+	thumbnailPath, thumbnailType := thumbnailFile.Name(), mediaType
+	thumbnailETag := hex.EncodeToString(hasher.Sum(nil))
+	var previewURL *string
+	if mediaType == "image/gif" {
+		// not every player animates a GIF poster, so the thumbnail is the
+		// first frame and the animation becomes a separate WebP preview
+		pngPath, animated, err := gifFirstFramePNG(thumbnailPath, cfg.assetsRoot)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode GIF", err)
+			return
+		}
+		defer os.Remove(pngPath)
+		if animated {
+			previewURL = cfg.saveGIFPreview(thumbnailPath)
+		}
+		thumbnailPath, thumbnailType = pngPath, "image/png"
+		thumbnailETag, err = fileSHA256(pngPath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't hash thumbnail", err)
+			return
+		}
+	}
 
-	thumbnailUrl := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filename)
-	video.ThumbnailURL = &thumbnailUrl
+	assetPath, err := cfg.saveAssetFile(thumbnailPath, thumbnailType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail file", err)
+		return
+	}
 
-	err = cfg.db.UpdateVideo(video)
+	thumbnailUrl := cfg.getAssetURL(assetPath)
+	video, err = cfg.updateVideo(video.ID, func(video *database.Video) {
+		video.ThumbnailURL = &thumbnailUrl
+		// a still thumbnail leaves the preview cut from the upload alone
+		if previewURL != nil || !video.ThumbnailPreviewGenerated {
+			video.ThumbnailPreviewURL = previewURL
+			video.ThumbnailPreviewGenerated = false
+		}
+		video.ThumbnailETag = &thumbnailETag
+		video.ThumbnailGenerated = false
+		video.ThumbnailBlurhash = nil
+		video.ThumbnailVersion = nil
+	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
+	video = cfg.refreshThumbnail(r.Context(), video)
 
-	respondWithJSON(w, http.StatusOK, video)
+	respondWithJSON(w, http.StatusOK, withAssetReadiness(cfg.withSignedThumbnail(video)))
 }
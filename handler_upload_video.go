@@ -1,25 +1,20 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"log"
 	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
+	"slices"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
 
-	// maxFileSize := http.MaxBytesReader(w, r.Body, 1<<30)
-	const maxFileSize = 1 << 30 // 1GB using bit shifting
-	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
-
 	// extract video ID from url
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -35,7 +30,7 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -47,15 +42,30 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "User not authorized to upload video", nil)
+	if !cfg.videoAccessAllowed(w, video, userID, videoAccessEdit) {
+		return
+	}
+
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
 		return
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoSize(plan))
+	body, finish := cfg.uploadProgresses.track(video.ID, r.ContentLength, r.Body)
+	defer finish()
+	r.Body = body
 
 	// parse video file from form data
 	file, header, err := r.FormFile("video")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithUploadViolations(w, []uploadViolation{cfg.videoSizeViolation(plan, 0)}, err, uploadRecovery{})
+			return
+		}
+		// most likely the connection dropped mid-body
+		respondWithUploadError(w, http.StatusBadRequest, "Unable to parse form file", err, uploadRecovery{Retryable: true})
 		return
 	}
 	defer file.Close()
@@ -66,88 +76,45 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
 		return
 	}
-	if mediaType != "video/mp4" {
+	if !slices.Contains(videoMediaTypes, mediaType) {
 		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
 		return
 	}
 
-	// save file temporarily to disk
-	tempFile, err := os.CreateTemp("", "tubely-upload-*.mp4")
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
-		return
-	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
-
-	if _, err := io.Copy(tempFile, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not write file to disk", err)
-		return
-	}
-
-	// reset tempFile's file pointer to the beginning
-	_, err = tempFile.Seek(0, io.SeekStart)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not reset file pointer", err)
-		return
-	}
-
-	// get video aspect ratio
-	videoAspectRatio, err := getVideoAspectRatio(tempFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video aspect ratio", err)
-		return
-	}
-
-	directory := ""
-	switch videoAspectRatio {
-	case "16:9":
-		directory = "landscape"
-	case "9:16":
-		directory = "portrait"
-	default:
-		directory = "other"
-	}
+	// the body is a little bigger than the file, and capped at the plan
+	cfg.storeVideoUpload(w, r, video, plan, mediaType, file, min(r.ContentLength, cfg.maxVideoSize(plan)))
+}
 
-	// process video for fast start
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
-	if err != nil {
-		log.Printf("Fast start processing error: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
+// storeVideoUpload runs an uploaded video through uploadPipeline and writes
+// the response. Shared by every way a video can be sent in one request.
+// contentType is what the client said it was sending, and is checked against
+// the bytes themselves. sizeHint is roughly how big the file is, if known, to
+// preallocate the spool. Clients that send Prefer: respond-async get a job to
+// poll instead of waiting for processing.
+func (cfg *apiConfig) storeVideoUpload(w http.ResponseWriter, r *http.Request, video database.Video, plan database.Plan, contentType string, file io.Reader, sizeHint int64) {
+	checksum, ok := expectedSHA256(w, r)
+	if !ok {
 		return
 	}
-	defer os.Remove(processedFilePath)
 
-	processedFile, err := os.Open(processedFilePath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed file", err)
-		return
+	in := &videoIngest{
+		video:       video,
+		plan:        plan,
+		contentType: contentType,
+		body:        file,
+		sizeHint:    sizeHint,
+		checksum:    checksum,
 	}
-	defer processedFile.Close()
-
-	// upload file to S3
-
-	key := getAssetPath(mediaType)
-	key = filepath.Join(directory, key)
-
-	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(key),
-		Body:        processedFile,
-		ContentType: aws.String("video/mp4"),
-	})
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload file to S3", err)
+	if preferAsync(r) {
+		cfg.storeVideoUploadAsync(w, r, in)
 		return
 	}
-
-	video.VideoURL = aws.String(cfg.s3CfDistribution + "/" + key)
-	err = cfg.db.UpdateVideo(video)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+	defer in.removeTemp()
+	if err := cfg.runIngest(r.Context(), cfg.uploadPipeline(), in); err != nil {
+		log.Printf("Video upload error: %v", err)
+		cfg.respondWithUploadPipelineError(w, in, err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
-
+	respondWithJSON(w, http.StatusOK, in.response)
 }
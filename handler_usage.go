@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerUserUsageGet reports what the caller has stored and uploaded against
+// their plan's limits, so clients can show remaining quota before an upload
+// is refused.
+func (cfg *apiConfig) handlerUserUsageGet(w http.ResponseWriter, r *http.Request) {
+	type uploadWindowUsage struct {
+		Period      database.UploadPeriod `json:"period"`
+		Uploads     int                   `json:"uploads"`
+		UploadLimit int                   `json:"upload_limit"`
+		Bytes       int64                 `json:"bytes"`
+		BytesLimit  int64                 `json:"bytes_limit"`
+		ResetsAt    time.Time             `json:"resets_at"`
+	}
+	type response struct {
+		Storage storageUsage        `json:"storage"`
+		Uploads []uploadWindowUsage `json:"uploads"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	plan, err := cfg.db.GetUserPlan(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	storage, err := cfg.storageUsage(userID, plan)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage usage", err)
+		return
+	}
+
+	now := cfg.now()
+	windows := []uploadWindowUsage{
+		{Period: database.UploadPeriodDay, UploadLimit: plan.DailyUploads, BytesLimit: plan.DailyUploadBytes},
+		{Period: database.UploadPeriodMonth, UploadLimit: plan.MonthlyUploads, BytesLimit: plan.MonthlyUploadBytes},
+	}
+	for i := range windows {
+		start, end := uploadWindow(windows[i].Period, now)
+		counter, err := cfg.db.GetUploadCounter(userID, windows[i].Period, start)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get upload counter", err)
+			return
+		}
+		windows[i].Uploads = counter.Uploads
+		windows[i].Bytes = counter.Bytes
+		windows[i].ResetsAt = end
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Storage: storage,
+		Uploads: windows,
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handlerVideoValidateUpload lets clients check a file against the upload
+// limits before sending any bytes.
+func (cfg *apiConfig) handlerVideoValidateUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Filename    string  `json:"filename"`
+		Size        int64   `json:"size"`
+		Duration    float64 `json:"duration"`
+		ContentType string  `json:"content_type"`
+	}
+	type response struct {
+		Accepted   bool              `json:"accepted"`
+		Violations []uploadViolation `json:"violations"`
+	}
+
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	violations := cfg.checkVideoUpload(plan, params.Filename, params.ContentType, params.Size, params.Duration)
+	respondWithJSON(w, http.StatusOK, response{
+		Accepted:   len(violations) == 0,
+		Violations: violations,
+	})
+}
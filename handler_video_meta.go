@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -19,7 +22,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -56,7 +59,7 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -67,8 +70,7 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+	if !cfg.videoAccessAllowed(w, video, userID, videoAccessOwner) {
 		return
 	}
 
@@ -95,6 +97,35 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	access, err := cfg.videoAccessFor(video, cfg.optionalUserID(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if videoHidden(video, access) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	video = cfg.withSignedThumbnail(video)
+	if watermarkRequired(video, access) {
+		// playback has to go through the viewer's rendition
+		video.VideoURL = nil
+	}
+
+	if premiereLocked(video, access, cfg.now()) {
+		respondWithJSON(w, http.StatusOK, newPremiereCountdown(video, cfg.now()))
+		return
+	}
+	// anyone else sees what the video's channel shows
+	if access == videoAccessNone {
+		respondWithJSON(w, http.StatusOK, newChannelVideo(video, uuid.Nil, cfg.now()))
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, video)
 }
 
@@ -104,17 +135,37 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	filter := database.VideoFilter{Query: strings.TrimSpace(r.URL.Query().Get("q"))}
+	for param, bound := range map[string]**float64{
+		"min_duration": &filter.MinDuration,
+		"max_duration": &filter.MaxDuration,
+	} {
+		v := r.URL.Query().Get(param)
+		if v == "" {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil || seconds < 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s must be a number of seconds", param), err)
+			return
+		}
+		*bound = &seconds
+	}
+
+	videos, err := cfg.db.GetVideos(userID, filter)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	for i := range videos {
+		videos[i] = cfg.withSignedThumbnail(videos[i])
+	}
 
 	respondWithJSON(w, http.StatusOK, videos)
 }
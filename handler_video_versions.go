@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const videoVersionURLExpiry = 15 * time.Minute
+
+type videoVersionResponse struct {
+	database.VideoVersion
+	Current bool   `json:"current"`
+	URL     string `json:"url"`
+}
+
+// handlerVideoVersionsRetrieve lists every stored upload of a video, newest
+// first, each with a short-lived presigned URL pinned to its S3 version.
+// Like any presigned playback, it needs a playback session for the video.
+func (cfg *apiConfig) handlerVideoVersionsRetrieve(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoFromRequest(w, r, videoAccessView)
+	if !ok {
+		return
+	}
+	session, ok := cfg.playbackSessionFromRequest(w, r, video.ID)
+	if !ok {
+		return
+	}
+
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video versions", err)
+		return
+	}
+
+	// versions are presigned against wherever the current upload is stored
+	store, currentKey, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	if !ok {
+		store = cfg.defaultStore()
+	}
+
+	requester := sessionPresigner(session)
+	resp := make([]videoVersionResponse, 0, len(versions))
+	for _, v := range versions {
+		url, err := cfg.presignObjectURL(r.Context(), store, requester, v.Key, aws.ToString(v.S3VersionID), videoVersionURLExpiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign video version", err)
+			return
+		}
+		resp = append(resp, videoVersionResponse{
+			VideoVersion: v,
+			Current:      v.Key == currentKey && aws.ToString(v.S3VersionID) == aws.ToString(video.VideoVersionID),
+			URL:          url,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerVideoVersionRollback points a video back at one of its earlier
+// uploads.
+func (cfg *apiConfig) handlerVideoVersionRollback(w http.ResponseWriter, r *http.Request) {
+	versionID, err := uuid.Parse(r.PathValue("versionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid version ID", err)
+		return
+	}
+
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+
+	version, err := cfg.db.GetVideoVersion(versionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video version", err)
+		return
+	}
+	if version.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Version not found", nil)
+		return
+	}
+
+	store, _, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	if !ok {
+		store = cfg.defaultStore()
+	}
+	versionURL := store.objectURL(version.Key)
+	head, err := store.client.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket:    aws.String(store.bucket),
+		Key:       aws.String(version.Key),
+		VersionId: version.S3VersionID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video version object", err)
+		return
+	}
+
+	hlsMaster := cfg.storedHLSMaster(r.Context(), store, version.Key)
+	dashManifest := cfg.storedDASHManifest(r.Context(), store, version.Key)
+	storyboard := cfg.storedStoryboard(r.Context(), store, version.Key)
+	ladder := cfg.storedLadder(version.Key)
+	metadata := cfg.storedMetadata(r.Context(), store, jobPresigner("rollback", &video.ID), version.Key, aws.ToString(version.S3VersionID))
+
+	video, err = cfg.updateVideo(video.ID, func(video *database.Video) {
+		// only the current upload is ever archived, so any other one is playable
+		if video.VideoURL == nil || *video.VideoURL != versionURL {
+			video.ArchivedAt = nil
+		}
+		video.VideoURL = aws.String(versionURL)
+		video.Status = database.VideoStatusReady
+		video.VideoVersionID = version.S3VersionID
+		video.VideoETag = objectFingerprint(head.ETag)
+		video.VideoSize = aws.ToInt64(head.ContentLength)
+		video.HLSMasterKey = hlsMaster
+		video.DASHManifestKey = dashManifest
+		video.StoryboardKey = storyboard
+		video.Duration = nil
+		if metadata != nil {
+			video.Duration = &metadata.Duration
+		}
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.recordVideoMetadata(video.ID, version.Key, metadata)
+	if err := cfg.db.DeleteVideoRenditions(video.ID); err != nil {
+		log.Printf("Couldn't forget renditions of video %s: %v", video.ID, err)
+	}
+	// a ladder still shared with another video comes back with the upload
+	for _, rendition := range ladder {
+		rendition.VideoID = video.ID
+		if err := cfg.db.SaveVideoRendition(rendition); err != nil {
+			log.Printf("Couldn't record %s rendition of video %s: %v", rendition.Name, video.ID, err)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	// how long a key's response is replayed before the key can be reused
+	idempotencyKeyTTL = 24 * time.Hour
+	// a request pending longer than this died with the server; URL ingests
+	// are the slowest and give up after urlIngestTimeout
+	idempotencyStaleAfter = urlIngestTimeout + 5*time.Minute
+	maxIdempotencyKeyLen  = 255
+	// upload responses are a video or a short error, anything bigger isn't
+	// worth keeping
+	maxIdempotentResponse = 1 << 20 // 1MB
+)
+
+// idempotent lets a client retry an upload request, say after a timeout,
+// without it being handled twice. A request with an Idempotency-Key header
+// claims the key for its user; a retry with the same key gets the original
+// response replayed, or a 409 while the original is still running. Responses
+// worth retrying, 5xx and 429, release the key instead of being stored.
+func (cfg *apiConfig) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			respondWithError(w, http.StatusBadRequest, "Idempotency-Key is too long", nil)
+			return
+		}
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+			return
+		}
+		userID, err := auth.ValidateJWT(token, cfg.jwt)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+
+		now := cfg.now()
+		record, claimed, err := cfg.db.ClaimIdempotencyKey(database.ClaimIdempotencyKeyParams{
+			UserID:      userID,
+			Key:         key,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			CreatedAt:   now,
+			StaleBefore: now.Add(-idempotencyStaleAfter),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check Idempotency-Key", err)
+			return
+		}
+		if !claimed {
+			switch {
+			case record.Method != r.Method || record.Path != r.URL.Path:
+				respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request", nil)
+			case record.CompletedAt == nil:
+				respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is still in progress", nil)
+			default:
+				if record.ContentType != "" {
+					w.Header().Set("Content-Type", record.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.StatusCode)
+				w.Write(record.Body)
+			}
+			return
+		}
+
+		rec := &idempotentRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// a limit may be gone by the retry, with a new day or deleted videos
+		if rec.status >= 500 || rec.status == http.StatusTooManyRequests || rec.status == http.StatusPaymentRequired || rec.overflow {
+			if err := cfg.db.DeleteIdempotencyKey(userID, key); err != nil {
+				log.Printf("Couldn't release Idempotency-Key %q of user %s: %v", key, userID, err)
+			}
+			return
+		}
+		if err := cfg.db.CompleteIdempotencyKey(userID, key, cfg.now(), rec.status, w.Header().Get("Content-Type"), rec.body.Bytes()); err != nil {
+			log.Printf("Couldn't store response for Idempotency-Key %q of user %s: %v", key, userID, err)
+		}
+	}
+}
+
+// idempotentRecorder passes a response through while keeping a copy.
+type idempotentRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *idempotentRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotentRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(p) > maxIdempotentResponse {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the real writer.
+func (rec *idempotentRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,3428 @@
+//go:build integration
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/jobs"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/malware"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/pipeline"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/transcribe"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/webhook"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// The suite runs the real handlers against an S3 API, LocalStack by default:
+//
+//	docker run --rm -p 4566:4566 localstack/localstack
+//	go test -tags integration -run Integration .
+//
+// Set TUBELY_TEST_S3_ENDPOINT to use MinIO or anything else that speaks S3.
+// ffmpeg and ffprobe are the stubs in testdata/fakeffmpeg, so the pipeline
+// runs without real media.
+const defaultTestS3Endpoint = "http://localhost:4566"
+
+// testClock is a clock the test moves by hand.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+type testServer struct {
+	t      *testing.T
+	cfg    *apiConfig
+	srv    *httptest.Server
+	clock  *testClock
+	bucket string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	endpoint := os.Getenv("TUBELY_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = defaultTestS3Endpoint
+	}
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(endpoint),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	bucket := "tubely-test-" + uuid.NewString()[:8]
+	ctx := context.Background()
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Skipf("no S3 at %s: %v", endpoint, err)
+	}
+	t.Cleanup(func() { emptyAndDeleteBucket(client, bucket) })
+
+	stubs, err := filepath.Abs(filepath.Join("testdata", "fakeffmpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ffmpeg.SetPaths(filepath.Join(stubs, "ffmpeg"), filepath.Join(stubs, "ffprobe"))
+	t.Cleanup(func() { ffmpeg.SetPaths("ffmpeg", "ffprobe") })
+
+	dir := t.TempDir()
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &testClock{t: time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)}
+	adminAlerts := newAdminAlerts("", "")
+	cfg := &apiConfig{
+		db: db,
+		jwt: auth.JWTConfig{
+			Secrets:      []string{"integration-secret"},
+			Issuer:       string(auth.TokenTypeAccess),
+			Audience:     "tubely",
+			LegacyIssuer: string(auth.TokenTypeAccess),
+		},
+		urlSigningSecret: "integration-url-secret",
+		platform:         "dev",
+		filepathRoot:     filepath.Join(dir, "app"),
+		assetsRoot:       filepath.Join(dir, "assets"),
+		s3Bucket:         bucket,
+		s3Region:         "us-east-1",
+		s3Client:         client,
+		s3CfDistribution: "https://cdn.tubely.test",
+		spoolDir:         dir,
+		videoLocks:       &videoLocks{locks: map[uuid.UUID]*videoLock{}},
+		uploadProgresses: &uploadProgresses{uploads: map[uuid.UUID]*uploadProgress{}},
+		watermarkRenders: &watermarkRenders{inFlight: map[string]bool{}},
+		userStores:       &userStores{stores: map[uuid.UUID]userStore{}},
+		liveArchivers:    &liveArchivers{archivers: map[uuid.UUID]*liveArchiver{}},
+		geoIP:            &geoIP{},
+		adminAlerts:      adminAlerts,
+		presignMonitor:   newPresignMonitor(defaultPresignAlertPerMinute, adminAlerts),
+		ingestClient:     newIngestClient(true),
+		webhookClient:    newWebhookClient(true),
+		s3Retry:          s3RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+		reconcileDir:     filepath.Join(dir, "reconcile"),
+		pipelineMetrics:  pipeline.NewMetrics(),
+		clock:            clock.now,
+	}
+	if err := cfg.ensureAssetsDir(); err != nil {
+		t.Fatal(err)
+	}
+	// no workers: tests run what's queued when they want it done
+	cfg.jobs = cfg.newJobQueue(1)
+
+	srv := httptest.NewServer(cfg.routes())
+	t.Cleanup(srv.Close)
+	return &testServer{t: t, cfg: cfg, srv: srv, clock: clock, bucket: bucket}
+}
+
+func emptyAndDeleteBucket(client *s3.Client, bucket string) {
+	ctx := context.Background()
+	versions, err := client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		for _, v := range versions.Versions {
+			client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: v.Key, VersionId: v.VersionId})
+		}
+	}
+	objects, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+	if err == nil {
+		for _, o := range objects.Contents {
+			client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: o.Key})
+		}
+	}
+	client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+}
+
+// do sends a request and decodes a JSON response into out, failing the test
+// unless the status is want.
+func (ts *testServer) do(req *http.Request, want int, out any) {
+	ts.t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != want {
+		ts.t.Fatalf("%s %s: got %d, want %d: %s", req.Method, req.URL.Path, resp.StatusCode, want, body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			ts.t.Fatalf("%s %s: %v: %s", req.Method, req.URL.Path, err, body)
+		}
+	}
+}
+
+func (ts *testServer) request(method, path, token string, body any) *http.Request {
+	ts.t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, ts.srv.URL+path, r)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// signUp creates a user and returns an access token for them.
+func (ts *testServer) signUp() string {
+	ts.t.Helper()
+	return ts.signUpAs(uuid.NewString() + "@tubely.test")
+}
+
+func (ts *testServer) signUpAs(email string) string {
+	ts.t.Helper()
+	creds := map[string]string{
+		"email":    email,
+		"password": "hunter2hunter2",
+	}
+	ts.do(ts.request("POST", "/api/users", "", creds), http.StatusCreated, nil)
+	var login struct {
+		Token string `json:"token"`
+	}
+	ts.do(ts.request("POST", "/api/login", "", creds), http.StatusOK, &login)
+	return login.Token
+}
+
+func (ts *testServer) createVideo(token string) database.Video {
+	ts.t.Helper()
+	var video database.Video
+	params := map[string]string{"title": "Integration", "description": "end to end"}
+	ts.do(ts.request("POST", "/api/videos", token, params), http.StatusCreated, &video)
+	return video
+}
+
+// uploadVideo uploads data and runs the background jobs it queued.
+func (ts *testServer) uploadVideo(token string, videoID uuid.UUID, data []byte) database.Video {
+	ts.t.Helper()
+	var video database.Video
+	ts.do(ts.uploadVideoRequest(token, videoID, data), http.StatusOK, &video)
+	ts.runJobs()
+	return video
+}
+
+// runJobs runs every background job that's due.
+func (ts *testServer) runJobs() {
+	for ts.cfg.jobs.RunNext(context.Background()) {
+	}
+}
+
+// uploadVideoRequest returns a form upload of data.
+func (ts *testServer) uploadVideoRequest(token string, videoID uuid.UUID, data []byte) *http.Request {
+	ts.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="clip.mp4"`)
+	header.Set("Content-Type", "video/mp4")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req := ts.request("POST", "/api/video_upload/"+videoID.String(), token, nil)
+	req.Body = io.NopCloser(&body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// useOwnBucket registers a bucket of the user's own for their uploads. The
+// fake S3 takes any credentials, so ours stand in for the assumed role.
+func (ts *testServer) useOwnBucket(userID uuid.UUID) objectStore {
+	ts.t.Helper()
+	err := ts.cfg.db.SetUserBucket(database.UserBucket{
+		UserID:  userID,
+		Bucket:  ts.bucket + "-own",
+		Region:  "us-east-1",
+		RoleARN: "arn:aws:iam::123456789012:role/tubely",
+	})
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	bucket, err := ts.cfg.db.GetUserBucket(userID)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	store := objectStore{
+		client:    ts.cfg.s3Client,
+		bucket:    bucket.Bucket,
+		urlPrefix: "https://" + bucket.Bucket + ".s3.us-east-1.amazonaws.com",
+	}
+	ts.cfg.userStores.mu.Lock()
+	defer ts.cfg.userStores.mu.Unlock()
+	ts.cfg.userStores.stores[userID] = userStore{bucket: bucket, store: store}
+	return store
+}
+
+// playbackURLRequest opens a playback session and returns the request for a
+// presigned URL under it.
+func (ts *testServer) playbackURLRequest(token string, videoID uuid.UUID) *http.Request {
+	ts.t.Helper()
+	return ts.inSession(ts.request("GET", fmt.Sprintf("/api/videos/%s/playback-url", videoID), token, nil), ts.playbackSession(token, videoID))
+}
+
+const testDeviceID = "integration-device"
+
+// playbackSession opens a playback session on the video for the user.
+func (ts *testServer) playbackSession(token string, videoID uuid.UUID) database.PlaybackSession {
+	ts.t.Helper()
+	var session database.PlaybackSession
+	path := fmt.Sprintf("/api/videos/%s/playback-sessions", videoID)
+	ts.do(ts.request("POST", path, token, map[string]string{"device_id": testDeviceID}), http.StatusCreated, &session)
+	return session
+}
+
+// inSession sends req under the playback session.
+func (ts *testServer) inSession(req *http.Request, session database.PlaybackSession) *http.Request {
+	req.Header.Set(playbackSessionHeader, session.Token)
+	req.Header.Set(playbackDeviceHeader, testDeviceID)
+	return req
+}
+
+// testMP4 is a fast start mp4 as far as the sniffer and the box walker are
+// concerned: ftyp, then moov, then mdat.
+func testMP4() []byte {
+	box := func(kind string, payload []byte) []byte {
+		b := make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+		copy(b[4:], kind)
+		return append(b, payload...)
+	}
+	var data []byte
+	data = append(data, box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))...)
+	data = append(data, box("moov", make([]byte, 64))...)
+	data = append(data, box("mdat", bytes.Repeat([]byte("tubely"), 1024))...)
+	return data
+}
+
+func TestIntegrationVideoLifecycle(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+
+	data := testMP4()
+	video = ts.uploadVideo(token, video.ID, data)
+	if video.VideoURL == nil {
+		t.Fatal("uploaded video has no URL")
+	}
+	key, ok := ts.cfg.defaultStore().keyFromURL(*video.VideoURL)
+	if !ok {
+		t.Fatalf("video URL %s isn't in the default store", *video.VideoURL)
+	}
+	if _, err := ts.cfg.s3Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(ts.bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		t.Fatalf("object %s wasn't stored: %v", key, err)
+	}
+
+	// the same bytes again reuse the object, skipping to persist
+	copied := ts.uploadVideo(token, ts.createVideo(token).ID, data)
+	if aws.ToString(copied.VideoURL) != *video.VideoURL {
+		t.Fatalf("duplicate upload stored at %v, want %s", copied.VideoURL, *video.VideoURL)
+	}
+	var metrics struct {
+		Stages map[string]pipeline.StageStats `json:"pipeline_stages"`
+	}
+	ts.do(ts.request("GET", "/admin/metrics", "", nil), http.StatusOK, &metrics)
+	if metrics.Stages["dedupe"].Runs != 2 || metrics.Stages["store"].Runs != 1 || metrics.Stages["persist"].Runs != 2 {
+		t.Fatalf("pipeline stages ran %+v", metrics.Stages)
+	}
+
+	var playback struct {
+		URL string `json:"url"`
+	}
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, &playback)
+	resp, err := http.Get(playback.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, data) {
+		t.Fatalf("presigned URL served %d with %d bytes, want the %d uploaded", resp.StatusCode, len(got), len(data))
+	}
+
+	path := "/api/videos/" + video.ID.String()
+	ts.do(ts.request("DELETE", path, token, nil), http.StatusNoContent, nil)
+	ts.do(ts.request("GET", path, token, nil), http.StatusNotFound, nil)
+}
+
+func TestIntegrationPlaybackSessionExpires(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	ts.uploadVideo(token, video.ID, testMP4())
+
+	req := ts.playbackURLRequest(token, video.ID)
+	ts.clock.advance(playbackSessionTTL + time.Second)
+	ts.do(req, http.StatusUnauthorized, nil)
+}
+
+func TestIntegrationDirectUpload(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	data := testMP4()
+	sum := sha256.Sum256(data)
+
+	var upload struct {
+		UploadID uuid.UUID   `json:"upload_id"`
+		URL      string      `json:"url"`
+		Method   string      `json:"method"`
+		Headers  http.Header `json:"headers"`
+	}
+	base := fmt.Sprintf("/api/videos/%s/upload/direct", video.ID)
+	params := map[string]any{"size": len(data), "sha256": hex.EncodeToString(sum[:])}
+	ts.do(ts.request("POST", base, token, params), http.StatusCreated, &upload)
+
+	confirm := fmt.Sprintf("%s/%s/confirm", base, upload.UploadID)
+	ts.do(ts.request("POST", confirm, token, nil), http.StatusConflict, nil)
+
+	req, err := http.NewRequest(upload.Method, upload.URL, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = upload.Headers
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("presigned PUT got %d", resp.StatusCode)
+	}
+
+	ts.do(ts.request("POST", confirm, token, nil), http.StatusOK, &video)
+	if video.VideoURL == nil || video.VideoSize != int64(len(data)) {
+		t.Fatalf("confirmed video has URL %v and size %d", video.VideoURL, video.VideoSize)
+	}
+	ts.do(ts.request("POST", confirm, token, nil), http.StatusNotFound, nil)
+}
+
+func TestIntegrationFormUpload(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	data := testMP4()
+
+	var upload struct {
+		UploadID uuid.UUID         `json:"upload_id"`
+		URL      string            `json:"url"`
+		Fields   map[string]string `json:"fields"`
+	}
+	path := fmt.Sprintf("/api/videos/%s/upload/form", video.ID)
+	ts.do(ts.request("POST", path, token, nil), http.StatusCreated, &upload)
+	if upload.Fields["policy"] == "" {
+		t.Fatalf("form upload has no policy: %v", upload.Fields)
+	}
+
+	confirm := fmt.Sprintf("/api/videos/%s/upload/direct/%s/confirm", video.ID, upload.UploadID)
+	ts.do(ts.request("POST", confirm, token, nil), http.StatusConflict, nil)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range upload.Fields {
+		mw.WriteField(name, value)
+	}
+	part, err := mw.CreateFormFile("file", "clip.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+	resp, err := http.Post(upload.URL, mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("form POST got %d", resp.StatusCode)
+	}
+
+	ts.do(ts.request("POST", confirm, token, nil), http.StatusOK, &video)
+	if video.VideoURL == nil || video.VideoSize != int64(len(data)) {
+		t.Fatalf("confirmed video has URL %v and size %d", video.VideoURL, video.VideoSize)
+	}
+	ts.do(ts.request("POST", confirm, token, nil), http.StatusNotFound, nil)
+}
+
+func TestIntegrationVideoArchive(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	ids := []uuid.UUID{}
+	for range 2 {
+		video := ts.createVideo(token)
+		ts.uploadVideo(token, video.ID, testMP4())
+		ids = append(ids, video.ID)
+	}
+
+	req := ts.request("POST", "/api/videos/archive", token, map[string]any{"video_ids": ids})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("archive got %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range zr.File {
+		if f.Method != zip.Store || f.UncompressedSize64 != uint64(len(testMP4())) {
+			t.Fatalf("%s stored with method %d and size %d", f.Name, f.Method, f.UncompressedSize64)
+		}
+		names = append(names, f.Name)
+	}
+	if want := []string{"Integration.mp4", "Integration (2).mp4"}; !slices.Equal(names, want) {
+		t.Fatalf("archive holds %v, want %v", names, want)
+	}
+
+	// viewers can't get round a watermark or a premiere with the originals
+	viewerEmail := uuid.NewString() + "@tubely.test"
+	viewer := ts.signUpAs(viewerEmail)
+	editorEmail := uuid.NewString() + "@tubely.test"
+	editor := ts.signUpAs(editorEmail)
+	for _, id := range ids {
+		collaborators := fmt.Sprintf("/api/videos/%s/collaborators", id)
+		ts.do(ts.request("POST", collaborators, token, map[string]string{"email": viewerEmail, "role": "viewer"}), http.StatusOK, nil)
+		ts.do(ts.request("POST", collaborators, token, map[string]string{"email": editorEmail, "role": "editor"}), http.StatusOK, nil)
+	}
+	ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/watermark", ids[0]), token, map[string]bool{"enabled": true}), http.StatusOK, nil)
+	ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/premiere", ids[1]), token, map[string]any{"premiere_at": time.Now().Add(time.Hour)}), http.StatusOK, nil)
+	for _, id := range ids {
+		ts.do(ts.request("POST", "/api/videos/archive", viewer, map[string]any{"video_ids": []uuid.UUID{id}}), http.StatusForbidden, nil)
+	}
+	ts.do(ts.request("POST", "/api/videos/archive", editor, map[string]any{"video_ids": ids}), http.StatusOK, nil)
+
+	// archived uploads can't be read until they're restored
+	if _, err := ts.cfg.updateVideo(ids[0], func(video *database.Video) {
+		now := time.Now()
+		video.ArchivedAt = &now
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ts.do(ts.request("POST", "/api/videos/archive", token, map[string]any{"video_ids": ids}), http.StatusConflict, nil)
+}
+
+func TestIntegrationRestitch(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	read := func(key string) []byte {
+		out, err := ts.cfg.s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String(ts.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Body.Close()
+		data, err := io.ReadAll(out.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	uploadKey, _ := ts.cfg.defaultStore().keyFromURL(*video.VideoURL)
+	upload := read(uploadKey)
+
+	intro := testMP4()
+	intro[len(intro)-1] = 'x'
+	clip := ts.uploadVideoRequest(token, video.ID, intro)
+	clip.Method, clip.URL.Path = "PUT", "/api/users/me/stitch_clips/intro"
+	ts.do(clip, http.StatusOK, nil)
+
+	// stitching again starts from the upload, not from the last stitch
+	for range 2 {
+		ts.do(ts.request("POST", fmt.Sprintf("/api/videos/%s/stitch", video.ID), token, nil), http.StatusOK, &video)
+		source, err := ts.cfg.db.GetStitchSource(video.ID)
+		if err != nil || source.Key == "" {
+			t.Fatalf("stitch source %+v: %v", source, err)
+		}
+		if !bytes.Equal(read(source.Key), upload) {
+			t.Fatal("stitch source isn't the unstitched upload")
+		}
+	}
+}
+
+func TestIntegrationOwnBucket(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	own := ts.useOwnBucket(video.UserID)
+	video = ts.uploadVideo(token, video.ID, testMP4())
+	if _, ok := own.keyFromURL(aws.ToString(video.VideoURL)); !ok {
+		t.Fatalf("upload stored at %v, want the user's bucket", video.VideoURL)
+	}
+
+	// intros are ours, the video the user's
+	clip := ts.uploadVideoRequest(token, video.ID, testMP4())
+	clip.Method, clip.URL.Path = "PUT", "/api/users/me/stitch_clips/intro"
+	ts.do(clip, http.StatusOK, nil)
+	ts.do(ts.request("POST", fmt.Sprintf("/api/videos/%s/stitch", video.ID), token, nil), http.StatusOK, &video)
+	key, ok := own.keyFromURL(aws.ToString(video.VideoURL))
+	if !ok {
+		t.Fatalf("stitched video stored at %v, want the user's bucket", video.VideoURL)
+	}
+
+	// backups record the upload without listing the rest of the bucket
+	if err := ts.cfg.runBackup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := ts.cfg.s3Client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{
+		Bucket: aws.String(ts.bucket),
+		Prefix: aws.String(backupPrefix),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifestKey string
+	for _, obj := range listed.Contents {
+		if strings.HasSuffix(aws.ToString(obj.Key), "/manifest.json") {
+			manifestKey = aws.ToString(obj.Key)
+		}
+	}
+	if manifestKey == "" {
+		t.Fatal("backup wrote no manifest")
+	}
+	manifestPath, err := ts.cfg.downloadObjectToTemp(context.Background(), ts.cfg.defaultStore(), t.TempDir(), manifestKey, "manifest-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest backupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(manifest.Objects, func(obj backupObject) bool {
+		return obj.Bucket == own.bucket && obj.Key == key
+	}) {
+		t.Fatalf("manifest objects %+v don't include %s/%s", manifest.Objects, own.bucket, key)
+	}
+}
+
+func TestIntegrationURLUpload(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/page" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(testMP4())
+	}))
+	defer source.Close()
+
+	path := fmt.Sprintf("/api/videos/%s/ingest", video.ID)
+	ts.do(ts.request("POST", path, token, map[string]string{"url": source.URL + "/page"}), http.StatusBadRequest, nil)
+	ts.do(ts.request("POST", path, token, map[string]string{"url": "file:///etc/passwd"}), http.StatusBadRequest, nil)
+	ts.do(ts.request("POST", path, token, map[string]string{"url": source.URL + "/clip.mp4"}), http.StatusOK, &video)
+	if video.VideoURL == nil || video.VideoSize != int64(len(testMP4())) {
+		t.Fatalf("ingested video has URL %v and size %d", video.VideoURL, video.VideoSize)
+	}
+
+	// outside dev, the test server's loopback address is off limits
+	if _, err := newIngestClient(false).Get(source.URL); !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("fetching from loopback got %v", err)
+	}
+}
+
+func TestIntegrationClient(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	creds := map[string]string{
+		"email":    uuid.NewString() + "@tubely.test",
+		"password": "hunter2hunter2",
+	}
+	ts.do(ts.request("POST", "/api/users", "", creds), http.StatusCreated, nil)
+
+	c := client.New(ts.srv.URL)
+	if err := c.Login(ctx, creds["email"], creds["password"]); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "clip.mp4")
+	if err := os.WriteFile(path, testMP4(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := map[string]func(uuid.UUID) (client.Video, error){
+		"form": func(id uuid.UUID) (client.Video, error) {
+			return c.UploadVideo(ctx, id, "clip.mp4", bytes.NewReader(testMP4()))
+		},
+		"async": func(id uuid.UUID) (client.Video, error) {
+			job, err := c.UploadVideoAsync(ctx, id, "clip.mp4", bytes.NewReader(testMP4()))
+			if err != nil {
+				return client.Video{}, err
+			}
+			ts.runJobs()
+			return c.WaitForJob(ctx, job.ID)
+		},
+		"chunked": func(id uuid.UUID) (client.Video, error) { return c.UploadVideoFile(ctx, id, path) },
+		"direct":  func(id uuid.UUID) (client.Video, error) { return c.UploadVideoDirect(ctx, id, path) },
+	}
+	for mode, upload := range uploads {
+		video, err := c.CreateVideo(ctx, mode, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		video, err = upload(video.ID)
+		if err != nil {
+			t.Fatalf("%s upload: %v", mode, err)
+		}
+		if video.VideoURL == nil {
+			t.Fatalf("%s upload left no video URL", mode)
+		}
+		if _, err := c.PlaybackURL(ctx, video.ID, "integration-device"); err != nil {
+			t.Fatalf("%s playback: %v", mode, err)
+		}
+	}
+
+	videos, err := c.ListVideos(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != len(uploads) {
+		t.Fatalf("listed %d videos, want %d", len(videos), len(uploads))
+	}
+}
+
+func TestIntegrationPublishReconcile(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+
+	// a second connection to make the video update fail after the upload
+	raw, err := sql.Open("sqlite3", filepath.Join(filepath.Dir(ts.cfg.reconcileDir), "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	if _, err := raw.Exec(`CREATE TRIGGER fail_publish BEFORE UPDATE ON videos
+	WHEN NEW.video_url IS NOT NULL BEGIN SELECT RAISE(FAIL, 'injected'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.do(ts.uploadVideoRequest(token, video.ID, testMP4()), http.StatusAccepted, nil)
+
+	// still failing, so the task waits for its next attempt
+	ts.clock.advance(reconcileInterval)
+	ts.cfg.reconcilePublishes()
+	if tasks, _ := os.ReadDir(ts.cfg.reconcileDir); len(tasks) != 1 {
+		t.Fatalf("got %d queued tasks, want 1", len(tasks))
+	}
+
+	if _, err := raw.Exec("DROP TRIGGER fail_publish"); err != nil {
+		t.Fatal(err)
+	}
+	ts.clock.advance(maxReconcileBackoff)
+	ts.cfg.reconcilePublishes()
+	video, err = ts.cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.VideoURL == nil || video.VideoSize != int64(len(testMP4())) {
+		t.Fatalf("reconciled video has URL %v and size %d", video.VideoURL, video.VideoSize)
+	}
+	if tasks, _ := os.ReadDir(ts.cfg.reconcileDir); len(tasks) != 0 {
+		t.Fatalf("got %d queued tasks after reconciling, want 0", len(tasks))
+	}
+}
+
+func TestIntegrationIdempotencyKey(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+
+	send := func(videoID uuid.UUID, want int) *http.Response {
+		t.Helper()
+		req := ts.uploadVideoRequest(token, videoID, testMP4())
+		req.Header.Set("Idempotency-Key", "retry-me")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("upload got %d, want %d", resp.StatusCode, want)
+		}
+		return resp
+	}
+	if resp := send(video.ID, http.StatusOK); resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatal("first upload was replayed")
+	}
+	if resp := send(video.ID, http.StatusOK); resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatal("retried upload wasn't replayed")
+	}
+	versions, err := ts.cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("got %d versions after a retried upload, want 1", len(versions))
+	}
+
+	// the key belongs to the first request
+	send(ts.createVideo(token).ID, http.StatusUnprocessableEntity)
+
+	ts.clock.advance(idempotencyKeyTTL + time.Minute)
+	if err := ts.cfg.db.DeleteIdempotencyKeysBefore(ts.cfg.now().Add(-idempotencyKeyTTL)); err != nil {
+		t.Fatal(err)
+	}
+	if resp := send(video.ID, http.StatusOK); resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatal("upload with an expired key was replayed")
+	}
+}
+
+func TestIntegrationAsyncUpload(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+
+	// a bad file is still turned away within the request
+	req := ts.uploadVideoRequest(token, video.ID, []byte("not a video"))
+	req.Header.Set("Prefer", "respond-async")
+	ts.do(req, http.StatusBadRequest, nil)
+
+	req = ts.uploadVideoRequest(token, video.ID, testMP4())
+	req.Header.Set("Prefer", "respond-async")
+	var job database.ProcessingJob
+	ts.do(req, http.StatusAccepted, &job)
+
+	var status struct {
+		database.ProcessingJob
+		Video *database.Video `json:"video"`
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		ts.runJobs()
+		ts.do(ts.request("GET", "/api/jobs/"+job.ID.String(), token, nil), http.StatusOK, &status)
+		if status.Status != database.ProcessingJobStatusProcessing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job is still processing")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if status.Status != database.ProcessingJobStatusReady || status.Video == nil || status.Video.VideoURL == nil {
+		t.Fatalf("job finished %s with video %+v: %s", status.Status, status.Video, status.Error)
+	}
+
+	ts.do(ts.request("GET", "/api/jobs/"+job.ID.String(), ts.signUp(), nil), http.StatusNotFound, nil)
+
+	// one run for the rejected file, and one the request and the background
+	// job shared
+	var entries []database.ProcessingLogEntry
+	ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s/processing-log", video.ID), token, nil), http.StatusOK, &entries)
+	if len(entries) == 0 || entries[0].Name != "validate" || entries[0].Error == "" {
+		t.Fatalf("processing log doesn't start with the rejected file: %+v", entries)
+	}
+	var stages []string
+	commands := 0
+	for _, entry := range entries[1:] {
+		if entry.RunID == entries[0].RunID {
+			t.Fatalf("rejected file and upload share a run: %+v", entries)
+		}
+		if entry.RunID != entries[1].RunID {
+			t.Fatalf("upload was logged to more than one run: %+v", entries)
+		}
+		switch entry.Kind {
+		case database.ProcessingLogKindStage:
+			stages = append(stages, entry.Name)
+		case database.ProcessingLogKindCommand:
+			commands++
+		}
+	}
+	if !slices.Contains(stages, "spool") || !slices.Contains(stages, "persist") || commands == 0 {
+		t.Fatalf("processing log has stages %v and %d commands", stages, commands)
+	}
+	ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s/processing-log", video.ID), ts.signUp(), nil), http.StatusForbidden, nil)
+}
+
+func TestIntegrationPublishGates(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.publishGates = []publishGate{publishGates["qc"]}
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	visibility := fmt.Sprintf("/api/videos/%s/visibility", video.ID)
+
+	ts.do(ts.request("PUT", visibility, token, map[string]string{"visibility": "private"}), http.StatusOK, nil)
+	var refused struct {
+		Unmet []unmetPublishGate `json:"unmet"`
+	}
+	ts.do(ts.request("PUT", visibility, token, map[string]string{"visibility": "public"}), http.StatusConflict, &refused)
+	if len(refused.Unmet) != 1 || refused.Unmet[0].Gate != "qc" {
+		t.Fatalf("unmet gates: %+v", refused.Unmet)
+	}
+	// only going public is gated
+	ts.do(ts.request("PUT", visibility, token, map[string]string{"visibility": "unlisted"}), http.StatusOK, nil)
+
+	ts.uploadVideo(token, video.ID, testMP4())
+	ts.do(ts.request("PUT", visibility, token, map[string]string{"visibility": "public"}), http.StatusOK, nil)
+}
+
+func TestIntegrationRetention(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	archived := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	data := testMP4()
+	data[len(data)-1] = 'z'
+	purged := ts.uploadVideo(token, ts.createVideo(token).ID, data)
+	ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/visibility", purged.ID), token, map[string]string{"visibility": "unlisted"}), http.StatusOK, nil)
+	purgedKey, _ := ts.cfg.defaultStore().keyFromURL(*purged.VideoURL)
+	for _, params := range []database.CreateRetentionRuleParams{
+		{Name: "cold-public", Visibility: database.VideoVisibilityPublic, UploadState: database.RetentionUploadComplete, MinAgeDays: 1, Action: database.RetentionActionArchive},
+		{Name: "purge-unlisted", Visibility: database.VideoVisibilityUnlisted, UploadState: database.RetentionUploadComplete, MinAgeDays: 1, Action: database.RetentionActionDelete},
+	} {
+		if _, err := ts.cfg.db.CreateRetentionRule(params); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handled, err := ts.cfg.applyRetentionRules(context.Background(), time.Now().Add(48*time.Hour), nil)
+	if err != nil || handled != 2 {
+		t.Fatalf("retention handled %d videos: %v", handled, err)
+	}
+	video, err := ts.cfg.db.GetVideo(archived.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stamped by the server's clock, like everything else
+	if video.ArchivedAt == nil || !video.ArchivedAt.Equal(ts.clock.now()) {
+		t.Fatalf("archived at %v, want %v", video.ArchivedAt, ts.clock.now())
+	}
+	if video, err = ts.cfg.db.GetVideo(purged.ID); err != nil || video.ID != uuid.Nil {
+		t.Fatalf("purged video is still there: %+v, %v", video, err)
+	}
+	if _, err := ts.cfg.s3Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(ts.bucket),
+		Key:    aws.String(purgedKey),
+	}); err == nil {
+		t.Fatal("purged video's upload is still in the bucket")
+	}
+}
+
+func TestIntegrationRetentionSharedUpload(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.signUp()
+	bob := ts.signUp()
+	// byte-identical uploads share one object across users
+	aliceVideo := ts.uploadVideo(alice, ts.createVideo(alice).ID, testMP4())
+	bobVideo := ts.uploadVideo(bob, ts.createVideo(bob).ID, testMP4())
+	if aws.ToString(aliceVideo.VideoURL) != aws.ToString(bobVideo.VideoURL) {
+		t.Fatalf("uploads weren't deduplicated: %v, %v", aws.ToString(aliceVideo.VideoURL), aws.ToString(bobVideo.VideoURL))
+	}
+	if err := ts.cfg.db.SetVideoRetentionExempt(bobVideo.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.cfg.db.CreateRetentionRule(database.CreateRetentionRuleParams{
+		Name: "cold-public", Visibility: database.VideoVisibilityPublic, UploadState: database.RetentionUploadComplete, MinAgeDays: 1, Action: database.RetentionActionArchive,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	archivedAt := func(id uuid.UUID) *time.Time {
+		video, err := ts.cfg.db.GetVideo(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return video.ArchivedAt
+	}
+
+	// the exempt video keeps the object where it is
+	handled, err := ts.cfg.applyRetentionRules(context.Background(), time.Now().Add(48*time.Hour), nil)
+	if err != nil || handled != 0 {
+		t.Fatalf("retention handled %d videos: %v", handled, err)
+	}
+	if archivedAt(aliceVideo.ID) != nil || archivedAt(bobVideo.ID) != nil {
+		t.Fatal("a video shared with an exempt one was archived")
+	}
+
+	// once the rule covers both, both go, and both owners hear about it
+	if err := ts.cfg.db.SetVideoRetentionExempt(bobVideo.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	handled, err = ts.cfg.applyRetentionRules(context.Background(), time.Now().Add(48*time.Hour), nil)
+	if err != nil || handled != 2 {
+		t.Fatalf("retention handled %d videos: %v", handled, err)
+	}
+	for _, video := range []database.Video{aliceVideo, bobVideo} {
+		if archivedAt(video.ID) == nil {
+			t.Fatalf("video %s wasn't archived", video.ID)
+		}
+		notifications, err := ts.cfg.db.GetNotifications(video.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notifications) != 1 || notifications[0].Kind != "video_archived" || *notifications[0].VideoID != video.ID {
+			t.Fatalf("owner of %s got %+v", video.ID, notifications)
+		}
+	}
+}
+
+func TestIntegrationChannelGet(t *testing.T) {
+	ts := newTestServer(t)
+	marker := []byte("tubely-test-malware")
+	ts.cfg.scanner = markerScanner{marker: marker}
+	email := uuid.NewString() + "@tubely.test"
+	token := ts.signUpAs(email)
+	publish := func() database.Video {
+		video := ts.createVideo(token)
+		ts.uploadVideo(token, video.ID, testMP4())
+		ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/visibility", video.ID), token, map[string]string{"visibility": "public"}), http.StatusOK, nil)
+		return video
+	}
+	ready := publish()
+	quarantined := publish()
+	ts.do(ts.uploadVideoRequest(token, quarantined.ID, append(testMP4(), marker...)), http.StatusUnprocessableEntity, nil)
+	processing := publish()
+	if _, err := ts.cfg.updateVideo(processing.ID, func(video *database.Video) {
+		video.Status = database.VideoStatusProcessing
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// anyone can look, and only sees what's fit to show
+	req := ts.request("GET", "/api/channels/"+ready.UserID.String(), "", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("channel got %d: %s", resp.StatusCode, body)
+	}
+	for _, private := range []string{email, "upload_sha256", "video_version_id"} {
+		if bytes.Contains(body, []byte(private)) {
+			t.Fatalf("channel shows %q: %s", private, body)
+		}
+	}
+	var channel struct {
+		Videos []channelVideo `json:"videos"`
+	}
+	if err := json.Unmarshal(body, &channel); err != nil {
+		t.Fatal(err)
+	}
+	if len(channel.Videos) != 1 || channel.Videos[0].ID != ready.ID || channel.Videos[0].VideoURL == nil {
+		t.Fatalf("channel videos = %+v, want only %s", channel.Videos, ready.ID)
+	}
+
+	// the video itself shows the public as much as the channel does, and its
+	// owner everything
+	for _, viewer := range []string{"", ts.signUp()} {
+		var shown map[string]any
+		ts.do(ts.request("GET", "/api/videos/"+ready.ID.String(), viewer, nil), http.StatusOK, &shown)
+		for _, private := range []string{"upload_sha256", "video_version_id", "status"} {
+			if _, ok := shown[private]; ok {
+				t.Fatalf("video shows %q to the public: %v", private, shown)
+			}
+		}
+	}
+	var owned map[string]any
+	ts.do(ts.request("GET", "/api/videos/"+ready.ID.String(), token, nil), http.StatusOK, &owned)
+	if _, ok := owned["upload_sha256"]; !ok {
+		t.Fatalf("video hides upload_sha256 from its owner: %v", owned)
+	}
+}
+
+// markerScanner flags any file containing its marker.
+type markerScanner struct {
+	marker []byte
+}
+
+func (s markerScanner) Scan(ctx context.Context, path string) (malware.Result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return malware.Result{}, err
+	}
+	if bytes.Contains(data, s.marker) {
+		return malware.Result{Infected: true, Signature: "Test-Marker"}, nil
+	}
+	return malware.Result{}, nil
+}
+
+func TestIntegrationMalwareScan(t *testing.T) {
+	ts := newTestServer(t)
+	marker := []byte("tubely-test-malware")
+	ts.cfg.scanner = markerScanner{marker: marker}
+	token := ts.signUp()
+	video := ts.createVideo(token)
+
+	clean := ts.uploadVideo(token, video.ID, testMP4())
+	ts.do(ts.uploadVideoRequest(token, video.ID, append(testMP4(), marker...)), http.StatusUnprocessableEntity, nil)
+	var quarantined database.Video
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String(), token, nil), http.StatusOK, &quarantined)
+	if quarantined.QuarantinedAt == nil || aws.ToString(quarantined.QuarantineReason) != "Test-Marker" {
+		t.Fatalf("video wasn't quarantined: %+v", quarantined)
+	}
+	// the infected upload went nowhere
+	if aws.ToString(quarantined.VideoURL) != aws.ToString(clean.VideoURL) {
+		t.Fatalf("video points at %s after a rejected upload, want %s", aws.ToString(quarantined.VideoURL), aws.ToString(clean.VideoURL))
+	}
+
+	cleared := ts.uploadVideo(token, video.ID, testMP4())
+	if cleared.QuarantinedAt != nil {
+		t.Fatal("a clean upload didn't lift the quarantine")
+	}
+}
+
+func TestIntegrationMalwareScanStagedUploads(t *testing.T) {
+	ts := newTestServer(t)
+	eicar := []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+	ts.cfg.scanner = markerScanner{marker: eicar}
+	token := ts.signUp()
+	infected := append(testMP4(), eicar...)
+	quarantined := func(videoID uuid.UUID) {
+		t.Helper()
+		var video database.Video
+		ts.do(ts.request("GET", "/api/videos/"+videoID.String(), token, nil), http.StatusOK, &video)
+		if video.QuarantinedAt == nil || video.VideoURL != nil {
+			t.Fatalf("staged upload wasn't quarantined: %+v", video)
+		}
+	}
+
+	video := ts.createVideo(token)
+	stream := ts.uploadVideoRequest(token, video.ID, infected)
+	stream.URL.Path += "/stream"
+	ts.do(stream, http.StatusUnprocessableEntity, nil)
+	quarantined(video.ID)
+
+	// what the web UI sends
+	video = ts.createVideo(token)
+	var upload struct {
+		UploadID uuid.UUID         `json:"upload_id"`
+		URL      string            `json:"url"`
+		Fields   map[string]string `json:"fields"`
+	}
+	ts.do(ts.request("POST", fmt.Sprintf("/api/videos/%s/upload/form", video.ID), token, nil), http.StatusCreated, &upload)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range upload.Fields {
+		mw.WriteField(name, value)
+	}
+	part, err := mw.CreateFormFile("file", "clip.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(infected)
+	mw.Close()
+	resp, err := http.Post(upload.URL, mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	confirm := fmt.Sprintf("/api/videos/%s/upload/direct/%s/confirm", video.ID, upload.UploadID)
+	ts.do(ts.request("POST", confirm, token, nil), http.StatusUnprocessableEntity, nil)
+	quarantined(video.ID)
+}
+
+func TestIntegrationConcurrentUploadLimit(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.uploadSlots = newUploadSlots(1)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+
+	// an upload whose body trickles in holds the only slot
+	data := testMP4()
+	slow := ts.uploadVideoRequest(token, video.ID, data)
+	body, err := io.ReadAll(slow.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	slow.Body = pr
+	slow.ContentLength = int64(len(body))
+	done := make(chan int, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(slow)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	pw.Write(body[:64])
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		ts.cfg.uploadSlots.mu.Lock()
+		active := ts.cfg.uploadSlots.active[video.UserID]
+		ts.cfg.uploadSlots.mu.Unlock()
+		if active == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slow upload never took its slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req := ts.uploadVideoRequest(token, video.ID, data)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("second upload got %d with Retry-After %q, want 429", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	// other users aren't held back
+	other := ts.signUp()
+	ts.uploadVideo(other, ts.createVideo(other).ID, data)
+
+	pw.Write(body[64:])
+	pw.Close()
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("slow upload finished with %d", code)
+	}
+	ts.uploadVideo(token, video.ID, data)
+}
+
+func TestIntegrationPlaybackCacheFallback(t *testing.T) {
+	ts := newTestServer(t)
+	cache, err := newPlaybackCache(t.TempDir(), defaultPlaybackCacheMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.cfg.playbackCache = cache
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+
+	type playback struct {
+		URL      string `json:"url"`
+		Fallback bool   `json:"fallback"`
+	}
+	var healthy playback
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, &healthy)
+	if healthy.Fallback {
+		t.Fatal("fell back while S3 was up")
+	}
+	key, _ := ts.cfg.defaultStore().keyFromURL(*video.VideoURL)
+	obj, err := ts.cfg.s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(ts.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens on port 1
+	ts.cfg.s3Client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String("http://127.0.0.1:1"),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	cache.health = map[string]storageHealth{}
+	var down playback
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, &down)
+	if !down.Fallback {
+		t.Fatalf("got %s with S3 down, want a fallback URL", down.URL)
+	}
+	fallback, err := url.Parse(down.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", ts.srv.URL+fallback.RequestURI(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-9")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(got, stored[:10]) {
+		t.Fatalf("range request got %d %q, want 206 %q", resp.StatusCode, got, stored[:10])
+	}
+
+	tampered := fallback.Query()
+	tampered.Set("sig", strings.Repeat("0", 64))
+	fallback.RawQuery = tampered.Encode()
+	ts.do(ts.request("GET", fallback.RequestURI(), "", nil), http.StatusForbidden, nil)
+}
+
+func TestIntegrationVideoCollaborators(t *testing.T) {
+	ts := newTestServer(t)
+	owner := ts.signUp()
+	editorEmail := uuid.NewString() + "@tubely.test"
+	editor := ts.signUpAs(editorEmail)
+	viewerEmail := uuid.NewString() + "@tubely.test"
+	viewer := ts.signUpAs(viewerEmail)
+	video := ts.createVideo(owner)
+	collaborators := fmt.Sprintf("/api/videos/%s/collaborators", video.ID)
+
+	ts.do(ts.uploadVideoRequest(editor, video.ID, testMP4()), http.StatusForbidden, nil)
+	ts.do(ts.request("POST", collaborators, owner, map[string]string{"email": editorEmail, "role": "editor"}), http.StatusOK, nil)
+	ts.do(ts.request("POST", collaborators, owner, map[string]string{"email": viewerEmail, "role": "viewer"}), http.StatusOK, nil)
+	ts.do(ts.request("POST", collaborators, editor, map[string]string{"email": viewerEmail, "role": "editor"}), http.StatusForbidden, nil)
+
+	ts.uploadVideo(editor, video.ID, testMP4())
+	ts.do(ts.uploadVideoRequest(viewer, video.ID, testMP4()), http.StatusForbidden, nil)
+
+	// viewers can still watch it while it's private
+	ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/visibility", video.ID), owner, map[string]string{"visibility": "private"}), http.StatusOK, nil)
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String(), viewer, nil), http.StatusOK, nil)
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String(), ts.signUp(), nil), http.StatusNotFound, nil)
+
+	// the editor takes over, and the previous owner stays on as an editor
+	transfer := fmt.Sprintf("/api/videos/%s/transfer", video.ID)
+	ts.do(ts.request("POST", transfer, editor, map[string]any{"email": editorEmail}), http.StatusForbidden, nil)
+	var transferred database.Video
+	ts.do(ts.request("POST", transfer, owner, map[string]any{"email": editorEmail, "keep_access": true}), http.StatusOK, &transferred)
+	var list []database.VideoCollaborator
+	ts.do(ts.request("GET", collaborators, viewer, nil), http.StatusOK, &list)
+	if len(list) != 2 || transferred.UserID == video.UserID {
+		t.Fatalf("after transfer: owner %s, collaborators %+v", transferred.UserID, list)
+	}
+	for _, c := range list {
+		if c.Email == editorEmail {
+			t.Fatal("new owner is still a collaborator")
+		}
+	}
+	ts.do(ts.request("DELETE", "/api/videos/"+video.ID.String(), owner, nil), http.StatusForbidden, nil)
+	ts.uploadVideo(owner, video.ID, testMP4())
+}
+
+func TestIntegrationStaleMultipartUploads(t *testing.T) {
+	ts := newTestServer(t)
+	// S3 stamps uploads with the real time
+	ts.clock.advance(time.Since(ts.clock.now()))
+	ctx := context.Background()
+	store := ts.cfg.defaultStore()
+	_, err := store.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String("landscape/abandoned.mp4"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := func() int {
+		out, err := store.client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{Bucket: aws.String(store.bucket)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(out.Uploads)
+	}
+
+	ts.cfg.abortStaleMultipartUploads(ctx, staleMultipartUploadMaxAge, nil)
+	if n := pending(); n != 1 {
+		t.Fatalf("%d uploads in progress after an early sweep, want 1", n)
+	}
+	ts.clock.advance(staleMultipartUploadMaxAge + time.Hour)
+	var report bytes.Buffer
+	plan := newDryRun(&report)
+	ts.cfg.abortStaleMultipartUploads(ctx, staleMultipartUploadMaxAge, plan)
+	if n := pending(); n != 1 || !strings.Contains(report.String(), "would abort multipart upload s3://"+store.bucket+"/landscape/abandoned.mp4") {
+		t.Fatalf("%d uploads in progress after a dry run, want 1; report:\n%s", n, report.String())
+	}
+	ts.cfg.abortStaleMultipartUploads(ctx, staleMultipartUploadMaxAge, nil)
+	if n := pending(); n != 0 {
+		t.Fatalf("%d uploads in progress after the sweep, want 0", n)
+	}
+}
+
+func TestIntegrationEmbedTokens(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	ts.uploadVideo(token, video.ID, testMP4())
+
+	var embed struct {
+		database.EmbedToken
+		Token    string `json:"token"`
+		EmbedURL string `json:"embed_url"`
+	}
+	embeds := fmt.Sprintf("/api/videos/%s/embeds", video.ID)
+	ts.do(ts.request("POST", embeds, ts.signUp(), map[string]string{"domain": "example.com"}), http.StatusForbidden, nil)
+	ts.do(ts.request("POST", embeds, token, map[string]string{"domain": "https://Example.com/"}), http.StatusCreated, &embed)
+	if embed.Domain != "example.com" {
+		t.Fatalf("domain %q, want example.com", embed.Domain)
+	}
+
+	page := func(embedToken, referer string) *http.Request {
+		req := ts.request("GET", fmt.Sprintf("/embed/%s?token=%s", video.ID, url.QueryEscape(embedToken)), "", nil)
+		req.Header.Set("Referer", referer)
+		return req
+	}
+	resp, err := http.DefaultClient.Do(page(embed.Token, "https://blog.example.com/post"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Security-Policy"), "frame-ancestors https://example.com") {
+		t.Fatalf("embed page: %d, CSP %q", resp.StatusCode, resp.Header.Get("Content-Security-Policy"))
+	}
+	ts.do(page(embed.Token, "https://example.com.evil.test/"), http.StatusForbidden, nil)
+	ts.do(page(embed.ID.String()+".forged", "https://example.com/"), http.StatusForbidden, nil)
+
+	var listed []database.EmbedToken
+	ts.do(ts.request("GET", embeds, token, nil), http.StatusOK, &listed)
+	if len(listed) != 1 || listed[0].Views != 1 || listed[0].LastViewedAt == nil {
+		t.Fatalf("embed tokens after one view: %+v", listed)
+	}
+
+	// rotating the JWT secret leaves embed links alone
+	secrets := ts.cfg.jwt.Secrets
+	ts.cfg.jwt.Secrets = []string{"rotated-secret"}
+	ts.do(page(embed.Token, "https://example.com/"), http.StatusOK, nil)
+	ts.cfg.jwt.Secrets = secrets
+
+	ts.do(ts.request("DELETE", embeds+"/"+embed.ID.String(), token, nil), http.StatusNoContent, nil)
+	ts.do(page(embed.Token, "https://example.com/"), http.StatusForbidden, nil)
+}
+
+func TestIntegrationVideoDuration(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	// one without an upload, so no duration
+	ts.createVideo(token)
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	// the ffprobe stub reports 12.5 seconds
+	if video.Duration == nil || *video.Duration != 12.5 {
+		t.Fatalf("duration %v, want 12.5", video.Duration)
+	}
+
+	list := func(query string) []database.Video {
+		var videos []database.Video
+		ts.do(ts.request("GET", "/api/videos"+query, token, nil), http.StatusOK, &videos)
+		return videos
+	}
+	if videos := list(""); len(videos) != 2 {
+		t.Fatalf("listed %d videos, want 2", len(videos))
+	}
+	if videos := list("?min_duration=10&max_duration=12.5"); len(videos) != 1 || videos[0].ID != video.ID {
+		t.Fatalf("videos from 10s to 12.5s: %+v", videos)
+	}
+	if videos := list("?min_duration=13"); len(videos) != 0 {
+		t.Fatalf("videos of 13s or more: %+v", videos)
+	}
+	ts.do(ts.request("GET", "/api/videos?max_duration=soon", token, nil), http.StatusBadRequest, nil)
+
+	var usage struct {
+		Storage struct {
+			DurationSeconds float64 `json:"duration_seconds"`
+		} `json:"storage"`
+	}
+	ts.do(ts.request("GET", "/api/users/me/usage", token, nil), http.StatusOK, &usage)
+	if usage.Storage.DurationSeconds != 12.5 {
+		t.Fatalf("stored %v seconds, want 12.5", usage.Storage.DurationSeconds)
+	}
+}
+
+func TestIntegrationLimitResponses(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+
+	var validation struct {
+		Violations []struct {
+			Field    string           `json:"field"`
+			Exceeded *limits.Exceeded `json:"exceeded"`
+		} `json:"violations"`
+	}
+	params := map[string]any{"filename": "big.mp4", "content_type": "video/mp4", "size": 2 << 30, "duration": 60}
+	ts.do(ts.request("POST", fmt.Sprintf("/api/videos/%s/validate-upload", video.ID), token, params), http.StatusOK, &validation)
+	if len(validation.Violations) != 1 || validation.Violations[0].Exceeded == nil {
+		t.Fatalf("violations of a 2GB upload: %+v", validation.Violations)
+	}
+	size := validation.Violations[0].Exceeded
+	if size.Name != limits.MaxVideoSize || size.Used != 2<<30 || size.Plan != database.PlanFree || size.Upgrade == nil || size.Upgrade.Plan != database.PlanPro {
+		t.Fatalf("size limit: %+v", size)
+	}
+
+	// the free plan takes 10 uploads a day
+	for range 10 {
+		ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	}
+	resp, err := http.DefaultClient.Do(ts.uploadVideoRequest(token, video.ID, testMP4()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Error string          `json:"error"`
+		Limit limits.Exceeded `json:"limit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "43200" {
+		t.Fatalf("11th upload got %d with Retry-After %q: %s", resp.StatusCode, resp.Header.Get("Retry-After"), body.Error)
+	}
+	daily := body.Limit
+	if daily.Name != limits.DailyUploads || daily.Used != 10 || daily.Limit != 10 || daily.ResetsAt == nil || daily.Upgrade == nil || daily.Upgrade.Limit != 100 {
+		t.Fatalf("daily upload limit: %+v", daily)
+	}
+}
+
+func TestIntegrationReviewLinks(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/visibility", video.ID), token, map[string]string{"visibility": "private"}), http.StatusOK, nil)
+
+	reviewerEmail := uuid.NewString() + "@tubely.test"
+	reviewer := ts.signUpAs(reviewerEmail)
+	stranger := ts.signUp()
+
+	var link struct {
+		database.ReviewLink
+		Token     string `json:"token"`
+		ReviewURL string `json:"review_url"`
+	}
+	links := fmt.Sprintf("/api/videos/%s/review-links", video.ID)
+	ts.do(ts.request("POST", links, reviewer, map[string]string{}), http.StatusForbidden, nil)
+	ts.do(ts.request("POST", links, token, map[string]string{"reviewer_email": reviewerEmail, "expires_in": "1h"}), http.StatusCreated, &link)
+	if link.ReviewerID == nil || link.ExpiresAt == nil {
+		t.Fatalf("reviewer link: %+v", link.ReviewLink)
+	}
+
+	review := func(userToken, reviewToken string) *http.Request {
+		return ts.request("GET", fmt.Sprintf("/api/review/%s/playback-url?token=%s", video.ID, url.QueryEscape(reviewToken)), userToken, nil)
+	}
+	ts.do(review(reviewer, link.Token), http.StatusNotFound, nil)
+
+	ts.uploadVideo(token, video.ID, testMP4())
+	var playback struct {
+		URL        string                   `json:"url"`
+		Visibility database.VideoVisibility `json:"visibility"`
+	}
+	ts.do(review(reviewer, link.Token), http.StatusOK, &playback)
+	if playback.URL == "" || playback.Visibility != database.VideoVisibilityPrivate {
+		t.Fatalf("review playback: %+v", playback)
+	}
+	ts.do(review(token, link.Token), http.StatusOK, nil)
+	ts.do(review(stranger, link.Token), http.StatusForbidden, nil)
+	ts.do(review(reviewer, link.ID.String()+".forged"), http.StatusForbidden, nil)
+
+	var ownerLink struct {
+		database.ReviewLink
+		Token string `json:"token"`
+	}
+	ts.do(ts.request("POST", links, token, map[string]string{}), http.StatusCreated, &ownerLink)
+	ts.do(review(reviewer, ownerLink.Token), http.StatusForbidden, nil)
+	ts.do(review(token, ownerLink.Token), http.StatusOK, nil)
+
+	var listed []database.ReviewLink
+	ts.do(ts.request("GET", links, token, nil), http.StatusOK, &listed)
+	if len(listed) != 2 || listed[0].Views != 2 {
+		t.Fatalf("review links: %+v", listed)
+	}
+
+	ts.clock.advance(2 * time.Hour)
+	ts.do(review(reviewer, link.Token), http.StatusForbidden, nil)
+	ts.do(ts.request("DELETE", links+"/"+ownerLink.ID.String(), token, nil), http.StatusNoContent, nil)
+	ts.do(review(token, ownerLink.Token), http.StatusForbidden, nil)
+}
+
+func TestIntegrationReuploadDropsPreviousObject(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	first := ts.uploadVideo(token, video.ID, testMP4())
+	firstKey, _ := ts.cfg.defaultStore().keyFromURL(*first.VideoURL)
+
+	// another video sharing the second upload keeps it alive
+	other := ts.createVideo(token)
+	second := testMP4()
+	second[len(second)-1] = 'x'
+	ts.uploadVideo(token, other.ID, second)
+
+	replaced := ts.uploadVideo(token, video.ID, second)
+	_, err := ts.cfg.s3Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(ts.bucket),
+		Key:    aws.String(firstKey),
+	})
+	if err == nil {
+		t.Fatal("replaced upload is still in the bucket")
+	}
+	versions, err := ts.cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a versioned bucket keeps the earlier upload for rollback
+	want := 1
+	if replaced.VideoVersionID != nil {
+		want = 2
+	}
+	if len(versions) != want {
+		t.Fatalf("got %d versions after a re-upload, want %d", len(versions), want)
+	}
+
+	ts.uploadVideo(token, video.ID, testMP4())
+	ts.do(ts.playbackURLRequest(token, other.ID), http.StatusOK, nil)
+}
+
+func TestIntegrationHLSRendition(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.hlsEnabled = true
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	first := ts.uploadVideo(token, video.ID, testMP4())
+	if first.HLSMasterKey == nil {
+		t.Fatal("upload has no HLS master playlist")
+	}
+	obj, err := ts.cfg.s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(ts.bucket),
+		Key:    first.HLSMasterKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, err := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(master, []byte("RESOLUTION=1280x720\n"+hlsStreamPlaylist)) {
+		t.Fatalf("unexpected master playlist:\n%s", master)
+	}
+	firstKey, _ := ts.cfg.defaultStore().keyFromURL(*first.VideoURL)
+	objects, err := listStagedObjects(context.Background(), ts.cfg.defaultStore(), hlsPrefix(firstKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("got %d HLS objects, want the master and stream playlists", len(objects))
+	}
+
+	// a duplicate upload shares the rendition
+	other := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if aws.ToString(other.HLSMasterKey) != *first.HLSMasterKey {
+		t.Fatalf("duplicate upload got HLS %s, want %s", aws.ToString(other.HLSMasterKey), *first.HLSMasterKey)
+	}
+
+	second := testMP4()
+	second[len(second)-1] = 'x'
+	replaced := ts.uploadVideo(token, video.ID, second)
+	if replaced.HLSMasterKey == nil || *replaced.HLSMasterKey == *first.HLSMasterKey {
+		t.Fatalf("re-upload has HLS %v", aws.ToString(replaced.HLSMasterKey))
+	}
+	ts.cfg.hlsEnabled = false
+	third := testMP4()
+	third[len(third)-1] = 'y'
+	if plain := ts.uploadVideo(token, video.ID, third); plain.HLSMasterKey != nil {
+		t.Fatal("upload without HLS kept the previous rendition")
+	}
+}
+
+func TestIntegrationDASHRendition(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.dashEnabled = true
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	first := ts.uploadVideo(token, video.ID, testMP4())
+	if first.DASHManifestKey == nil || first.HLSMasterKey != nil {
+		t.Fatalf("got DASH %v and HLS %v, want only DASH", aws.ToString(first.DASHManifestKey), aws.ToString(first.HLSMasterKey))
+	}
+	if storedRendition(context.Background(), ts.cfg.defaultStore(), *first.DASHManifestKey) == nil {
+		t.Fatal("DASH manifest wasn't stored")
+	}
+
+	other := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if aws.ToString(other.DASHManifestKey) != *first.DASHManifestKey {
+		t.Fatalf("duplicate upload got DASH %s, want %s", aws.ToString(other.DASHManifestKey), *first.DASHManifestKey)
+	}
+
+	// replacing an upload only another video shares keeps its rendition
+	second := testMP4()
+	second[len(second)-1] = 'x'
+	replaced := ts.uploadVideo(token, video.ID, second)
+	if replaced.DASHManifestKey == nil || *replaced.DASHManifestKey == *first.DASHManifestKey {
+		t.Fatalf("re-upload has DASH %v", aws.ToString(replaced.DASHManifestKey))
+	}
+	if storedRendition(context.Background(), ts.cfg.defaultStore(), *first.DASHManifestKey) == nil {
+		t.Fatal("shared DASH rendition was deleted")
+	}
+}
+
+func TestIntegrationMonthlyBandwidth(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	start, _ := uploadWindow(database.UploadPeriodMonth, ts.clock.now())
+
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, nil)
+	used, err := ts.cfg.db.GetBandwidth(video.UserID, start)
+	if err != nil || used != video.VideoSize {
+		t.Fatalf("bandwidth used %d after one viewing, want %d: %v", used, video.VideoSize, err)
+	}
+
+	// the free plan hands out 50GiB a month
+	if err := ts.cfg.db.AddBandwidth(video.UserID, start, 50<<30-used); err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Limit limits.Exceeded `json:"limit"`
+	}
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusTooManyRequests, &body)
+	if body.Limit.Name != limits.MonthlyBandwidth || body.Limit.Used != 50<<30 || body.Limit.ResetsAt == nil {
+		t.Fatalf("bandwidth limit: %+v", body.Limit)
+	}
+
+	// a new month starts over
+	ts.clock.advance(31 * 24 * time.Hour)
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, nil)
+}
+
+func TestIntegrationResolutionLadder(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.ladder = []int{1080, 720, 480, 360}
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+
+	type playback struct {
+		Renditions []playbackRendition `json:"renditions"`
+	}
+	var got playback
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, &got)
+	// the 720p upload isn't scaled up, and the free plan stops at two
+	if len(got.Renditions) != 2 || got.Renditions[0].Name != "720p" || got.Renditions[1].Name != "480p" {
+		t.Fatalf("got renditions %+v, want 720p and 480p", got.Renditions)
+	}
+	if r := got.Renditions[1]; r.Width != 854 || r.Height != 480 || r.Bitrate == 0 || r.URL == "" {
+		t.Fatalf("unexpected 480p rendition %+v", r)
+	}
+	key, _ := ts.cfg.defaultStore().keyFromURL(*video.VideoURL)
+	if storedRendition(context.Background(), ts.cfg.defaultStore(), ladderKey(key, 480)) == nil {
+		t.Fatal("480p rendition wasn't stored")
+	}
+
+	// a duplicate upload shares the ladder
+	other := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	ts.do(ts.playbackURLRequest(token, other.ID), http.StatusOK, &got)
+	if len(got.Renditions) != 2 {
+		t.Fatalf("duplicate upload got %d renditions, want 2", len(got.Renditions))
+	}
+
+	ts.cfg.ladder = nil
+	second := testMP4()
+	second[len(second)-1] = 'x'
+	ts.uploadVideo(token, video.ID, second)
+	got = playback{}
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, &got)
+	if len(got.Renditions) != 0 {
+		t.Fatalf("re-upload kept %d renditions of the previous upload", len(got.Renditions))
+	}
+}
+
+func TestIntegrationGeneratedThumbnail(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if video.ThumbnailURL == nil || !video.ThumbnailGenerated {
+		t.Fatalf("got thumbnail %v, generated %v", aws.ToString(video.ThumbnailURL), video.ThumbnailGenerated)
+	}
+	if video.ThumbnailPreviewURL == nil || !video.ThumbnailPreviewGenerated {
+		t.Fatalf("got hover preview %v, generated %v", aws.ToString(video.ThumbnailPreviewURL), video.ThumbnailPreviewGenerated)
+	}
+	generated, generatedPreview := *video.ThumbnailURL, *video.ThumbnailPreviewURL
+
+	second := testMP4()
+	second[len(second)-1] = 'x'
+	video = ts.uploadVideo(token, video.ID, second)
+	if video.ThumbnailURL == nil || *video.ThumbnailURL == generated {
+		t.Fatal("re-upload kept the thumbnail generated from the previous upload")
+	}
+	if video.ThumbnailPreviewURL == nil || *video.ThumbnailPreviewURL == generatedPreview {
+		t.Fatal("re-upload kept the hover preview of the previous upload")
+	}
+	generatedPreview = *video.ThumbnailPreviewURL
+
+	// one the owner sent stays
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("thumbnail", "thumbnail.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(part, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	form.Close()
+	req := ts.request("POST", "/api/thumbnail_upload/"+video.ID.String(), token, nil)
+	req.Body, req.ContentLength = io.NopCloser(&body), int64(body.Len())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	ts.do(req, http.StatusOK, &video)
+	if video.ThumbnailGenerated {
+		t.Fatal("uploaded thumbnail is flagged as generated")
+	}
+	if aws.ToString(video.ThumbnailPreviewURL) != generatedPreview {
+		t.Fatal("still thumbnail dropped the generated hover preview")
+	}
+	uploaded := *video.ThumbnailURL
+	third := testMP4()
+	third[len(third)-1] = 'y'
+	video = ts.uploadVideo(token, video.ID, third)
+	if aws.ToString(video.ThumbnailURL) != uploaded {
+		t.Fatalf("upload replaced the owner's thumbnail with %s", aws.ToString(video.ThumbnailURL))
+	}
+}
+
+func TestIntegrationGIFThumbnail(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	upload := func(data []byte, want int) database.Video {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, err := form.CreateFormFile("thumbnail", "thumbnail.gif")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+		form.Close()
+		req := ts.request("POST", "/api/thumbnail_upload/"+video.ID.String(), token, nil)
+		req.Body, req.ContentLength = io.NopCloser(&body), int64(body.Len())
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		var got database.Video
+		if want == http.StatusOK {
+			ts.do(req, want, &got)
+		} else {
+			ts.do(req, want, nil)
+		}
+		return got
+	}
+	encode := func(frames int) []byte {
+		g := &gif.GIF{}
+		for i := range frames {
+			frame := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+			frame.SetColorIndex(i%4, 0, 1)
+			g.Image = append(g.Image, frame)
+			g.Delay = append(g.Delay, 10)
+		}
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// a still GIF is only a thumbnail, an animated one gets a preview too
+	if got := upload(encode(1), http.StatusOK); got.ThumbnailURL == nil || got.ThumbnailPreviewURL != nil {
+		t.Fatalf("still GIF got thumbnail %v and preview %v", got.ThumbnailURL, got.ThumbnailPreviewURL)
+	}
+	if got := upload(encode(3), http.StatusOK); got.ThumbnailPreviewURL == nil {
+		t.Fatal("animated GIF got no preview")
+	}
+
+	// a tiny file can claim a canvas far too big to draw
+	huge := encode(1)
+	binary.LittleEndian.PutUint16(huge[6:], 65535)
+	binary.LittleEndian.PutUint16(huge[8:], 65535)
+	upload(huge, http.StatusBadRequest)
+}
+
+func TestIntegrationPlaybackAnalytics(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.analytics = database.AnalyticsPolicy{Enabled: true, MinViewers: 2, TruncateIPs: true}
+	ownerEmail := uuid.NewString() + "@tubely.test"
+	owner := ts.signUpAs(ownerEmail)
+	video := ts.uploadVideo(owner, ts.createVideo(owner).ID, testMP4())
+
+	type report struct {
+		TotalViews int64            `json:"total_views"`
+		Networks   []analyticsGroup `json:"networks"`
+	}
+	analytics := func() report {
+		t.Helper()
+		var got report
+		ts.do(ts.request("GET", "/api/videos/"+video.ID.String()+"/analytics", owner, nil), http.StatusOK, &got)
+		return got
+	}
+
+	ts.playbackURLRequest(owner, video.ID)
+	viewer := ts.signUp()
+	ts.playbackURLRequest(viewer, video.ID)
+	// one viewer is below the threshold
+	if got := analytics(); got.TotalViews != 0 || len(got.Networks) != 0 {
+		t.Fatalf("reported %+v below the threshold", got)
+	}
+	ts.playbackURLRequest(ts.signUp(), video.ID)
+	got := analytics()
+	if got.TotalViews != 2 || len(got.Networks) != 1 || got.Networks[0].Key != "127.0.0.0/24" {
+		t.Fatalf("got %+v, want 2 views from 127.0.0.0/24", got)
+	}
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String()+"/analytics", viewer, nil), http.StatusForbidden, nil)
+
+	// an owner can have counting switched off
+	if err := ts.cfg.runSetAnalytics(ownerEmail, database.AnalyticsPolicy{MinViewers: 1}, false); err != nil {
+		t.Fatal(err)
+	}
+	ts.playbackURLRequest(ts.signUp(), video.ID)
+	if got := analytics(); got.TotalViews != 2 {
+		t.Fatalf("counted %d views with analytics off", got.TotalViews)
+	}
+}
+
+func TestIntegrationSlowUploadDeadline(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.uploadDeadline = uploadDeadline{window: 300 * time.Millisecond, minRate: 1000}
+	token := ts.signUp()
+	// trickle sends the upload 200 bytes at a time, pausing for pause after
+	// the chunk at stallAt
+	trickle := func(videoID uuid.UUID, every time.Duration, stallAt int, pause time.Duration) *http.Request {
+		req := ts.uploadVideoRequest(token, videoID, testMP4())
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			for i := 0; len(data) > 0; i++ {
+				n := min(200, len(data))
+				if _, err := pw.Write(data[:n]); err != nil {
+					return
+				}
+				data = data[n:]
+				time.Sleep(every)
+				if i == stallAt {
+					time.Sleep(pause)
+				}
+			}
+			pw.Close()
+		}()
+		req.Body = pr
+		return req
+	}
+
+	// about 4KB a second, for several windows
+	video := ts.createVideo(token)
+	var uploaded database.Video
+	ts.do(trickle(video.ID, 50*time.Millisecond, -1, 0), http.StatusOK, &uploaded)
+	if uploaded.VideoURL == nil {
+		t.Fatal("slow upload wasn't stored")
+	}
+
+	resp, err := http.DefaultClient.Do(trickle(ts.createVideo(token).ID, 50*time.Millisecond, 3, time.Second))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatal("stalled upload went through")
+		}
+	}
+}
+
+func TestIntegrationStoryboard(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.storyboardsEnabled = true
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if video.StoryboardKey == nil {
+		t.Fatal("upload has no storyboard")
+	}
+	obj, err := ts.cfg.s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(ts.bucket),
+		Key:    video.StoryboardKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stub video is 12.5 seconds of 1280x720: 13 tiles of 160x90
+	if !bytes.HasSuffix(index, []byte("\n00:00:12.000 --> 00:00:12.500\nsprite.jpg#xywh=320,90,160,90\n")) {
+		t.Fatalf("unexpected storyboard index:\n%s", index)
+	}
+
+	var playback struct {
+		Storyboard *playbackStoryboard `json:"storyboard"`
+	}
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, &playback)
+	if playback.Storyboard == nil || !strings.Contains(playback.Storyboard.SpriteURL, storyboardSprite) {
+		t.Fatalf("playback has storyboard %+v", playback.Storyboard)
+	}
+
+	second := testMP4()
+	second[len(second)-1] = 'x'
+	ts.uploadVideo(token, video.ID, second)
+	if storedRendition(context.Background(), ts.cfg.defaultStore(), *video.StoryboardKey) != nil {
+		t.Fatal("replaced upload's storyboard is still stored")
+	}
+}
+
+func TestIntegrationTranscoderCallback(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.transcoderCallbackSecret = "transcoder-secret"
+	ts.srv.Config.Handler = ts.cfg.routes()
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	key, _ := ts.cfg.defaultStore().keyFromURL(*video.VideoURL)
+	output := hlsPrefix(key) + "720p.mp4"
+
+	callback := func(body map[string]any, secret string, want int) string {
+		t.Helper()
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := ts.request("POST", "/api/transcoder/callback", "", nil)
+		req.Body = io.NopCloser(bytes.NewReader(data))
+		webhook.SignRequest(req, secret, "", data)
+		var resp struct {
+			Status string `json:"status"`
+		}
+		ts.do(req, want, &resp)
+		return resp.Status
+	}
+	done := map[string]any{
+		"job_id":     "job-1",
+		"video_id":   video.ID,
+		"status":     "complete",
+		"source_key": key,
+		"renditions": []map[string]any{{"name": "720p", "key": output, "width": 1280, "height": 720, "bitrate": 2500000}},
+	}
+
+	callback(done, "wrong-secret", http.StatusUnauthorized)
+	// nothing at the output key yet
+	callback(done, "transcoder-secret", http.StatusUnprocessableEntity)
+	_, err := ts.cfg.s3Client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(ts.bucket),
+		Key:    aws.String(output),
+		Body:   bytes.NewReader(testMP4()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := callback(done, "transcoder-secret", http.StatusOK); status != "applied" {
+		t.Fatalf("callback was %s", status)
+	}
+	if status := callback(done, "transcoder-secret", http.StatusOK); status != "duplicate" {
+		t.Fatalf("repeated callback was %s", status)
+	}
+	renditions, err := ts.cfg.db.GetVideoRenditions(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renditions) != 1 || renditions[0].Key != output || renditions[0].Height != 720 {
+		t.Fatalf("renditions: %+v", renditions)
+	}
+
+	stale := map[string]any{"job_id": "job-2", "video_id": video.ID, "status": "complete", "source_key": "landscape/old.mp4"}
+	if status := callback(stale, "transcoder-secret", http.StatusOK); status != "stale" {
+		t.Fatalf("callback for an old upload was %s", status)
+	}
+
+	second := testMP4()
+	second[len(second)-1] = 'x'
+	ts.uploadVideo(token, video.ID, second)
+	renditions, err = ts.cfg.db.GetVideoRenditions(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renditions) != 0 {
+		t.Fatalf("re-upload kept %d renditions of the old upload", len(renditions))
+	}
+}
+
+func TestIntegrationJWTKeyRotation(t *testing.T) {
+	ts := newTestServer(t)
+	// tokens expire by the wall clock
+	ts.clock.advance(time.Since(ts.clock.now()))
+	static := auth.SigningKey{ID: auth.KeyID(ts.cfg.jwt.Secrets[0]), Secret: ts.cfg.jwt.Secrets[0]}
+	ts.cfg.jwt.Keys = auth.NewKeySet(static)
+	ts.cfg.jwtRotation = &jwtRotation{interval: 24 * time.Hour, grace: 48 * time.Hour, static: []auth.SigningKey{static}}
+	rotate := func(d time.Duration) {
+		t.Helper()
+		ts.clock.advance(d)
+		if err := ts.cfg.rotateJWTKeys(ts.clock.now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kid := func(token string) string {
+		t.Helper()
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := parsed.Header["kid"].(string)
+		return id
+	}
+	authorized := func(token string, want int) {
+		t.Helper()
+		ts.do(ts.request("GET", "/api/videos", token, nil), want, nil)
+	}
+
+	// the first generated key waits for every server to load it
+	rotate(0)
+	first := ts.signUp()
+	if kid(first) != static.ID {
+		t.Fatalf("signed with %s before the generated key was active", kid(first))
+	}
+	rotate(jwtKeyActivationDelay)
+	second := ts.signUp()
+	if kid(second) == static.ID {
+		t.Fatal("still signing with the configured secret")
+	}
+
+	rotate(24 * time.Hour)
+	if kid(ts.signUp()) != kid(second) {
+		t.Fatal("signed with the replacement before it was active")
+	}
+	rotate(jwtKeyActivationDelay)
+	third := ts.signUp()
+	if kid(third) == kid(second) {
+		t.Fatal("key wasn't rotated after the interval")
+	}
+	authorized(first, http.StatusOK)
+	authorized(second, http.StatusOK)
+
+	// past the grace, keys that were replaced are gone
+	rotate(49 * time.Hour)
+	authorized(first, http.StatusUnauthorized)
+	authorized(second, http.StatusUnauthorized)
+	authorized(third, http.StatusOK)
+}
+
+func TestIntegrationLegacyJWT(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.jwt.Issuer = "tubely-integration"
+	userID, err := auth.ValidateJWT(ts.signUp(), ts.cfg.jwt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims jwt.RegisteredClaims) string {
+		t.Helper()
+		now := time.Now().UTC()
+		claims.Subject = userID.String()
+		claims.IssuedAt = jwt.NewNumericDate(now)
+		claims.ExpiresAt = jwt.NewNumericDate(now.Add(time.Hour))
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(ts.cfg.jwt.Secrets[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	authorized := func(token string, want int) {
+		t.Helper()
+		ts.do(ts.request("GET", "/api/videos", token, nil), want, nil)
+	}
+
+	// tokens from before the audience was checked still work
+	authorized(sign(jwt.RegisteredClaims{Issuer: string(auth.TokenTypeAccess)}), http.StatusOK)
+	// but only from the old issuer, and only without an audience
+	authorized(sign(jwt.RegisteredClaims{Issuer: "someone-else"}), http.StatusUnauthorized)
+	authorized(sign(jwt.RegisteredClaims{}), http.StatusUnauthorized)
+	authorized(sign(jwt.RegisteredClaims{Issuer: string(auth.TokenTypeAccess), Audience: jwt.ClaimStrings{"elsewhere"}}), http.StatusUnauthorized)
+	authorized(sign(jwt.RegisteredClaims{Issuer: "tubely-integration", Audience: jwt.ClaimStrings{"tubely"}}), http.StatusOK)
+}
+
+func TestIntegrationThumbnailRegeneration(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.thumbnailPipeline = thumbnailPipeline{widths: []int{2}, formats: []string{"jpeg"}}
+	token := ts.signUp()
+	video := ts.createVideo(token)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("thumbnail", "thumbnail.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(part, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	form.Close()
+	req := ts.request("POST", "/api/thumbnail_upload/"+video.ID.String(), token, nil)
+	req.Body, req.ContentLength = io.NopCloser(&body), int64(body.Len())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	ts.do(req, http.StatusOK, &video)
+	if video.ThumbnailBlurhash == nil || len(*video.ThumbnailBlurhash) != 28 {
+		t.Fatalf("thumbnail blurhash = %v, want a 4x3 hash", video.ThumbnailBlurhash)
+	}
+
+	type thumbnails struct {
+		Blurhash *string                     `json:"blurhash"`
+		Current  bool                        `json:"current"`
+		Variants []database.ThumbnailVariant `json:"variants"`
+	}
+	var got thumbnails
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String()+"/thumbnails", token, nil), http.StatusOK, &got)
+	if !got.Current || len(got.Variants) != 1 || got.Variants[0].Width != 2 || got.Variants[0].Height != 2 {
+		t.Fatalf("thumbnails = %+v, want one current 2x2 variant", got)
+	}
+	first := got.Variants[0].URL
+
+	// new settings leave every thumbnail behind until the job catches up
+	ts.cfg.thumbnailPipeline = thumbnailPipeline{widths: []int{2, 4, 8}, formats: []string{"jpeg", "webp"}}
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String()+"/thumbnails", token, nil), http.StatusOK, &got)
+	if got.Current {
+		t.Fatal("thumbnail made with the old settings reported as current")
+	}
+
+	var planned bytes.Buffer
+	plan := newDryRun(&planned)
+	if err := ts.cfg.runRegenerateThumbnails(context.Background(), 2, false, plan); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(planned.String(), video.ID.String()) {
+		t.Fatalf("dry run didn't list the stale thumbnail:\n%s", planned.String())
+	}
+
+	if err := ts.cfg.runRegenerateThumbnails(context.Background(), 2, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String()+"/thumbnails", token, nil), http.StatusOK, &got)
+	// nothing is scaled up past the 4px thumbnail
+	if !got.Current || len(got.Variants) != 4 {
+		t.Fatalf("thumbnails after regenerating = %+v, want 4 current variants", got)
+	}
+	assetPath, _ := strings.CutPrefix(first, ts.cfg.getAssetURL(""))
+	diskPath, err := ts.cfg.getAssetDiskPath(assetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(diskPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("regenerating left the replaced variant on disk")
+	}
+
+	// a second run finds everything current
+	planned.Reset()
+	if err := ts.cfg.runRegenerateThumbnails(context.Background(), 2, false, newDryRun(&planned)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(planned.String(), video.ID.String()) {
+		t.Fatalf("current thumbnail listed for regeneration:\n%s", planned.String())
+	}
+}
+
+func TestIntegrationVideoMetadata(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String()+"/metadata", token, nil), http.StatusNotFound, nil)
+
+	ts.uploadVideo(token, video.ID, testMP4())
+	var metadata database.VideoMetadata
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String()+"/metadata", token, nil), http.StatusOK, &metadata)
+	// what the ffprobe stub reports
+	want := database.VideoMetadata{
+		ProbedAt:        metadata.ProbedAt,
+		Container:       "mov,mp4,m4a,3gp,3g2,mj2",
+		Duration:        12.5,
+		Bitrate:         2130000,
+		VideoCodec:      "h264",
+		Width:           1280,
+		Height:          720,
+		FPS:             30,
+		VideoBitrate:    2000000,
+		PixelFormat:     "yuv420p",
+		AudioCodec:      "aac",
+		AudioChannels:   2,
+		AudioSampleRate: 48000,
+		AudioBitrate:    128000,
+	}
+	if metadata != want {
+		t.Fatalf("metadata = %+v, want %+v", metadata, want)
+	}
+	if !metadata.ProbedAt.Equal(ts.clock.now()) {
+		t.Fatalf("probed at %v, want %v", metadata.ProbedAt, ts.clock.now())
+	}
+
+	// a duplicate upload reuses the metadata recorded for the object
+	ts.clock.advance(time.Hour)
+	original, err := ts.cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if aws.ToString(duplicate.VideoURL) != aws.ToString(original.VideoURL) {
+		t.Fatal("duplicate upload didn't reuse the stored object")
+	}
+	stored, err := ts.cfg.db.GetVideoMetadata(duplicate.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.VideoCodec != "h264" || stored.Key == "" {
+		t.Fatalf("duplicate's metadata = %+v", stored)
+	}
+
+	// the video's metadata is for its current upload
+	second := testMP4()
+	second[len(second)-1] = 'z'
+	ts.uploadVideo(token, video.ID, second)
+	replaced, err := ts.cfg.db.GetVideoMetadata(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.Key == stored.Key {
+		t.Fatal("re-upload kept the metadata of the previous upload")
+	}
+}
+
+func TestIntegrationRotatedVideo(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if !strings.Contains(aws.ToString(video.VideoURL), "/landscape/") {
+		t.Fatalf("1280x720 upload stored at %s, want landscape", aws.ToString(video.VideoURL))
+	}
+
+	// the ffprobe stub turns this one a quarter with a display matrix
+	data := append(testMP4(), []byte("tubely-rotate-90")...)
+	video = ts.uploadVideo(token, ts.createVideo(token).ID, data)
+	if !strings.Contains(aws.ToString(video.VideoURL), "/portrait/") {
+		t.Fatalf("rotated upload stored at %s, want portrait", aws.ToString(video.VideoURL))
+	}
+	metadata, err := ts.cfg.db.GetVideoMetadata(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Width != 720 || metadata.Height != 1280 || metadata.Rotation != 90 {
+		t.Fatalf("rotated metadata = %dx%d turned %d, want 720x1280 turned 90", metadata.Width, metadata.Height, metadata.Rotation)
+	}
+}
+
+func TestIntegrationDemoSeed(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	if err := ts.cfg.seedDemo(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	creds := map[string]string{"email": "demo@tubely.dev", "password": demoPassword}
+	ts.do(ts.request("POST", "/api/login", "", creds), http.StatusOK, &login)
+	var videos []database.Video
+	ts.do(ts.request("GET", "/api/videos", login.Token, nil), http.StatusOK, &videos)
+	if len(videos) != len(demoUsers[0].clips) {
+		t.Fatalf("demo user has %d videos, want %d", len(videos), len(demoUsers[0].clips))
+	}
+	friend, err := ts.cfg.db.GetUserByEmail("friend@tubely.dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, video := range videos {
+		if video.VideoURL == nil || video.ThumbnailURL == nil {
+			t.Fatalf("demo video %q has video %v and thumbnail %v", video.Title, video.VideoURL, video.ThumbnailURL)
+		}
+		if video.Visibility != database.VideoVisibilityPrivate {
+			continue
+		}
+		role, err := ts.cfg.db.GetVideoRole(video.ID, friend.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role != database.VideoRoleViewer {
+			t.Fatalf("friend's role on private demo video = %q, want viewer", role)
+		}
+	}
+
+	// seeding again leaves everything as it was
+	if err := ts.cfg.seedDemo(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ts.do(ts.request("GET", "/api/videos", login.Token, nil), http.StatusOK, &videos)
+	if len(videos) != len(demoUsers[0].clips) {
+		t.Fatalf("demo user has %d videos after seeding twice, want %d", len(videos), len(demoUsers[0].clips))
+	}
+}
+
+func TestIntegrationFFmpegLimits(t *testing.T) {
+	ts := newTestServer(t)
+	ffmpeg.SetLimits(1, 0, 200*time.Millisecond)
+	t.Cleanup(func() { ffmpeg.SetLimits(0, 0, 0) })
+	token := ts.signUp()
+
+	// the ffprobe stub hangs on this one, so it's killed
+	video := ts.createVideo(token)
+	data := append(testMP4(), []byte("tubely-slow-probe")...)
+	started := time.Now()
+	resp, err := http.DefaultClient.Do(ts.uploadVideoRequest(token, video.ID, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("upload with a hung probe succeeded")
+	}
+	// the stub's sleep is killed with it, or the wait for its output would
+	// hold the upload for seconds more
+	if took := time.Since(started); took > 2*time.Second {
+		t.Fatalf("hung probe took %s to fail, want it killed after 200ms", took)
+	}
+	var entries []database.ProcessingLogEntry
+	ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s/processing-log", video.ID), token, nil), http.StatusOK, &entries)
+	killed := false
+	for _, entry := range entries {
+		if entry.Name == "ffprobe" && strings.Contains(entry.Error, ffmpeg.ErrTimeout.Error()) {
+			killed = true
+		}
+	}
+	if !killed {
+		t.Fatalf("processing log %+v has no timed out ffprobe", entries)
+	}
+
+	// its slot was given back, so the next upload runs
+	if stats := ffmpeg.Stats(); stats.Running != 0 || stats.Queued != 0 {
+		t.Fatalf("pool after the upload = %+v, want it idle", stats)
+	}
+	ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+
+	// a request that ends takes its commands down with it
+	path := filepath.Join(t.TempDir(), "slow.mp4")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started = time.Now()
+	if _, err := ffmpeg.FFprobe().Input(path).Run(ctx); err == nil {
+		t.Fatal("probe outlived its context")
+	}
+	if took := time.Since(started); took > 2*time.Second {
+		t.Fatalf("probe took %s to stop after its context ended", took)
+	}
+}
+
+func TestIntegrationBackgroundJobs(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	failing := true
+	runs := 0
+	ts.cfg.jobs.Handle("integration-flaky", 2, func(ctx context.Context, job jobs.Job) error {
+		runs++
+		if failing {
+			return errors.New("still down")
+		}
+		return nil
+	})
+	if _, err := ts.cfg.jobs.Enqueue(ctx, "integration-flaky", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed run waits out its backoff before the next
+	ts.runJobs()
+	ts.runJobs()
+	if runs != 1 {
+		t.Fatalf("job ran %d times before its backoff ended, want 1", runs)
+	}
+	ts.clock.advance(jobs.Backoff(1))
+	ts.runJobs()
+	if runs != 2 {
+		t.Fatalf("job ran %d times after its backoff, want 2", runs)
+	}
+
+	// out of attempts, it's kept as failed until someone requeues it
+	failed, err := ts.cfg.db.GetBackgroundJobs(jobs.StatusFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Attempts != 2 || failed[0].LastError != "still down" {
+		t.Fatalf("failed jobs = %+v", failed)
+	}
+	failing = false
+	if n, err := ts.cfg.db.RequeueFailedJobs(ts.cfg.now()); err != nil || n != 1 {
+		t.Fatalf("requeued %d jobs: %v", n, err)
+	}
+	ts.runJobs()
+	if runs != 3 {
+		t.Fatalf("requeued job ran %d times, want 3", runs)
+	}
+	for _, status := range []jobs.Status{jobs.StatusQueued, jobs.StatusRunning, jobs.StatusFailed} {
+		if left, err := ts.cfg.db.GetBackgroundJobs(status); err != nil || len(left) != 0 {
+			t.Fatalf("%s jobs after success = %+v, %v", status, left, err)
+		}
+	}
+
+	// an async upload queued before a restart is processed after it
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	req := ts.uploadVideoRequest(token, video.ID, testMP4())
+	req.Header.Set("Prefer", "respond-async")
+	var job database.ProcessingJob
+	ts.do(req, http.StatusAccepted, &job)
+	if err := ts.cfg.db.RequeueRunningJobs(); err != nil {
+		t.Fatal(err)
+	}
+	ts.cfg.jobs = ts.cfg.newJobQueue(1)
+	ts.runJobs()
+	ts.do(ts.request("GET", "/api/jobs/"+job.ID.String(), token, nil), http.StatusOK, &job)
+	if job.Status != database.ProcessingJobStatusReady {
+		t.Fatalf("upload queued before the restart finished %s: %s", job.Status, job.Error)
+	}
+}
+
+func TestIntegrationVideoStatus(t *testing.T) {
+	ts := newTestServer(t)
+	marker := []byte("tubely-test-malware")
+	ts.cfg.scanner = markerScanner{marker: marker}
+	token := ts.signUp()
+	status := func(videoID uuid.UUID) database.VideoStatus {
+		t.Helper()
+		var video database.Video
+		ts.do(ts.request("GET", "/api/videos/"+videoID.String(), token, nil), http.StatusOK, &video)
+		return video.Status
+	}
+
+	video := ts.createVideo(token)
+	if video.Status != database.VideoStatusUploading {
+		t.Fatalf("new video is %s, want uploading", video.Status)
+	}
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusNotFound, nil)
+
+	// queued for processing, it can't be played yet
+	req := ts.uploadVideoRequest(token, video.ID, testMP4())
+	req.Header.Set("Prefer", "respond-async")
+	ts.do(req, http.StatusAccepted, nil)
+	if got := status(video.ID); got != database.VideoStatusProcessing {
+		t.Fatalf("video with a queued upload is %s, want processing", got)
+	}
+	resp, err := http.DefaultClient.Do(ts.playbackURLRequest(token, video.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("playback of a processing video got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	ts.runJobs()
+	if got := status(video.ID); got != database.VideoStatusReady {
+		t.Fatalf("processed video is %s, want ready", got)
+	}
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, nil)
+
+	// a rejected re-upload leaves the earlier one playing
+	ts.do(ts.uploadVideoRequest(token, video.ID, append(testMP4(), marker...)), http.StatusUnprocessableEntity, nil)
+	if got := status(video.ID); got != database.VideoStatusReady {
+		t.Fatalf("video after a rejected re-upload is %s, want ready", got)
+	}
+
+	// a first upload that's rejected fails the video until another works
+	rejected := ts.createVideo(token)
+	ts.do(ts.uploadVideoRequest(token, rejected.ID, append(testMP4(), marker...)), http.StatusUnprocessableEntity, nil)
+	if got := status(rejected.ID); got != database.VideoStatusFailed {
+		t.Fatalf("video with a rejected upload is %s, want failed", got)
+	}
+	ts.do(ts.playbackURLRequest(token, rejected.ID), http.StatusConflict, nil)
+	if got := ts.uploadVideo(token, rejected.ID, testMP4()); got.Status != database.VideoStatusReady {
+		t.Fatalf("video after a good upload is %s, want ready", got.Status)
+	}
+}
+
+func TestIntegrationWebhooks(t *testing.T) {
+	ts := newTestServer(t)
+	marker := []byte("tubely-test-malware")
+	ts.cfg.scanner = markerScanner{marker: marker}
+	token := ts.signUp()
+
+	type delivery struct {
+		id    string
+		event webhookEvent
+	}
+	var deliveries []delivery
+	var secret string
+	var lastHeader http.Header
+	var lastBody []byte
+	failNext := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := webhook.VerifyRequest(r, secret, 0)
+		if err != nil {
+			t.Errorf("delivery didn't verify: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lastHeader, lastBody = r.Header.Clone(), body
+		var event webhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("couldn't decode delivery: %v", err)
+		}
+		deliveries = append(deliveries, delivery{id: r.Header.Get(webhook.HeaderDelivery), event: event})
+		if failNext {
+			failNext = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	ts.do(ts.request("POST", "/api/webhooks", token, map[string]string{"url": "not a url"}), http.StatusBadRequest, nil)
+	var created struct {
+		database.Webhook
+		Secret string `json:"secret"`
+	}
+	ts.do(ts.request("POST", "/api/webhooks", token, map[string]string{"url": receiver.URL}), http.StatusCreated, &created)
+	secret = created.Secret
+	if secret == "" {
+		t.Fatal("created webhook has no secret")
+	}
+	var listed []map[string]any
+	ts.do(ts.request("GET", "/api/webhooks", token, nil), http.StatusOK, &listed)
+	if len(listed) != 1 || listed[0]["secret"] != nil {
+		t.Fatalf("listed webhooks = %+v, want one without its secret", listed)
+	}
+
+	// a 5xx is tried again after the backoff, as the same delivery
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries after the upload, want 1", len(deliveries))
+	}
+	ts.clock.advance(jobs.Backoff(1))
+	ts.runJobs()
+	if len(deliveries) != 2 || deliveries[1].id != deliveries[0].id {
+		t.Fatalf("deliveries after the retry = %+v, want the first again", deliveries)
+	}
+	ready := deliveries[1].event
+	if ready.Event != "video.ready" || ready.VideoID != video.ID || ready.Status != database.VideoStatusReady || ready.Key == "" || ready.Duration == nil {
+		t.Fatalf("ready event = %+v", ready)
+	}
+
+	// a video whose only upload is rejected fails
+	rejected := ts.createVideo(token)
+	ts.do(ts.uploadVideoRequest(token, rejected.ID, append(testMP4(), marker...)), http.StatusUnprocessableEntity, nil)
+	ts.runJobs()
+	if len(deliveries) != 3 || deliveries[2].event.Event != "video.failed" || deliveries[2].event.VideoID != rejected.ID {
+		t.Fatalf("deliveries after the rejected upload = %+v, want a failed event", deliveries)
+	}
+
+	// a captured delivery replayed as is is caught by the guard, and can't
+	// get past it under a new ID
+	guard := webhook.NewReplayGuard(0)
+	for _, want := range []error{nil, webhook.ErrReplayed} {
+		if err := webhook.Verify(secret, lastHeader, lastBody, 0); err != nil {
+			t.Fatalf("captured delivery didn't verify: %v", err)
+		}
+		if err := guard.Check(lastHeader.Get(webhook.HeaderDelivery)); err != want {
+			t.Fatalf("replay guard got %v, want %v", err, want)
+		}
+	}
+	lastHeader.Set(webhook.HeaderDelivery, uuid.NewString())
+	if err := webhook.Verify(secret, lastHeader, lastBody, 0); !errors.Is(err, webhook.ErrInvalidSignature) {
+		t.Fatalf("delivery replayed under a new ID got %v, want %v", err, webhook.ErrInvalidSignature)
+	}
+
+	// deleted webhooks hear nothing more
+	ts.do(ts.request("DELETE", "/api/webhooks/"+created.ID.String(), token, nil), http.StatusNoContent, nil)
+	ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if len(deliveries) != 3 {
+		t.Fatalf("got %d deliveries after deleting the webhook, want 3", len(deliveries))
+	}
+}
+
+func TestIntegrationFFmpegCheck(t *testing.T) {
+	newTestServer(t)
+	versions, err := ffmpeg.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != "tubely-stub" || versions[1].Command != "ffprobe" {
+		t.Fatalf("versions = %+v", versions)
+	}
+
+	// a missing ffprobe is named with where it was looked for
+	missing := filepath.Join(t.TempDir(), "ffprobe")
+	ffmpeg.SetPaths("", missing)
+	if _, err := ffmpeg.Check(context.Background()); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Fatalf("check with a missing ffprobe = %v, want it named", err)
+	}
+
+	// so is something that isn't ffprobe at all
+	ffmpeg.SetPaths("", "true")
+	if _, err := ffmpeg.Check(context.Background()); err == nil || !strings.Contains(err.Error(), "doesn't look like ffprobe") {
+		t.Fatalf("check with the wrong binary = %v", err)
+	}
+}
+
+func TestIntegrationLoudnessNormalization(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	normalized := func(videoID uuid.UUID) bool {
+		var entries []database.ProcessingLogEntry
+		ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s/processing-log", videoID), token, nil), http.StatusOK, &entries)
+		for _, entry := range entries {
+			if entry.Name == "ffmpeg" && strings.Contains(entry.Args, "loudnorm=I=-16:TP=-1.5:LRA=11") {
+				return true
+			}
+		}
+		return false
+	}
+
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if normalized(video.ID) {
+		t.Fatal("audio was normalized without LOUDNORM_TARGET_LUFS")
+	}
+
+	ts.cfg.loudnormTarget = -16
+	data := testMP4()
+	data[len(data)-1] = 'x'
+	video = ts.uploadVideo(token, ts.createVideo(token).ID, data)
+	if !normalized(video.ID) {
+		t.Fatal("upload's audio wasn't normalized to -16 LUFS")
+	}
+	if video.Status != database.VideoStatusReady {
+		t.Fatalf("normalized video is %s, want ready", video.Status)
+	}
+
+	// uploads that land in S3 first are pulled back to be normalized
+	data[len(data)-1] = 'z'
+	video = ts.createVideo(token)
+	stream := ts.uploadVideoRequest(token, video.ID, data)
+	stream.URL.Path += "/stream"
+	ts.do(stream, http.StatusOK, &video)
+	if !normalized(video.ID) || video.Status != database.VideoStatusReady {
+		t.Fatalf("streamed upload is %s, normalized %t", video.Status, normalized(video.ID))
+	}
+}
+
+func TestIntegrationAudioExtraction(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	type audio struct {
+		URL         string `json:"url"`
+		Format      string `json:"format"`
+		ContentType string `json:"content_type"`
+	}
+	audioRequest := func(token string, session database.PlaybackSession, body any) *http.Request {
+		return ts.inSession(ts.request("POST", fmt.Sprintf("/api/videos/%s/audio", session.VideoID), token, body), session)
+	}
+
+	empty := ts.createVideo(token)
+	ts.do(audioRequest(token, ts.playbackSession(token, empty.ID), nil), http.StatusNotFound, nil)
+
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	key, _ := ts.cfg.defaultStore().keyFromURL(*video.VideoURL)
+	session := ts.playbackSession(token, video.ID)
+	// like the playback URL, it takes a session
+	ts.do(ts.request("POST", fmt.Sprintf("/api/videos/%s/audio", video.ID), token, nil), http.StatusUnauthorized, nil)
+	var got audio
+	ts.do(audioRequest(token, session, nil), http.StatusOK, &got)
+	if got.Format != "aac" || got.ContentType != "audio/mp4" || got.URL == "" {
+		t.Fatalf("default extraction got %+v, want an aac URL", got)
+	}
+	if storedRendition(context.Background(), ts.cfg.defaultStore(), audioKey(key, audioFormats["aac"])) == nil {
+		t.Fatal("extracted m4a wasn't stored")
+	}
+	ts.do(audioRequest(token, session, map[string]string{"format": "mp3"}), http.StatusOK, &got)
+	if got.Format != "mp3" || got.ContentType != "audio/mpeg" {
+		t.Fatalf("mp3 extraction got %+v", got)
+	}
+	ts.do(audioRequest(token, session, map[string]string{"format": "flac"}), http.StatusBadRequest, nil)
+	// other users can listen to videos they can watch, but not before the
+	// premiere or once it's private
+	other := ts.signUp()
+	otherSession := ts.playbackSession(other, video.ID)
+	ts.do(audioRequest(other, otherSession, nil), http.StatusOK, nil)
+	premiere := time.Now().Add(time.Hour).UTC()
+	ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/premiere", video.ID), token, map[string]any{"premiere_at": premiere}), http.StatusOK, nil)
+	ts.do(audioRequest(other, otherSession, nil), http.StatusForbidden, nil)
+	ts.do(audioRequest(token, session, nil), http.StatusOK, nil)
+	ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/premiere", video.ID), token, map[string]any{"premiere_at": nil}), http.StatusOK, nil)
+	ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/visibility", video.ID), token, map[string]string{"visibility": "private"}), http.StatusOK, nil)
+	ts.do(audioRequest(other, otherSession, nil), http.StatusNotFound, nil)
+
+	// a re-upload drops the tracks with the upload's other renditions
+	second := testMP4()
+	second[len(second)-1] = 'x'
+	ts.uploadVideo(token, video.ID, second)
+	if storedRendition(context.Background(), ts.cfg.defaultStore(), audioKey(key, audioFormats["mp3"])) != nil {
+		t.Fatal("extracted mp3 outlived its upload")
+	}
+}
+
+func TestIntegrationBranding(t *testing.T) {
+	ts := newTestServer(t)
+	logo := filepath.Join(t.TempDir(), "logo.png")
+	f, err := os.Create(logo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 8, 4))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	token := ts.signUp()
+	overlay := func(videoID uuid.UUID) string {
+		t.Helper()
+		var entries []database.ProcessingLogEntry
+		ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s/processing-log", videoID), token, nil), http.StatusOK, &entries)
+		for _, entry := range entries {
+			if _, after, ok := strings.Cut(entry.Args, "overlay="); ok && entry.Name == "ffmpeg" {
+				return strings.Split(after, ",")[0]
+			}
+		}
+		return ""
+	}
+	brandingRequest := func(position string) *http.Request {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("position", position)
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="image"; filename="logo.png"`)
+		header.Set("Content-Type", "image/png")
+		part, err := form.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(part, image.NewRGBA(image.Rect(0, 0, 8, 4))); err != nil {
+			t.Fatal(err)
+		}
+		form.Close()
+		req := ts.request("PUT", "/api/channels/me/branding", token, nil)
+		req.Body, req.ContentLength = io.NopCloser(&body), int64(body.Len())
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		return req
+	}
+
+	plain := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if got := overlay(plain.ID); got != "" {
+		t.Fatalf("upload without branding got overlay %s", got)
+	}
+
+	// the deployment's branding, which isn't shared with the unbranded upload
+	// of the same file
+	ts.cfg.branding = &branding{imagePath: logo, position: "top-left"}
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if got := overlay(video.ID); got != "W*0.02:H*0.02" {
+		t.Fatalf("deployment branding overlaid at %q, want the top left", got)
+	}
+	if aws.ToString(video.VideoURL) == aws.ToString(plain.VideoURL) {
+		t.Fatal("branded upload reused the unbranded one")
+	}
+	// so is an upload that lands in S3 first, rather than being copied
+	// into place
+	streamed := ts.createVideo(token)
+	stream := ts.uploadVideoRequest(token, streamed.ID, testMP4())
+	stream.URL.Path += "/stream"
+	ts.do(stream, http.StatusOK, &streamed)
+	if got := overlay(streamed.ID); got != "W*0.02:H*0.02" {
+		t.Fatalf("streamed upload overlaid at %q, want the top left", got)
+	}
+	if aws.ToString(streamed.VideoURL) == aws.ToString(plain.VideoURL) {
+		t.Fatal("branded streamed upload reused the unbranded one")
+	}
+
+	// the user's own takes over
+	ts.do(brandingRequest("middle"), http.StatusBadRequest, nil)
+	var channel database.Channel
+	ts.do(brandingRequest("bottom-left"), http.StatusOK, &channel)
+	if channel.BrandingURL == nil || channel.BrandingPosition != "bottom-left" {
+		t.Fatalf("channel after setting branding = %+v", channel)
+	}
+	video = ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if got := overlay(video.ID); got != "W*0.02:H-h-H*0.02" {
+		t.Fatalf("user branding overlaid at %q, want the bottom left", got)
+	}
+
+	ts.do(ts.request("DELETE", "/api/channels/me/branding", token, nil), http.StatusOK, &channel)
+	if channel.BrandingURL != nil {
+		t.Fatal("branding wasn't removed")
+	}
+	video = ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	if got := overlay(video.ID); got != "W*0.02:H*0.02" {
+		t.Fatalf("upload after removing branding overlaid at %q, want the deployment's", got)
+	}
+}
+
+func TestIntegrationCaptions(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	captionRequest := func(language, label, data string) *http.Request {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		if label != "" {
+			form.WriteField("label", label)
+		}
+		part, err := form.CreateFormFile("captions", "captions.srt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(data))
+		form.Close()
+		req := ts.request("PUT", fmt.Sprintf("/api/videos/%s/captions/%s", video.ID, language), token, nil)
+		req.Body, req.ContentLength = io.NopCloser(&body), int64(body.Len())
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		return req
+	}
+	const srt = "1\r\n0:00:01,500 --> 0:00:04,000\r\nHello there\r\n\r\n2\r\n00:00:05,000 --> 00:00:06,250\r\nGeneral Kenobi\r\n"
+
+	ts.do(captionRequest("not a language", "", srt), http.StatusBadRequest, nil)
+	ts.do(captionRequest("en", "", "just some text"), http.StatusBadRequest, nil)
+
+	var caption database.VideoCaption
+	ts.do(captionRequest("en", "English", srt), http.StatusOK, &caption)
+	obj, err := ts.cfg.s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(ts.bucket),
+		Key:    aws.String(caption.Key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	want := "WEBVTT\n\n1\n00:00:01.500 --> 00:00:04.000\nHello there\n\n2\n00:00:05.000 --> 00:00:06.250\nGeneral Kenobi\n"
+	if string(stored) != want {
+		t.Fatalf("stored captions:\n%s\nwant:\n%s", stored, want)
+	}
+	ts.do(captionRequest("pt-BR", "", "WEBVTT\n\n00:01.000 --> 00:02.000\nOlá\n"), http.StatusOK, &caption)
+	if caption.Label != "pt-BR" {
+		t.Fatalf("unlabelled track got label %q, want its language", caption.Label)
+	}
+
+	type playback struct {
+		Captions []playbackCaption `json:"captions"`
+	}
+	var got playback
+	ts.do(ts.playbackURLRequest(token, video.ID), http.StatusOK, &got)
+	if len(got.Captions) != 2 || got.Captions[0].Language != "en" || got.Captions[0].Label != "English" || got.Captions[0].URL == "" {
+		t.Fatalf("playback captions = %+v, want en and pt-BR", got.Captions)
+	}
+
+	// another user can't change them
+	other := ts.request("DELETE", fmt.Sprintf("/api/videos/%s/captions/en", video.ID), ts.signUp(), nil)
+	ts.do(other, http.StatusForbidden, nil)
+	ts.do(ts.request("DELETE", fmt.Sprintf("/api/videos/%s/captions/en", video.ID), token, nil), http.StatusNoContent, nil)
+	var tracks []database.VideoCaption
+	ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s/captions", video.ID), token, nil), http.StatusOK, &tracks)
+	if len(tracks) != 1 || tracks[0].Language != "pt-BR" {
+		t.Fatalf("tracks after deleting en = %+v", tracks)
+	}
+}
+
+func TestIntegrationTranscription(t *testing.T) {
+	var sent struct {
+		model string
+		file  int
+	}
+	whisper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			http.Error(w, "bad key", http.StatusUnauthorized)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		sent.model, sent.file = r.FormValue("model"), len(data)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"language": "english", "text": " The quick brown fox.", "segments": [
+			{"start": 0, "end": 1.5, "text": " The quick"},
+			{"start": 1.5, "end": 3.25, "text": " brown fox."}
+		]}`)
+	}))
+	defer whisper.Close()
+
+	ts := newTestServer(t)
+	ts.cfg.transcriber = transcribe.NewWhisper(whisper.URL, "test-key", "")
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	ts.runJobs()
+	if sent.model != transcribe.WhisperDefaultModel || sent.file == 0 {
+		t.Fatalf("whisper got model %q and a %d byte file", sent.model, sent.file)
+	}
+
+	var got database.Video
+	ts.do(ts.request("GET", "/api/videos/"+video.ID.String(), token, nil), http.StatusOK, &got)
+	if got.Transcript == nil || *got.Transcript != "The quick brown fox." {
+		t.Fatalf("transcript = %v", got.Transcript)
+	}
+	var found []database.Video
+	ts.do(ts.request("GET", "/api/videos?q=BROWN+FOX", token, nil), http.StatusOK, &found)
+	if len(found) != 1 || found[0].ID != video.ID {
+		t.Fatalf("search for words in the transcript found %d videos", len(found))
+	}
+	ts.do(ts.request("GET", "/api/videos?q=100%25", token, nil), http.StatusOK, &found)
+	if len(found) != 0 {
+		t.Fatalf("search for 100%% found %d videos", len(found))
+	}
+
+	var tracks []database.VideoCaption
+	ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s/captions", video.ID), token, nil), http.StatusOK, &tracks)
+	if len(tracks) != 1 || tracks[0].Language != "en" || !tracks[0].Generated || tracks[0].Label != "en (auto-generated)" {
+		t.Fatalf("tracks = %+v, want a generated en track", tracks)
+	}
+	obj, err := ts.cfg.s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(ts.bucket),
+		Key:    aws.String(tracks[0].Key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	want := "WEBVTT\n\n00:00:00.000 --> 00:00:01.500\nThe quick\n\n00:00:01.500 --> 00:00:03.250\nbrown fox.\n"
+	if string(stored) != want {
+		t.Fatalf("generated captions:\n%s\nwant:\n%s", stored, want)
+	}
+
+	// an uploaded track replaces the generated one, and a later
+	// transcription leaves it alone
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("captions", "captions.vtt")
+	part.Write([]byte("WEBVTT\n\n00:01.000 --> 00:02.000\nHand made\n"))
+	form.Close()
+	req := ts.request("PUT", fmt.Sprintf("/api/videos/%s/captions/en", video.ID), token, nil)
+	req.Body, req.ContentLength = io.NopCloser(&body), int64(body.Len())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	ts.do(req, http.StatusOK, nil)
+	ts.uploadVideo(token, video.ID, testMP4())
+	ts.runJobs()
+	ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s/captions", video.ID), token, nil), http.StatusOK, &tracks)
+	if len(tracks) != 1 || tracks[0].Generated || tracks[0].Label != "en" {
+		t.Fatalf("tracks after re-upload = %+v, want the uploaded one", tracks)
+	}
+}
+
+func TestIntegrationUploadBatchBrokenOff(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+
+	// one whole file, then the body ends partway through the next
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range []string{"one.mp4", "two.mp4"} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="videos"; filename=%q`, name))
+		header.Set("Content-Type", "video/mp4")
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(testMP4())
+	}
+	req := ts.request("POST", "/api/video_upload/batch", token, nil)
+	req.Body = io.NopCloser(&body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var results []batchUploadResult
+	ts.do(req, http.StatusAccepted, &results)
+	if len(results) != 2 || !results[0].Accepted || results[0].VideoID == nil || results[1].Accepted || results[1].Error == "" {
+		t.Fatalf("results of a broken-off batch: %+v", results)
+	}
+	// the file that made it in is processed all the same
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		video, err := ts.cfg.db.GetVideo(*results[0].VideoID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if video.Status == database.VideoStatusReady {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("accepted file is %s, want ready", video.Status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestIntegrationVideoClips(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	source := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	path := fmt.Sprintf("/api/videos/%s/clips", source.ID)
+	clipBody := func(start, end float64) map[string]any {
+		return map[string]any{"start": start, "end": end}
+	}
+
+	ts.do(ts.request("POST", path, token, map[string]any{"start": 1}), http.StatusBadRequest, nil)
+	ts.do(ts.request("POST", path, token, clipBody(2, 1)), http.StatusBadRequest, nil)
+	ts.do(ts.request("POST", path, token, clipBody(0, 1e6)), http.StatusBadRequest, nil)
+	ts.do(ts.request("POST", path, ts.signUp(), clipBody(0, 1)), http.StatusForbidden, nil)
+
+	var clip database.Video
+	ts.do(ts.request("POST", path, token, clipBody(0.25, 1)), http.StatusCreated, &clip)
+	if clip.ParentVideoID == nil || *clip.ParentVideoID != source.ID {
+		t.Fatalf("clip's parent = %v, want %s", clip.ParentVideoID, source.ID)
+	}
+	if clip.ClipStart == nil || *clip.ClipStart != 0.25 || clip.ClipEnd == nil || *clip.ClipEnd != 1 {
+		t.Fatalf("clip covers %v to %v, want 0.25 to 1", clip.ClipStart, clip.ClipEnd)
+	}
+	if clip.Title != source.Title+" (clip)" || clip.Status != database.VideoStatusReady || clip.VideoURL == nil {
+		t.Fatalf("clip = %q, %s, %v; want a ready video of its own", clip.Title, clip.Status, clip.VideoURL)
+	}
+	if *clip.VideoURL == *source.VideoURL {
+		t.Fatal("clip shares its parent's upload")
+	}
+
+	var clips []database.Video
+	ts.do(ts.request("GET", path, token, nil), http.StatusOK, &clips)
+	if len(clips) != 1 || clips[0].ID != clip.ID {
+		t.Fatalf("clips = %d videos, want the one cut", len(clips))
+	}
+
+	// a clip is held to the limits an upload of it would be, and one that
+	// can't be made leaves nothing behind
+	ts.cfg.maxUploadSize = 1
+	ts.do(ts.request("POST", path, token, clipBody(0.25, 1)), http.StatusRequestEntityTooLarge, nil)
+	var videos []database.Video
+	ts.do(ts.request("GET", "/api/videos", token, nil), http.StatusOK, &videos)
+	if len(videos) != 2 {
+		t.Fatalf("%d videos after a clip over the size limit, want 2", len(videos))
+	}
+}
+
+func TestIntegrationLiveRecordingFLV(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.rtmpCallbackSecret = "rtmp-secret"
+	ts.cfg.rtmpRecordDir = t.TempDir()
+	ts.srv.Config.Handler = ts.cfg.routes()
+	token := ts.signUp()
+
+	var stream database.LiveStream
+	ts.do(ts.request("POST", "/api/live_streams", token, map[string]string{"title": "Live"}), http.StatusCreated, &stream)
+
+	// an FLV header and an empty first tag, as nginx-rtmp writes them
+	flv := append([]byte("FLV\x01\x05\x00\x00\x00\x09\x00\x00\x00\x00"), bytes.Repeat([]byte("tubely"), 1024)...)
+	if err := os.WriteFile(filepath.Join(ts.cfg.rtmpRecordDir, "live.flv"), flv, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"name": {stream.StreamKey}, "path": {"/var/rec/live.flv"}}
+	resp, err := http.PostForm(ts.srv.URL+"/api/rtmp/on_record_done?secret=rtmp-secret", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("on_record_done got %d", resp.StatusCode)
+	}
+
+	// the recording is published in the background
+	var streams []database.LiveStream
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		ts.do(ts.request("GET", "/api/live_streams", token, nil), http.StatusOK, &streams)
+		if len(streams) == 1 && streams[0].VideoID != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recording wasn't published: %+v", streams)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	var video database.Video
+	ts.do(ts.request("GET", "/api/videos/"+streams[0].VideoID.String(), token, nil), http.StatusOK, &video)
+	if video.Status != database.VideoStatusReady || video.VideoURL == nil {
+		t.Fatalf("recording's video is %s with URL %v, want ready", video.Status, video.VideoURL)
+	}
+	var entries []database.ProcessingLogEntry
+	ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s/processing-log", video.ID), token, nil), http.StatusOK, &entries)
+	transcoded := false
+	for _, entry := range entries {
+		if entry.Name == "ffmpeg" && strings.Contains(entry.Args, "libx264") {
+			transcoded = true
+		}
+	}
+	if !transcoded {
+		t.Fatal("flv recording wasn't transcoded")
+	}
+}
+
+func TestIntegrationLiveHLSArchive(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.liveHLSDir = t.TempDir()
+	token := ts.signUp()
+
+	var stream database.LiveStream
+	ts.do(ts.request("POST", "/api/live_streams", token, map[string]string{"title": "Live"}), http.StatusCreated, &stream)
+	stream, err := ts.cfg.db.GetLiveStream(stream.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := ts.cfg.liveStreamHLSDir(stream)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// a few MPEG-TS packets a segment
+	packet := append([]byte{0x47}, make([]byte, mpegTSPacketLen-1)...)
+	for _, segment := range []string{"0.ts", "1.ts"} {
+		if err := os.WriteFile(filepath.Join(dir, segment), bytes.Repeat(packet, 4), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte("#EXTM3U\n#EXTINF:2.0,\n0.ts\n#EXTINF:2.0,\n1.ts\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.cfg.startLiveArchive(stream)
+	ts.cfg.finishLiveArchive(stream)
+
+	if stream, err = ts.cfg.db.GetLiveStream(stream.ID); err != nil || stream.VideoID == nil {
+		t.Fatalf("archive wasn't published: %+v, %v", stream, err)
+	}
+	// the segments go once the recording is published
+	left, err := listStagedObjects(context.Background(), ts.cfg.defaultStore(), liveArchivePrefix(stream.ID))
+	if err != nil || len(left) != 0 {
+		t.Fatalf("%d archived segments left: %v", len(left), err)
+	}
+}
+
+func TestIntegrationLiveRecordingPlanLimits(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.rtmpRecordDir = t.TempDir()
+	token := ts.signUp()
+
+	var stream database.LiveStream
+	ts.do(ts.request("POST", "/api/live_streams", token, map[string]string{"title": "Live"}), http.StatusCreated, &stream)
+	stream, err := ts.cfg.db.GetLiveStream(stream.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the free plan takes 10 uploads a day, and a recording is one more
+	for range 10 {
+		ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	}
+	recordingPath := filepath.Join(ts.cfg.rtmpRecordDir, "live.mp4")
+	if err := os.WriteFile(recordingPath, testMP4(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ts.cfg.publishLiveRecording(stream, recordingPath)
+
+	var videos []database.Video
+	ts.do(ts.request("GET", "/api/videos", token, nil), http.StatusOK, &videos)
+	if len(videos) != 10 {
+		t.Fatalf("%d videos after a recording over the daily cap, want 10", len(videos))
+	}
+	if stream, err = ts.cfg.db.GetLiveStream(stream.ID); err != nil || stream.VideoID != nil {
+		t.Fatalf("stream over the cap was published: %+v, %v", stream, err)
+	}
+}
+
+func TestIntegrationPremiereReschedule(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.createVideo(token)
+	ts.uploadVideo(token, video.ID, testMP4())
+	other := ts.signUp()
+
+	premiereRequest := func(at time.Time) {
+		ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/premiere", video.ID), token, map[string]any{"premiere_at": at}), http.StatusOK, nil)
+	}
+	announced := func() int {
+		notifications, err := ts.cfg.db.GetNotifications(video.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, notification := range notifications {
+			if notification.Kind == "premiere_started" {
+				count++
+			}
+		}
+		return count
+	}
+
+	// premieres are timed on the server's clock
+	premiereRequest(ts.clock.now().Add(time.Hour))
+	sessionPath := fmt.Sprintf("/api/videos/%s/playback-sessions", video.ID)
+	ts.do(ts.request("POST", sessionPath, other, map[string]string{"device_id": testDeviceID}), http.StatusForbidden, nil)
+	ts.clock.advance(2 * time.Hour)
+	ts.do(ts.playbackURLRequest(other, video.ID), http.StatusOK, nil)
+	ts.cfg.notifyDuePremieres(ts.clock.now())
+	ts.cfg.notifyDuePremieres(ts.clock.now())
+	if got := announced(); got != 1 {
+		t.Fatalf("got %d announcements, want 1", got)
+	}
+
+	// a rescheduled premiere is announced again when it starts
+	premiereRequest(ts.clock.now().Add(time.Hour))
+	ts.cfg.notifyDuePremieres(ts.clock.now())
+	if got := announced(); got != 1 {
+		t.Fatalf("got %d announcements before the new premiere, want 1", got)
+	}
+	ts.clock.advance(2 * time.Hour)
+	ts.cfg.notifyDuePremieres(ts.clock.now())
+	if got := announced(); got != 2 {
+		t.Fatalf("got %d announcements after the new premiere, want 2", got)
+	}
+}
+
+func TestIntegrationSFTPDropBox(t *testing.T) {
+	ts := newTestServer(t)
+	email := uuid.NewString() + "@tubely.test"
+	token := ts.signUpAs(email)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if err := ts.cfg.startSFTPServer(addr, t.TempDir(), ""); err != nil {
+		t.Fatal(err)
+	}
+	sshClient, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            email,
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshClient.Close()
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// two uploads of the same name at once each become a video
+	first, err := client.Create("clip.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.Create("clip.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := testMP4()
+	other[len(other)-1] = 'x'
+	for _, upload := range []struct {
+		f    *sftp.File
+		data []byte
+	}{{first, testMP4()}, {second, other}} {
+		if _, err := upload.f.Write(upload.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := client.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("drop box lists %d entries while uploads wait to be ingested", len(entries))
+	}
+
+	ts.runJobs()
+	var videos []database.Video
+	ts.do(ts.request("GET", "/api/videos", token, nil), http.StatusOK, &videos)
+	etags := map[string]bool{}
+	for _, video := range videos {
+		if video.Title != "clip" || video.VideoETag == nil {
+			t.Fatalf("ingested %+v", video)
+		}
+		etags[*video.VideoETag] = true
+	}
+	if len(videos) != 2 || len(etags) != 2 {
+		t.Fatalf("got %d videos of %d uploads, want 2 of 2", len(videos), len(etags))
+	}
+}
+
+func TestIntegrationPrivateThumbnailExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.signUp()
+	video := ts.uploadVideo(token, ts.createVideo(token).ID, testMP4())
+	ts.do(ts.request("PUT", fmt.Sprintf("/api/videos/%s/visibility", video.ID), token, map[string]string{"visibility": "private"}), http.StatusOK, nil)
+	ts.do(ts.request("GET", fmt.Sprintf("/api/videos/%s", video.ID), token, nil), http.StatusOK, &video)
+	signed, err := url.Parse(aws.ToString(video.ThumbnailURL))
+	if err != nil || signed.Query().Get("sig") == "" {
+		t.Fatalf("private thumbnail URL %q isn't signed", aws.ToString(video.ThumbnailURL))
+	}
+	fetch := func(want int) {
+		t.Helper()
+		resp, err := http.Get(ts.srv.URL + signed.RequestURI())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("GET %s: got %d, want %d", signed.Path, resp.StatusCode, want)
+		}
+	}
+
+	// signed URLs expire by the server's clock
+	fetch(http.StatusOK)
+	ts.clock.advance(signedAssetURLExpiry + time.Minute)
+	fetch(http.StatusNotFound)
+}
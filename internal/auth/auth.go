@@ -2,11 +2,13 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -20,7 +22,10 @@ const (
 	TokenTypeAccess TokenType = "tubely-access"
 )
 
-var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
+var (
+	ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
+	ErrUnknownSigningKey    = errors.New("token was signed with an unknown or retired key")
+)
 
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -34,44 +39,195 @@ func CheckPasswordHash(password, hash string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
+// JWTConfig controls how access tokens are issued and validated.
+type JWTConfig struct {
+	// Secrets holds every accepted signing secret. Tokens are signed with the
+	// first one, the rest are still accepted so a secret can be rotated out
+	// without invalidating every session at once.
+	Secrets []string
+	// Keys, when set, signs tokens in place of Secrets, naming the key in
+	// the token's kid header. Tokens without a kid are checked against
+	// every key the set still accepts.
+	Keys     *KeySet
+	Issuer   string
+	Audience string
+	// LegacyIssuer, when set, is the issuer of tokens made before they
+	// named an audience. Those are accepted without one, so deploying the
+	// audience check doesn't log everyone out; none are made any more, so
+	// they stop turning up once the last of them expires.
+	LegacyIssuer string
+	ClockSkew    time.Duration
+}
+
+// SigningKey is a secret tokens are signed with, named by the kid header of
+// the tokens it signs.
+type SigningKey struct {
+	ID     string
+	Secret string
+	// tokens it signed are accepted until then; zero for as long as it's in
+	// the set
+	AcceptUntil time.Time
+}
+
+// KeyID names a secret by a fingerprint of it, for keys that have no other
+// name.
+func KeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// KeySet holds the keys tokens are signed and validated with. It's safe for
+// concurrent use, so keys can be rotated while requests are served.
+type KeySet struct {
+	mu      sync.RWMutex
+	signing SigningKey
+	keys    map[string]SigningKey
+}
+
+// NewKeySet signs with signing and accepts it and the other keys.
+func NewKeySet(signing SigningKey, others ...SigningKey) *KeySet {
+	s := &KeySet{}
+	s.Set(signing, others...)
+	return s
+}
+
+// Set replaces the keys in the set.
+func (s *KeySet) Set(signing SigningKey, others ...SigningKey) {
+	keys := map[string]SigningKey{signing.ID: signing}
+	for _, key := range others {
+		keys[key.ID] = key
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signing = signing
+	s.keys = keys
+}
+
+func (s *KeySet) signingKey() SigningKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.signing
+}
+
+// acceptedSecrets returns the secrets of every key still accepted at now,
+// signing key first.
+func (s *KeySet) acceptedSecrets(now time.Time) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	secrets := []string{s.signing.Secret}
+	for _, key := range s.keys {
+		if key.ID != s.signing.ID && (key.AcceptUntil.IsZero() || !now.After(key.AcceptUntil)) {
+			secrets = append(secrets, key.Secret)
+		}
+	}
+	return secrets
+}
+
+// lookup returns the key named id if tokens signed with it are still
+// accepted at now.
+func (s *KeySet) lookup(id string, now time.Time) (SigningKey, bool) {
+	s.mu.RLock()
+	key, ok := s.keys[id]
+	s.mu.RUnlock()
+	if !ok || (!key.AcceptUntil.IsZero() && now.After(key.AcceptUntil)) {
+		return SigningKey{}, false
+	}
+	return key, true
+}
+
 func MakeJWT(
 	userID uuid.UUID,
-	tokenSecret string,
+	cfg JWTConfig,
 	expiresIn time.Duration,
 ) (string, error) {
-	signingKey := []byte(tokenSecret)
+	var key SigningKey
+	switch {
+	case cfg.Keys != nil:
+		key = cfg.Keys.signingKey()
+	case len(cfg.Secrets) > 0:
+		key = SigningKey{Secret: cfg.Secrets[0]}
+	default:
+		return "", errors.New("no signing secret configured")
+	}
+	now := time.Now().UTC()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+		Issuer:    cfg.Issuer,
+		Audience:  jwt.ClaimStrings{cfg.Audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
 		Subject:   userID.String(),
 	})
-	return token.SignedString(signingKey)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString([]byte(key.Secret))
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
-	)
+func ValidateJWT(tokenString string, cfg JWTConfig) (uuid.UUID, error) {
+	if cfg.Keys != nil {
+		kid, err := tokenKeyID(tokenString)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if kid != "" {
+			key, ok := cfg.Keys.lookup(kid, time.Now())
+			if !ok {
+				return uuid.Nil, ErrUnknownSigningKey
+			}
+			return validateJWTWithSecret(tokenString, key.Secret, cfg)
+		}
+	}
+
+	// tokens from before key IDs were used
+	secrets := cfg.Secrets
+	if cfg.Keys != nil {
+		secrets = cfg.Keys.acceptedSecrets(time.Now())
+	}
+	err := errors.New("no signing secret configured")
+	for _, secret := range secrets {
+		var id uuid.UUID
+		id, err = validateJWTWithSecret(tokenString, secret, cfg)
+		if err == nil {
+			return id, nil
+		}
+		// only a signature mismatch means another secret might still match
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return uuid.Nil, err
+		}
+	}
+	return uuid.Nil, err
+}
+
+// tokenKeyID reads the kid header of a token without checking it, which is
+// for the signature check that follows.
+func tokenKeyID(tokenString string) (string, error) {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &jwt.RegisteredClaims{})
 	if err != nil {
-		return uuid.Nil, err
+		return "", err
 	}
+	kid, _ := token.Header["kid"].(string)
+	return kid, nil
+}
 
-	userIDString, err := token.Claims.GetSubject()
+func validateJWTWithSecret(tokenString, tokenSecret string, cfg JWTConfig) (uuid.UUID, error) {
+	token, err := parseJWT(tokenString, tokenSecret, cfg.ClockSkew, jwt.WithIssuer(cfg.Issuer), jwt.WithAudience(cfg.Audience))
+	if err != nil && cfg.LegacyIssuer != "" && errors.Is(err, jwt.ErrTokenRequiredClaimMissing) {
+		legacy, legacyErr := parseJWT(tokenString, tokenSecret, cfg.ClockSkew, jwt.WithIssuer(cfg.LegacyIssuer))
+		if legacyErr == nil {
+			if aud, _ := legacy.Claims.GetAudience(); len(aud) == 0 {
+				token, err = legacy, nil
+			}
+		}
+	}
 	if err != nil {
 		return uuid.Nil, err
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
 		return uuid.Nil, err
 	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
-	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
@@ -80,6 +236,22 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 	return id, nil
 }
 
+// parseJWT checks a token's signature and times, allowing clockSkew, and
+// whatever claims opts ask for.
+func parseJWT(tokenString, tokenSecret string, clockSkew time.Duration, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	opts = append(opts,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithLeeway(clockSkew),
+		jwt.WithIssuedAt(),
+	)
+	return jwt.ParseWithClaims(
+		tokenString,
+		&jwt.RegisteredClaims{},
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		opts...,
+	)
+}
+
 func GetBearerToken(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
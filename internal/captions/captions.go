@@ -0,0 +1,77 @@
+// Package captions reads subtitle files in the formats people have them in,
+// SRT and WebVTT, and turns them into WebVTT, which is what browsers play.
+package captions
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"unicode/utf8"
+)
+
+var (
+	ErrEmpty   = errors.New("captions: no cues")
+	ErrInvalid = errors.New("captions: not SRT or WebVTT")
+)
+
+// an SRT cue's timing line, e.g. "00:00:01,500 --> 00:00:04,000", with
+// anything after the end time, like position hints, kept
+var srtTiming = regexp.MustCompile(`^(\d{1,2}:\d{2}:\d{2}),(\d{3}) +--> +(\d{1,2}:\d{2}:\d{2}),(\d{3})(.*)$`)
+
+var vttTiming = regexp.MustCompile(`^(\d+:)?\d{2}:\d{2}\.\d{3} +--> +(\d+:)?\d{2}:\d{2}\.\d{3}`)
+
+var byteOrderMark = []byte("\uFEFF")
+
+// ToWebVTT returns data as WebVTT. A WebVTT file is checked for cues and
+// returned with its line endings normalized; anything else is read as SRT,
+// whose cues only differ in the decimal comma of their timings.
+func ToWebVTT(data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, ErrInvalid
+	}
+	data = bytes.TrimPrefix(data, byteOrderMark)
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+
+	if bytes.HasPrefix(lines[0], []byte("WEBVTT")) {
+		header := lines[0][len("WEBVTT"):]
+		if len(header) > 0 && header[0] != ' ' && header[0] != '\t' {
+			return nil, ErrInvalid
+		}
+		for _, line := range lines[1:] {
+			if vttTiming.Match(line) {
+				return data, nil
+			}
+		}
+		return nil, ErrEmpty
+	}
+
+	var out bytes.Buffer
+	out.WriteString("WEBVTT\n\n")
+	cues := 0
+	for _, line := range lines {
+		if m := srtTiming.FindSubmatch(bytes.TrimSpace(line)); m != nil {
+			cues++
+			// SRT hours may be one digit; WebVTT wants two
+			out.WriteString(padHours(m[1]) + "." + string(m[2]) + " --> " + padHours(m[3]) + "." + string(m[4]) + string(m[5]) + "\n")
+			continue
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if cues == 0 {
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil, ErrEmpty
+		}
+		return nil, ErrInvalid
+	}
+	return out.Bytes(), nil
+}
+
+func padHours(timestamp []byte) string {
+	if len(timestamp) == len("0:00:00") {
+		return "0" + string(timestamp)
+	}
+	return string(timestamp)
+}
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/jobs"
+)
+
+const backgroundJobColumns = `id, created_at, kind, payload, status, attempts, max_attempts, run_at, last_error`
+
+func scanBackgroundJob(row interface{ Scan(...any) error }) (jobs.Job, error) {
+	var job jobs.Job
+	var payload string
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Kind,
+		&payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+	)
+	job.Payload = []byte(payload)
+	return job, err
+}
+
+// JobBackend keeps the background job queue in the database, for workers in
+// this process.
+func (c Client) JobBackend() jobs.Backend {
+	return jobBackend{c}
+}
+
+type jobBackend struct {
+	c Client
+}
+
+func (b jobBackend) Enqueue(ctx context.Context, job jobs.Job) error {
+	query := `
+	INSERT INTO background_jobs (` + backgroundJobColumns + `, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := b.c.db.ExecContext(ctx, query,
+		job.ID,
+		job.CreatedAt.UTC(),
+		job.Kind,
+		string(job.Payload),
+		job.Status,
+		job.Attempts,
+		job.MaxAttempts,
+		job.RunAt.UTC().Truncate(time.Second),
+		job.LastError,
+	)
+	return err
+}
+
+func (b jobBackend) Claim(ctx context.Context, now time.Time) (jobs.Job, bool, error) {
+	query := `
+	UPDATE background_jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM background_jobs
+		WHERE status = ? AND run_at <= ?
+		ORDER BY run_at ASC, created_at ASC
+		LIMIT 1
+	)
+	AND status = ?
+	RETURNING ` + backgroundJobColumns
+	job, err := scanBackgroundJob(b.c.db.QueryRowContext(ctx, query,
+		jobs.StatusRunning,
+		jobs.StatusQueued,
+		now.UTC().Truncate(time.Second),
+		jobs.StatusQueued,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return jobs.Job{}, false, nil
+	}
+	if err != nil {
+		return jobs.Job{}, false, err
+	}
+	return job, true, nil
+}
+
+func (b jobBackend) Complete(ctx context.Context, job jobs.Job) error {
+	_, err := b.c.db.ExecContext(ctx, "DELETE FROM background_jobs WHERE id = ?", job.ID)
+	return err
+}
+
+func (b jobBackend) Retry(ctx context.Context, job jobs.Job, at time.Time, reason string) error {
+	query := `
+	UPDATE background_jobs
+	SET
+		status = ?,
+		run_at = ?,
+		last_error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := b.c.db.ExecContext(ctx, query, jobs.StatusQueued, at.UTC().Truncate(time.Second), reason, job.ID)
+	return err
+}
+
+func (b jobBackend) Fail(ctx context.Context, job jobs.Job, reason string) error {
+	query := `
+	UPDATE background_jobs
+	SET
+		status = ?,
+		last_error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := b.c.db.ExecContext(ctx, query, jobs.StatusFailed, reason, job.ID)
+	return err
+}
+
+// RequeueRunningJobs puts jobs that were running back in the queue, for when
+// the process running them is gone. The attempt they were on still counts.
+func (c Client) RequeueRunningJobs() error {
+	query := `
+	UPDATE background_jobs
+	SET
+		status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE status = ?
+	`
+	_, err := c.db.Exec(query, jobs.StatusQueued, jobs.StatusRunning)
+	return err
+}
+
+// GetBackgroundJobs returns the jobs with the status, oldest first.
+func (c Client) GetBackgroundJobs(status jobs.Status) ([]jobs.Job, error) {
+	query := `
+	SELECT ` + backgroundJobColumns + `
+	FROM background_jobs
+	WHERE status = ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := []jobs.Job{}
+	for rows.Next() {
+		job, err := scanBackgroundJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, job)
+	}
+	return found, rows.Err()
+}
+
+// RequeueFailedJobs gives every failed job a fresh set of attempts starting
+// at now, and returns how many there were.
+func (c Client) RequeueFailedJobs(now time.Time) (int, error) {
+	query := `
+	UPDATE background_jobs
+	SET
+		status = ?,
+		attempts = 0,
+		run_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE status = ?
+	`
+	result, err := c.db.Exec(query, jobs.StatusQueued, now.UTC().Truncate(time.Second), jobs.StatusFailed)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
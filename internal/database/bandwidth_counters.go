@@ -0,0 +1,44 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GetBandwidth returns the bytes handed out for a user's videos in the month
+// starting at startsAt.
+func (c Client) GetBandwidth(userID uuid.UUID, startsAt time.Time) (int64, error) {
+	query := `
+	SELECT bytes
+	FROM bandwidth_counters
+	WHERE user_id = ? AND starts_at = ?
+	`
+	var bytes int64
+	err := c.db.QueryRow(query, userID, startsAt.UTC()).Scan(&bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return bytes, err
+}
+
+// AddBandwidth counts size bytes handed out for a user's videos in the
+// month starting at startsAt.
+func (c Client) AddBandwidth(userID uuid.UUID, startsAt time.Time, size int64) error {
+	query := `
+	INSERT INTO bandwidth_counters (user_id, starts_at, bytes)
+	VALUES (?, ?, ?)
+	ON CONFLICT(user_id, starts_at) DO UPDATE SET
+		bytes = bytes + excluded.bytes
+	`
+	_, err := c.db.Exec(query, userID, startsAt.UTC(), size)
+	return err
+}
+
+// DeleteBandwidthBefore drops counters for months that started before t.
+func (c Client) DeleteBandwidthBefore(t time.Time) error {
+	_, err := c.db.Exec("DELETE FROM bandwidth_counters WHERE starts_at < ?", t.UTC())
+	return err
+}
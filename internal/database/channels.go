@@ -0,0 +1,109 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Channel struct {
+	UserID        uuid.UUID  `json:"user_id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	Bio           string     `json:"bio"`
+	BannerURL     *string    `json:"banner_url"`
+	PinnedVideoID *uuid.UUID `json:"pinned_video_id"`
+	// an image composited onto the owner's uploads, in place of the
+	// deployment's; nil to use the deployment's
+	BrandingURL      *string `json:"branding_url"`
+	BrandingPosition string  `json:"branding_position"`
+}
+
+func (c Client) GetChannel(userID uuid.UUID) (Channel, error) {
+	query := `
+	SELECT
+		user_id,
+		created_at,
+		updated_at,
+		bio,
+		banner_url,
+		pinned_video_id,
+		branding_url,
+		branding_position
+	FROM channels
+	WHERE user_id = ?
+	`
+
+	var channel Channel
+	var pinnedVideoID *string
+	err := c.db.QueryRow(query, userID).Scan(
+		&channel.UserID,
+		&channel.CreatedAt,
+		&channel.UpdatedAt,
+		&channel.Bio,
+		&channel.BannerURL,
+		&pinnedVideoID,
+		&channel.BrandingURL,
+		&channel.BrandingPosition)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Channel{UserID: userID}, nil
+		}
+		return Channel{}, err
+	}
+
+	if pinnedVideoID != nil {
+		id, err := uuid.Parse(*pinnedVideoID)
+		if err != nil {
+			return Channel{}, err
+		}
+		channel.PinnedVideoID = &id
+	}
+
+	return channel, nil
+}
+
+func (c Client) UpsertChannel(channel Channel) (Channel, error) {
+	query := `
+	INSERT INTO channels (
+		user_id,
+		created_at,
+		updated_at,
+		bio,
+		banner_url,
+		pinned_video_id,
+		branding_url,
+		branding_position
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		bio = excluded.bio,
+		banner_url = excluded.banner_url,
+		pinned_video_id = excluded.pinned_video_id,
+		branding_url = excluded.branding_url,
+		branding_position = excluded.branding_position
+	`
+
+	var pinnedVideoID *string
+	if channel.PinnedVideoID != nil {
+		id := channel.PinnedVideoID.String()
+		pinnedVideoID = &id
+	}
+
+	_, err := c.db.Exec(
+		query,
+		channel.UserID,
+		channel.Bio,
+		channel.BannerURL,
+		pinnedVideoID,
+		channel.BrandingURL,
+		channel.BrandingPosition,
+	)
+	if err != nil {
+		return Channel{}, err
+	}
+
+	return c.GetChannel(channel.UserID)
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ChunkedUpload is an S3 multipart upload a client is filling part by part.
+type ChunkedUpload struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateChunkedUploadParams
+}
+
+type CreateChunkedUploadParams struct {
+	VideoID    uuid.UUID `json:"video_id"`
+	UserID     uuid.UUID `json:"user_id"`
+	S3UploadID string    `json:"-"`
+	Key        string    `json:"-"`
+	Size       int64     `json:"size"`
+	PartSize   int64     `json:"part_size"`
+	// the upload is abandoned if it isn't completed by then
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ChunkedUploadPart struct {
+	PartNumber int32  `json:"part_number"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+}
+
+func (c Client) CreateChunkedUpload(params CreateChunkedUploadParams) (ChunkedUpload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO chunked_uploads (
+		id,
+		created_at,
+		video_id,
+		user_id,
+		s3_upload_id,
+		key,
+		size,
+		part_size,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.UserID, params.S3UploadID, params.Key, params.Size, params.PartSize, params.ExpiresAt.UTC())
+	if err != nil {
+		return ChunkedUpload{}, err
+	}
+	return c.GetChunkedUpload(id)
+}
+
+const chunkedUploadColumns = `id, created_at, video_id, user_id, s3_upload_id, key, size, part_size, expires_at`
+
+func scanChunkedUpload(row interface{ Scan(...any) error }) (ChunkedUpload, error) {
+	var upload ChunkedUpload
+	err := row.Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.S3UploadID,
+		&upload.Key,
+		&upload.Size,
+		&upload.PartSize,
+		&upload.ExpiresAt,
+	)
+	return upload, err
+}
+
+// GetChunkedUpload returns an empty ChunkedUpload if there is none with the ID.
+func (c Client) GetChunkedUpload(id uuid.UUID) (ChunkedUpload, error) {
+	query := `
+	SELECT ` + chunkedUploadColumns + `
+	FROM chunked_uploads
+	WHERE id = ?
+	`
+	upload, err := scanChunkedUpload(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChunkedUpload{}, nil
+	}
+	return upload, err
+}
+
+// GetExpiredChunkedUploads returns uploads whose deadline passed before now.
+func (c Client) GetExpiredChunkedUploads(now time.Time) ([]ChunkedUpload, error) {
+	query := `
+	SELECT ` + chunkedUploadColumns + `
+	FROM chunked_uploads
+	WHERE expires_at < ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []ChunkedUpload{}
+	for rows.Next() {
+		upload, err := scanChunkedUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// PutChunkedUploadPart records a part, replacing an earlier attempt at it.
+func (c Client) PutChunkedUploadPart(uploadID uuid.UUID, part ChunkedUploadPart) error {
+	query := `
+	INSERT INTO chunked_upload_parts (upload_id, part_number, etag, size)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(upload_id, part_number) DO UPDATE SET
+		etag = excluded.etag,
+		size = excluded.size
+	`
+	_, err := c.db.Exec(query, uploadID, part.PartNumber, part.ETag, part.Size)
+	return err
+}
+
+func (c Client) GetChunkedUploadParts(uploadID uuid.UUID) ([]ChunkedUploadPart, error) {
+	query := `
+	SELECT part_number, etag, size
+	FROM chunked_upload_parts
+	WHERE upload_id = ?
+	ORDER BY part_number ASC
+	`
+	rows, err := c.db.Query(query, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := []ChunkedUploadPart{}
+	for rows.Next() {
+		var part ChunkedUploadPart
+		if err := rows.Scan(&part.PartNumber, &part.ETag, &part.Size); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
+
+func (c Client) DeleteChunkedUpload(id uuid.UUID) error {
+	if _, err := c.db.Exec("DELETE FROM chunked_upload_parts WHERE upload_id = ?", id); err != nil {
+		return err
+	}
+	_, err := c.db.Exec("DELETE FROM chunked_uploads WHERE id = ?", id)
+	return err
+}
@@ -72,13 +72,843 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	videoColumns := []struct{ name, definition string }{
+		{"premiere_at", "TIMESTAMP"},
+		{"premiere_notified_at", "TIMESTAMP"},
+		{"video_version_id", "TEXT"},
+		{"visibility", "TEXT NOT NULL DEFAULT 'public'"},
+		{"thumbnail_preview_url", "TEXT"},
+		{"archived_at", "TIMESTAMP"},
+		{"retention_exempt", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"watermark_viewers", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"upload_sha256", "TEXT"},
+		{"upload_abandoned_at", "TIMESTAMP"},
+		{"video_etag", "TEXT"},
+		{"thumbnail_etag", "TEXT"},
+		{"video_size", "INTEGER NOT NULL DEFAULT 0"},
+		{"quarantined_at", "TIMESTAMP"},
+		{"quarantine_reason", "TEXT"},
+		{"hls_master_key", "TEXT"},
+		{"dash_manifest_key", "TEXT"},
+		{"thumbnail_generated", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"storyboard_key", "TEXT"},
+		{"thumbnail_preview_generated", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"duration", "REAL"},
+		{"thumbnail_blurhash", "TEXT"},
+		{"thumbnail_version", "TEXT"},
+		{"status", "TEXT NOT NULL DEFAULT 'uploading'"},
+		{"transcript", "TEXT"},
+		{"parent_video_id", "TEXT"},
+		{"clip_start", "REAL"},
+		{"clip_end", "REAL"},
+	}
+	for _, col := range videoColumns {
+		err = c.addColumnIfMissing("videos", col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+	// videos from before statuses were kept play if they have an upload
+	_, err = c.db.Exec("UPDATE videos SET status = ? WHERE status = ? AND video_url IS NOT NULL", VideoStatusReady, VideoStatusUploading)
+	if err != nil {
+		return err
+	}
+	// uploads are deduplicated by checksum
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS videos_upload_sha256 ON videos(upload_sha256)")
+	if err != nil {
+		return err
+	}
+
+	channelTable := `
+	CREATE TABLE IF NOT EXISTS channels (
+		user_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		bio TEXT NOT NULL DEFAULT '',
+		banner_url TEXT,
+		pinned_video_id TEXT,
+		branding_url TEXT,
+		branding_position TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(channelTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("channels", "branding_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("channels", "branding_position", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	liveStreamTable := `
+	CREATE TABLE IF NOT EXISTS live_streams (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		stream_key TEXT UNIQUE NOT NULL,
+		status TEXT NOT NULL,
+		video_id TEXT,
+		title TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(liveStreamTable)
+	if err != nil {
+		return err
+	}
+
+	notificationTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		read_at TIMESTAMP,
+		user_id TEXT NOT NULL,
+		video_id TEXT,
+		kind TEXT NOT NULL,
+		message TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(notificationTable)
+	if err != nil {
+		return err
+	}
+
+	stitchClipTable := `
+	CREATE TABLE IF NOT EXISTS stitch_clips (
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		key TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, kind),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(stitchClipTable)
+	if err != nil {
+		return err
+	}
+
+	stitchSourceTable := `
+	CREATE TABLE IF NOT EXISTS stitch_sources (
+		video_id TEXT PRIMARY KEY,
+		key TEXT NOT NULL,
+		stitched_sha256 TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(stitchSourceTable)
+	if err != nil {
+		return err
+	}
+
+	videoVersionTable := `
+	CREATE TABLE IF NOT EXISTS video_versions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		s3_version_id TEXT,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoVersionTable)
+	if err != nil {
+		return err
+	}
+
+	presignAuditTable := `
+	CREATE TABLE IF NOT EXISTS presign_audit (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		requester TEXT NOT NULL,
+		user_id TEXT,
+		video_id TEXT,
+		object_key TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(presignAuditTable)
+	if err != nil {
+		return err
+	}
+
+	playbackSessionTable := `
+	CREATE TABLE IF NOT EXISTS playback_sessions (
+		token TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(playbackSessionTable)
+	if err != nil {
+		return err
+	}
+
+	tusUploadTable := `
+	CREATE TABLE IF NOT EXISTS tus_uploads (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		upload_offset INTEGER NOT NULL,
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		length INTEGER NOT NULL,
+		filename TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(tusUploadTable)
+	if err != nil {
+		return err
+	}
+
+	chunkedUploadTable := `
+	CREATE TABLE IF NOT EXISTS chunked_uploads (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		s3_upload_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		part_size INTEGER NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE TABLE IF NOT EXISTS chunked_upload_parts (
+		upload_id TEXT NOT NULL,
+		part_number INTEGER NOT NULL,
+		etag TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		PRIMARY KEY(upload_id, part_number),
+		FOREIGN KEY(upload_id) REFERENCES chunked_uploads(id)
+	);
+	`
+	_, err = c.db.Exec(chunkedUploadTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("chunked_uploads", "expires_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	// uploads from before deadlines existed are abandoned at the next sweep
+	_, err = c.db.Exec("UPDATE chunked_uploads SET expires_at = CURRENT_TIMESTAMP WHERE expires_at IS NULL")
+	if err != nil {
+		return err
+	}
+
+	directUploadTable := `
+	CREATE TABLE IF NOT EXISTS direct_uploads (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(directUploadTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("direct_uploads", "form", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	videoArchiveTable := `
+	CREATE TABLE IF NOT EXISTS video_archives (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		status TEXT NOT NULL,
+		size INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		user_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		video_count INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(videoArchiveTable)
+	if err != nil {
+		return err
+	}
+
+	userBucketTable := `
+	CREATE TABLE IF NOT EXISTS user_buckets (
+		user_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		bucket TEXT NOT NULL,
+		region TEXT NOT NULL,
+		role_arn TEXT NOT NULL,
+		external_id TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userBucketTable)
+	if err != nil {
+		return err
+	}
+
+	uploadCounterTable := `
+	CREATE TABLE IF NOT EXISTS upload_counters (
+		user_id TEXT NOT NULL,
+		period TEXT NOT NULL,
+		starts_at TIMESTAMP NOT NULL,
+		uploads INTEGER NOT NULL DEFAULT 0,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(user_id, period, starts_at),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(uploadCounterTable)
+	if err != nil {
+		return err
+	}
+
+	bandwidthCounterTable := `
+	CREATE TABLE IF NOT EXISTS bandwidth_counters (
+		user_id TEXT NOT NULL,
+		starts_at TIMESTAMP NOT NULL,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(user_id, starts_at),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(bandwidthCounterTable)
+	if err != nil {
+		return err
+	}
+
+	videoCollaboratorTable := `
+	CREATE TABLE IF NOT EXISTS video_collaborators (
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(video_id, user_id),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(videoCollaboratorTable)
+	if err != nil {
+		return err
+	}
+
+	embedTokenTable := `
+	CREATE TABLE IF NOT EXISTS embed_tokens (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		views INTEGER NOT NULL DEFAULT 0,
+		last_viewed_at TIMESTAMP,
+		UNIQUE(video_id, domain),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(embedTokenTable)
+	if err != nil {
+		return err
+	}
+
+	reviewLinkTable := `
+	CREATE TABLE IF NOT EXISTS review_links (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		reviewer_id TEXT,
+		expires_at TIMESTAMP,
+		views INTEGER NOT NULL DEFAULT 0,
+		last_viewed_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(reviewer_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(reviewLinkTable)
+	if err != nil {
+		return err
+	}
+
+	processingLogTable := `
+	CREATE TABLE IF NOT EXISTS processing_logs (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		run_id TEXT NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		args TEXT NOT NULL DEFAULT '',
+		stdout TEXT NOT NULL DEFAULT '',
+		stderr TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(processingLogTable)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS processing_logs_video ON processing_logs(video_id, started_at)")
+	if err != nil {
+		return err
+	}
+
+	signingKeyTable := `
+	CREATE TABLE IF NOT EXISTS signing_keys (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		secret TEXT NOT NULL
+	);
+	`
+	_, err = c.db.Exec(signingKeyTable)
+	if err != nil {
+		return err
+	}
+
+	videoRenditionTable := `
+	CREATE TABLE IF NOT EXISTS video_renditions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		key TEXT NOT NULL,
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		bitrate INTEGER NOT NULL DEFAULT 0,
+		UNIQUE(video_id, name),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoRenditionTable)
+	if err != nil {
+		return err
+	}
+
+	videoCaptionTable := `
+	CREATE TABLE IF NOT EXISTS video_captions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		key TEXT NOT NULL,
+		generated INTEGER NOT NULL DEFAULT 0,
+		UNIQUE(video_id, language),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoCaptionTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_captions", "generated", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	videoMetadataTable := `
+	CREATE TABLE IF NOT EXISTS video_metadata (
+		video_id TEXT PRIMARY KEY,
+		key TEXT NOT NULL,
+		probed_at TIMESTAMP NOT NULL,
+		container TEXT NOT NULL DEFAULT '',
+		duration REAL NOT NULL DEFAULT 0,
+		bitrate INTEGER NOT NULL DEFAULT 0,
+		video_codec TEXT NOT NULL DEFAULT '',
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		fps REAL NOT NULL DEFAULT 0,
+		video_bitrate INTEGER NOT NULL DEFAULT 0,
+		pixel_format TEXT NOT NULL DEFAULT '',
+		audio_codec TEXT NOT NULL DEFAULT '',
+		audio_channels INTEGER NOT NULL DEFAULT 0,
+		audio_sample_rate INTEGER NOT NULL DEFAULT 0,
+		audio_bitrate INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoMetadataTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_metadata", "rotation", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	thumbnailVariantTable := `
+	CREATE TABLE IF NOT EXISTS thumbnail_variants (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		format TEXT NOT NULL,
+		url TEXT NOT NULL,
+		UNIQUE(video_id, width, format),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(thumbnailVariantTable)
+	if err != nil {
+		return err
+	}
+
+	backgroundJobTable := `
+	CREATE TABLE IF NOT EXISTS background_jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		kind TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		run_at TIMESTAMP NOT NULL,
+		last_error TEXT NOT NULL DEFAULT ''
+	);
+	`
+	_, err = c.db.Exec(backgroundJobTable)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS background_jobs_due ON background_jobs(status, run_at)")
+	if err != nil {
+		return err
+	}
+
+	webhookTable := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(webhookTable)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS webhooks_user ON webhooks(user_id)")
+	if err != nil {
+		return err
+	}
+
+	transcoderJobTable := `
+	CREATE TABLE IF NOT EXISTS transcoder_jobs (
+		id TEXT PRIMARY KEY,
+		received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(transcoderJobTable)
+	if err != nil {
+		return err
+	}
+
+	analyticsPolicyTable := `
+	CREATE TABLE IF NOT EXISTS analytics_policies (
+		user_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		min_viewers INTEGER NOT NULL DEFAULT 0,
+		truncate_ips BOOLEAN NOT NULL DEFAULT TRUE,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(analyticsPolicyTable)
+	if err != nil {
+		return err
+	}
+
+	playbackStatTable := `
+	CREATE TABLE IF NOT EXISTS playback_stats (
+		video_id TEXT NOT NULL,
+		day TEXT NOT NULL,
+		country TEXT NOT NULL DEFAULT '',
+		network TEXT NOT NULL DEFAULT '',
+		views INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(video_id, day, country, network),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(playbackStatTable)
+	if err != nil {
+		return err
+	}
+
+	processingJobTable := `
+	CREATE TABLE IF NOT EXISTS processing_jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		retryable BOOLEAN NOT NULL DEFAULT FALSE,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(processingJobTable)
+	if err != nil {
+		return err
+	}
+
+	idempotencyKeyTable := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		completed_at TIMESTAMP,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		content_type TEXT NOT NULL DEFAULT '',
+		body BLOB,
+		PRIMARY KEY(user_id, key),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(idempotencyKeyTable)
+	if err != nil {
+		return err
+	}
+
+	retentionRuleTable := `
+	CREATE TABLE IF NOT EXISTS retention_rules (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		name TEXT NOT NULL,
+		visibility TEXT NOT NULL,
+		upload_state TEXT NOT NULL,
+		min_age_days INTEGER NOT NULL,
+		action TEXT NOT NULL
+	);
+	`
+	_, err = c.db.Exec(retentionRuleTable)
+	if err != nil {
+		return err
+	}
+
+	planTable := `
+	CREATE TABLE IF NOT EXISTS plans (
+		name TEXT PRIMARY KEY,
+		max_video_size INTEGER NOT NULL,
+		max_video_duration INTEGER NOT NULL,
+		max_renditions INTEGER NOT NULL,
+		monthly_bandwidth INTEGER NOT NULL,
+		daily_uploads INTEGER NOT NULL DEFAULT 0,
+		daily_upload_bytes INTEGER NOT NULL DEFAULT 0,
+		monthly_uploads INTEGER NOT NULL DEFAULT 0,
+		monthly_upload_bytes INTEGER NOT NULL DEFAULT 0
+	);
+	`
+	_, err = c.db.Exec(planTable)
+	if err != nil {
+		return err
+	}
+	// plans from before upload caps and storage quotas existed stay uncapped
+	// until tuned
+	planCapColumns := []struct{ name, definition string }{
+		{"daily_uploads", "INTEGER NOT NULL DEFAULT 0"},
+		{"daily_upload_bytes", "INTEGER NOT NULL DEFAULT 0"},
+		{"monthly_uploads", "INTEGER NOT NULL DEFAULT 0"},
+		{"monthly_upload_bytes", "INTEGER NOT NULL DEFAULT 0"},
+		{"storage_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, col := range planCapColumns {
+		err = c.addColumnIfMissing("plans", col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+	for _, plan := range defaultPlans {
+		_, err = c.db.Exec(`INSERT OR IGNORE INTO plans (`+planColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			plan.Name, plan.MaxVideoSize, plan.MaxVideoDuration, plan.MaxRenditions, plan.MonthlyBandwidth,
+			plan.DailyUploads, plan.DailyUploadBytes, plan.MonthlyUploads, plan.MonthlyUploadBytes, plan.StorageBytes)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.addColumnIfMissing("users", "plan", "TEXT NOT NULL DEFAULT '"+PlanFree+"'")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// addColumnIfMissing brings tables created by older versions up to date,
+// CREATE TABLE IF NOT EXISTS leaves existing tables untouched.
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
+// Snapshot writes a consistent copy of the database to path, which must not
+// exist yet.
+func (c Client) Snapshot(path string) error {
+	_, err := c.db.Exec("VACUUM INTO ?", path)
+	return err
+}
+
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM video_captions"); err != nil {
+		return fmt.Errorf("failed to reset table video_captions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_renditions"); err != nil {
+		return fmt.Errorf("failed to reset table video_renditions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_metadata"); err != nil {
+		return fmt.Errorf("failed to reset table video_metadata: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM thumbnail_variants"); err != nil {
+		return fmt.Errorf("failed to reset table thumbnail_variants: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM background_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table background_jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM webhooks"); err != nil {
+		return fmt.Errorf("failed to reset table webhooks: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM transcoder_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table transcoder_jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM playback_stats"); err != nil {
+		return fmt.Errorf("failed to reset table playback_stats: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM analytics_policies"); err != nil {
+		return fmt.Errorf("failed to reset table analytics_policies: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_logs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_logs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM embed_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table embed_tokens: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM review_links"); err != nil {
+		return fmt.Errorf("failed to reset table review_links: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_collaborators"); err != nil {
+		return fmt.Errorf("failed to reset table video_collaborators: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM idempotency_keys"); err != nil {
+		return fmt.Errorf("failed to reset table idempotency_keys: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_counters"); err != nil {
+		return fmt.Errorf("failed to reset table upload_counters: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM bandwidth_counters"); err != nil {
+		return fmt.Errorf("failed to reset table bandwidth_counters: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_buckets"); err != nil {
+		return fmt.Errorf("failed to reset table user_buckets: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM chunked_upload_parts"); err != nil {
+		return fmt.Errorf("failed to reset table chunked_upload_parts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM chunked_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table chunked_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_archives"); err != nil {
+		return fmt.Errorf("failed to reset table video_archives: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM direct_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table direct_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM tus_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table tus_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM retention_rules"); err != nil {
+		return fmt.Errorf("failed to reset table retention_rules: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM playback_sessions"); err != nil {
+		return fmt.Errorf("failed to reset table playback_sessions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM presign_audit"); err != nil {
+		return fmt.Errorf("failed to reset table presign_audit: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_versions"); err != nil {
+		return fmt.Errorf("failed to reset table video_versions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM stitch_clips"); err != nil {
+		return fmt.Errorf("failed to reset table stitch_clips: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM stitch_sources"); err != nil {
+		return fmt.Errorf("failed to reset table stitch_sources: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM notifications"); err != nil {
+		return fmt.Errorf("failed to reset table notifications: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM live_streams"); err != nil {
+		return fmt.Errorf("failed to reset table live_streams: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM channels"); err != nil {
+		return fmt.Errorf("failed to reset table channels: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DirectUpload is a presigned PUT or form POST a client was given, waiting
+// for the client to confirm the object is in place.
+type DirectUpload struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateDirectUploadParams
+}
+
+type CreateDirectUploadParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	UserID  uuid.UUID `json:"user_id"`
+	Key     string    `json:"-"`
+	// form uploads name the object themselves somewhere under Key, and
+	// their Size is only known once it's there
+	Form bool  `json:"form"`
+	Size int64 `json:"size"`
+	// hex SHA-256 the client declared, which S3 checked the upload against;
+	// empty if none was given
+	SHA256 string `json:"sha256"`
+	// the upload is abandoned if it isn't confirmed by then
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (c Client) CreateDirectUpload(params CreateDirectUploadParams) (DirectUpload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO direct_uploads (
+		id,
+		created_at,
+		video_id,
+		user_id,
+		key,
+		form,
+		size,
+		sha256,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.UserID, params.Key, params.Form, params.Size, params.SHA256, params.ExpiresAt.UTC())
+	if err != nil {
+		return DirectUpload{}, err
+	}
+	return c.GetDirectUpload(id)
+}
+
+const directUploadColumns = `id, created_at, video_id, user_id, key, form, size, sha256, expires_at`
+
+func scanDirectUpload(row interface{ Scan(...any) error }) (DirectUpload, error) {
+	var upload DirectUpload
+	err := row.Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.Key,
+		&upload.Form,
+		&upload.Size,
+		&upload.SHA256,
+		&upload.ExpiresAt,
+	)
+	return upload, err
+}
+
+// GetDirectUpload returns an empty DirectUpload if there is none with the ID.
+func (c Client) GetDirectUpload(id uuid.UUID) (DirectUpload, error) {
+	query := `
+	SELECT ` + directUploadColumns + `
+	FROM direct_uploads
+	WHERE id = ?
+	`
+	upload, err := scanDirectUpload(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return DirectUpload{}, nil
+	}
+	return upload, err
+}
+
+// GetExpiredDirectUploads returns uploads whose deadline passed before now.
+func (c Client) GetExpiredDirectUploads(now time.Time) ([]DirectUpload, error) {
+	query := `
+	SELECT ` + directUploadColumns + `
+	FROM direct_uploads
+	WHERE expires_at < ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []DirectUpload{}
+	for rows.Next() {
+		upload, err := scanDirectUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+func (c Client) DeleteDirectUpload(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM direct_uploads WHERE id = ?", id)
+	return err
+}
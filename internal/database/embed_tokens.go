@@ -0,0 +1,109 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EmbedToken lets one third-party domain embed a video. The token itself is
+// a signature over the row, so only the ID is stored.
+type EmbedToken struct {
+	ID           uuid.UUID  `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	VideoID      uuid.UUID  `json:"video_id"`
+	Domain       string     `json:"domain"`
+	Views        int64      `json:"views"`
+	LastViewedAt *time.Time `json:"last_viewed_at"`
+}
+
+const embedTokenColumns = `id, created_at, video_id, domain, views, last_viewed_at`
+
+func scanEmbedToken(row interface{ Scan(...any) error }) (EmbedToken, error) {
+	var token EmbedToken
+	var lastViewedAt sql.NullTime
+	err := row.Scan(
+		&token.ID,
+		&token.CreatedAt,
+		&token.VideoID,
+		&token.Domain,
+		&token.Views,
+		&lastViewedAt,
+	)
+	if lastViewedAt.Valid {
+		token.LastViewedAt = &lastViewedAt.Time
+	}
+	return token, err
+}
+
+// CreateEmbedToken returns the video's token for the domain, creating it if
+// there isn't one yet.
+func (c Client) CreateEmbedToken(videoID uuid.UUID, domain string) (EmbedToken, error) {
+	query := `
+	INSERT INTO embed_tokens (id, created_at, video_id, domain)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?)
+	ON CONFLICT(video_id, domain) DO NOTHING
+	`
+	_, err := c.db.Exec(query, uuid.New(), videoID, domain)
+	if err != nil {
+		return EmbedToken{}, err
+	}
+	query = `
+	SELECT ` + embedTokenColumns + `
+	FROM embed_tokens
+	WHERE video_id = ? AND domain = ?
+	`
+	return scanEmbedToken(c.db.QueryRow(query, videoID, domain))
+}
+
+// GetEmbedToken returns an empty EmbedToken if there is none with the ID.
+func (c Client) GetEmbedToken(id uuid.UUID) (EmbedToken, error) {
+	query := `
+	SELECT ` + embedTokenColumns + `
+	FROM embed_tokens
+	WHERE id = ?
+	`
+	token, err := scanEmbedToken(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return EmbedToken{}, nil
+	}
+	return token, err
+}
+
+func (c Client) GetEmbedTokens(videoID uuid.UUID) ([]EmbedToken, error) {
+	query := `
+	SELECT ` + embedTokenColumns + `
+	FROM embed_tokens
+	WHERE video_id = ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []EmbedToken{}
+	for rows.Next() {
+		token, err := scanEmbedToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RecordEmbedView counts a view through the token.
+func (c Client) RecordEmbedView(id uuid.UUID, at time.Time) error {
+	_, err := c.db.Exec("UPDATE embed_tokens SET views = views + 1, last_viewed_at = ? WHERE id = ?", at.UTC(), id)
+	return err
+}
+
+// DeleteEmbedToken revokes the token; embeds using it stop working.
+func (c Client) DeleteEmbedToken(videoID, id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM embed_tokens WHERE video_id = ? AND id = ?", videoID, id)
+	return err
+}
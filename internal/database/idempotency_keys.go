@@ -0,0 +1,120 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyKey is a client-chosen key for one request, with the response
+// it got once it completes.
+type IdempotencyKey struct {
+	UserID    uuid.UUID
+	Key       string
+	CreatedAt time.Time
+	Method    string
+	Path      string
+	// nil while the request is still being handled
+	CompletedAt *time.Time
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+type ClaimIdempotencyKeyParams struct {
+	UserID    uuid.UUID
+	Key       string
+	Method    string
+	Path      string
+	CreatedAt time.Time
+	// a request still pending from before this is taken to have died with
+	// the server, and the key is claimed anew
+	StaleBefore time.Time
+}
+
+const idempotencyKeyColumns = `user_id, key, created_at, method, path, completed_at, status_code, content_type, body`
+
+func scanIdempotencyKey(row interface{ Scan(...any) error }) (IdempotencyKey, error) {
+	var key IdempotencyKey
+	err := row.Scan(
+		&key.UserID,
+		&key.Key,
+		&key.CreatedAt,
+		&key.Method,
+		&key.Path,
+		&key.CompletedAt,
+		&key.StatusCode,
+		&key.ContentType,
+		&key.Body,
+	)
+	return key, err
+}
+
+// ClaimIdempotencyKey records a new request under the key, reporting whether
+// it was claimed. If it wasn't, the key's existing request is returned.
+func (c Client) ClaimIdempotencyKey(params ClaimIdempotencyKeyParams) (IdempotencyKey, bool, error) {
+	query := `
+	INSERT INTO idempotency_keys (user_id, key, created_at, method, path)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(user_id, key) DO UPDATE SET
+		created_at = excluded.created_at,
+		method = excluded.method,
+		path = excluded.path
+	WHERE completed_at IS NULL AND created_at < ?
+	`
+	result, err := c.db.Exec(query, params.UserID, params.Key, params.CreatedAt.UTC(), params.Method, params.Path, params.StaleBefore.UTC())
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+	key, err := c.GetIdempotencyKey(params.UserID, params.Key)
+	return key, claimed == 1, err
+}
+
+// GetIdempotencyKey returns an empty IdempotencyKey if the user hasn't used
+// the key.
+func (c Client) GetIdempotencyKey(userID uuid.UUID, key string) (IdempotencyKey, error) {
+	query := `
+	SELECT ` + idempotencyKeyColumns + `
+	FROM idempotency_keys
+	WHERE user_id = ? AND key = ?
+	`
+	record, err := scanIdempotencyKey(c.db.QueryRow(query, userID, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return IdempotencyKey{}, nil
+	}
+	return record, err
+}
+
+// CompleteIdempotencyKey stores the response a key's request got, to be
+// replayed to retries.
+func (c Client) CompleteIdempotencyKey(userID uuid.UUID, key string, completedAt time.Time, statusCode int, contentType string, body []byte) error {
+	query := `
+	UPDATE idempotency_keys
+	SET
+		completed_at = ?,
+		status_code = ?,
+		content_type = ?,
+		body = ?
+	WHERE user_id = ? AND key = ?
+	`
+	_, err := c.db.Exec(query, completedAt.UTC(), statusCode, contentType, body, userID, key)
+	return err
+}
+
+func (c Client) DeleteIdempotencyKey(userID uuid.UUID, key string) error {
+	_, err := c.db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?", userID, key)
+	return err
+}
+
+// DeleteIdempotencyKeysBefore drops keys first used before t, which can then
+// be reused.
+func (c Client) DeleteIdempotencyKeysBefore(t time.Time) error {
+	_, err := c.db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", t.UTC())
+	return err
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type LiveStreamStatus string
+
+const (
+	LiveStreamStatusIdle  LiveStreamStatus = "idle"
+	LiveStreamStatusLive  LiveStreamStatus = "live"
+	LiveStreamStatusEnded LiveStreamStatus = "ended"
+)
+
+type LiveStream struct {
+	ID        uuid.UUID        `json:"id"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Status    LiveStreamStatus `json:"status"`
+	VideoID   *uuid.UUID       `json:"video_id"`
+	CreateLiveStreamParams
+}
+
+type CreateLiveStreamParams struct {
+	Title     string    `json:"title"`
+	UserID    uuid.UUID `json:"user_id"`
+	StreamKey string    `json:"stream_key"`
+}
+
+const liveStreamColumns = `
+	id,
+	created_at,
+	updated_at,
+	stream_key,
+	status,
+	video_id,
+	title,
+	user_id
+`
+
+func scanLiveStream(row interface{ Scan(...any) error }) (LiveStream, error) {
+	var stream LiveStream
+	var videoID *string
+	err := row.Scan(
+		&stream.ID,
+		&stream.CreatedAt,
+		&stream.UpdatedAt,
+		&stream.StreamKey,
+		&stream.Status,
+		&videoID,
+		&stream.Title,
+		&stream.UserID,
+	)
+	if err != nil {
+		return LiveStream{}, err
+	}
+	if videoID != nil {
+		id, err := uuid.Parse(*videoID)
+		if err != nil {
+			return LiveStream{}, err
+		}
+		stream.VideoID = &id
+	}
+	return stream, nil
+}
+
+func (c Client) CreateLiveStream(params CreateLiveStreamParams) (LiveStream, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO live_streams (
+		id,
+		created_at,
+		updated_at,
+		stream_key,
+		status,
+		title,
+		user_id
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.StreamKey, LiveStreamStatusIdle, params.Title, params.UserID)
+	if err != nil {
+		return LiveStream{}, err
+	}
+
+	return c.GetLiveStream(id)
+}
+
+func (c Client) GetLiveStream(id uuid.UUID) (LiveStream, error) {
+	query := `SELECT ` + liveStreamColumns + ` FROM live_streams WHERE id = ?`
+	stream, err := scanLiveStream(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return LiveStream{}, nil
+	}
+	return stream, err
+}
+
+func (c Client) GetLiveStreamByKey(streamKey string) (LiveStream, error) {
+	query := `SELECT ` + liveStreamColumns + ` FROM live_streams WHERE stream_key = ?`
+	stream, err := scanLiveStream(c.db.QueryRow(query, streamKey))
+	if errors.Is(err, sql.ErrNoRows) {
+		return LiveStream{}, nil
+	}
+	return stream, err
+}
+
+func (c Client) GetLiveStreams(userID uuid.UUID) ([]LiveStream, error) {
+	query := `SELECT ` + liveStreamColumns + ` FROM live_streams WHERE user_id = ? ORDER BY created_at DESC`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	streams := []LiveStream{}
+	for rows.Next() {
+		stream, err := scanLiveStream(rows)
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+
+	return streams, nil
+}
+
+func (c Client) UpdateLiveStream(stream LiveStream) error {
+	query := `
+	UPDATE live_streams
+	SET
+		updated_at = CURRENT_TIMESTAMP,
+		status = ?,
+		video_id = ?,
+		title = ?
+	WHERE id = ?
+	`
+
+	var videoID *string
+	if stream.VideoID != nil {
+		id := stream.VideoID.String()
+		videoID = &id
+	}
+
+	_, err := c.db.Exec(query, stream.Status, videoID, stream.Title, stream.ID)
+	return err
+}
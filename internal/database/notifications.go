@@ -0,0 +1,102 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Notification struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreateNotificationParams
+}
+
+type CreateNotificationParams struct {
+	UserID  uuid.UUID  `json:"user_id"`
+	VideoID *uuid.UUID `json:"video_id"`
+	Kind    string     `json:"kind"`
+	Message string     `json:"message"`
+}
+
+func (c Client) CreateNotification(params CreateNotificationParams) error {
+	query := `
+	INSERT INTO notifications (
+		id,
+		created_at,
+		user_id,
+		video_id,
+		kind,
+		message
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+
+	var videoID *string
+	if params.VideoID != nil {
+		id := params.VideoID.String()
+		videoID = &id
+	}
+
+	_, err := c.db.Exec(query, uuid.New(), params.UserID, videoID, params.Kind, params.Message)
+	return err
+}
+
+func (c Client) GetNotifications(userID uuid.UUID) ([]Notification, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		read_at,
+		user_id,
+		video_id,
+		kind,
+		message
+	FROM notifications
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`
+
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var videoID *string
+		if err := rows.Scan(
+			&n.ID,
+			&n.CreatedAt,
+			&n.ReadAt,
+			&n.UserID,
+			&videoID,
+			&n.Kind,
+			&n.Message,
+		); err != nil {
+			return nil, err
+		}
+		if videoID != nil {
+			id, err := uuid.Parse(*videoID)
+			if err != nil {
+				return nil, err
+			}
+			n.VideoID = &id
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, rows.Err()
+}
+
+func (c Client) MarkNotificationsRead(userID uuid.UUID) error {
+	query := `
+	UPDATE notifications
+	SET read_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND read_at IS NULL
+	`
+	_, err := c.db.Exec(query, userID)
+	return err
+}
@@ -0,0 +1,117 @@
+package database
+
+import "github.com/google/uuid"
+
+type Plan struct {
+	Name             string `json:"name"`
+	MaxVideoSize     int64  `json:"max_video_size"`
+	MaxVideoDuration int    `json:"max_video_duration"`
+	MaxRenditions    int    `json:"max_renditions"`
+	MonthlyBandwidth int64  `json:"monthly_bandwidth"`
+	// caps on uploads per UTC day and calendar month, zero for none
+	DailyUploads       int   `json:"daily_uploads"`
+	DailyUploadBytes   int64 `json:"daily_upload_bytes"`
+	MonthlyUploads     int   `json:"monthly_uploads"`
+	MonthlyUploadBytes int64 `json:"monthly_upload_bytes"`
+	// total size of the videos a user can keep, zero for no quota
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+const (
+	PlanFree = "free"
+	PlanPro  = "pro"
+)
+
+// defaultPlans are created on first start. Limits live in the database so
+// they can be tuned without a release; existing rows are never overwritten.
+var defaultPlans = []Plan{
+	{
+		Name:               PlanFree,
+		MaxVideoSize:       1 << 30,
+		MaxVideoDuration:   60 * 60,
+		MaxRenditions:      2,
+		MonthlyBandwidth:   50 << 30,
+		DailyUploads:       10,
+		DailyUploadBytes:   5 << 30,
+		MonthlyUploads:     100,
+		MonthlyUploadBytes: 50 << 30,
+		StorageBytes:       25 << 30,
+	},
+	{
+		Name:             PlanPro,
+		MaxVideoSize:     10 << 30,
+		MaxVideoDuration: 4 * 60 * 60,
+		MaxRenditions:    5,
+		MonthlyBandwidth: 1 << 40,
+		DailyUploads:     100,
+		DailyUploadBytes: 100 << 30,
+		StorageBytes:     2 << 40,
+	},
+}
+
+const planColumns = `
+	name,
+	max_video_size,
+	max_video_duration,
+	max_renditions,
+	monthly_bandwidth,
+	daily_uploads,
+	daily_upload_bytes,
+	monthly_uploads,
+	monthly_upload_bytes,
+	storage_bytes
+`
+
+func scanPlan(row interface{ Scan(...any) error }) (Plan, error) {
+	var plan Plan
+	err := row.Scan(
+		&plan.Name,
+		&plan.MaxVideoSize,
+		&plan.MaxVideoDuration,
+		&plan.MaxRenditions,
+		&plan.MonthlyBandwidth,
+		&plan.DailyUploads,
+		&plan.DailyUploadBytes,
+		&plan.MonthlyUploads,
+		&plan.MonthlyUploadBytes,
+		&plan.StorageBytes,
+	)
+	return plan, err
+}
+
+func (c Client) GetPlans() ([]Plan, error) {
+	rows, err := c.db.Query(`SELECT ` + planColumns + ` FROM plans ORDER BY max_video_size`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []Plan{}
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	return plans, rows.Err()
+}
+
+// GetUserPlan returns the plan the user is on.
+func (c Client) GetUserPlan(userID uuid.UUID) (Plan, error) {
+	query := `
+	SELECT ` + planColumns + `
+	FROM plans
+	WHERE name = (SELECT plan FROM users WHERE id = ?)
+	`
+	return scanPlan(c.db.QueryRow(query, userID))
+}
+
+func (c Client) SetUserPlan(userID uuid.UUID, plan string) error {
+	_, err := c.db.Exec(`UPDATE users SET plan = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, plan, userID)
+	return err
+}
+
+func (c Client) GetPlan(name string) (Plan, error) {
+	return scanPlan(c.db.QueryRow(`SELECT `+planColumns+` FROM plans WHERE name = ?`, name))
+}
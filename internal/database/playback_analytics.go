@@ -0,0 +1,111 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AnalyticsPolicy is how playback of a user's videos is counted, overriding
+// the deployment's defaults for them.
+type AnalyticsPolicy struct {
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Enabled   bool      `json:"enabled"`
+	// groups of fewer viewers than this are left out of reports
+	MinViewers int `json:"min_viewers"`
+	// count networks instead of addresses
+	TruncateIPs bool `json:"truncate_ips"`
+}
+
+// SetAnalyticsPolicy sets a user's policy, replacing any earlier one.
+func (c Client) SetAnalyticsPolicy(policy AnalyticsPolicy) error {
+	query := `
+	INSERT INTO analytics_policies (user_id, created_at, enabled, min_viewers, truncate_ips)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		created_at = CURRENT_TIMESTAMP,
+		enabled = excluded.enabled,
+		min_viewers = excluded.min_viewers,
+		truncate_ips = excluded.truncate_ips
+	`
+	_, err := c.db.Exec(query, policy.UserID, policy.Enabled, policy.MinViewers, policy.TruncateIPs)
+	return err
+}
+
+// GetAnalyticsPolicy returns an empty AnalyticsPolicy if the user has none
+// of their own.
+func (c Client) GetAnalyticsPolicy(userID uuid.UUID) (AnalyticsPolicy, error) {
+	query := `
+	SELECT user_id, created_at, enabled, min_viewers, truncate_ips
+	FROM analytics_policies
+	WHERE user_id = ?
+	`
+	var policy AnalyticsPolicy
+	err := c.db.QueryRow(query, userID).Scan(
+		&policy.UserID,
+		&policy.CreatedAt,
+		&policy.Enabled,
+		&policy.MinViewers,
+		&policy.TruncateIPs,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AnalyticsPolicy{}, nil
+	}
+	return policy, err
+}
+
+func (c Client) DeleteAnalyticsPolicy(userID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM analytics_policies WHERE user_id = ?", userID)
+	return err
+}
+
+// PlaybackStat counts the views of a video on one day from one country and
+// network. Views are only ever stored counted like this.
+type PlaybackStat struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// UTC date, as YYYY-MM-DD
+	Day     string `json:"day"`
+	Country string `json:"country"`
+	Network string `json:"network"`
+	Views   int64  `json:"views"`
+}
+
+// RecordPlaybackView adds a view to the count it falls under.
+func (c Client) RecordPlaybackView(stat PlaybackStat) error {
+	query := `
+	INSERT INTO playback_stats (video_id, day, country, network, views)
+	VALUES (?, ?, ?, ?, 1)
+	ON CONFLICT(video_id, day, country, network) DO UPDATE SET
+		views = views + 1
+	`
+	_, err := c.db.Exec(query, stat.VideoID, stat.Day, stat.Country, stat.Network)
+	return err
+}
+
+// GetPlaybackStats returns every count for the video, oldest day first.
+func (c Client) GetPlaybackStats(videoID uuid.UUID) ([]PlaybackStat, error) {
+	query := `
+	SELECT video_id, day, country, network, views
+	FROM playback_stats
+	WHERE video_id = ?
+	ORDER BY day ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []PlaybackStat{}
+	for rows.Next() {
+		var stat PlaybackStat
+		if err := rows.Scan(&stat.VideoID, &stat.Day, &stat.Country, &stat.Network, &stat.Views); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
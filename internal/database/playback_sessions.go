@@ -0,0 +1,78 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PlaybackSession struct {
+	CreatePlaybackSessionParams
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreatePlaybackSessionParams struct {
+	Token     string    `json:"token"`
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	DeviceID  string    `json:"device_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (c Client) CreatePlaybackSession(params CreatePlaybackSessionParams) (PlaybackSession, error) {
+	query := `
+		INSERT INTO playback_sessions (
+			token,
+			created_at,
+			video_id,
+			user_id,
+			device_id,
+			expires_at
+		) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, params.Token, params.VideoID.String(), params.UserID.String(), params.DeviceID, params.ExpiresAt)
+	if err != nil {
+		return PlaybackSession{}, err
+	}
+
+	return c.GetPlaybackSession(params.Token)
+}
+
+func (c Client) GetPlaybackSession(token string) (PlaybackSession, error) {
+	query := `
+		SELECT token, created_at, video_id, user_id, device_id, expires_at
+		FROM playback_sessions
+		WHERE token = ?
+	`
+	var s PlaybackSession
+	var videoID, userID string
+	err := c.db.QueryRow(query, token).
+		Scan(&s.Token, &s.CreatedAt, &videoID, &userID, &s.DeviceID, &s.ExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return PlaybackSession{}, nil
+		}
+		return PlaybackSession{}, err
+	}
+
+	s.VideoID, err = uuid.Parse(videoID)
+	if err != nil {
+		return PlaybackSession{}, err
+	}
+	s.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return PlaybackSession{}, err
+	}
+
+	return s, nil
+}
+
+// DeleteExpiredPlaybackSessions removes sessions that expired before cutoff.
+func (c Client) DeleteExpiredPlaybackSessions(cutoff time.Time) (int64, error) {
+	result, err := c.db.Exec("DELETE FROM playback_sessions WHERE expires_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
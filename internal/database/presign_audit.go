@@ -0,0 +1,33 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CreatePresignAuditParams struct {
+	// who asked: a token fingerprint for API requests, or the name of the
+	// background job
+	Requester string
+	UserID    *uuid.UUID
+	VideoID   *uuid.UUID
+	ObjectKey string
+	ExpiresAt time.Time
+}
+
+func (c Client) CreatePresignAudit(params CreatePresignAuditParams) error {
+	query := `
+	INSERT INTO presign_audit (
+		id,
+		created_at,
+		requester,
+		user_id,
+		video_id,
+		object_key,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, uuid.New(), params.Requester, params.UserID, params.VideoID, params.ObjectKey, params.ExpiresAt)
+	return err
+}
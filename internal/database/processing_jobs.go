@@ -0,0 +1,103 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ProcessingJobStatus string
+
+const (
+	ProcessingJobStatusProcessing ProcessingJobStatus = "processing"
+	ProcessingJobStatusReady      ProcessingJobStatus = "ready"
+	ProcessingJobStatusFailed     ProcessingJobStatus = "failed"
+)
+
+// ProcessingJob is an upload being processed after its request returned.
+type ProcessingJob struct {
+	ID        uuid.UUID           `json:"id"`
+	CreatedAt time.Time           `json:"created_at"`
+	UpdatedAt time.Time           `json:"updated_at"`
+	UserID    uuid.UUID           `json:"user_id"`
+	VideoID   uuid.UUID           `json:"video_id"`
+	Status    ProcessingJobStatus `json:"status"`
+	Error     string              `json:"error,omitempty"`
+	// whether sending the upload again may work
+	Retryable bool `json:"retryable"`
+}
+
+const processingJobColumns = `id, created_at, updated_at, user_id, video_id, status, error, retryable`
+
+func scanProcessingJob(row interface{ Scan(...any) error }) (ProcessingJob, error) {
+	var job ProcessingJob
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.UserID,
+		&job.VideoID,
+		&job.Status,
+		&job.Error,
+		&job.Retryable,
+	)
+	return job, err
+}
+
+func (c Client) CreateProcessingJob(userID, videoID uuid.UUID) (ProcessingJob, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO processing_jobs (
+		id,
+		created_at,
+		updated_at,
+		user_id,
+		video_id,
+		status,
+		error,
+		retryable
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, '', FALSE)
+	`
+	_, err := c.db.Exec(query, id, userID, videoID, ProcessingJobStatusProcessing)
+	if err != nil {
+		return ProcessingJob{}, err
+	}
+	return c.GetProcessingJob(id)
+}
+
+// GetProcessingJob returns an empty ProcessingJob if there is none with the
+// ID.
+func (c Client) GetProcessingJob(id uuid.UUID) (ProcessingJob, error) {
+	query := `
+	SELECT ` + processingJobColumns + `
+	FROM processing_jobs
+	WHERE id = ?
+	`
+	job, err := scanProcessingJob(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ProcessingJob{}, nil
+	}
+	return job, err
+}
+
+func (c Client) UpdateProcessingJob(job ProcessingJob) error {
+	query := `
+	UPDATE processing_jobs
+	SET
+		updated_at = CURRENT_TIMESTAMP,
+		status = ?,
+		error = ?,
+		retryable = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, job.Status, job.Error, job.Retryable, job.ID)
+	return err
+}
+
+// DeleteProcessingJobsBefore drops finished jobs last updated before t.
+func (c Client) DeleteProcessingJobsBefore(t time.Time) error {
+	_, err := c.db.Exec("DELETE FROM processing_jobs WHERE status != ? AND updated_at < ?", ProcessingJobStatusProcessing, t.UTC())
+	return err
+}
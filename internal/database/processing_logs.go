@@ -0,0 +1,116 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ProcessingLogKind string
+
+const (
+	// a pipeline stage, with how long it took
+	ProcessingLogKindStage ProcessingLogKind = "stage"
+	// an ffmpeg or ffprobe run, with what it printed
+	ProcessingLogKindCommand ProcessingLogKind = "command"
+)
+
+// ProcessingLogEntry is one step of processing an upload of a video. The
+// entries of one upload share a RunID.
+type ProcessingLogEntry struct {
+	ID         uuid.UUID         `json:"id"`
+	VideoID    uuid.UUID         `json:"video_id"`
+	RunID      uuid.UUID         `json:"run_id"`
+	StartedAt  time.Time         `json:"started_at"`
+	DurationMS int64             `json:"duration_ms"`
+	Kind       ProcessingLogKind `json:"kind"`
+	// the stage or the command
+	Name   string `json:"name"`
+	Args   string `json:"args,omitempty"`
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+const processingLogColumns = `id, video_id, run_id, started_at, duration_ms, kind, name, args, stdout, stderr, error`
+
+func scanProcessingLogEntry(row interface{ Scan(...any) error }) (ProcessingLogEntry, error) {
+	var entry ProcessingLogEntry
+	err := row.Scan(
+		&entry.ID,
+		&entry.VideoID,
+		&entry.RunID,
+		&entry.StartedAt,
+		&entry.DurationMS,
+		&entry.Kind,
+		&entry.Name,
+		&entry.Args,
+		&entry.Stdout,
+		&entry.Stderr,
+		&entry.Error,
+	)
+	return entry, err
+}
+
+func (c Client) CreateProcessingLogEntry(entry ProcessingLogEntry) error {
+	query := `
+	INSERT INTO processing_logs (` + processingLogColumns + `)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query,
+		uuid.New(),
+		entry.VideoID,
+		entry.RunID,
+		entry.StartedAt.UTC(),
+		entry.DurationMS,
+		entry.Kind,
+		entry.Name,
+		entry.Args,
+		entry.Stdout,
+		entry.Stderr,
+		entry.Error,
+	)
+	return err
+}
+
+// GetProcessingLog returns the entries of every kept run for the video, in
+// the order they started.
+func (c Client) GetProcessingLog(videoID uuid.UUID) ([]ProcessingLogEntry, error) {
+	query := `
+	SELECT ` + processingLogColumns + `
+	FROM processing_logs
+	WHERE video_id = ?
+	ORDER BY started_at ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ProcessingLogEntry{}
+	for rows.Next() {
+		entry, err := scanProcessingLogEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// PruneProcessingLog deletes all but the keep most recent runs of the video.
+func (c Client) PruneProcessingLog(videoID uuid.UUID, keep int) error {
+	query := `
+	DELETE FROM processing_logs
+	WHERE video_id = ? AND run_id NOT IN (
+		SELECT run_id FROM processing_logs
+		WHERE video_id = ?
+		GROUP BY run_id
+		ORDER BY MIN(started_at) DESC
+		LIMIT ?
+	)
+	`
+	_, err := c.db.Exec(query, videoID, videoID, keep)
+	return err
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type RetentionAction string
+
+const (
+	// move the video object to Glacier
+	RetentionActionArchive RetentionAction = "archive"
+	// delete the video record
+	RetentionActionDelete RetentionAction = "delete"
+)
+
+type RetentionUploadState string
+
+const (
+	RetentionUploadComplete RetentionUploadState = "complete"
+	// the video record was created but no upload ever finished
+	RetentionUploadFailed RetentionUploadState = "failed"
+)
+
+type RetentionRule struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateRetentionRuleParams
+}
+
+type CreateRetentionRuleParams struct {
+	Name string `json:"name"`
+	// empty matches every visibility
+	Visibility  VideoVisibility      `json:"visibility"`
+	UploadState RetentionUploadState `json:"upload_state"`
+	MinAgeDays  int                  `json:"min_age_days"`
+	Action      RetentionAction      `json:"action"`
+}
+
+func (c Client) CreateRetentionRule(params CreateRetentionRuleParams) (RetentionRule, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO retention_rules (
+		id,
+		created_at,
+		name,
+		visibility,
+		upload_state,
+		min_age_days,
+		action
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.Name, params.Visibility, params.UploadState, params.MinAgeDays, params.Action)
+	if err != nil {
+		return RetentionRule{}, err
+	}
+
+	query = `
+	SELECT ` + retentionRuleColumns + `
+	FROM retention_rules
+	WHERE id = ?
+	`
+	return scanRetentionRule(c.db.QueryRow(query, id))
+}
+
+const retentionRuleColumns = `id, created_at, name, visibility, upload_state, min_age_days, action`
+
+func scanRetentionRule(row interface{ Scan(...any) error }) (RetentionRule, error) {
+	var rule RetentionRule
+	err := row.Scan(&rule.ID, &rule.CreatedAt, &rule.Name, &rule.Visibility, &rule.UploadState, &rule.MinAgeDays, &rule.Action)
+	return rule, err
+}
+
+func (c Client) GetRetentionRules() ([]RetentionRule, error) {
+	query := `
+	SELECT ` + retentionRuleColumns + `
+	FROM retention_rules
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []RetentionRule{}
+	for rows.Next() {
+		rule, err := scanRetentionRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// DeleteRetentionRule reports whether a rule with the ID existed.
+func (c Client) DeleteRetentionRule(id uuid.UUID) (bool, error) {
+	result, err := c.db.Exec("DELETE FROM retention_rules WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetRetentionCandidates returns the videos a rule applies to at now,
+// leaving out exempt videos and ones the rule already handled.
+func (c Client) GetRetentionCandidates(rule RetentionRule, now time.Time) ([]Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	WHERE retention_exempt = FALSE
+		AND created_at < ?
+		AND (? = '' OR visibility = ?)
+	`
+	if rule.UploadState == RetentionUploadFailed {
+		query += " AND video_url IS NULL"
+	} else {
+		query += " AND video_url IS NOT NULL"
+	}
+	if rule.Action == RetentionActionArchive {
+		query += " AND archived_at IS NULL"
+	}
+	query += " ORDER BY created_at ASC"
+
+	cutoff := now.UTC().AddDate(0, 0, -rule.MinAgeDays).Truncate(time.Second)
+	return c.queryVideos(query, cutoff, rule.Visibility, rule.Visibility)
+}
+
+// SetVideoRetentionExempt keeps retention rules away from a video, or lets
+// them apply again.
+func (c Client) SetVideoRetentionExempt(id uuid.UUID, exempt bool) error {
+	_, err := c.db.Exec("UPDATE videos SET retention_exempt = ? WHERE id = ?", exempt, id)
+	return err
+}
+
+func (c Client) GetRetentionExemptVideos() ([]Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	WHERE retention_exempt = TRUE
+	ORDER BY created_at ASC
+	`
+	return c.queryVideos(query)
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReviewLink lets the owner, or one reviewer, watch a video before it's
+// public. Like an embed token, the link's token is a signature over the row,
+// so only the ID is stored.
+type ReviewLink struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	VideoID   uuid.UUID `json:"video_id"`
+	// the one user besides the owner who can use it; nil for owner-only links
+	ReviewerID   *uuid.UUID `json:"reviewer_id"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	Views        int64      `json:"views"`
+	LastViewedAt *time.Time `json:"last_viewed_at"`
+}
+
+const reviewLinkColumns = `id, created_at, video_id, reviewer_id, expires_at, views, last_viewed_at`
+
+func scanReviewLink(row interface{ Scan(...any) error }) (ReviewLink, error) {
+	var link ReviewLink
+	var reviewerID uuid.NullUUID
+	var expiresAt, lastViewedAt sql.NullTime
+	err := row.Scan(
+		&link.ID,
+		&link.CreatedAt,
+		&link.VideoID,
+		&reviewerID,
+		&expiresAt,
+		&link.Views,
+		&lastViewedAt,
+	)
+	if reviewerID.Valid {
+		link.ReviewerID = &reviewerID.UUID
+	}
+	if expiresAt.Valid {
+		link.ExpiresAt = &expiresAt.Time
+	}
+	if lastViewedAt.Valid {
+		link.LastViewedAt = &lastViewedAt.Time
+	}
+	return link, err
+}
+
+type CreateReviewLinkParams struct {
+	VideoID    uuid.UUID
+	ReviewerID *uuid.UUID
+	ExpiresAt  *time.Time
+}
+
+func (c Client) CreateReviewLink(params CreateReviewLinkParams) (ReviewLink, error) {
+	id := uuid.New()
+	var expiresAt *time.Time
+	if params.ExpiresAt != nil {
+		t := params.ExpiresAt.UTC()
+		expiresAt = &t
+	}
+	query := `
+	INSERT INTO review_links (id, created_at, video_id, reviewer_id, expires_at)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.ReviewerID, expiresAt)
+	if err != nil {
+		return ReviewLink{}, err
+	}
+	return c.GetReviewLink(id)
+}
+
+// GetReviewLink returns an empty ReviewLink if there is none with the ID.
+func (c Client) GetReviewLink(id uuid.UUID) (ReviewLink, error) {
+	query := `
+	SELECT ` + reviewLinkColumns + `
+	FROM review_links
+	WHERE id = ?
+	`
+	link, err := scanReviewLink(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReviewLink{}, nil
+	}
+	return link, err
+}
+
+func (c Client) GetReviewLinks(videoID uuid.UUID) ([]ReviewLink, error) {
+	query := `
+	SELECT ` + reviewLinkColumns + `
+	FROM review_links
+	WHERE video_id = ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []ReviewLink{}
+	for rows.Next() {
+		link, err := scanReviewLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// RecordReviewLinkView counts a view through the link.
+func (c Client) RecordReviewLinkView(id uuid.UUID, at time.Time) error {
+	_, err := c.db.Exec("UPDATE review_links SET views = views + 1, last_viewed_at = ? WHERE id = ?", at.UTC(), id)
+	return err
+}
+
+// DeleteReviewLink revokes the link.
+func (c Client) DeleteReviewLink(videoID, id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM review_links WHERE video_id = ? AND id = ?", videoID, id)
+	return err
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"time"
+)
+
+// SigningKey is a generated JWT signing secret, shared by every server
+// through the database.
+type SigningKey struct {
+	ID        string
+	CreatedAt time.Time
+	Secret    string
+}
+
+func (c Client) CreateSigningKey(key SigningKey) error {
+	query := `
+	INSERT INTO signing_keys (id, created_at, secret)
+	VALUES (?, ?, ?)
+	`
+	_, err := c.db.Exec(query, key.ID, key.CreatedAt.UTC(), key.Secret)
+	return err
+}
+
+// GetSigningKeys returns every key, newest first.
+func (c Client) GetSigningKeys() ([]SigningKey, error) {
+	query := `
+	SELECT id, created_at, secret
+	FROM signing_keys
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []SigningKey{}
+	for rows.Next() {
+		var key SigningKey
+		if err := rows.Scan(&key.ID, &key.CreatedAt, &key.Secret); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (c Client) DeleteSigningKey(id string) error {
+	_, err := c.db.Exec("DELETE FROM signing_keys WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type StitchClipKind string
+
+const (
+	StitchClipIntro StitchClipKind = "intro"
+	StitchClipOutro StitchClipKind = "outro"
+)
+
+type StitchClip struct {
+	UserID    uuid.UUID      `json:"user_id"`
+	Kind      StitchClipKind `json:"kind"`
+	Key       string         `json:"key"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+func (c Client) SetStitchClip(userID uuid.UUID, kind StitchClipKind, key string) error {
+	query := `
+	INSERT INTO stitch_clips (user_id, kind, key, updated_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(user_id, kind) DO UPDATE SET
+		key = excluded.key,
+		updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := c.db.Exec(query, userID, kind, key)
+	return err
+}
+
+func (c Client) GetStitchClips(userID uuid.UUID) ([]StitchClip, error) {
+	query := `
+	SELECT user_id, kind, key, updated_at
+	FROM stitch_clips
+	WHERE user_id = ?
+	`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clips := []StitchClip{}
+	for rows.Next() {
+		var clip StitchClip
+		if err := rows.Scan(&clip.UserID, &clip.Kind, &clip.Key, &clip.UpdatedAt); err != nil {
+			return nil, err
+		}
+		clips = append(clips, clip)
+	}
+	return clips, rows.Err()
+}
+
+func (c Client) DeleteStitchClip(userID uuid.UUID, kind StitchClipKind) error {
+	query := `
+	DELETE FROM stitch_clips
+	WHERE user_id = ? AND kind = ?
+	`
+	_, err := c.db.Exec(query, userID, kind)
+	return err
+}
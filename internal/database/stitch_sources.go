@@ -0,0 +1,47 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// StitchSource is the upload a video was last stitched from, kept so that
+// stitching it again starts over from that rather than from the result.
+type StitchSource struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// where the unstitched upload is kept, in the video's bucket
+	Key string `json:"key"`
+	// upload_sha256 the video had once stitched; anything else means it was
+	// uploaded again since
+	StitchedSHA256 string `json:"stitched_sha256"`
+}
+
+// GetStitchSource returns the video's stitch source, or an empty one if it
+// was never stitched.
+func (c Client) GetStitchSource(videoID uuid.UUID) (StitchSource, error) {
+	query := `
+	SELECT video_id, key, stitched_sha256
+	FROM stitch_sources
+	WHERE video_id = ?
+	`
+	var source StitchSource
+	err := c.db.QueryRow(query, videoID).Scan(&source.VideoID, &source.Key, &source.StitchedSHA256)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StitchSource{}, nil
+	}
+	return source, err
+}
+
+func (c Client) SetStitchSource(source StitchSource) error {
+	query := `
+	INSERT INTO stitch_sources (video_id, key, stitched_sha256)
+	VALUES (?, ?, ?)
+	ON CONFLICT(video_id) DO UPDATE SET
+		key = excluded.key,
+		stitched_sha256 = excluded.stitched_sha256
+	`
+	_, err := c.db.Exec(query, source.VideoID, source.Key, source.StitchedSHA256)
+	return err
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ThumbnailVariant is a video's thumbnail scaled to one width and encoded in
+// one format, stored as an asset like the thumbnail itself.
+type ThumbnailVariant struct {
+	ID        uuid.UUID `json:"-"`
+	CreatedAt time.Time `json:"-"`
+	VideoID   uuid.UUID `json:"-"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	// "jpeg" or "webp"
+	Format string `json:"format"`
+	URL    string `json:"url"`
+}
+
+const thumbnailVariantColumns = `id, created_at, video_id, width, height, format, url`
+
+// GetThumbnailVariants returns the video's variants, smallest first.
+func (c Client) GetThumbnailVariants(videoID uuid.UUID) ([]ThumbnailVariant, error) {
+	query := `
+	SELECT ` + thumbnailVariantColumns + `
+	FROM thumbnail_variants
+	WHERE video_id = ?
+	ORDER BY width ASC, format ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []ThumbnailVariant{}
+	for rows.Next() {
+		var variant ThumbnailVariant
+		err := rows.Scan(
+			&variant.ID,
+			&variant.CreatedAt,
+			&variant.VideoID,
+			&variant.Width,
+			&variant.Height,
+			&variant.Format,
+			&variant.URL,
+		)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+	return variants, rows.Err()
+}
+
+// ReplaceThumbnailVariants swaps the video's variants for variants, which
+// may be empty, and returns the ones it dropped so their files can go.
+func (c Client) ReplaceThumbnailVariants(videoID uuid.UUID, variants []ThumbnailVariant) ([]ThumbnailVariant, error) {
+	old, err := c.GetThumbnailVariants(videoID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM thumbnail_variants WHERE video_id = ?", videoID); err != nil {
+		return nil, err
+	}
+	query := `
+	INSERT INTO thumbnail_variants (` + thumbnailVariantColumns + `)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	for _, variant := range variants {
+		_, err := tx.Exec(query,
+			uuid.New(),
+			videoID,
+			variant.Width,
+			variant.Height,
+			variant.Format,
+			variant.URL,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return old, tx.Commit()
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TranscoderJob is a finished job of an external transcoder that reported
+// back, kept so a repeated callback for it is only applied once.
+type TranscoderJob struct {
+	// the transcoder's own job ID
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"received_at"`
+	VideoID    uuid.UUID `json:"video_id"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// CreateTranscoderJob records a job's callback, reporting false if the job
+// was already recorded.
+func (c Client) CreateTranscoderJob(job TranscoderJob) (bool, error) {
+	query := `
+	INSERT INTO transcoder_jobs (id, received_at, video_id, status, error)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	ON CONFLICT(id) DO NOTHING
+	`
+	result, err := c.db.Exec(query, job.ID, job.VideoID, job.Status, job.Error)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteTranscoderJob forgets a job, so its callback can be applied when
+// it's sent again.
+func (c Client) DeleteTranscoderJob(id string) error {
+	_, err := c.db.Exec("DELETE FROM transcoder_jobs WHERE id = ?", id)
+	return err
+}
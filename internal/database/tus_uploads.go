@@ -0,0 +1,109 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TusUpload is a resumable upload in progress. Offset is how many bytes of
+// Length have been received so far.
+type TusUpload struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Offset    int64     `json:"offset"`
+	CreateTusUploadParams
+}
+
+type CreateTusUploadParams struct {
+	UserID   uuid.UUID `json:"user_id"`
+	VideoID  uuid.UUID `json:"video_id"`
+	Length   int64     `json:"length"`
+	Filename string    `json:"filename"`
+}
+
+const tusUploadColumns = `id, created_at, updated_at, upload_offset, user_id, video_id, length, filename`
+
+func scanTusUpload(row interface{ Scan(...any) error }) (TusUpload, error) {
+	var upload TusUpload
+	err := row.Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&upload.Offset,
+		&upload.UserID,
+		&upload.VideoID,
+		&upload.Length,
+		&upload.Filename,
+	)
+	return upload, err
+}
+
+func (c Client) CreateTusUpload(params CreateTusUploadParams) (TusUpload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO tus_uploads (
+		id,
+		created_at,
+		updated_at,
+		upload_offset,
+		user_id,
+		video_id,
+		length,
+		filename
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 0, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.UserID, params.VideoID, params.Length, params.Filename)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	return c.GetTusUpload(id)
+}
+
+// GetTusUpload returns an empty TusUpload if there is none with the ID.
+func (c Client) GetTusUpload(id uuid.UUID) (TusUpload, error) {
+	query := `SELECT ` + tusUploadColumns + ` FROM tus_uploads WHERE id = ?`
+	upload, err := scanTusUpload(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return TusUpload{}, nil
+	}
+	return upload, err
+}
+
+func (c Client) SetTusUploadOffset(id uuid.UUID, offset int64) error {
+	query := `
+	UPDATE tus_uploads
+	SET upload_offset = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, offset, id)
+	return err
+}
+
+func (c Client) DeleteTusUpload(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM tus_uploads WHERE id = ?", id)
+	return err
+}
+
+// GetStaleTusUploads returns uploads that haven't received data since before.
+func (c Client) GetStaleTusUploads(before time.Time) ([]TusUpload, error) {
+	query := `SELECT ` + tusUploadColumns + ` FROM tus_uploads WHERE updated_at < ?`
+	rows, err := c.db.Query(query, before.UTC().Truncate(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []TusUpload{}
+	for rows.Next() {
+		upload, err := scanTusUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UploadPeriod string
+
+const (
+	UploadPeriodDay   UploadPeriod = "day"
+	UploadPeriodMonth UploadPeriod = "month"
+)
+
+// UploadCounter tallies what a user uploaded in one window of a period.
+type UploadCounter struct {
+	UserID   uuid.UUID    `json:"user_id"`
+	Period   UploadPeriod `json:"period"`
+	StartsAt time.Time    `json:"starts_at"`
+	Uploads  int          `json:"uploads"`
+	Bytes    int64        `json:"bytes"`
+}
+
+// GetUploadCounter returns the counter for the window starting at startsAt,
+// with zero counts if nothing was uploaded in it yet.
+func (c Client) GetUploadCounter(userID uuid.UUID, period UploadPeriod, startsAt time.Time) (UploadCounter, error) {
+	query := `
+	SELECT uploads, bytes
+	FROM upload_counters
+	WHERE user_id = ? AND period = ? AND starts_at = ?
+	`
+	counter := UploadCounter{
+		UserID:   userID,
+		Period:   period,
+		StartsAt: startsAt,
+	}
+	err := c.db.QueryRow(query, userID, period, startsAt.UTC()).Scan(&counter.Uploads, &counter.Bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return counter, nil
+	}
+	return counter, err
+}
+
+// AddUploadCounter counts one upload of size bytes in the window starting
+// at startsAt.
+func (c Client) AddUploadCounter(userID uuid.UUID, period UploadPeriod, startsAt time.Time, size int64) error {
+	query := `
+	INSERT INTO upload_counters (user_id, period, starts_at, uploads, bytes)
+	VALUES (?, ?, ?, 1, ?)
+	ON CONFLICT(user_id, period, starts_at) DO UPDATE SET
+		uploads = uploads + 1,
+		bytes = bytes + excluded.bytes
+	`
+	_, err := c.db.Exec(query, userID, period, startsAt.UTC(), size)
+	return err
+}
+
+// DeleteUploadCountersBefore drops counters for windows that started before
+// t, which no longer limit anything.
+func (c Client) DeleteUploadCountersBefore(t time.Time) error {
+	_, err := c.db.Exec("DELETE FROM upload_counters WHERE starts_at < ?", t.UTC())
+	return err
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserBucket is a customer's own bucket that their uploads are stored in,
+// reached by assuming a role in their account.
+type UserBucket struct {
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Bucket    string    `json:"bucket"`
+	Region    string    `json:"region"`
+	RoleARN   string    `json:"role_arn"`
+	// the customer's trust policy requires it, so nobody else can make us
+	// assume their role
+	ExternalID string `json:"-"`
+}
+
+// SetUserBucket registers a bucket for a user, replacing any earlier one.
+func (c Client) SetUserBucket(bucket UserBucket) error {
+	query := `
+	INSERT INTO user_buckets (user_id, created_at, bucket, region, role_arn, external_id)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		created_at = CURRENT_TIMESTAMP,
+		bucket = excluded.bucket,
+		region = excluded.region,
+		role_arn = excluded.role_arn,
+		external_id = excluded.external_id
+	`
+	_, err := c.db.Exec(query, bucket.UserID, bucket.Bucket, bucket.Region, bucket.RoleARN, bucket.ExternalID)
+	return err
+}
+
+// GetUserBucket returns an empty UserBucket if the user stores in ours.
+func (c Client) GetUserBucket(userID uuid.UUID) (UserBucket, error) {
+	query := `
+	SELECT user_id, created_at, bucket, region, role_arn, external_id
+	FROM user_buckets
+	WHERE user_id = ?
+	`
+	var bucket UserBucket
+	err := c.db.QueryRow(query, userID).Scan(
+		&bucket.UserID,
+		&bucket.CreatedAt,
+		&bucket.Bucket,
+		&bucket.Region,
+		&bucket.RoleARN,
+		&bucket.ExternalID,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserBucket{}, nil
+	}
+	return bucket, err
+}
+
+func (c Client) DeleteUserBucket(userID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM user_buckets WHERE user_id = ?", userID)
+	return err
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type VideoArchiveStatus string
+
+const (
+	VideoArchiveStatusPending VideoArchiveStatus = "pending"
+	VideoArchiveStatusReady   VideoArchiveStatus = "ready"
+	VideoArchiveStatusFailed  VideoArchiveStatus = "failed"
+)
+
+// VideoArchive is a zip of several videos built in the background and kept
+// in S3 until it expires.
+type VideoArchive struct {
+	ID        uuid.UUID          `json:"id"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	Status    VideoArchiveStatus `json:"status"`
+	// the zip's size once it's ready
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+	CreateVideoArchiveParams
+}
+
+type CreateVideoArchiveParams struct {
+	UserID     uuid.UUID `json:"user_id"`
+	Key        string    `json:"-"`
+	VideoCount int       `json:"video_count"`
+	// the archive and its object are dropped then, whether or not it was
+	// downloaded
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const videoArchiveColumns = `id, created_at, updated_at, status, size, error, user_id, key, video_count, expires_at`
+
+func scanVideoArchive(row interface{ Scan(...any) error }) (VideoArchive, error) {
+	var archive VideoArchive
+	err := row.Scan(
+		&archive.ID,
+		&archive.CreatedAt,
+		&archive.UpdatedAt,
+		&archive.Status,
+		&archive.Size,
+		&archive.Error,
+		&archive.UserID,
+		&archive.Key,
+		&archive.VideoCount,
+		&archive.ExpiresAt,
+	)
+	return archive, err
+}
+
+func (c Client) CreateVideoArchive(params CreateVideoArchiveParams) (VideoArchive, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO video_archives (
+		id,
+		created_at,
+		updated_at,
+		status,
+		size,
+		error,
+		user_id,
+		key,
+		video_count,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, 0, '', ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, VideoArchiveStatusPending, params.UserID, params.Key, params.VideoCount, params.ExpiresAt.UTC())
+	if err != nil {
+		return VideoArchive{}, err
+	}
+	return c.GetVideoArchive(id)
+}
+
+// GetVideoArchive returns an empty VideoArchive if there is none with the ID.
+func (c Client) GetVideoArchive(id uuid.UUID) (VideoArchive, error) {
+	query := `
+	SELECT ` + videoArchiveColumns + `
+	FROM video_archives
+	WHERE id = ?
+	`
+	archive, err := scanVideoArchive(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoArchive{}, nil
+	}
+	return archive, err
+}
+
+// GetExpiredVideoArchives returns archives whose expiry passed before now.
+func (c Client) GetExpiredVideoArchives(now time.Time) ([]VideoArchive, error) {
+	query := `
+	SELECT ` + videoArchiveColumns + `
+	FROM video_archives
+	WHERE expires_at < ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	archives := []VideoArchive{}
+	for rows.Next() {
+		archive, err := scanVideoArchive(rows)
+		if err != nil {
+			return nil, err
+		}
+		archives = append(archives, archive)
+	}
+	return archives, rows.Err()
+}
+
+func (c Client) UpdateVideoArchive(archive VideoArchive) error {
+	query := `
+	UPDATE video_archives
+	SET
+		updated_at = CURRENT_TIMESTAMP,
+		status = ?,
+		size = ?,
+		error = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, archive.Status, archive.Size, archive.Error, archive.ID)
+	return err
+}
+
+func (c Client) DeleteVideoArchive(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_archives WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoCaption is a WebVTT subtitle track of a video in one language,
+// stored in its owner's bucket. Captions belong to the video rather than an
+// upload, so they're kept through re-uploads.
+type VideoCaption struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	VideoID   uuid.UUID `json:"video_id"`
+	// a BCP 47 language tag, e.g. "en" or "pt-BR"; a video has one track
+	// per language
+	Language string `json:"language"`
+	// what players show in their caption menu
+	Label string `json:"label"`
+	Key   string `json:"key"`
+	// made from the video's transcript rather than uploaded
+	Generated bool `json:"generated"`
+}
+
+const videoCaptionColumns = `id, created_at, video_id, language, label, key, generated`
+
+func scanVideoCaption(row interface{ Scan(...any) error }) (VideoCaption, error) {
+	var caption VideoCaption
+	err := row.Scan(
+		&caption.ID,
+		&caption.CreatedAt,
+		&caption.VideoID,
+		&caption.Language,
+		&caption.Label,
+		&caption.Key,
+		&caption.Generated,
+	)
+	return caption, err
+}
+
+// SaveVideoCaption stores a caption track, replacing the video's track in
+// the same language, and returns the track the video ends up with. A
+// generated track doesn't replace an uploaded one.
+func (c Client) SaveVideoCaption(caption VideoCaption) (VideoCaption, error) {
+	query := `
+	INSERT INTO video_captions (` + videoCaptionColumns + `)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	ON CONFLICT(video_id, language) DO UPDATE SET
+		created_at = CURRENT_TIMESTAMP,
+		label = excluded.label,
+		key = excluded.key,
+		generated = excluded.generated
+	WHERE video_captions.generated = 1 OR excluded.generated = 0
+	`
+	_, err := c.db.Exec(query,
+		uuid.New(),
+		caption.VideoID,
+		caption.Language,
+		caption.Label,
+		caption.Key,
+		caption.Generated,
+	)
+	if err != nil {
+		return VideoCaption{}, err
+	}
+	return c.GetVideoCaption(caption.VideoID, caption.Language)
+}
+
+// GetVideoCaption returns an empty VideoCaption if the video has no track in
+// the language.
+func (c Client) GetVideoCaption(videoID uuid.UUID, language string) (VideoCaption, error) {
+	query := `
+	SELECT ` + videoCaptionColumns + `
+	FROM video_captions
+	WHERE video_id = ? AND language = ?
+	`
+	caption, err := scanVideoCaption(c.db.QueryRow(query, videoID, language))
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoCaption{}, nil
+	}
+	return caption, err
+}
+
+// GetVideoCaptions returns the video's caption tracks by language.
+func (c Client) GetVideoCaptions(videoID uuid.UUID) ([]VideoCaption, error) {
+	query := `
+	SELECT ` + videoCaptionColumns + `
+	FROM video_captions
+	WHERE video_id = ?
+	ORDER BY language ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	captions := []VideoCaption{}
+	for rows.Next() {
+		caption, err := scanVideoCaption(rows)
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, caption)
+	}
+	return captions, rows.Err()
+}
+
+func (c Client) DeleteVideoCaption(videoID uuid.UUID, language string) error {
+	_, err := c.db.Exec("DELETE FROM video_captions WHERE video_id = ? AND language = ?", videoID, language)
+	return err
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type VideoRole string
+
+const (
+	// can watch the video, even while it's private or before its premiere
+	VideoRoleViewer VideoRole = "viewer"
+	// can also upload to it and change its settings
+	VideoRoleEditor VideoRole = "editor"
+)
+
+// VideoCollaborator is a user the owner shared a video with.
+type VideoCollaborator struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      VideoRole `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SetVideoCollaborator adds the user to the video, or changes their role.
+func (c Client) SetVideoCollaborator(videoID, userID uuid.UUID, role VideoRole) error {
+	query := `
+	INSERT INTO video_collaborators (video_id, user_id, role, created_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(video_id, user_id) DO UPDATE SET
+		role = excluded.role
+	`
+	_, err := c.db.Exec(query, videoID, userID, role)
+	return err
+}
+
+// GetVideoRole returns the user's role on the video, or "" if they aren't a
+// collaborator.
+func (c Client) GetVideoRole(videoID, userID uuid.UUID) (VideoRole, error) {
+	var role VideoRole
+	err := c.db.QueryRow("SELECT role FROM video_collaborators WHERE video_id = ? AND user_id = ?", videoID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+func (c Client) GetVideoCollaborators(videoID uuid.UUID) ([]VideoCollaborator, error) {
+	query := `
+	SELECT c.video_id, c.user_id, u.email, c.role, c.created_at
+	FROM video_collaborators c
+	JOIN users u ON u.id = c.user_id
+	WHERE c.video_id = ?
+	ORDER BY c.created_at ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collaborators := []VideoCollaborator{}
+	for rows.Next() {
+		var collaborator VideoCollaborator
+		if err := rows.Scan(
+			&collaborator.VideoID,
+			&collaborator.UserID,
+			&collaborator.Email,
+			&collaborator.Role,
+			&collaborator.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		collaborators = append(collaborators, collaborator)
+	}
+	return collaborators, rows.Err()
+}
+
+func (c Client) DeleteVideoCollaborator(videoID, userID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_collaborators WHERE video_id = ? AND user_id = ?", videoID, userID)
+	return err
+}
+
+// TransferVideo makes newOwnerID the video's owner. The new owner stops
+// being a collaborator; the previous one becomes one with previousOwnerRole,
+// unless it's "".
+func (c Client) TransferVideo(videoID, newOwnerID uuid.UUID, previousOwnerRole VideoRole) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previousOwnerID uuid.UUID
+	if err := tx.QueryRow("SELECT user_id FROM videos WHERE id = ?", videoID).Scan(&previousOwnerID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE videos SET user_id = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", newOwnerID, videoID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM video_collaborators WHERE video_id = ? AND user_id = ?", videoID, newOwnerID); err != nil {
+		return err
+	}
+	if previousOwnerRole != "" {
+		query := `
+		INSERT INTO video_collaborators (video_id, user_id, role, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		`
+		if _, err := tx.Exec(query, videoID, previousOwnerID, previousOwnerRole); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoMetadata is what ffprobe read of a video's current upload: its
+// container, first video stream and first audio stream.
+type VideoMetadata struct {
+	VideoID uuid.UUID `json:"-"`
+	// the upload it describes
+	Key      string    `json:"-"`
+	ProbedAt time.Time `json:"probed_at"`
+	// ffprobe's names for the container, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	Container string  `json:"container"`
+	Duration  float64 `json:"duration"`
+	// bits a second, over the whole file and for each stream; zero when the
+	// file doesn't say
+	Bitrate    int64  `json:"bitrate"`
+	VideoCodec string `json:"video_codec"`
+	// as displayed, so a portrait phone video stored as 1920x1080 with a
+	// quarter turn is 1080x1920
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// clockwise degrees players turn the stored frames by: 0, 90, 180 or
+	// 270
+	Rotation     int     `json:"rotation"`
+	FPS          float64 `json:"fps"`
+	VideoBitrate int64   `json:"video_bitrate"`
+	PixelFormat  string  `json:"pixel_format"`
+	// empty when the upload has no sound
+	AudioCodec      string `json:"audio_codec"`
+	AudioChannels   int    `json:"audio_channels"`
+	AudioSampleRate int    `json:"audio_sample_rate"`
+	AudioBitrate    int64  `json:"audio_bitrate"`
+}
+
+const videoMetadataColumns = `
+	video_id,
+	key,
+	probed_at,
+	container,
+	duration,
+	bitrate,
+	video_codec,
+	width,
+	height,
+	fps,
+	video_bitrate,
+	pixel_format,
+	audio_codec,
+	audio_channels,
+	audio_sample_rate,
+	audio_bitrate,
+	rotation
+`
+
+func scanVideoMetadata(row interface{ Scan(...any) error }) (VideoMetadata, error) {
+	var metadata VideoMetadata
+	err := row.Scan(
+		&metadata.VideoID,
+		&metadata.Key,
+		&metadata.ProbedAt,
+		&metadata.Container,
+		&metadata.Duration,
+		&metadata.Bitrate,
+		&metadata.VideoCodec,
+		&metadata.Width,
+		&metadata.Height,
+		&metadata.FPS,
+		&metadata.VideoBitrate,
+		&metadata.PixelFormat,
+		&metadata.AudioCodec,
+		&metadata.AudioChannels,
+		&metadata.AudioSampleRate,
+		&metadata.AudioBitrate,
+		&metadata.Rotation,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoMetadata{}, nil
+	}
+	return metadata, err
+}
+
+// SaveVideoMetadata stores the metadata of the video's current upload,
+// replacing what was stored for the one before.
+func (c Client) SaveVideoMetadata(metadata VideoMetadata) error {
+	query := `
+	INSERT INTO video_metadata (` + videoMetadataColumns + `)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(video_id) DO UPDATE SET
+		key = excluded.key,
+		probed_at = excluded.probed_at,
+		container = excluded.container,
+		duration = excluded.duration,
+		bitrate = excluded.bitrate,
+		video_codec = excluded.video_codec,
+		width = excluded.width,
+		height = excluded.height,
+		fps = excluded.fps,
+		video_bitrate = excluded.video_bitrate,
+		pixel_format = excluded.pixel_format,
+		audio_codec = excluded.audio_codec,
+		audio_channels = excluded.audio_channels,
+		audio_sample_rate = excluded.audio_sample_rate,
+		audio_bitrate = excluded.audio_bitrate,
+		rotation = excluded.rotation
+	`
+	_, err := c.db.Exec(query,
+		metadata.VideoID,
+		metadata.Key,
+		metadata.ProbedAt.UTC(),
+		metadata.Container,
+		metadata.Duration,
+		metadata.Bitrate,
+		metadata.VideoCodec,
+		metadata.Width,
+		metadata.Height,
+		metadata.FPS,
+		metadata.VideoBitrate,
+		metadata.PixelFormat,
+		metadata.AudioCodec,
+		metadata.AudioChannels,
+		metadata.AudioSampleRate,
+		metadata.AudioBitrate,
+		metadata.Rotation,
+	)
+	return err
+}
+
+// GetVideoMetadata returns the metadata of the video's current upload, or an
+// empty VideoMetadata if it hasn't been recorded.
+func (c Client) GetVideoMetadata(videoID uuid.UUID) (VideoMetadata, error) {
+	query := `
+	SELECT ` + videoMetadataColumns + `
+	FROM video_metadata
+	WHERE video_id = ?
+	`
+	return scanVideoMetadata(c.db.QueryRow(query, videoID))
+}
+
+// GetVideoMetadataForKey returns the metadata a video has recorded for the
+// upload at key, as duplicate uploads share one object, or an empty
+// VideoMetadata if none has.
+func (c Client) GetVideoMetadataForKey(key string) (VideoMetadata, error) {
+	query := `
+	SELECT ` + videoMetadataColumns + `
+	FROM video_metadata
+	WHERE key = ?
+	AND video_id IN (SELECT id FROM videos)
+	ORDER BY probed_at DESC
+	LIMIT 1
+	`
+	return scanVideoMetadata(c.db.QueryRow(query, key))
+}
+
+// DeleteVideoMetadata forgets the video's metadata, once it no longer
+// matches its upload.
+func (c Client) DeleteVideoMetadata(videoID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_metadata WHERE video_id = ?", videoID)
+	return err
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoRendition is an extra encoding of a video's current upload, such as
+// one quality of a resolution ladder, stored in the video's bucket.
+type VideoRendition struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	VideoID   uuid.UUID `json:"video_id"`
+	// what sets it apart, e.g. "720p"; a video has one rendition per name
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bitrate int64  `json:"bitrate"`
+}
+
+const videoRenditionColumns = `id, created_at, video_id, name, key, width, height, bitrate`
+
+func scanVideoRendition(row interface{ Scan(...any) error }) (VideoRendition, error) {
+	var rendition VideoRendition
+	err := row.Scan(
+		&rendition.ID,
+		&rendition.CreatedAt,
+		&rendition.VideoID,
+		&rendition.Name,
+		&rendition.Key,
+		&rendition.Width,
+		&rendition.Height,
+		&rendition.Bitrate,
+	)
+	return rendition, err
+}
+
+// SaveVideoRendition stores a rendition, replacing the video's rendition of
+// the same name.
+func (c Client) SaveVideoRendition(rendition VideoRendition) error {
+	query := `
+	INSERT INTO video_renditions (` + videoRenditionColumns + `)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(video_id, name) DO UPDATE SET
+		created_at = CURRENT_TIMESTAMP,
+		key = excluded.key,
+		width = excluded.width,
+		height = excluded.height,
+		bitrate = excluded.bitrate
+	`
+	_, err := c.db.Exec(query,
+		uuid.New(),
+		rendition.VideoID,
+		rendition.Name,
+		rendition.Key,
+		rendition.Width,
+		rendition.Height,
+		rendition.Bitrate,
+	)
+	return err
+}
+
+// GetVideoRenditions returns the video's renditions, highest first.
+func (c Client) GetVideoRenditions(videoID uuid.UUID) ([]VideoRendition, error) {
+	query := `
+	SELECT ` + videoRenditionColumns + `
+	FROM video_renditions
+	WHERE video_id = ?
+	ORDER BY height DESC, bitrate DESC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	renditions := []VideoRendition{}
+	for rows.Next() {
+		rendition, err := scanVideoRendition(rows)
+		if err != nil {
+			return nil, err
+		}
+		renditions = append(renditions, rendition)
+	}
+	return renditions, rows.Err()
+}
+
+// DeleteVideoRenditions forgets the video's renditions, once they no longer
+// match its upload.
+func (c Client) DeleteVideoRenditions(videoID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_renditions WHERE video_id = ?", videoID)
+	return err
+}
+
+// GetVideoRenditionsUnder returns the renditions videos have recorded with a
+// key under prefix, one per name, as duplicate uploads share one set of
+// objects.
+func (c Client) GetVideoRenditionsUnder(prefix string) ([]VideoRendition, error) {
+	query := `
+	SELECT ` + videoRenditionColumns + `
+	FROM video_renditions
+	WHERE substr(key, 1, length(?)) = ?
+	AND video_id IN (SELECT id FROM videos)
+	ORDER BY height DESC, bitrate DESC, created_at DESC
+	`
+	rows, err := c.db.Query(query, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	renditions := []VideoRendition{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		rendition, err := scanVideoRendition(rows)
+		if err != nil {
+			return nil, err
+		}
+		if seen[rendition.Name] {
+			continue
+		}
+		seen[rendition.Name] = true
+		renditions = append(renditions, rendition)
+	}
+	return renditions, rows.Err()
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoVersion is one stored upload of a video. S3VersionID is only set when
+// the bucket has versioning enabled.
+type VideoVersion struct {
+	ID          uuid.UUID `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	VideoID     uuid.UUID `json:"video_id"`
+	Key         string    `json:"key"`
+	S3VersionID *string   `json:"s3_version_id"`
+}
+
+func (c Client) CreateVideoVersion(videoID uuid.UUID, key string, s3VersionID *string) (VideoVersion, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO video_versions (
+		id,
+		created_at,
+		video_id,
+		key,
+		s3_version_id
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, videoID, key, s3VersionID)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+	return c.GetVideoVersion(id)
+}
+
+func (c Client) GetVideoVersion(id uuid.UUID) (VideoVersion, error) {
+	query := `
+	SELECT id, created_at, video_id, key, s3_version_id
+	FROM video_versions
+	WHERE id = ?
+	`
+	var v VideoVersion
+	err := c.db.QueryRow(query, id).Scan(&v.ID, &v.CreatedAt, &v.VideoID, &v.Key, &v.S3VersionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoVersion{}, nil
+		}
+		return VideoVersion{}, err
+	}
+	return v, nil
+}
+
+func (c Client) GetVideoVersions(videoID uuid.UUID) ([]VideoVersion, error) {
+	query := `
+	SELECT id, created_at, video_id, key, s3_version_id
+	FROM video_versions
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []VideoVersion{}
+	for rows.Next() {
+		var v VideoVersion
+		if err := rows.Scan(&v.ID, &v.CreatedAt, &v.VideoID, &v.Key, &v.S3VersionID); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// SetVideoVersionS3ID updates the S3 version recorded for every upload
+// stored at key, e.g. after the object was copied to a new bucket.
+func (c Client) SetVideoVersionS3ID(key string, s3VersionID *string) error {
+	_, err := c.db.Exec(`UPDATE video_versions SET s3_version_id = ? WHERE key = ?`, s3VersionID, key)
+	return err
+}
+
+// VideoVersionKeyShared reports whether a video other than videoID has an
+// upload stored at key, which byte-identical uploads share.
+func (c Client) VideoVersionKeyShared(videoID uuid.UUID, key string) (bool, error) {
+	var shared bool
+	err := c.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM video_versions WHERE key = ? AND video_id != ?)`, key, videoID).Scan(&shared)
+	return shared, err
+}
+
+// DeleteVideoVersionsByKey forgets the video's uploads stored at key, once
+// the object is gone.
+func (c Client) DeleteVideoVersionsByKey(videoID uuid.UUID, key string) error {
+	_, err := c.db.Exec(`DELETE FROM video_versions WHERE video_id = ? AND key = ?`, videoID, key)
+	return err
+}
@@ -3,17 +3,107 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+type VideoVisibility string
+
+const (
+	// only the owner can see the video or its thumbnail
+	VideoVisibilityPrivate VideoVisibility = "private"
+	// anyone with the link, but left out of channel listings
+	VideoVisibilityUnlisted VideoVisibility = "unlisted"
+	VideoVisibilityPublic   VideoVisibility = "public"
+)
+
+// VideoStatus is how far a video's upload has got. A video that plays stays
+// ready while a new upload of it is processed, as the earlier one keeps
+// playing until it's replaced.
+type VideoStatus string
+
+const (
+	// waiting for its upload to arrive
+	VideoStatusUploading VideoStatus = "uploading"
+	// the upload arrived and is being scanned, transcoded and stored
+	VideoStatusProcessing VideoStatus = "processing"
+	// has an upload that can be played
+	VideoStatusReady VideoStatus = "ready"
+	// the upload couldn't be processed; another can be sent
+	VideoStatusFailed VideoStatus = "failed"
+)
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID           uuid.UUID  `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	ThumbnailURL *string    `json:"thumbnail_url"`
+	VideoURL     *string    `json:"video_url"`
+	PremiereAt   *time.Time `json:"premiere_at"`
+	// S3 version of the object at VideoURL, set when bucket versioning is on
+	VideoVersionID *string         `json:"video_version_id"`
+	Visibility     VideoVisibility `json:"visibility"`
+	// looping preview for listings to play on hover, cut from the upload or
+	// made from a thumbnail uploaded as an animated GIF
+	ThumbnailPreviewURL *string `json:"thumbnail_preview_url"`
+	// set once a retention rule moved the video to cold storage; it has to
+	// be restored before it can play again
+	ArchivedAt *time.Time `json:"archived_at"`
+	// burn each viewer's identity into what they're served, for screeners
+	WatermarkViewers bool `json:"watermark_viewers"`
+	// hex SHA-256 of the current upload as it was received, before any
+	// processing, when the upload path hashed it
+	UploadSHA256 *string `json:"upload_sha256"`
+	// set when an upload was started but never finished before its deadline
+	// and the video still has nothing to play
+	UploadAbandonedAt *time.Time `json:"upload_abandoned_at"`
+	// fingerprints of the current upload and thumbnail, for clients that
+	// sync assets and want to skip unchanged ones; the video's is the S3
+	// ETag, the thumbnail's a hex SHA-256 of the served file
+	VideoETag     *string `json:"video_etag"`
+	ThumbnailETag *string `json:"thumbnail_etag"`
+	// bytes stored for the current upload, counted against the owner's
+	// storage quota
+	VideoSize int64 `json:"video_size"`
+	// set when the last upload was rejected by the malware scanner, with
+	// what it found; a clean upload clears it
+	QuarantinedAt    *time.Time `json:"quarantined_at"`
+	QuarantineReason *string    `json:"quarantine_reason"`
+	// master playlist of the HLS rendition of the current upload, when one
+	// was made
+	HLSMasterKey *string `json:"hls_master_key"`
+	// manifest of the DASH rendition of the current upload, when one was
+	// made
+	DASHManifestKey *string `json:"dash_manifest_key"`
+	// set while the thumbnail is a frame picked from the upload rather than
+	// one the owner sent, so a new upload replaces it
+	ThumbnailGenerated bool `json:"thumbnail_generated"`
+	// WebVTT index of the storyboard sprite of the current upload, for seek
+	// bar previews, when one was made
+	StoryboardKey *string `json:"storyboard_key"`
+	// set while the preview was cut from the upload rather than made from an
+	// animated GIF thumbnail, so a new upload replaces it
+	ThumbnailPreviewGenerated bool `json:"thumbnail_preview_generated"`
+	// length of the current upload in seconds, as ffprobe read it; nil for
+	// uploads from before durations were recorded
+	Duration *float64 `json:"duration"`
+	// BlurHash of the thumbnail, for clients to show while it loads
+	ThumbnailBlurhash *string `json:"thumbnail_blurhash"`
+	// the thumbnail pipeline settings its variants and blurhash were made
+	// with; regenerate-thumbnails redoes thumbnails made with others
+	ThumbnailVersion *string `json:"thumbnail_version"`
+	// where the video's upload stands, see VideoStatus
+	Status VideoStatus `json:"status"`
+	// what's said in the upload, written by the transcriber when one is
+	// set up; nil until then
+	Transcript *string `json:"transcript,omitempty"`
+	// the video this one was cut from, for clips; nil otherwise
+	ParentVideoID *uuid.UUID `json:"parent_video_id,omitempty"`
+	// where in the parent a clip starts and ends, in seconds
+	ClipStart *float64 `json:"clip_start,omitempty"`
+	ClipEnd   *float64 `json:"clip_end,omitempty"`
 	CreateVideoParams
 }
 
@@ -23,23 +113,86 @@ type CreateVideoParams struct {
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+const videoColumns = `
+	id,
+	created_at,
+	updated_at,
+	title,
+	description,
+	thumbnail_url,
+	thumbnail_preview_url,
+	video_url,
+	premiere_at,
+	video_version_id,
+	visibility,
+	archived_at,
+	watermark_viewers,
+	upload_sha256,
+	upload_abandoned_at,
+	video_etag,
+	thumbnail_etag,
+	video_size,
+	quarantined_at,
+	quarantine_reason,
+	hls_master_key,
+	dash_manifest_key,
+	thumbnail_generated,
+	storyboard_key,
+	thumbnail_preview_generated,
+	duration,
+	thumbnail_blurhash,
+	thumbnail_version,
+	status,
+	transcript,
+	parent_video_id,
+	clip_start,
+	clip_end,
+	user_id
+`
 
-	rows, err := c.db.Query(query, userID)
+func scanVideo(row interface{ Scan(...any) error }) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailPreviewURL,
+		&video.VideoURL,
+		&video.PremiereAt,
+		&video.VideoVersionID,
+		&video.Visibility,
+		&video.ArchivedAt,
+		&video.WatermarkViewers,
+		&video.UploadSHA256,
+		&video.UploadAbandonedAt,
+		&video.VideoETag,
+		&video.ThumbnailETag,
+		&video.VideoSize,
+		&video.QuarantinedAt,
+		&video.QuarantineReason,
+		&video.HLSMasterKey,
+		&video.DASHManifestKey,
+		&video.ThumbnailGenerated,
+		&video.StoryboardKey,
+		&video.ThumbnailPreviewGenerated,
+		&video.Duration,
+		&video.ThumbnailBlurhash,
+		&video.ThumbnailVersion,
+		&video.Status,
+		&video.Transcript,
+		&video.ParentVideoID,
+		&video.ClipStart,
+		&video.ClipEnd,
+		&video.UserID,
+	)
+	return video, err
+}
+
+func (c Client) queryVideos(query string, args ...any) ([]Video, error) {
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,23 +200,184 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
+}
+
+// VideoFilter narrows a listing of videos. Bounds are in seconds and
+// inclusive; videos with no recorded duration are left out when either is
+// set.
+type VideoFilter struct {
+	MinDuration *float64
+	MaxDuration *float64
+	// words the title, description or transcript contains, ignoring case
+	Query string
+}
+
+func (c Client) GetVideos(userID uuid.UUID, filter VideoFilter) ([]Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	WHERE user_id = ?
+	`
+	args := []any{userID}
+	if filter.MinDuration != nil {
+		query += " AND duration >= ?"
+		args = append(args, *filter.MinDuration)
+	}
+	if filter.MaxDuration != nil {
+		query += " AND duration <= ?"
+		args = append(args, *filter.MaxDuration)
+	}
+	if filter.Query != "" {
+		pattern := "%" + escapeLike(filter.Query) + "%"
+		query += ` AND (title LIKE ? ESCAPE '\' OR description LIKE ? ESCAPE '\' OR transcript LIKE ? ESCAPE '\')`
+		args = append(args, pattern, pattern, pattern)
+	}
+	query += " ORDER BY created_at DESC"
+	return c.queryVideos(query, args...)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike makes s match itself in a LIKE pattern escaped with '\'.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// GetVideoClips returns the videos cut from the video, newest first.
+func (c Client) GetVideoClips(parentID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	WHERE parent_video_id = ?
+	ORDER BY created_at DESC
+	`
+	return c.queryVideos(query, parentID)
+}
+
+func (c Client) GetPublishedVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND video_url IS NOT NULL AND visibility = 'public'
+	AND status = 'ready' AND quarantined_at IS NULL
+	ORDER BY created_at DESC
+	`
+	return c.queryVideos(query, userID)
+}
+
+// GetVideoByThumbnailURL finds the video using a thumbnail, thumbnail
+// preview or thumbnail variant, returning an empty Video if none does.
+func (c Client) GetVideoByThumbnailURL(thumbnailURL string) (Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	WHERE thumbnail_url = ? OR thumbnail_preview_url = ?
+	OR id IN (SELECT video_id FROM thumbnail_variants WHERE url = ?)
+	`
+	video, err := scanVideo(c.db.QueryRow(query, thumbnailURL, thumbnailURL, thumbnailURL))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+	return video, nil
+}
+
+// GetVideoByUploadSHA256 finds a playable video whose current upload had
+// the checksum, returning an empty Video if none does. Archived uploads are
+// left out since they can't be served.
+func (c Client) GetVideoByUploadSHA256(sum string) (Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	WHERE upload_sha256 = ? AND video_url IS NOT NULL AND archived_at IS NULL
+	ORDER BY created_at ASC
+	LIMIT 1
+	`
+	video, err := scanVideo(c.db.QueryRow(query, sum))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+	return video, nil
+}
+
+// UserStorage is what a user's videos with an upload add up to.
+type UserStorage struct {
+	Videos int
+	Bytes  int64
+	// of the videos with a recorded duration
+	Seconds float64
+}
+
+func (c Client) GetUserStorage(userID uuid.UUID) (UserStorage, error) {
+	query := `
+	SELECT COUNT(*), COALESCE(SUM(video_size), 0), COALESCE(SUM(duration), 0)
+	FROM videos
+	WHERE user_id = ? AND video_url IS NOT NULL
+	`
+	var storage UserStorage
+	err := c.db.QueryRow(query, userID).Scan(&storage.Videos, &storage.Bytes, &storage.Seconds)
+	return storage, err
+}
+
+// GetVideosByVideoURL returns every video pointing at the same object, which
+// deduplicated uploads share.
+func (c Client) GetVideosByVideoURL(videoURL string) ([]Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	WHERE video_url = ?
+	ORDER BY created_at ASC
+	`
+	return c.queryVideos(query, videoURL)
+}
+
+// GetDuePremieres returns videos whose premiere time has passed but whose
+// premiere hasn't been announced yet.
+func (c Client) GetDuePremieres(now time.Time) ([]Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	WHERE premiere_at IS NOT NULL
+		AND premiere_at <= ?
+		AND premiere_notified_at IS NULL
+	ORDER BY premiere_at ASC
+	`
+	return c.queryVideos(query, now.UTC().Truncate(time.Second))
+}
+
+// ClearPremiereNotified forgets that a premiere was announced so that a
+// rescheduled premiere is announced again.
+func (c Client) ClearPremiereNotified(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET premiere_notified_at = NULL
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+func (c Client) MarkPremiereNotified(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET premiere_notified_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
@@ -88,29 +402,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT ` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -128,7 +425,33 @@ func (c Client) UpdateVideo(video Video) error {
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_preview_url = ?,
 		video_url = ?,
+		premiere_at = ?,
+		video_version_id = ?,
+		visibility = ?,
+		archived_at = ?,
+		watermark_viewers = ?,
+		upload_sha256 = ?,
+		upload_abandoned_at = ?,
+		video_etag = ?,
+		thumbnail_etag = ?,
+		video_size = ?,
+		quarantined_at = ?,
+		quarantine_reason = ?,
+		hls_master_key = ?,
+		dash_manifest_key = ?,
+		thumbnail_generated = ?,
+		storyboard_key = ?,
+		thumbnail_preview_generated = ?,
+		duration = ?,
+		thumbnail_blurhash = ?,
+		thumbnail_version = ?,
+		status = ?,
+		transcript = ?,
+		parent_video_id = ?,
+		clip_start = ?,
+		clip_end = ?,
 		user_id = ?
 	WHERE id = ?
 	`
@@ -138,7 +461,33 @@ func (c Client) UpdateVideo(video Video) error {
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		video.ThumbnailPreviewURL,
 		&video.VideoURL,
+		video.PremiereAt,
+		video.VideoVersionID,
+		video.Visibility,
+		video.ArchivedAt,
+		video.WatermarkViewers,
+		video.UploadSHA256,
+		video.UploadAbandonedAt,
+		video.VideoETag,
+		video.ThumbnailETag,
+		video.VideoSize,
+		video.QuarantinedAt,
+		video.QuarantineReason,
+		video.HLSMasterKey,
+		video.DASHManifestKey,
+		video.ThumbnailGenerated,
+		video.StoryboardKey,
+		video.ThumbnailPreviewGenerated,
+		video.Duration,
+		video.ThumbnailBlurhash,
+		video.ThumbnailVersion,
+		video.Status,
+		video.Transcript,
+		video.ParentVideoID,
+		video.ClipStart,
+		video.ClipEnd,
 		video.UserID,
 		video.ID,
 	)
@@ -153,3 +502,125 @@ func (c Client) DeleteVideo(id uuid.UUID) error {
 	_, err := c.db.Exec(query, id)
 	return err
 }
+
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT ` + videoColumns + `
+	FROM videos
+	ORDER BY created_at ASC
+	`
+	return c.queryVideos(query)
+}
+
+// RestoreVideo writes a video record as-is, keeping its original ID and
+// timestamps. Used to rebuild records from a backup manifest.
+func (c Client) RestoreVideo(video Video) error {
+	query := `
+	INSERT INTO videos (
+		id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		thumbnail_url,
+		thumbnail_preview_url,
+		video_url,
+		premiere_at,
+		video_version_id,
+		visibility,
+		archived_at,
+		watermark_viewers,
+		upload_sha256,
+		upload_abandoned_at,
+		video_etag,
+		thumbnail_etag,
+		video_size,
+		quarantined_at,
+		quarantine_reason,
+		hls_master_key,
+		dash_manifest_key,
+		thumbnail_generated,
+		storyboard_key,
+		thumbnail_preview_generated,
+		duration,
+		thumbnail_blurhash,
+		thumbnail_version,
+		status,
+		transcript,
+		parent_video_id,
+		clip_start,
+		clip_end,
+		user_id
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+		title = excluded.title,
+		description = excluded.description,
+		thumbnail_url = excluded.thumbnail_url,
+		thumbnail_preview_url = excluded.thumbnail_preview_url,
+		video_url = excluded.video_url,
+		premiere_at = excluded.premiere_at,
+		video_version_id = excluded.video_version_id,
+		visibility = excluded.visibility,
+		archived_at = excluded.archived_at,
+		watermark_viewers = excluded.watermark_viewers,
+		upload_sha256 = excluded.upload_sha256,
+		upload_abandoned_at = excluded.upload_abandoned_at,
+		video_etag = excluded.video_etag,
+		thumbnail_etag = excluded.thumbnail_etag,
+		video_size = excluded.video_size,
+		quarantined_at = excluded.quarantined_at,
+		quarantine_reason = excluded.quarantine_reason,
+		hls_master_key = excluded.hls_master_key,
+		dash_manifest_key = excluded.dash_manifest_key,
+		thumbnail_generated = excluded.thumbnail_generated,
+		storyboard_key = excluded.storyboard_key,
+		thumbnail_preview_generated = excluded.thumbnail_preview_generated,
+		duration = excluded.duration,
+		thumbnail_blurhash = excluded.thumbnail_blurhash,
+		thumbnail_version = excluded.thumbnail_version,
+		status = excluded.status,
+		transcript = excluded.transcript,
+		parent_video_id = excluded.parent_video_id,
+		clip_start = excluded.clip_start,
+		clip_end = excluded.clip_end,
+		user_id = excluded.user_id
+	`
+	_, err := c.db.Exec(
+		query,
+		video.ID,
+		video.CreatedAt,
+		video.UpdatedAt,
+		video.Title,
+		video.Description,
+		video.ThumbnailURL,
+		video.ThumbnailPreviewURL,
+		video.VideoURL,
+		video.PremiereAt,
+		video.VideoVersionID,
+		video.Visibility,
+		video.ArchivedAt,
+		video.WatermarkViewers,
+		video.UploadSHA256,
+		video.UploadAbandonedAt,
+		video.VideoETag,
+		video.ThumbnailETag,
+		video.VideoSize,
+		video.QuarantinedAt,
+		video.QuarantineReason,
+		video.HLSMasterKey,
+		video.DASHManifestKey,
+		video.ThumbnailGenerated,
+		video.StoryboardKey,
+		video.ThumbnailPreviewGenerated,
+		video.Duration,
+		video.ThumbnailBlurhash,
+		video.ThumbnailVersion,
+		video.Status,
+		video.Transcript,
+		video.ParentVideoID,
+		video.ClipStart,
+		video.ClipEnd,
+		video.UserID,
+	)
+	return err
+}
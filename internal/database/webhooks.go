@@ -0,0 +1,91 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook is a URL a user wants told when their videos finish processing.
+// Deliveries are signed with Secret, which is only shown when the webhook
+// is created.
+type Webhook struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    uuid.UUID `json:"user_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+}
+
+const webhookColumns = `id, created_at, user_id, url, secret`
+
+func scanWebhook(row interface{ Scan(...any) error }) (Webhook, error) {
+	var webhook Webhook
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.UserID,
+		&webhook.URL,
+		&webhook.Secret,
+	)
+	return webhook, err
+}
+
+func (c Client) CreateWebhook(userID uuid.UUID, url, secret string) (Webhook, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO webhooks (id, created_at, user_id, url, secret)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	`
+	if _, err := c.db.Exec(query, id, userID, url, secret); err != nil {
+		return Webhook{}, err
+	}
+	return c.GetWebhook(id)
+}
+
+// GetWebhook returns an empty Webhook if there is none with the ID.
+func (c Client) GetWebhook(id uuid.UUID) (Webhook, error) {
+	query := `
+	SELECT ` + webhookColumns + `
+	FROM webhooks
+	WHERE id = ?
+	`
+	webhook, err := scanWebhook(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Webhook{}, nil
+	}
+	return webhook, err
+}
+
+func (c Client) GetWebhooks(userID uuid.UUID) ([]Webhook, error) {
+	query := `
+	SELECT ` + webhookColumns + `
+	FROM webhooks
+	WHERE user_id = ?
+	ORDER BY created_at ASC
+	`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook stops deliveries to the user's webhook, queued ones
+// included.
+func (c Client) DeleteWebhook(userID, id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM webhooks WHERE user_id = ? AND id = ?", userID, id)
+	return err
+}
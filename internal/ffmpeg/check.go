@@ -0,0 +1,57 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// how long a binary gets to print its version
+const checkTimeout = 10 * time.Second
+
+// Version is what one of the executables said about itself.
+type Version struct {
+	Command string
+	// where it was found
+	Path    string
+	Version string
+}
+
+// Check finds the ffmpeg and ffprobe executables and asks each for its
+// version, so a missing or broken install is caught when the server starts
+// rather than by the first upload. The error says which one is wrong and
+// where it was looked for.
+func Check(ctx context.Context) ([]Version, error) {
+	versions := []Version{}
+	for _, bin := range []string{binFFmpeg, binFFprobe} {
+		version, err := check(ctx, bin)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+func check(ctx context.Context, bin string) (Version, error) {
+	path, err := exec.LookPath(paths[bin])
+	if err != nil {
+		return Version{}, fmt.Errorf("couldn't find %s at %q: %w", bin, paths[bin], err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return Version{}, fmt.Errorf("couldn't run %s at %s: %w", bin, path, err)
+	}
+	// "ffmpeg version 6.1.1-3ubuntu5 Copyright ..."
+	first, _, _ := bytes.Cut(out, []byte("\n"))
+	fields := strings.Fields(string(first))
+	if len(fields) < 3 || fields[0] != bin || fields[1] != "version" {
+		return Version{}, fmt.Errorf("%s at %s doesn't look like %s, it printed %q", bin, path, bin, first)
+	}
+	return Version{Command: bin, Path: path, Version: fields[2]}, nil
+}
@@ -0,0 +1,323 @@
+// Package ffmpeg builds and runs ffmpeg and ffprobe commands. Options are
+// checked against an allow-list so nothing a user controls can smuggle in
+// extra flags, commands queue for a bounded number of slots and are killed,
+// with anything they started, when their context ends or they run past their
+// timeout, stderr is kept for error messages, ffmpeg's -progress output is
+// parsed into Progress events, and finished runs are reported to a Recorder
+// in the context.
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	binFFmpeg  = "ffmpeg"
+	binFFprobe = "ffprobe"
+
+	// stderr is trimmed to its tail, which is where ffmpeg puts the reason
+	// it gave up
+	maxStderr = 16 << 10
+	// stdout is only kept for a Recorder, and likewise trimmed
+	maxRecordedStdout = 16 << 10
+	// how long a killed command's output is drained before giving up on it
+	killWaitDelay = 5 * time.Second
+)
+
+// options maps every allowed option to the number of values it takes.
+var options = map[string]map[string]int{
+	binFFmpeg: {
+		"-y":              0,
+		"-nostats":        0,
+		"-v":              1,
+		"-progress":       1,
+		"-i":              1,
+		"-c":              1,
+		"-c:v":            1,
+		"-c:a":            1,
+		"-movflags":       1,
+		"-f":              1,
+		"-filter_complex": 1,
+		"-vf":             1,
+		"-af":             1,
+		"-ar":             1,
+		"-ac":             1,
+		"-b:a":            1,
+		"-map":            1,
+		"-preset":         1,
+		"-crf":            1,
+		"-maxrate":        1,
+		"-bufsize":        1,
+		"-q:v":            1,
+		"-q:a":            1,
+		"-loop":           1,
+		"-ss":             1,
+		"-t":              1,
+		"-an":             0,
+		"-frames:v":       1,
+		// HLS
+		"-force_key_frames":     1,
+		"-hls_time":             1,
+		"-hls_playlist_type":    1,
+		"-hls_segment_filename": 1,
+		// DASH
+		"-seg_duration":   1,
+		"-use_template":   1,
+		"-use_timeline":   1,
+		"-init_seg_name":  1,
+		"-media_seg_name": 1,
+	},
+	binFFprobe: {
+		"-v":              1,
+		"-print_format":   1,
+		"-show_streams":   0,
+		"-show_entries":   1,
+		"-select_streams": 1,
+	},
+}
+
+var ErrOptionNotAllowed = errors.New("option not allowed")
+
+var runHook func(ctx context.Context, bin string, args []string) error
+
+// paths are the executables run for each binary, found on PATH by default.
+var paths = map[string]string{
+	binFFmpeg:  binFFmpeg,
+	binFFprobe: binFFprobe,
+}
+
+// SetPaths runs the given ffmpeg and ffprobe executables instead of the ones
+// on PATH, such as stubs in integration tests. An empty path keeps the
+// current one.
+func SetPaths(ffmpegPath, ffprobePath string) {
+	if ffmpegPath != "" {
+		paths[binFFmpeg] = ffmpegPath
+	}
+	if ffprobePath != "" {
+		paths[binFFprobe] = ffprobePath
+	}
+}
+
+// SetRunHook installs a function that runs before every command and fails
+// it by returning an error. It exists for fault injection in tests; pass nil
+// to remove it.
+func SetRunHook(hook func(ctx context.Context, bin string, args []string) error) {
+	runHook = hook
+}
+
+// Command is an ffmpeg or ffprobe invocation under construction. The first
+// invalid option or argument is remembered and returned from Run.
+type Command struct {
+	bin  string
+	args []string
+	err  error
+}
+
+func FFmpeg() *Command {
+	return &Command{bin: binFFmpeg}
+}
+
+func FFprobe() *Command {
+	return &Command{bin: binFFprobe}
+}
+
+// Option appends an option and its values.
+func (c *Command) Option(name string, values ...string) *Command {
+	if c.err != nil {
+		return c
+	}
+	n, ok := options[c.bin][name]
+	if !ok {
+		c.err = fmt.Errorf("%s %s: %w", c.bin, name, ErrOptionNotAllowed)
+		return c
+	}
+	if len(values) != n {
+		c.err = fmt.Errorf("%s %s takes %d values, got %d", c.bin, name, n, len(values))
+		return c
+	}
+	c.args = append(c.args, name)
+	c.args = append(c.args, values...)
+	return c
+}
+
+// Input adds an input file or URL.
+func (c *Command) Input(path string) *Command {
+	if c.bin == binFFprobe {
+		return c.arg(path)
+	}
+	if c.err != nil {
+		return c
+	}
+	if err := checkPath(path); err != nil {
+		c.err = err
+		return c
+	}
+	return c.Option("-i", path)
+}
+
+// Output adds an output file.
+func (c *Command) Output(path string) *Command {
+	return c.arg(path)
+}
+
+func (c *Command) arg(path string) *Command {
+	if c.err != nil {
+		return c
+	}
+	if err := checkPath(path); err != nil {
+		c.err = err
+		return c
+	}
+	c.args = append(c.args, path)
+	return c
+}
+
+// checkPath rejects paths ffmpeg would read as an option.
+func checkPath(path string) error {
+	if path == "" || strings.HasPrefix(path, "-") {
+		return fmt.Errorf("invalid path %q", path)
+	}
+	return nil
+}
+
+// Args returns the arguments built so far.
+func (c *Command) Args() []string {
+	return append([]string(nil), c.args...)
+}
+
+// Error is returned when a command exits unsuccessfully.
+type Error struct {
+	Command string
+	Stderr  string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v, stderr: %s", e.Command, e.Err, e.Stderr)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Run runs the command and returns its stdout.
+func (c *Command) Run(ctx context.Context) ([]byte, error) {
+	var stdout bytes.Buffer
+	if err := c.run(ctx, &stdout); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// RunWithProgress runs an ffmpeg command, calling fn for every progress
+// update ffmpeg reports.
+func (c *Command) RunWithProgress(ctx context.Context, fn func(Progress)) error {
+	if c.bin != binFFmpeg {
+		return fmt.Errorf("%s doesn't report progress", c.bin)
+	}
+	if c.err != nil {
+		return c.err
+	}
+	// global options go first, ffmpeg ignores anything after the output
+	c.args = append([]string{"-progress", "pipe:1", "-nostats"}, c.args...)
+
+	pr, pw := io.Pipe()
+	parsed := make(chan error, 1)
+	go func() {
+		err := ParseProgress(pr, fn)
+		// keep draining so ffmpeg never blocks on a full pipe
+		io.Copy(io.Discard, pr)
+		parsed <- err
+	}()
+
+	err := c.run(ctx, pw)
+	pw.Close()
+	if perr := <-parsed; err == nil && perr != nil {
+		return fmt.Errorf("couldn't parse progress: %w", perr)
+	}
+	return err
+}
+
+func (c *Command) run(ctx context.Context, stdout io.Writer) error {
+	if c.err != nil {
+		return c.err
+	}
+	record := recorderFrom(ctx)
+	started := time.Now()
+	if runHook != nil {
+		if err := runHook(ctx, c.bin, c.args); err != nil {
+			err = &Error{Command: c.bin, Err: err}
+			if record != nil {
+				record(Record{Command: c.bin, Args: c.Args(), Started: started, Err: err})
+			}
+			return err
+		}
+	}
+	if err := runPool.acquire(ctx); err != nil {
+		return &Error{Command: c.bin, Err: fmt.Errorf("gave up waiting for a free slot: %w", err)}
+	}
+	defer runPool.release()
+	// the time spent queueing isn't the command's
+	started = time.Now()
+	timeout := runPool.timeout(c.bin)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, ErrTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, paths[c.bin], c.args...)
+	killTreeOnCancel(cmd)
+	// don't wait on pipes something the kill missed may still hold
+	cmd.WaitDelay = killWaitDelay
+	stderr := &tailBuffer{max: maxStderr}
+	recorded := &tailBuffer{max: maxRecordedStdout}
+	cmd.Stdout = stdout
+	if record != nil {
+		cmd.Stdout = io.MultiWriter(stdout, recorded)
+	}
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		if errors.Is(context.Cause(ctx), ErrTimeout) {
+			err = fmt.Errorf("killed after %s: %w", timeout, ErrTimeout)
+		}
+		err = &Error{Command: c.bin, Stderr: stderr.String(), Err: err}
+	}
+	if record != nil {
+		record(Record{
+			Command: c.bin,
+			Args:    c.Args(),
+			Started: started,
+			Took:    time.Since(started),
+			Stdout:  recorded.String(),
+			Stderr:  stderr.String(),
+			Err:     err,
+		})
+	}
+	return err
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
@@ -0,0 +1,115 @@
+package ffmpeg
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is what a command killed for running past its timeout fails
+// with, wrapped in an Error.
+var ErrTimeout = errors.New("ran past its timeout")
+
+// pool caps how many commands run at once. Commands past the cap wait their
+// turn in the order they came, unless their context ends first.
+type pool struct {
+	mu sync.Mutex
+	// zero for no cap
+	limit   int
+	running int
+	queue   []chan struct{}
+	// how long each binary may run, zero for as long as it takes
+	timeouts map[string]time.Duration
+}
+
+var runPool = &pool{timeouts: map[string]time.Duration{}}
+
+// SetLimits caps how many ffmpeg and ffprobe commands run at once across
+// the process, queueing the rest, and how long one may run before it's
+// killed. Zero means no cap and no timeout.
+func SetLimits(concurrency int, ffmpegTimeout, ffprobeTimeout time.Duration) {
+	p := runPool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit = max(0, concurrency)
+	p.timeouts[binFFmpeg] = ffmpegTimeout
+	p.timeouts[binFFprobe] = ffprobeTimeout
+	// a raised cap lets queued commands go now
+	for len(p.queue) > 0 && (p.limit == 0 || p.running < p.limit) {
+		p.running++
+		p.handOff()
+	}
+}
+
+// PoolStats is how busy the pool is.
+type PoolStats struct {
+	Limit   int `json:"limit"`
+	Running int `json:"running"`
+	Queued  int `json:"queued"`
+}
+
+// Stats reports how many commands are running and waiting.
+func Stats() PoolStats {
+	p := runPool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{Limit: p.limit, Running: p.running, Queued: len(p.queue)}
+}
+
+func (p *pool) timeout(bin string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.timeouts[bin]
+}
+
+// acquire waits for a slot, failing with ctx's error if it ends first.
+func (p *pool) acquire(ctx context.Context) error {
+	p.mu.Lock()
+	if p.limit == 0 || p.running < p.limit {
+		p.running++
+		p.mu.Unlock()
+		return nil
+	}
+	turn := make(chan struct{})
+	p.queue = append(p.queue, turn)
+	p.mu.Unlock()
+
+	select {
+	case <-turn:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if i := slices.Index(p.queue, turn); i >= 0 {
+			p.queue = slices.Delete(p.queue, i, i+1)
+		} else {
+			// the slot came as ctx ended, so it goes to the next in line
+			p.releaseLocked()
+		}
+		return ctx.Err()
+	}
+}
+
+func (p *pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.releaseLocked()
+}
+
+// releaseLocked passes a finished command's slot to the first one waiting,
+// unless the cap has been lowered below what's running.
+func (p *pool) releaseLocked() {
+	if len(p.queue) > 0 && (p.limit == 0 || p.running <= p.limit) {
+		p.handOff()
+		return
+	}
+	p.running--
+}
+
+func (p *pool) handOff() {
+	turn := p.queue[0]
+	p.queue = p.queue[1:]
+	close(turn)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package ffmpeg
+
+import "os/exec"
+
+// killTreeOnCancel leaves cmd to exec's default of killing just the process
+// where there are no process groups.
+func killTreeOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package ffmpeg
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killTreeOnCancel runs cmd in a process group of its own and has a
+// cancelled or timed out context kill the whole group, so nothing it
+// started, like a wrapper script's children, is left running.
+func killTreeOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
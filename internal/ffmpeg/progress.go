@@ -0,0 +1,52 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is one block of ffmpeg -progress output.
+type Progress struct {
+	Frame     int64
+	FPS       float64
+	OutTime   time.Duration
+	TotalSize int64
+	Speed     float64
+	Done      bool
+}
+
+// ParseProgress reads key=value lines as written by ffmpeg -progress and
+// calls fn at the end of every block, which ffmpeg marks with a
+// progress=continue or progress=end line.
+func ParseProgress(r io.Reader, fn func(Progress)) error {
+	var p Progress
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "frame":
+			p.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			p.FPS, _ = strconv.ParseFloat(value, 64)
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				p.OutTime = time.Duration(us) * time.Microsecond
+			}
+		case "total_size":
+			p.TotalSize, _ = strconv.ParseInt(value, 10, 64)
+		case "speed":
+			p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "progress":
+			p.Done = value == "end"
+			fn(p)
+			p = Progress{}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,35 @@
+package ffmpeg
+
+import (
+	"context"
+	"time"
+)
+
+// Record is a finished run of a command, as handed to a Recorder. Stdout and
+// Stderr are the tails of what it wrote.
+type Record struct {
+	Command string
+	Args    []string
+	Started time.Time
+	Took    time.Duration
+	Stdout  string
+	Stderr  string
+	// nil if it exited successfully
+	Err error
+}
+
+// Recorder is called after every command run with a context it was added to.
+type Recorder func(Record)
+
+type recorderKey struct{}
+
+// WithRecorder returns a context that has commands run with it reported to
+// record, such as to keep a log of how one video was processed.
+func WithRecorder(ctx context.Context, record Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, record)
+}
+
+func recorderFrom(ctx context.Context) Recorder {
+	record, _ := ctx.Value(recorderKey{}).(Recorder)
+	return record
+}
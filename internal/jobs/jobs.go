@@ -0,0 +1,241 @@
+// Package jobs runs background work that has to outlive the request that
+// started it. Jobs are kept by a Backend, handed to a pool of workers by
+// kind, and retried with backoff when they fail until they run out of
+// attempts, when they're kept as failed for someone to look at.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	// ran out of attempts, or failed in a way retrying can't fix
+	StatusFailed Status = "failed"
+)
+
+const (
+	defaultMaxAttempts = 5
+	// how often idle workers look for jobs that came due, as a retry's
+	// backoff ending doesn't wake them
+	pollInterval = 5 * time.Second
+	firstBackoff = 30 * time.Second
+	maxBackoff   = 30 * time.Minute
+)
+
+// Job is one piece of work of a kind, with what it needs to run in Payload.
+// Payloads are all a job has to go on after a restart, so they hold IDs and
+// paths rather than anything kept in memory.
+type Job struct {
+	ID        uuid.UUID       `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Kind      string          `json:"kind"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    Status          `json:"status"`
+	// runs so far, counting the one in progress
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"max_attempts"`
+	RunAt       time.Time `json:"run_at"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// LastAttempt reports whether the run in progress is the job's last, for
+// handlers to give up cleanly instead of leaving a retry that won't come.
+func (j Job) LastAttempt() bool {
+	return j.Attempts >= j.MaxAttempts
+}
+
+// Backend keeps jobs and hands them to workers. The in-process one keeps
+// them in the database; one on a message queue such as SQS fits the same
+// shape, with Claim as a receive and the message's visibility as the claim.
+type Backend interface {
+	Enqueue(ctx context.Context, job Job) error
+	// Claim marks the queued job due soonest by now as running and returns
+	// it with Attempts counting this run, or reports false if none is due.
+	Claim(ctx context.Context, now time.Time) (Job, bool, error)
+	// Complete forgets a job that ran successfully.
+	Complete(ctx context.Context, job Job) error
+	// Retry queues the job to run again at at.
+	Retry(ctx context.Context, job Job, at time.Time, reason string) error
+	// Fail keeps the job as failed.
+	Fail(ctx context.Context, job Job, reason string) error
+}
+
+// Handler runs a job. An error fails the run, to be retried unless it's
+// Permanent or the job is on its last attempt.
+type Handler func(ctx context.Context, job Job) error
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as one retrying won't fix, so the job fails straight
+// away.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+type kind struct {
+	handler     Handler
+	maxAttempts int
+}
+
+// Queue runs jobs from a Backend on a fixed number of workers.
+type Queue struct {
+	backend Backend
+	workers int
+	kinds   map[string]kind
+	wake    chan struct{}
+	now     func() time.Time
+}
+
+// New returns a queue over backend that runs workers jobs at a time once
+// started. now is its clock, nil for the wall clock.
+func New(backend Backend, workers int, now func() time.Time) *Queue {
+	if now == nil {
+		now = time.Now
+	}
+	return &Queue{
+		backend: backend,
+		workers: max(1, workers),
+		kinds:   map[string]kind{},
+		wake:    make(chan struct{}, 1),
+		now:     now,
+	}
+}
+
+// Handle runs jobs of the kind with handler, trying each up to maxAttempts
+// times, or 5 if it's zero. Kinds are registered before the queue starts.
+func (q *Queue) Handle(name string, maxAttempts int, handler Handler) {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	q.kinds[name] = kind{handler: handler, maxAttempts: maxAttempts}
+}
+
+// Enqueue queues a job of the kind to run as soon as a worker is free, with
+// payload encoded as JSON.
+func (q *Queue) Enqueue(ctx context.Context, name string, payload any) (Job, error) {
+	k, ok := q.kinds[name]
+	if !ok {
+		return Job{}, fmt.Errorf("jobs: no handler for %q", name)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	now := q.now().UTC()
+	job := Job{
+		ID:          uuid.New(),
+		CreatedAt:   now,
+		Kind:        name,
+		Payload:     data,
+		Status:      StatusQueued,
+		MaxAttempts: k.maxAttempts,
+		RunAt:       now,
+	}
+	if err := q.backend.Enqueue(ctx, job); err != nil {
+		return Job{}, err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Start runs the workers until ctx ends.
+func (q *Queue) Start(ctx context.Context) {
+	for range q.workers {
+		go q.work(ctx)
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		if q.RunNext(ctx) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// RunNext runs the job due soonest, if there is one, and reports whether
+// there was.
+func (q *Queue) RunNext(ctx context.Context) bool {
+	job, ok, err := q.backend.Claim(ctx, q.now().UTC())
+	if err != nil {
+		log.Printf("jobs: couldn't claim a job: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	q.run(ctx, job)
+	return true
+}
+
+func (q *Queue) run(ctx context.Context, job Job) {
+	err := q.call(ctx, job)
+	if err == nil {
+		if err := q.backend.Complete(ctx, job); err != nil {
+			log.Printf("jobs: couldn't complete %s job %s: %v", job.Kind, job.ID, err)
+		}
+		return
+	}
+
+	var permanent permanentError
+	if errors.As(err, &permanent) || job.LastAttempt() {
+		log.Printf("jobs: %s job %s failed for good after %d attempts: %v", job.Kind, job.ID, job.Attempts, err)
+		if err := q.backend.Fail(ctx, job, err.Error()); err != nil {
+			log.Printf("jobs: couldn't fail %s job %s: %v", job.Kind, job.ID, err)
+		}
+		return
+	}
+	at := q.now().UTC().Add(Backoff(job.Attempts))
+	log.Printf("jobs: %s job %s failed, retrying at %s: %v", job.Kind, job.ID, at.Format(time.RFC3339), err)
+	if err := q.backend.Retry(ctx, job, at, err.Error()); err != nil {
+		log.Printf("jobs: couldn't queue retry of %s job %s: %v", job.Kind, job.ID, err)
+	}
+}
+
+// call runs the job's handler, turning a panic into a failed run so one bad
+// job can't take the worker down.
+func (q *Queue) call(ctx context.Context, job Job) (err error) {
+	k, ok := q.kinds[job.Kind]
+	if !ok {
+		return Permanent(fmt.Errorf("no handler for %q", job.Kind))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return k.handler(ctx, job)
+}
+
+// Backoff is how long a job waits after its attempt-th failed run: 30s,
+// doubling each time up to half an hour.
+func Backoff(attempt int) time.Duration {
+	backoff := firstBackoff
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
@@ -0,0 +1,186 @@
+// Package limits describes a limit a request ran into, so every place that
+// enforces one answers the same way: 413 when one upload is too big, 402
+// when an allowance is used up until the plan changes, and 429 when a window
+// or a cap on work in flight frees up on its own.
+package limits
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+type Kind int
+
+const (
+	// one upload is bigger or longer than allowed
+	Size Kind = iota
+	// an allowance only a bigger plan lifts, like storage
+	Quota
+	// a cap that frees up with time: a window that resets, or the uploads a
+	// user has in flight
+	Rate
+)
+
+// Names of plan limits, as in the plan's JSON.
+const (
+	MaxVideoSize       = "max_video_size"
+	MaxVideoDuration   = "max_video_duration"
+	DailyUploads       = "daily_uploads"
+	DailyUploadBytes   = "daily_upload_bytes"
+	MonthlyUploads     = "monthly_uploads"
+	MonthlyUploadBytes = "monthly_upload_bytes"
+	MonthlyBandwidth   = "monthly_bandwidth"
+	StorageBytes       = "storage_bytes"
+)
+
+type planLimit struct {
+	kind Kind
+	unit string
+	// zero means the plan has no such limit
+	zeroUnlimited bool
+	value         func(database.Plan) int64
+}
+
+var planLimits = map[string]planLimit{
+	MaxVideoSize:       {Size, "bytes", false, func(p database.Plan) int64 { return p.MaxVideoSize }},
+	MaxVideoDuration:   {Size, "seconds", false, func(p database.Plan) int64 { return int64(p.MaxVideoDuration) }},
+	DailyUploads:       {Rate, "uploads", true, func(p database.Plan) int64 { return int64(p.DailyUploads) }},
+	DailyUploadBytes:   {Rate, "bytes", true, func(p database.Plan) int64 { return p.DailyUploadBytes }},
+	MonthlyUploads:     {Rate, "uploads", true, func(p database.Plan) int64 { return int64(p.MonthlyUploads) }},
+	MonthlyUploadBytes: {Rate, "bytes", true, func(p database.Plan) int64 { return p.MonthlyUploadBytes }},
+	MonthlyBandwidth:   {Rate, "bytes", true, func(p database.Plan) int64 { return p.MonthlyBandwidth }},
+	StorageBytes:       {Quota, "bytes", true, func(p database.Plan) int64 { return p.StorageBytes }},
+}
+
+// Exceeded is a limit a request ran into. For Size limits Used is the size
+// of the upload, zero if it's only known to be too big; for the others it's
+// what the window or allowance already holds, and Pending what the request
+// would have added.
+type Exceeded struct {
+	Kind    Kind   `json:"-"`
+	Name    string `json:"name"`
+	Unit    string `json:"unit"`
+	Used    int64  `json:"used"`
+	Pending int64  `json:"pending,omitempty"`
+	Limit   int64  `json:"limit"`
+	// when a Rate limit frees up, if it's known
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+	// the plan the limit comes from; empty for the deployment's own limits,
+	// which no upgrade lifts
+	Plan    string   `json:"plan,omitempty"`
+	Upgrade *Upgrade `json:"upgrade,omitempty"`
+	// how long to wait on a Rate limit with no reset time
+	RetryAfter time.Duration `json:"-"`
+}
+
+// Upgrade is a plan that would have allowed the request.
+type Upgrade struct {
+	Plan string `json:"plan"`
+	// zero when the plan has no such limit
+	Limit int64 `json:"limit"`
+}
+
+// ForPlan describes plan's limit called name, for the caller to fill in
+// what was used. It panics if name isn't a plan limit.
+func ForPlan(name string, plan database.Plan) Exceeded {
+	l, ok := planLimits[name]
+	if !ok {
+		panic("limits: unknown plan limit " + name)
+	}
+	return Exceeded{
+		Kind:  l.kind,
+		Name:  name,
+		Unit:  l.unit,
+		Limit: l.value(plan),
+		Plan:  plan.Name,
+	}
+}
+
+// WithUpgrade suggests the plan among plans with the smallest limit that
+// would have allowed the request, or one without the limit if none does.
+func (e Exceeded) WithUpgrade(plans []database.Plan) Exceeded {
+	l, ok := planLimits[e.Name]
+	if !ok || e.Plan == "" {
+		return e
+	}
+	need := e.Used + e.Pending
+	var best, unlimited *Upgrade
+	for _, p := range plans {
+		v := l.value(p)
+		switch {
+		case p.Name == e.Plan:
+		case v == 0 && l.zeroUnlimited:
+			if unlimited == nil {
+				unlimited = &Upgrade{Plan: p.Name}
+			}
+		case v > e.Limit && v >= need && (best == nil || v < best.Limit):
+			best = &Upgrade{Plan: p.Name, Limit: v}
+		}
+	}
+	e.Upgrade = best
+	if best == nil {
+		e.Upgrade = unlimited
+	}
+	return e
+}
+
+// Status is the HTTP status to answer with.
+func (e Exceeded) Status() int {
+	switch e.Kind {
+	case Quota:
+		return http.StatusPaymentRequired
+	case Rate:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusRequestEntityTooLarge
+	}
+}
+
+// SetRetryAfter tells clients when a Rate limit frees up.
+func (e Exceeded) SetRetryAfter(h http.Header, now time.Time) {
+	if e.Kind != Rate {
+		return
+	}
+	wait := e.RetryAfter
+	if e.ResetsAt != nil {
+		wait = e.ResetsAt.Sub(now)
+	}
+	if wait > 0 {
+		h.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	}
+}
+
+func (e Exceeded) Error() string {
+	msg := fmt.Sprintf("%s exceeded: %s allowed", e.Name, e.amount(e.Limit))
+	if e.Plan != "" {
+		msg += " on the " + e.Plan + " plan"
+	}
+	switch {
+	case e.Kind != Size:
+		msg += fmt.Sprintf(", %s used", e.amount(e.Used))
+	case e.Used > 0:
+		msg += fmt.Sprintf(", this upload is %s", e.amount(e.Used))
+	}
+	if e.Pending > 0 {
+		msg += fmt.Sprintf(", %s more needed", e.amount(e.Pending))
+	}
+	if e.ResetsAt != nil {
+		msg += ", resets at " + e.ResetsAt.UTC().Format(time.RFC3339)
+	}
+	if e.Upgrade != nil {
+		msg += ", the " + e.Upgrade.Plan + " plan allows more"
+	}
+	return msg
+}
+
+func (e Exceeded) amount(n int64) string {
+	if e.Unit == "seconds" {
+		return (time.Duration(n) * time.Second).String()
+	}
+	return fmt.Sprintf("%d %s", n, e.Unit)
+}
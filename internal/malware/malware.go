@@ -0,0 +1,157 @@
+// Package malware scans uploaded files before they're published. Scanner
+// is the hook; Clamd is an implementation that streams files to a ClamAV
+// daemon.
+package malware
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Result is what a scan found.
+type Result struct {
+	Infected bool
+	// the name of what was found, when Infected
+	Signature string
+}
+
+// Scanner checks a local file for malware. An error means the file couldn't
+// be scanned, not that it's infected.
+type Scanner interface {
+	Scan(ctx context.Context, path string) (Result, error)
+}
+
+const (
+	// clamd's default StreamMaxLength is 25MB, and larger chunks than this
+	// gain nothing
+	clamdChunkSize = 1 << 20
+	// clamd has to read the whole stream before it answers
+	clamdDefaultTimeout = 10 * time.Minute
+)
+
+// Clamd scans files with a clamd daemon using its INSTREAM command, so clamd
+// doesn't need access to our disk. clamd refuses streams longer than its
+// StreamMaxLength, which has to be raised to the largest upload allowed.
+type Clamd struct {
+	network string
+	address string
+	// for a whole scan; clamdDefaultTimeout if zero
+	Timeout time.Duration
+}
+
+// NewClamd takes the daemon's address as tcp://host:port or
+// unix:///path/to/clamd.sock.
+func NewClamd(addr string) (*Clamd, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clamd address %q: %w", addr, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("clamd address %q has no host", addr)
+		}
+		return &Clamd{network: "tcp", address: u.Host}, nil
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("clamd address %q has no socket path", addr)
+		}
+		return &Clamd{network: "unix", address: u.Path}, nil
+	default:
+		return nil, fmt.Errorf("clamd address %q must start with tcp:// or unix://", addr)
+	}
+}
+
+func (c *Clamd) Scan(ctx context.Context, path string) (Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = clamdDefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return Result{}, fmt.Errorf("couldn't reach clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// a cancelled upload shouldn't keep clamd busy
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	sendErr := clamdStream(conn, f)
+	// clamd answers and hangs up early when the stream is too long, and
+	// its answer says why better than the failed write
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if reply == "" && sendErr != nil {
+		return Result{}, fmt.Errorf("couldn't send file to clamd: %w", sendErr)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Result{}, fmt.Errorf("couldn't read clamd reply: %w", err)
+	}
+	result, err := parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+	if err == nil && !result.Infected && sendErr != nil {
+		return Result{}, fmt.Errorf("couldn't send file to clamd: %w", sendErr)
+	}
+	return result, err
+}
+
+// clamdStream sends r as an INSTREAM: length-prefixed chunks ending with an
+// empty one.
+func clamdStream(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdReply reads "stream: OK", "stream: <signature> FOUND" or
+// "<reason> ERROR".
+func parseClamdReply(reply string) (Result, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return Result{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(reply, " ERROR"))
+	default:
+		return Result{}, fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+}
@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"sync"
+	"time"
+)
+
+// StageStats is how a stage has fared since the process started.
+type StageStats struct {
+	Runs     int64         `json:"runs"`
+	Failures int64         `json:"failures"`
+	Total    time.Duration `json:"total_ns"`
+	Max      time.Duration `json:"max_ns"`
+}
+
+// Metrics collects StageStats by stage name. Pipelines sharing stages can
+// share one. It's safe for concurrent use.
+type Metrics struct {
+	mu     sync.Mutex
+	stages map[string]StageStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{stages: map[string]StageStats{}}
+}
+
+func (m *Metrics) observe(stage string, took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stages[stage]
+	stats.Runs++
+	if err != nil {
+		stats.Failures++
+	}
+	stats.Total += took
+	stats.Max = max(stats.Max, took)
+	m.stages[stage] = stats
+}
+
+// Snapshot returns a copy of the stats so far.
+func (m *Metrics) Snapshot() map[string]StageStats {
+	snapshot := map[string]StageStats{}
+	if m == nil {
+		return snapshot
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for stage, stats := range m.stages {
+		snapshot[stage] = stats
+	}
+	return snapshot
+}
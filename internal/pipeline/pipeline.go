@@ -0,0 +1,147 @@
+// Package pipeline runs a job as a sequence of named stages over shared
+// state. Each stage is timed into Metrics and its failure tagged with the
+// stage's name, so steps can be added, removed or reordered without the
+// others knowing.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Stage is one step of a pipeline. It reads what earlier stages left in
+// state and adds its own results.
+type Stage[T any] struct {
+	Name string
+	Run  func(ctx context.Context, state *T) error
+}
+
+// StageError is a failure of one stage. Run stops at the first.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// FailedStage returns the stage err came from, or "" if it didn't come from
+// one.
+func FailedStage(err error) string {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return stageErr.Stage
+	}
+	return ""
+}
+
+// skipTo is returned by a stage that made the stages up to the named one
+// unnecessary.
+type skipTo struct {
+	stage string
+}
+
+func (s skipTo) Error() string {
+	return "skip to " + s.stage
+}
+
+// SkipTo returns an error that, returned from a stage, has Run carry on at
+// the named stage instead of the next one. A stage that found the work
+// already done, like a duplicate upload, uses it to jump past the stages
+// that would have done it.
+func SkipTo(stage string) error {
+	return skipTo{stage: stage}
+}
+
+// Pipeline is an ordered list of stages. Its methods return modified copies,
+// so a shared pipeline can be extended for one caller.
+type Pipeline[T any] struct {
+	stages  []Stage[T]
+	metrics *Metrics
+	observe []Observer[T]
+}
+
+// Observer is told about every stage a pipeline ran, with how long it took
+// and its error, if any. Unlike Metrics it sees the state, so it can keep a
+// record per job.
+type Observer[T any] func(state *T, stage string, took time.Duration, err error)
+
+// New returns a pipeline of stages, timed into metrics if it's not nil.
+func New[T any](metrics *Metrics, stages ...Stage[T]) Pipeline[T] {
+	return Pipeline[T]{stages: stages, metrics: metrics}
+}
+
+// Then returns p with stages added at the end.
+func (p Pipeline[T]) Then(stages ...Stage[T]) Pipeline[T] {
+	p.stages = append(slices.Clip(p.stages), stages...)
+	return p
+}
+
+// Before returns p with stage added in front of the named one. It panics if
+// there's no such stage, as that's a mistake in how the pipeline was put
+// together.
+func (p Pipeline[T]) Before(name string, stage Stage[T]) Pipeline[T] {
+	p.stages = slices.Insert(slices.Clone(p.stages), p.index(name), stage)
+	return p
+}
+
+// After returns p with stage added behind the named one. It panics like
+// Before.
+func (p Pipeline[T]) After(name string, stage Stage[T]) Pipeline[T] {
+	p.stages = slices.Insert(slices.Clone(p.stages), p.index(name)+1, stage)
+	return p
+}
+
+// Observe returns p with fn called after every stage it runs, stages that
+// skip ahead included.
+func (p Pipeline[T]) Observe(fn Observer[T]) Pipeline[T] {
+	p.observe = append(slices.Clip(p.observe), fn)
+	return p
+}
+
+func (p Pipeline[T]) index(name string) int {
+	i := slices.IndexFunc(p.stages, func(s Stage[T]) bool { return s.Name == name })
+	if i < 0 {
+		panic(fmt.Sprintf("pipeline: no stage named %q", name))
+	}
+	return i
+}
+
+// Run runs the stages in order until one fails, returning its error as a
+// *StageError. A cancelled ctx stops it between stages.
+func (p Pipeline[T]) Run(ctx context.Context, state *T) error {
+	for i := 0; i < len(p.stages); i++ {
+		stage := p.stages[i]
+		if err := ctx.Err(); err != nil {
+			return &StageError{Stage: stage.Name, Err: err}
+		}
+		start := time.Now()
+		err := stage.Run(ctx, state)
+		var skip skipTo
+		if errors.As(err, &skip) {
+			p.finished(state, stage.Name, time.Since(start), nil)
+			i = p.index(skip.stage) - 1
+			continue
+		}
+		p.finished(state, stage.Name, time.Since(start), err)
+		if err != nil {
+			return &StageError{Stage: stage.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+func (p Pipeline[T]) finished(state *T, stage string, took time.Duration, err error) {
+	p.metrics.observe(stage, took, err)
+	for _, fn := range p.observe {
+		fn(state, stage, took, err)
+	}
+}
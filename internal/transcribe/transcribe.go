@@ -0,0 +1,179 @@
+// Package transcribe turns the speech in audio files into text. Transcriber
+// is the hook; Whisper is an implementation that sends files to OpenAI's
+// Whisper API, or anything serving the same endpoint.
+package transcribe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrTooLarge is what a file too big for the transcriber fails with;
+// sending it again won't help.
+var ErrTooLarge = errors.New("file is too large to transcribe")
+
+// Segment is a stretch of speech and when it's said.
+type Segment struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// Transcript is what was said in a file.
+type Transcript struct {
+	// the spoken language as a code like "en", when the transcriber could
+	// tell
+	Language string
+	Text     string
+	Segments []Segment
+}
+
+// Transcriber transcribes a local audio file.
+type Transcriber interface {
+	Transcribe(ctx context.Context, path string) (Transcript, error)
+}
+
+// WebVTT returns the transcript's segments as WebVTT cues, for captions.
+func (t Transcript) WebVTT() []byte {
+	var b bytes.Buffer
+	b.WriteString("WEBVTT\n")
+	for _, s := range t.Segments {
+		text := strings.TrimSpace(s.Text)
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s --> %s\n%s\n", vttTimestamp(s.Start), vttTimestamp(s.End), text)
+	}
+	return b.Bytes()
+}
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+const (
+	WhisperEndpoint     = "https://api.openai.com/v1/audio/transcriptions"
+	WhisperDefaultModel = "whisper-1"
+	// the API refuses larger files
+	WhisperMaxFileSize = 25 << 20
+	// a long file takes a while to transcribe
+	whisperTimeout = 10 * time.Minute
+)
+
+// Whisper transcribes with the Whisper API's transcriptions endpoint.
+type Whisper struct {
+	endpoint string
+	apiKey   string
+	model    string
+	Client   *http.Client
+}
+
+// NewWhisper sends files to endpoint, WhisperEndpoint if empty, to be
+// transcribed by model, WhisperDefaultModel if empty.
+func NewWhisper(endpoint, apiKey, model string) *Whisper {
+	if endpoint == "" {
+		endpoint = WhisperEndpoint
+	}
+	if model == "" {
+		model = WhisperDefaultModel
+	}
+	return &Whisper{
+		endpoint: endpoint,
+		apiKey:   apiKey,
+		model:    model,
+		Client:   &http.Client{Timeout: whisperTimeout},
+	}
+}
+
+// whisperResponse is the API's verbose_json transcription, with times in
+// seconds.
+type whisperResponse struct {
+	Language string `json:"language"`
+	Text     string `json:"text"`
+	Segments []struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		Text  string  `json:"text"`
+	} `json:"segments"`
+}
+
+func (w *Whisper) Transcribe(ctx context.Context, path string) (Transcript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Transcript{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Transcript{}, err
+	}
+	if info.Size() > WhisperMaxFileSize {
+		return Transcript{}, fmt.Errorf("whisper: %s is %d bytes, over the API's limit of %d: %w", filepath.Base(path), info.Size(), WhisperMaxFileSize, ErrTooLarge)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("model", w.model)
+	form.WriteField("response_format", "verbose_json")
+	form.WriteField("timestamp_granularities[]", "segment")
+	part, err := form.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return Transcript{}, err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return Transcript{}, err
+	}
+	if err := form.Close(); err != nil {
+		return Transcript{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, &body)
+	if err != nil {
+		return Transcript{}, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if w.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+w.apiKey)
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("whisper: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return Transcript{}, fmt.Errorf("whisper: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var decoded whisperResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return Transcript{}, fmt.Errorf("whisper: couldn't decode transcription: %w", err)
+	}
+	transcript := Transcript{
+		Language: whisperLanguages[strings.ToLower(decoded.Language)],
+		Text:     strings.TrimSpace(decoded.Text),
+	}
+	// some servers answer with the code already
+	if transcript.Language == "" && len(decoded.Language) == 2 {
+		transcript.Language = strings.ToLower(decoded.Language)
+	}
+	for _, s := range decoded.Segments {
+		transcript.Segments = append(transcript.Segments, Segment{
+			Start: time.Duration(s.Start * float64(time.Second)),
+			End:   time.Duration(s.End * float64(time.Second)),
+			Text:  s.Text,
+		})
+	}
+	return transcript, nil
+}
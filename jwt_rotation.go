@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// how often servers reload the signing keys, and rotate when it's due
+	jwtKeyCheckInterval = time.Minute
+	// a new key only signs once every server has had time to load it, so no
+	// server is handed a token with a kid it doesn't know yet
+	jwtKeyActivationDelay = 2 * jwtKeyCheckInterval
+	// long enough for every token signed with a key rotated out to expire;
+	// login hands out tokens for 30 days
+	defaultJWTRotationGrace = 30 * 24 * time.Hour
+)
+
+// jwtRotation generates a new signing key every interval, keeping the ones
+// it replaced for grace so the tokens they signed stay valid until they
+// expire. Keys live in the database, so every server signs with the same
+// one.
+type jwtRotation struct {
+	interval time.Duration
+	grace    time.Duration
+	// JWT_SECRET and JWT_PREVIOUS_SECRETS, which sign until the first
+	// generated key takes over and are then rotated out like one
+	static []auth.SigningKey
+}
+
+func (cfg *apiConfig) runJWTKeyRotation() {
+	ticker := time.NewTicker(jwtKeyCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := cfg.rotateJWTKeys(cfg.now()); err != nil {
+			log.Printf("jwt rotation: %v", err)
+		}
+	}
+}
+
+// rotateJWTKeys adds a key when the signing one is due to be replaced,
+// drops keys past their grace and loads the rest into cfg.jwt.Keys.
+func (cfg *apiConfig) rotateJWTKeys(now time.Time) error {
+	rotation := cfg.jwtRotation
+	keys, err := cfg.db.GetSigningKeys()
+	if err != nil {
+		return fmt.Errorf("couldn't get signing keys: %w", err)
+	}
+	// made ahead of time, so it's active when the interval is up
+	if len(keys) == 0 || now.Sub(keys[0].CreatedAt) >= rotation.interval-jwtKeyActivationDelay {
+		secret, err := auth.MakeRefreshToken()
+		if err != nil {
+			return err
+		}
+		key := database.SigningKey{ID: uuid.NewString(), CreatedAt: now.UTC(), Secret: secret}
+		if err := cfg.db.CreateSigningKey(key); err != nil {
+			return fmt.Errorf("couldn't create signing key: %w", err)
+		}
+		log.Printf("jwt rotation: created signing key %s", key.ID)
+		keys = append([]database.SigningKey{key}, keys...)
+	}
+
+	// keys are newest first; each signed until the one before it became
+	// active
+	var signing *auth.SigningKey
+	var accepted []auth.SigningKey
+	var replacedAt time.Time
+	for _, key := range keys {
+		activeAt := key.CreatedAt.Add(jwtKeyActivationDelay)
+		k := auth.SigningKey{ID: key.ID, Secret: key.Secret}
+		switch {
+		case now.Before(activeAt):
+			// not signing yet, but known to every server when it is
+		case signing == nil:
+			signing = &k
+		default:
+			k.AcceptUntil = replacedAt.Add(rotation.grace)
+		}
+		if !now.Before(activeAt) {
+			replacedAt = activeAt
+		}
+		if !k.AcceptUntil.IsZero() && now.After(k.AcceptUntil) {
+			if err := cfg.db.DeleteSigningKey(key.ID); err != nil {
+				return fmt.Errorf("couldn't delete signing key: %w", err)
+			}
+			log.Printf("jwt rotation: retired signing key %s", key.ID)
+			continue
+		}
+		if signing == nil || k.ID != signing.ID {
+			accepted = append(accepted, k)
+		}
+	}
+
+	for _, key := range rotation.static {
+		if signing == nil {
+			signing = &key
+			continue
+		}
+		if !replacedAt.IsZero() {
+			key.AcceptUntil = replacedAt.Add(rotation.grace)
+			if now.After(key.AcceptUntil) {
+				continue
+			}
+		}
+		accepted = append(accepted, key)
+	}
+	cfg.jwt.Keys.Set(*signing, accepted...)
+	return nil
+}
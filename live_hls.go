@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const liveArchiveInterval = 2 * time.Second
+
+type liveArchivers struct {
+	mu        sync.Mutex
+	archivers map[uuid.UUID]*liveArchiver
+}
+
+// liveArchiver copies finished HLS segments of an active stream to S3 so
+// they survive nginx-rtmp's playlist cleanup and can be stitched into a VOD.
+type liveArchiver struct {
+	stream   database.LiveStream
+	dir      string
+	archived []string
+	seen     map[string]bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (cfg *apiConfig) liveStreamHLSDir(stream database.LiveStream) string {
+	return filepath.Join(cfg.liveHLSDir, stream.StreamKey)
+}
+
+func liveArchivePrefix(streamID uuid.UUID) string {
+	return path.Join("live", streamID.String()) + "/"
+}
+
+func liveArchiveKey(streamID uuid.UUID, segment string) string {
+	return liveArchivePrefix(streamID) + segment
+}
+
+func (cfg *apiConfig) startLiveArchive(stream database.LiveStream) {
+	cfg.liveArchivers.mu.Lock()
+	defer cfg.liveArchivers.mu.Unlock()
+	if _, ok := cfg.liveArchivers.archivers[stream.ID]; ok {
+		return
+	}
+
+	a := &liveArchiver{
+		stream: stream,
+		dir:    cfg.liveStreamHLSDir(stream),
+		seen:   map[string]bool{},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	cfg.liveArchivers.archivers[stream.ID] = a
+	go cfg.runLiveArchive(a)
+}
+
+// finishLiveArchive stops archiving, uploads the remaining segments and
+// publishes the stitched recording as a video. The segments are dropped once
+// it's published, and kept to stitch again by hand if it isn't.
+func (cfg *apiConfig) finishLiveArchive(stream database.LiveStream) {
+	cfg.liveArchivers.mu.Lock()
+	a, ok := cfg.liveArchivers.archivers[stream.ID]
+	delete(cfg.liveArchivers.archivers, stream.ID)
+	cfg.liveArchivers.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	close(a.stop)
+	<-a.done
+
+	if len(a.archived) == 0 {
+		log.Printf("live: stream %s ended without any archived segments", stream.ID)
+		return
+	}
+
+	store := cfg.defaultStore()
+	stitchedPath, err := cfg.stitchLiveArchive(store, stream.ID, a.archived)
+	if err != nil {
+		log.Printf("live: couldn't stitch archive for stream %s: %v", stream.ID, err)
+		return
+	}
+	if cfg.publishLiveRecording(stream, stitchedPath) {
+		dropLiveArchive(context.Background(), store, stream.ID)
+	}
+}
+
+func (cfg *apiConfig) runLiveArchive(a *liveArchiver) {
+	defer close(a.done)
+
+	ticker := time.NewTicker(liveArchiveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cfg.archiveLiveSegments(a)
+		case <-a.stop:
+			cfg.archiveLiveSegments(a)
+			return
+		}
+	}
+}
+
+// archiveLiveSegments uploads every segment referenced by the current
+// playlist that hasn't been uploaded yet. nginx only lists a segment once it
+// has been fully written.
+func (cfg *apiConfig) archiveLiveSegments(a *liveArchiver) {
+	segments, err := readHLSPlaylistSegments(filepath.Join(a.dir, "index.m3u8"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("live: couldn't read playlist for stream %s: %v", a.stream.ID, err)
+		}
+		return
+	}
+
+	for _, segment := range segments {
+		if a.seen[segment] {
+			continue
+		}
+		err := cfg.uploadLiveSegment(a.stream.ID, filepath.Join(a.dir, segment), segment)
+		if err != nil {
+			log.Printf("live: couldn't archive segment %s of stream %s: %v", segment, a.stream.ID, err)
+			return
+		}
+		a.seen[segment] = true
+		a.archived = append(a.archived, segment)
+	}
+}
+
+func (cfg *apiConfig) uploadLiveSegment(streamID uuid.UUID, localPath, segment string) error {
+	return cfg.uploadFileToS3(context.Background(), cfg.defaultStore(), liveArchiveKey(streamID, segment), "video/mp2t", localPath)
+}
+
+func readHLSPlaylistSegments(playlistPath string) ([]string, error) {
+	f, err := os.Open(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	segments := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		segments = append(segments, path.Base(line))
+	}
+	return segments, scanner.Err()
+}
+
+// stitchLiveArchive downloads the archived segments in order and
+// concatenates them. MPEG-TS segments can be joined byte for byte, ffmpeg
+// remuxes the result into mp4 during ingest.
+func (cfg *apiConfig) stitchLiveArchive(store objectStore, streamID uuid.UUID, segments []string) (string, error) {
+	stitched, err := os.CreateTemp(cfg.spoolDir, "tubely-live-*.ts")
+	if err != nil {
+		return "", err
+	}
+	defer stitched.Close()
+
+	for _, segment := range segments {
+		out, err := store.client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(liveArchiveKey(streamID, segment)),
+		})
+		if err != nil {
+			os.Remove(stitched.Name())
+			return "", fmt.Errorf("couldn't download segment %s: %w", segment, err)
+		}
+		_, err = io.Copy(stitched, out.Body)
+		out.Body.Close()
+		if err != nil {
+			os.Remove(stitched.Name())
+			return "", fmt.Errorf("couldn't write segment %s: %w", segment, err)
+		}
+	}
+
+	return stitched.Name(), nil
+}
+
+// dropLiveArchive deletes the archived segments of a stream.
+func dropLiveArchive(ctx context.Context, store objectStore, streamID uuid.UUID) {
+	objects, err := listStagedObjects(ctx, store, liveArchivePrefix(streamID))
+	if err != nil {
+		log.Printf("live: couldn't list archive of stream %s: %v", streamID, err)
+		return
+	}
+	for _, obj := range objects {
+		_, err := store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(obj.Key),
+		})
+		if err != nil {
+			log.Printf("live: couldn't delete %s: %v", obj.Key, err)
+		}
+	}
+}
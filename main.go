@@ -5,26 +5,104 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/jobs"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/malware"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/pipeline"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/transcribe"
+	"github.com/google/uuid"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Bucket         string
-	s3Region         string
-	s3Client         *s3.Client
-	s3CfDistribution string
-	port             string
+	db                 database.Client
+	jwt                auth.JWTConfig
+	platform           string
+	filepathRoot       string
+	assetsRoot         string
+	s3Bucket           string
+	s3Region           string
+	s3Client           *s3.Client
+	s3CfDistribution   string
+	port               string
+	rtmpIngestURL      string
+	rtmpCallbackSecret string
+	rtmpRecordDir      string
+	// generates JWT signing keys; nil to only use the configured secrets
+	jwtRotation *jwtRotation
+	// signs long-lived links, apart from the JWT keys so they outlive rotation
+	urlSigningSecret string
+	// signs external transcoder callbacks; the endpoint is off when empty
+	transcoderCallbackSecret string
+	liveHLSDir               string
+	liveArchivers            *liveArchivers
+	videoLocks               *videoLocks
+	uploadProgresses         *uploadProgresses
+	watermarkRenders         *watermarkRenders
+	userStores               *userStores
+	spoolDir                 string
+	spoolDirectIO            bool
+	// deployment-wide cap on video size, on top of plan limits; 0 for none
+	maxUploadSize int64
+	s3Retry       s3RetryPolicy
+	// checks a video has to pass to be made public
+	publishGates []publishGate
+	// checks uploads before they're published; nil to skip
+	scanner malware.Scanner
+	// per-user cap on uploads in flight; nil for none
+	uploadSlots *uploadSlots
+	// cuts uploads that stall; a zero window for none
+	uploadDeadline uploadDeadline
+	// cut uploads into HLS and DASH segments next to the mp4
+	hlsEnabled  bool
+	dashEnabled bool
+	// tile frames of uploads into seek bar previews
+	storyboardsEnabled bool
+	// heights to encode each upload at as well, tallest first
+	ladder []int
+	// composited onto uploads of users without branding of their own; nil
+	// for none
+	branding *branding
+	// integrated loudness in LUFS to normalize audio to; zero to leave it
+	// as uploaded
+	loudnormTarget float64
+	// transcribes uploads for captions and search; nil for none
+	transcriber transcribe.Transcriber
+	// sizes and formats every thumbnail is also stored in
+	thumbnailPipeline thumbnailPipeline
+	// local copies to play from while S3 is down; nil for none
+	playbackCache *playbackCache
+	// how views are counted for owners without a policy of their own
+	analytics      database.AnalyticsPolicy
+	s3Replicas     []regionalReplica
+	geoIP          *geoIP
+	adminAlerts    *adminAlerts
+	presignMonitor *presignMonitor
+	// where video updates that failed after an upload wait to be retried
+	reconcileDir string
+	// stage timings of the upload pipelines
+	pipelineMetrics *pipeline.Metrics
+	// fetches videos for URL uploads
+	ingestClient *http.Client
+	// sends deliveries to users' webhooks
+	webhookClient *http.Client
+	// background work that outlives requests
+	jobs *jobs.Queue
+	// nil for the wall clock
+	clock func() time.Time
 }
 
 func main() {
@@ -39,12 +117,69 @@ func main() {
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
+	// their workers went with the process that was running them
+	if err := db.RequeueRunningJobs(); err != nil {
+		log.Fatalf("Couldn't requeue interrupted jobs: %v", err)
+	}
 
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
 		log.Fatal("JWT_SECRET environment variable is not set")
 	}
 
+	// previous secrets are still accepted for validation while they rotate out
+	jwtSecrets := []string{jwtSecret}
+	for _, secret := range strings.Split(os.Getenv("JWT_PREVIOUS_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			jwtSecrets = append(jwtSecrets, secret)
+		}
+	}
+
+	// before it was split out, links were signed with JWT_SECRET, so that's
+	// what keeps them valid until one is set
+	urlSigningSecret := os.Getenv("URL_SIGNING_SECRET")
+	if urlSigningSecret == "" {
+		urlSigningSecret = jwtSecret
+	}
+
+	jwtIssuer := os.Getenv("JWT_ISSUER")
+	if jwtIssuer == "" {
+		jwtIssuer = string(auth.TokenTypeAccess)
+	}
+
+	jwtAudience := os.Getenv("JWT_AUDIENCE")
+	if jwtAudience == "" {
+		jwtAudience = "tubely"
+	}
+
+	jwtClockSkew := 30 * time.Second
+	if skew := os.Getenv("JWT_CLOCK_SKEW"); skew != "" {
+		jwtClockSkew, err = time.ParseDuration(skew)
+		if err != nil {
+			log.Fatalf("Invalid JWT_CLOCK_SKEW: %v", err)
+		}
+	}
+
+	staticKeys := make([]auth.SigningKey, 0, len(jwtSecrets))
+	for _, secret := range jwtSecrets {
+		staticKeys = append(staticKeys, auth.SigningKey{ID: auth.KeyID(secret), Secret: secret})
+	}
+	var rotation *jwtRotation
+	if v := os.Getenv("JWT_ROTATION_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval < time.Hour {
+			log.Fatalf("JWT_ROTATION_INTERVAL must be a duration of at least 1h: %s", v)
+		}
+		grace := defaultJWTRotationGrace
+		if v := os.Getenv("JWT_ROTATION_GRACE"); v != "" {
+			grace, err = time.ParseDuration(v)
+			if err != nil || grace < 0 {
+				log.Fatalf("Invalid JWT_ROTATION_GRACE: %s", v)
+			}
+		}
+		rotation = &jwtRotation{interval: interval, grace: grace, static: staticKeys}
+	}
+
 	platform := os.Getenv("PLATFORM")
 	if platform == "" {
 		log.Fatal("PLATFORM environment variable is not set")
@@ -80,26 +215,327 @@ func main() {
 		log.Fatal("PORT environment variable is not set")
 	}
 
+	spoolDir := os.Getenv("SPOOL_DIR")
+	if spoolDir == "" {
+		spoolDir = os.TempDir()
+	}
+	err = os.MkdirAll(spoolDir, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create spool directory: %v", err)
+	}
+
+	spoolDirectIO := false
+	if v := os.Getenv("SPOOL_DIRECT_IO"); v != "" {
+		spoolDirectIO, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("SPOOL_DIRECT_IO must be true or false: %s", v)
+		}
+		if spoolDirectIO && !directIOSupported {
+			log.Fatal("SPOOL_DIRECT_IO is only supported on Linux")
+		}
+	}
+
+	var maxUploadSize int64
+	if v := os.Getenv("MAX_UPLOAD_SIZE"); v != "" {
+		maxUploadSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxUploadSize < 0 {
+			log.Fatalf("MAX_UPLOAD_SIZE must be a number of bytes: %s", v)
+		}
+	}
+
+	s3Retry := defaultS3RetryPolicy
+	if v := os.Getenv("S3_PUT_ATTEMPTS"); v != "" {
+		s3Retry.Attempts, err = strconv.Atoi(v)
+		if err != nil || s3Retry.Attempts < 1 {
+			log.Fatalf("S3_PUT_ATTEMPTS must be a positive number: %s", v)
+		}
+	}
+
+	hlsEnabled := false
+	if v := os.Getenv("HLS_ENABLED"); v != "" {
+		hlsEnabled, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("HLS_ENABLED must be true or false: %s", v)
+		}
+	}
+	dashEnabled := false
+	if v := os.Getenv("DASH_ENABLED"); v != "" {
+		dashEnabled, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("DASH_ENABLED must be true or false: %s", v)
+		}
+	}
+	storyboardsEnabled := false
+	if v := os.Getenv("STORYBOARDS_ENABLED"); v != "" {
+		storyboardsEnabled, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("STORYBOARDS_ENABLED must be true or false: %s", v)
+		}
+	}
+	var ladder []int
+	for _, v := range strings.Split(os.Getenv("RENDITION_LADDER"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		height, err := strconv.Atoi(strings.TrimSuffix(v, "p"))
+		if err != nil || height < 2 || height%2 != 0 {
+			log.Fatalf("RENDITION_LADDER must be a list of even heights: %s", v)
+		}
+		ladder = append(ladder, height)
+	}
+	slices.Sort(ladder)
+	slices.Reverse(ladder)
+	ladder = slices.Compact(ladder)
+
+	var loudnormTarget float64
+	if v := os.Getenv("LOUDNORM_TARGET_LUFS"); v != "" {
+		loudnormTarget, err = strconv.ParseFloat(v, 64)
+		if err != nil || loudnormTarget < minLoudnormTarget || loudnormTarget > maxLoudnormTarget {
+			log.Fatalf("LOUDNORM_TARGET_LUFS must be a loudness between %d and %d: %s", minLoudnormTarget, maxLoudnormTarget, v)
+		}
+	}
+
+	var deploymentBranding *branding
+	if v := os.Getenv("BRANDING_IMAGE"); v != "" {
+		if _, err := os.Stat(v); err != nil {
+			log.Fatalf("BRANDING_IMAGE must be an image file: %v", err)
+		}
+		deploymentBranding = &branding{imagePath: v, position: defaultBrandingPosition}
+		if p := os.Getenv("BRANDING_POSITION"); p != "" {
+			if !validBrandingPosition(p) {
+				log.Fatalf("BRANDING_POSITION must be top-left, top-right, bottom-left or bottom-right: %s", p)
+			}
+			deploymentBranding.position = p
+		}
+	}
+
+	var transcriber transcribe.Transcriber
+	if key := os.Getenv("WHISPER_API_KEY"); key != "" {
+		transcriber = transcribe.NewWhisper(os.Getenv("WHISPER_API_URL"), key, os.Getenv("WHISPER_MODEL"))
+	}
+
+	var thumbnails thumbnailPipeline
+	for _, v := range strings.Split(os.Getenv("THUMBNAIL_WIDTHS"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		width, err := strconv.Atoi(v)
+		if err != nil || width < 1 {
+			log.Fatalf("THUMBNAIL_WIDTHS must be a list of widths: %s", v)
+		}
+		thumbnails.widths = append(thumbnails.widths, width)
+	}
+	slices.Sort(thumbnails.widths)
+	thumbnails.widths = slices.Compact(thumbnails.widths)
+	thumbnails.formats = []string{"jpeg"}
+	if v := os.Getenv("THUMBNAIL_FORMATS"); v != "" {
+		thumbnails.formats = nil
+		for _, format := range strings.Split(v, ",") {
+			format = strings.TrimSpace(format)
+			if _, ok := thumbnailFormats[format]; !ok {
+				log.Fatalf("THUMBNAIL_FORMATS must be a list of jpeg and webp: %s", format)
+			}
+			if !slices.Contains(thumbnails.formats, format) {
+				thumbnails.formats = append(thumbnails.formats, format)
+			}
+		}
+	}
+
+	jobWorkers := defaultJobWorkers
+	if v := os.Getenv("JOB_WORKERS"); v != "" {
+		jobWorkers, err = strconv.Atoi(v)
+		if err != nil || jobWorkers < 1 {
+			log.Fatalf("JOB_WORKERS must be a positive number: %s", v)
+		}
+	}
+
+	maxConcurrentUploads := defaultMaxConcurrentUploads
+	if v := os.Getenv("MAX_CONCURRENT_UPLOADS"); v != "" {
+		maxConcurrentUploads, err = strconv.Atoi(v)
+		if err != nil || maxConcurrentUploads < 0 {
+			log.Fatalf("MAX_CONCURRENT_UPLOADS must be a number: %s", v)
+		}
+	}
+
+	uploadDeadline := uploadDeadline{window: defaultUploadStallTimeout, minRate: defaultUploadMinRate}
+	if v := os.Getenv("UPLOAD_STALL_TIMEOUT"); v != "" {
+		uploadDeadline.window, err = time.ParseDuration(v)
+		if err != nil || uploadDeadline.window < 0 {
+			log.Fatalf("Invalid UPLOAD_STALL_TIMEOUT: %s", v)
+		}
+	}
+	if v := os.Getenv("UPLOAD_MIN_RATE"); v != "" {
+		uploadDeadline.minRate, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || uploadDeadline.minRate < 0 {
+			log.Fatalf("UPLOAD_MIN_RATE must be a number of bytes a second: %s", v)
+		}
+	}
+
+	analytics := database.AnalyticsPolicy{MinViewers: defaultAnalyticsMinViewers, TruncateIPs: true}
+	if v := os.Getenv("ANALYTICS_ENABLED"); v != "" {
+		analytics.Enabled, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("ANALYTICS_ENABLED must be true or false: %s", v)
+		}
+	}
+	if v := os.Getenv("ANALYTICS_MIN_VIEWERS"); v != "" {
+		analytics.MinViewers, err = strconv.Atoi(v)
+		if err != nil || analytics.MinViewers < 1 {
+			log.Fatalf("ANALYTICS_MIN_VIEWERS must be a positive number: %s", v)
+		}
+	}
+	if v := os.Getenv("ANALYTICS_TRUNCATE_IPS"); v != "" {
+		analytics.TruncateIPs, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("ANALYTICS_TRUNCATE_IPS must be true or false: %s", v)
+		}
+	}
+
+	var playbackCache *playbackCache
+	if dir := os.Getenv("PLAYBACK_CACHE_DIR"); dir != "" {
+		maxBytes := int64(defaultPlaybackCacheMaxBytes)
+		if v := os.Getenv("PLAYBACK_CACHE_MAX_BYTES"); v != "" {
+			maxBytes, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || maxBytes <= 0 {
+				log.Fatalf("PLAYBACK_CACHE_MAX_BYTES must be a positive number: %s", v)
+			}
+		}
+		playbackCache, err = newPlaybackCache(dir, maxBytes)
+		if err != nil {
+			log.Fatalf("Couldn't create playback cache directory: %v", err)
+		}
+	}
+
+	publishGates, err := parsePublishGates(os.Getenv("PUBLISH_GATES"))
+	if err != nil {
+		log.Fatalf("PUBLISH_GATES: %v", err)
+	}
+
+	var scanner malware.Scanner
+	if addr := os.Getenv("CLAMD_ADDR"); addr != "" {
+		scanner, err = malware.NewClamd(addr)
+		if err != nil {
+			log.Fatalf("CLAMD_ADDR: %v", err)
+		}
+	}
+
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		db: db,
+		jwt: auth.JWTConfig{
+			Secrets:  jwtSecrets,
+			Keys:     auth.NewKeySet(staticKeys[0], staticKeys[1:]...),
+			Issuer:   jwtIssuer,
+			Audience: jwtAudience,
+			// tokens from before JWT_ISSUER and JWT_AUDIENCE existed
+			LegacyIssuer: string(auth.TokenTypeAccess),
+			ClockSkew:    jwtClockSkew,
+		},
+		urlSigningSecret:   urlSigningSecret,
+		platform:           platform,
+		filepathRoot:       filepathRoot,
+		assetsRoot:         assetsRoot,
+		s3Bucket:           s3Bucket,
+		s3Region:           s3Region,
+		s3CfDistribution:   s3CfDistribution,
+		port:               port,
+		spoolDir:           spoolDir,
+		spoolDirectIO:      spoolDirectIO,
+		maxUploadSize:      maxUploadSize,
+		s3Retry:            s3Retry,
+		publishGates:       publishGates,
+		scanner:            scanner,
+		hlsEnabled:         hlsEnabled,
+		dashEnabled:        dashEnabled,
+		ladder:             ladder,
+		loudnormTarget:     loudnormTarget,
+		branding:           deploymentBranding,
+		transcriber:        transcriber,
+		thumbnailPipeline:  thumbnails,
+		storyboardsEnabled: storyboardsEnabled,
+		jwtRotation:        rotation,
+		playbackCache:      playbackCache,
+		analytics:          analytics,
+		uploadDeadline:     uploadDeadline,
+		// next to the database, which is what they're waiting on
+		reconcileDir:    filepath.Join(filepath.Dir(pathToDB), "reconcile"),
+		pipelineMetrics: pipeline.NewMetrics(),
 	}
 
+	presignAlertPerMinute := defaultPresignAlertPerMinute
+	if limit := os.Getenv("PRESIGN_ALERT_PER_MINUTE"); limit != "" {
+		presignAlertPerMinute, err = strconv.Atoi(limit)
+		if err != nil || presignAlertPerMinute <= 0 {
+			log.Fatalf("PRESIGN_ALERT_PER_MINUTE must be a positive number: %s", limit)
+		}
+	}
+	if maxConcurrentUploads > 0 {
+		cfg.uploadSlots = newUploadSlots(maxConcurrentUploads)
+	}
+	cfg.adminAlerts = newAdminAlerts(os.Getenv("ADMIN_ALERTS_URL"), os.Getenv("ADMIN_ALERTS_SECRET"))
+	cfg.presignMonitor = newPresignMonitor(presignAlertPerMinute, cfg.adminAlerts)
+	cfg.videoLocks = &videoLocks{locks: map[uuid.UUID]*videoLock{}}
+	cfg.uploadProgresses = &uploadProgresses{uploads: map[uuid.UUID]*uploadProgress{}}
+	cfg.watermarkRenders = &watermarkRenders{inFlight: map[string]bool{}}
+	cfg.userStores = &userStores{stores: map[uuid.UUID]userStore{}}
+	cfg.jobs = cfg.newJobQueue(jobWorkers)
+	// dev is allowed to ingest from a server on the same machine
+	cfg.ingestClient = newIngestClient(platform == "dev")
+	cfg.webhookClient = newWebhookClient(platform == "dev")
+
 	// AWS config
 	awsCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(cfg.s3Region))
 	if err != nil {
 		log.Fatal("unable to load AWS SDK config:", err)
 	}
 
-	s3Client := s3.NewFromConfig(awsCfg)
+	s3Options := setupFaultInjection()
+	// LocalStack and MinIO only speak path-style requests
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		s3Options = append(s3Options, func(o *s3.Options) {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		})
+	}
+	s3Client := s3.NewFromConfig(awsCfg, s3Options...)
 	cfg.s3Client = s3Client
+	ffmpeg.SetPaths(os.Getenv("FFMPEG_PATH"), os.Getenv("FFPROBE_PATH"))
+	ffmpegConcurrency := defaultFFmpegConcurrency
+	if v := os.Getenv("FFMPEG_CONCURRENCY"); v != "" {
+		ffmpegConcurrency, err = strconv.Atoi(v)
+		if err != nil || ffmpegConcurrency < 0 {
+			log.Fatalf("FFMPEG_CONCURRENCY must be a number: %s", v)
+		}
+	}
+	ffmpegTimeout := defaultFFmpegTimeout
+	if v := os.Getenv("FFMPEG_TIMEOUT"); v != "" {
+		ffmpegTimeout, err = time.ParseDuration(v)
+		if err != nil || ffmpegTimeout < 0 {
+			log.Fatalf("Invalid FFMPEG_TIMEOUT: %s", v)
+		}
+	}
+	ffprobeTimeout := defaultFFprobeTimeout
+	if v := os.Getenv("FFPROBE_TIMEOUT"); v != "" {
+		ffprobeTimeout, err = time.ParseDuration(v)
+		if err != nil || ffprobeTimeout < 0 {
+			log.Fatalf("Invalid FFPROBE_TIMEOUT: %s", v)
+		}
+	}
+	ffmpeg.SetLimits(ffmpegConcurrency, ffmpegTimeout, ffprobeTimeout)
+
+	cfg.s3Replicas, err = parseReplicas(os.Getenv("S3_REPLICAS"), s3Client)
+	if err != nil {
+		log.Fatalf("S3_REPLICAS: %v", err)
+	}
+	cfg.geoIP = &geoIP{header: defaultGeoIPCountryHeader}
+	if header, ok := os.LookupEnv("GEOIP_COUNTRY_HEADER"); ok {
+		cfg.geoIP.header = header
+	}
+	if path := os.Getenv("GEOIP_DB"); path != "" {
+		cfg.geoIP.ranges, err = loadGeoIPRanges(path)
+		if err != nil {
+			log.Fatalf("Couldn't load GEOIP_DB: %v", err)
+		}
+	}
 
 	err = cfg.ensureAssetsDir()
 	if err != nil {
@@ -111,33 +547,215 @@ func main() {
 		log.Fatal("unable to list S3 buckets:", err)
 	}
 
+	if len(os.Args) > 1 {
+		err = cfg.runCommand(os.Args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// uploads can't do anything without these, so don't start without them
+	versions, err := ffmpeg.Check(context.Background())
+	if err != nil {
+		log.Fatalf("%v; install it or point FFMPEG_PATH/FFPROBE_PATH at it", err)
+	}
+	for _, v := range versions {
+		log.Printf("Using %s %s at %s", v.Command, v.Version, v.Path)
+	}
+
+	if v := os.Getenv("DEMO_SEED"); v != "" {
+		seed, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("DEMO_SEED must be true or false: %s", v)
+		}
+		if seed {
+			if err := cfg.seedDemo(context.Background()); err != nil {
+				log.Fatalf("Couldn't seed demo data: %v", err)
+			}
+		}
+	}
+
+	sftpAddr := os.Getenv("SFTP_ADDR")
+	if sftpAddr != "" {
+		sftpRoot := os.Getenv("SFTP_ROOT")
+		if sftpRoot == "" {
+			sftpRoot = "./sftp"
+		}
+		err = cfg.startSFTPServer(sftpAddr, sftpRoot, os.Getenv("SFTP_HOST_KEY"))
+		if err != nil {
+			log.Fatalf("Couldn't start SFTP server: %v", err)
+		}
+	}
+
+	watchDir := os.Getenv("WATCH_DIR")
+	if watchDir != "" {
+		watchUserEmail := os.Getenv("WATCH_USER_EMAIL")
+		if watchUserEmail == "" {
+			log.Fatal("WATCH_USER_EMAIL must be set when WATCH_DIR is set")
+		}
+		watchUser, err := db.GetUserByEmail(watchUserEmail)
+		if err != nil {
+			log.Fatalf("Couldn't get watch folder user: %v", err)
+		}
+		if watchUser.Email == "" {
+			log.Fatalf("Watch folder user %s doesn't exist", watchUserEmail)
+		}
+		err = cfg.startWatchFolder(watchDir, watchUser.ID)
+		if err != nil {
+			log.Fatalf("Couldn't start watch folder: %v", err)
+		}
+	}
+
+	cfg.rtmpCallbackSecret = os.Getenv("RTMP_CALLBACK_SECRET")
+	cfg.rtmpIngestURL = os.Getenv("RTMP_INGEST_URL")
+	cfg.rtmpRecordDir = os.Getenv("RTMP_RECORD_DIR")
+	if cfg.rtmpCallbackSecret != "" && cfg.rtmpRecordDir == "" {
+		log.Fatal("RTMP_RECORD_DIR must be set when RTMP_CALLBACK_SECRET is set")
+	}
+	cfg.liveHLSDir = os.Getenv("LIVE_HLS_DIR")
+	cfg.transcoderCallbackSecret = os.Getenv("TRANSCODER_CALLBACK_SECRET")
+	cfg.liveArchivers = &liveArchivers{archivers: map[uuid.UUID]*liveArchiver{}}
+
+	cfg.jobs.Start(context.Background())
+	go cfg.runPremiereScheduler()
+	go cfg.runUploadDirJanitor()
+	go cfg.runPlaybackSessionJanitor()
+	go cfg.runRetentionScheduler()
+	go cfg.runPublishReconciler()
+	if cfg.jwtRotation != nil {
+		if err := cfg.rotateJWTKeys(cfg.now()); err != nil {
+			log.Fatalf("Couldn't load JWT signing keys: %v", err)
+		}
+		go cfg.runJWTKeyRotation()
+	}
+
+	// no ReadTimeout: uploads get their own deadline, which moves on while
+	// they make progress
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           cfg.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("Serving on: http://localhost:%s/app/\n", port)
+	log.Fatal(srv.ListenAndServe())
+}
+
+// routes registers every handler, the API surface integration tests drive
+// through httptest.
+func (cfg *apiConfig) routes() *http.ServeMux {
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(cfg.filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(cfg.assetsRoot)))
+	mux.Handle("/assets/", noCacheMiddleware(cfg.privateAssetMiddleware(assetsHandler)))
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("GET /api/users/me/plan", cfg.handlerUserPlanGet)
+	mux.HandleFunc("GET /api/users/me/usage", cfg.handlerUserUsageGet)
+	mux.HandleFunc("GET /api/users/me/stitch_clips", cfg.handlerStitchClipsRetrieve)
+	mux.HandleFunc("PUT /api/users/me/stitch_clips/{kind}", cfg.handlerStitchClipUpload)
+	mux.HandleFunc("DELETE /api/users/me/stitch_clips/{kind}", cfg.handlerStitchClipDelete)
+
+	mux.HandleFunc("GET /api/upload-config", cfg.handlerUploadConfig)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.idempotent(cfg.handlerUploadThumbnail))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.keepUploadAlive(cfg.limitUploads(cfg.idempotent(cfg.handlerUploadVideo))))
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}/base64", cfg.idempotent(cfg.handlerUploadThumbnailBase64))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/base64", cfg.keepUploadAlive(cfg.limitUploads(cfg.idempotent(cfg.handlerUploadVideoBase64))))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/stream", cfg.keepUploadAlive(cfg.limitUploads(cfg.idempotent(cfg.handlerUploadVideoStream))))
+	mux.HandleFunc("POST /api/videos/{videoID}/ingest", cfg.limitUploads(cfg.idempotent(cfg.handlerUploadVideoURL)))
+	mux.HandleFunc("POST /api/video_upload/batch", cfg.keepUploadAlive(cfg.limitUploads(cfg.idempotent(cfg.handlerUploadBatch))))
+	mux.HandleFunc("OPTIONS /api/tus/{$}", cfg.handlerTusOptions)
+	mux.HandleFunc("POST /api/tus/{$}", cfg.handlerTusCreate)
+	mux.HandleFunc("HEAD /api/tus/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH /api/tus/{uploadID}", cfg.keepUploadAlive(cfg.limitUploads(cfg.handlerTusPatch)))
+	mux.HandleFunc("DELETE /api/tus/{uploadID}", cfg.handlerTusDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/validate-upload", cfg.handlerVideoValidateUpload)
+	mux.HandleFunc("GET /api/videos/{videoID}/upload/progress", cfg.handlerUploadProgress)
+	mux.HandleFunc("POST /api/videos/{videoID}/upload/init", cfg.idempotent(cfg.handlerChunkedUploadInit))
+	mux.HandleFunc("PUT /api/videos/{videoID}/upload/{uploadID}/parts/{partNumber}", cfg.keepUploadAlive(cfg.handlerChunkedUploadPart))
+	mux.HandleFunc("POST /api/videos/{videoID}/upload/{uploadID}/complete", cfg.limitUploads(cfg.idempotent(cfg.handlerChunkedUploadComplete)))
+	mux.HandleFunc("DELETE /api/videos/{videoID}/upload/{uploadID}", cfg.handlerChunkedUploadAbort)
+	mux.HandleFunc("POST /api/videos/{videoID}/upload/direct", cfg.idempotent(cfg.handlerDirectUploadInit))
+	mux.HandleFunc("POST /api/videos/{videoID}/upload/form", cfg.idempotent(cfg.handlerFormUploadInit))
+	mux.HandleFunc("POST /api/videos/{videoID}/upload/direct/{uploadID}/confirm", cfg.idempotent(cfg.handlerDirectUploadConfirm))
+	mux.HandleFunc("DELETE /api/videos/{videoID}/upload/direct/{uploadID}", cfg.handlerDirectUploadAbort)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("POST /api/videos/archive", cfg.handlerVideoArchiveCreate)
+	mux.HandleFunc("GET /api/archives/{archiveID}", cfg.handlerVideoArchiveGet)
+	mux.HandleFunc("GET /api/jobs/{jobID}", cfg.handlerJobGet)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("PUT /api/videos/{videoID}/premiere", cfg.handlerVideoPremiereSet)
+	mux.HandleFunc("PUT /api/videos/{videoID}/visibility", cfg.handlerVideoVisibilitySet)
+	mux.HandleFunc("PUT /api/videos/{videoID}/watermark", cfg.handlerVideoWatermarkSet)
+	mux.HandleFunc("POST /api/videos/{videoID}/collaborators", cfg.handlerVideoCollaboratorSet)
+	mux.HandleFunc("GET /api/videos/{videoID}/collaborators", cfg.handlerVideoCollaboratorsRetrieve)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/collaborators/{userID}", cfg.handlerVideoCollaboratorDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/transfer", cfg.handlerVideoTransfer)
+	mux.HandleFunc("GET /api/videos/{videoID}/processing-log", cfg.handlerProcessingLogRetrieve)
+	mux.HandleFunc("POST /api/videos/{videoID}/embeds", cfg.handlerEmbedTokenCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/embeds", cfg.handlerEmbedTokensRetrieve)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/embeds/{tokenID}", cfg.handlerEmbedTokenDelete)
+	mux.HandleFunc("GET /embed/{videoID}", cfg.handlerEmbedPage)
+	mux.HandleFunc("GET /api/embed/{videoID}/playback-url", cfg.handlerEmbedPlaybackURL)
+	mux.HandleFunc("POST /api/videos/{videoID}/review-links", cfg.handlerReviewLinkCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/review-links", cfg.handlerReviewLinksRetrieve)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/review-links/{linkID}", cfg.handlerReviewLinkDelete)
+	mux.HandleFunc("GET /api/review/{videoID}/playback-url", cfg.handlerReviewPlaybackURL)
+	mux.HandleFunc("GET /api/playback-cache/{name}", cfg.handlerPlaybackCache)
+	mux.HandleFunc("POST /api/videos/{videoID}/stitch", cfg.limitUploads(cfg.handlerVideoStitch))
+	mux.HandleFunc("POST /api/videos/{videoID}/clips", cfg.limitUploads(cfg.handlerVideoClipCreate))
+	mux.HandleFunc("GET /api/videos/{videoID}/clips", cfg.handlerVideoClipsRetrieve)
+	mux.HandleFunc("GET /api/videos/{videoID}/og.png", cfg.handlerVideoOGImage)
+	mux.HandleFunc("GET /api/videos/{videoID}/thumbnails", cfg.handlerVideoThumbnailsRetrieve)
+	mux.HandleFunc("GET /api/videos/{videoID}/metadata", cfg.handlerVideoMetadataGet)
+	mux.HandleFunc("POST /api/videos/{videoID}/playback-sessions", cfg.handlerPlaybackSessionCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/playback-url", cfg.handlerVideoPlaybackURL)
+	mux.HandleFunc("POST /api/videos/{videoID}/audio", cfg.handlerVideoAudioCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/captions", cfg.handlerVideoCaptionsRetrieve)
+	mux.HandleFunc("PUT /api/videos/{videoID}/captions/{language}", cfg.handlerVideoCaptionUpload)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/captions/{language}", cfg.handlerVideoCaptionDelete)
+	mux.HandleFunc("GET /api/videos/{videoID}/analytics", cfg.handlerVideoAnalytics)
+	mux.HandleFunc("GET /api/videos/{videoID}/versions", cfg.handlerVideoVersionsRetrieve)
+	mux.HandleFunc("POST /api/videos/{videoID}/versions/{versionID}/rollback", cfg.handlerVideoVersionRollback)
 
-	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("GET /api/notifications", cfg.handlerNotificationsRetrieve)
+	mux.HandleFunc("POST /api/notifications/read", cfg.handlerNotificationsMarkRead)
+	mux.HandleFunc("POST /api/webhooks", cfg.handlerWebhookCreate)
+	mux.HandleFunc("GET /api/webhooks", cfg.handlerWebhooksRetrieve)
+	mux.HandleFunc("DELETE /api/webhooks/{webhookID}", cfg.handlerWebhookDelete)
 
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+	mux.HandleFunc("GET /api/channels/{userID}", cfg.handlerChannelGet)
+	mux.HandleFunc("PUT /api/channels/me", cfg.handlerChannelUpdate)
+	mux.HandleFunc("POST /api/channels/me/banner", cfg.handlerChannelBannerUpload)
+	mux.HandleFunc("PUT /api/channels/me/branding", cfg.handlerChannelBrandingUpload)
+	mux.HandleFunc("DELETE /api/channels/me/branding", cfg.handlerChannelBrandingDelete)
+
+	mux.HandleFunc("POST /api/live_streams", cfg.handlerLiveStreamCreate)
+	mux.HandleFunc("GET /api/live_streams", cfg.handlerLiveStreamsRetrieve)
+	if cfg.liveHLSDir != "" {
+		mux.HandleFunc("GET /api/live_streams/{streamID}/hls/{file}", cfg.handlerLiveStreamHLS)
+	}
+	if cfg.rtmpCallbackSecret != "" {
+		mux.HandleFunc("POST /api/rtmp/on_publish", cfg.handlerRTMPOnPublish)
+		mux.HandleFunc("POST /api/rtmp/on_publish_done", cfg.handlerRTMPOnPublishDone)
+		mux.HandleFunc("POST /api/rtmp/on_record_done", cfg.handlerRTMPOnRecordDone)
+	}
+	if cfg.transcoderCallbackSecret != "" {
+		mux.HandleFunc("POST /api/transcoder/callback", cfg.handlerTranscoderCallback)
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("GET /admin/metrics", cfg.handlerMetrics)
+
+	return mux
 }
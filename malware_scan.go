@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+var (
+	errUploadQuarantined = errors.New("upload failed the malware scan")
+	errMalwareScan       = errors.New("couldn't scan upload")
+)
+
+// scanStage runs the upload past the malware scanner, when one is set up,
+// before anything is stored. An infected upload is dropped and the video
+// marked quarantined, keeping whatever it played before. An upload that
+// can't be scanned isn't published either.
+func (cfg *apiConfig) scanStage(ctx context.Context, in *videoIngest) error {
+	video, err := cfg.scanUpload(ctx, in.video, in.filePath, in.uploadSHA256)
+	in.video = video
+	return err
+}
+
+// scanUpload scans the upload of video at path, quarantining the video if
+// it's infected. It returns the video as it stands after.
+func (cfg *apiConfig) scanUpload(ctx context.Context, video database.Video, path, uploadSHA256 string) (database.Video, error) {
+	if cfg.scanner == nil {
+		return video, nil
+	}
+	result, err := cfg.scanner.Scan(ctx, path)
+	if err != nil {
+		return video, fmt.Errorf("%w: %w", errMalwareScan, err)
+	}
+	if !result.Infected {
+		return video, nil
+	}
+
+	cfg.adminAlerts.send("upload_quarantined", "Malware scanner rejected an upload", map[string]any{
+		"video_id":  video.ID,
+		"user_id":   video.UserID,
+		"signature": result.Signature,
+		"sha256":    uploadSHA256,
+	})
+	now := cfg.now().UTC()
+	quarantined, err := cfg.updateVideo(video.ID, func(video *database.Video) {
+		video.QuarantinedAt = &now
+		video.QuarantineReason = &result.Signature
+	})
+	if err != nil {
+		log.Printf("Couldn't quarantine video %s: %v", video.ID, err)
+	} else {
+		video = quarantined
+	}
+	return video, fmt.Errorf("%w: %s", errUploadQuarantined, result.Signature)
+}
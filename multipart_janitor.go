@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// staleMultipartUploadMaxAge is comfortably past any upload deadline we hand
+// out, so only multipart uploads nothing is tracking any more are aborted:
+// streamed uploads and copies cut off by a crash, or chunked uploads whose
+// record is gone.
+const staleMultipartUploadMaxAge = 2 * chunkedUploadDeadline
+
+// abortStaleMultipartUploads aborts incomplete multipart uploads in our
+// bucket started before maxAge ago. S3 bills for their parts until they're
+// completed or aborted. Customers' own buckets are left to their lifecycle
+// rules, since not every upload in them is ours. With a plan nothing is
+// aborted, the uploads and the size of their parts are only recorded in it.
+func (cfg *apiConfig) abortStaleMultipartUploads(ctx context.Context, maxAge time.Duration, plan *dryRun) {
+	store := cfg.defaultStore()
+	cutoff := cfg.now().Add(-maxAge)
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(store.bucket)}
+	for {
+		out, err := store.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			log.Printf("multipart: couldn't list uploads: %v", err)
+			return
+		}
+		for _, upload := range out.Uploads {
+			if upload.Initiated == nil || upload.Initiated.After(cutoff) {
+				continue
+			}
+			if plan != nil {
+				size, err := multipartUploadSize(ctx, store, upload.Key, upload.UploadId)
+				if err != nil {
+					log.Printf("multipart: couldn't list parts of %s: %v", aws.ToString(upload.Key), err)
+				}
+				plan.would("abort multipart upload", fmt.Sprintf("s3://%s/%s started %s", store.bucket, aws.ToString(upload.Key), upload.Initiated.Format(time.RFC3339)), size)
+				continue
+			}
+			_, err := store.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(store.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				log.Printf("multipart: couldn't abort upload of %s: %v", aws.ToString(upload.Key), err)
+				continue
+			}
+			log.Printf("multipart: aborted upload of %s started %s", aws.ToString(upload.Key), upload.Initiated.Format(time.RFC3339))
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return
+		}
+		input.KeyMarker = out.NextKeyMarker
+		input.UploadIdMarker = out.NextUploadIdMarker
+	}
+}
+
+// multipartUploadSize adds up the parts uploaded so far.
+func multipartUploadSize(ctx context.Context, store objectStore, key, uploadID *string) (int64, error) {
+	var size int64
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(store.bucket),
+		Key:      key,
+		UploadId: uploadID,
+	}
+	for {
+		out, err := store.client.ListParts(ctx, input)
+		if err != nil {
+			return size, err
+		}
+		for _, part := range out.Parts {
+			size += aws.ToInt64(part.Size)
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return size, nil
+		}
+		input.PartNumberMarker = out.NextPartNumberMarker
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// objectStore is a bucket along with a client allowed to use it. Videos go
+// to our bucket unless their owner registered one of their own.
+type objectStore struct {
+	client *s3.Client
+	bucket string
+	// stored video URLs are this, a slash and the key
+	urlPrefix string
+}
+
+func (s objectStore) objectURL(key string) string {
+	return s.urlPrefix + "/" + key
+}
+
+func (s objectStore) keyFromURL(objectURL string) (string, bool) {
+	return strings.CutPrefix(objectURL, s.urlPrefix+"/")
+}
+
+func (cfg *apiConfig) defaultStore() objectStore {
+	return objectStore{
+		client:    cfg.s3Client,
+		bucket:    cfg.s3Bucket,
+		urlPrefix: cfg.s3CfDistribution,
+	}
+}
+
+// userStores caches a client per registered bucket; the assumed role's
+// credentials refresh themselves inside it.
+type userStores struct {
+	mu     sync.Mutex
+	stores map[uuid.UUID]userStore
+}
+
+type userStore struct {
+	bucket database.UserBucket
+	store  objectStore
+}
+
+// storeForUser returns where new uploads of userID go.
+func (cfg *apiConfig) storeForUser(userID uuid.UUID) (objectStore, error) {
+	bucket, err := cfg.db.GetUserBucket(userID)
+	if err != nil {
+		return objectStore{}, fmt.Errorf("couldn't get bucket of user %s: %w", userID, err)
+	}
+	if bucket.Bucket == "" {
+		return cfg.defaultStore(), nil
+	}
+
+	cfg.userStores.mu.Lock()
+	defer cfg.userStores.mu.Unlock()
+	cached, ok := cfg.userStores.stores[userID]
+	if ok && cached.bucket == bucket {
+		return cached.store, nil
+	}
+
+	roleProvider := stscreds.NewAssumeRoleProvider(sts.New(sts.Options{
+		Region:      cfg.s3Region,
+		Credentials: cfg.s3Client.Options().Credentials,
+	}), bucket.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = "tubely-" + userID.String()
+		if bucket.ExternalID != "" {
+			o.ExternalID = aws.String(bucket.ExternalID)
+		}
+	})
+	store := objectStore{
+		client: s3.New(cfg.s3Client.Options(), func(o *s3.Options) {
+			o.Region = bucket.Region
+			o.Credentials = aws.NewCredentialsCache(roleProvider)
+		}),
+		bucket:    bucket.Bucket,
+		urlPrefix: fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket.Bucket, bucket.Region),
+	}
+	cfg.userStores.stores[userID] = userStore{bucket: bucket, store: store}
+	return store, nil
+}
+
+// storeForVideo finds the store holding the current upload of a video and
+// its key there. Uploads from before the owner registered a bucket stay in
+// ours, so both are tried.
+func (cfg *apiConfig) storeForVideo(video database.Video) (objectStore, string, bool, error) {
+	if video.VideoURL == nil {
+		return objectStore{}, "", false, nil
+	}
+	store, err := cfg.storeForUser(video.UserID)
+	if err != nil {
+		return objectStore{}, "", false, err
+	}
+	for _, s := range []objectStore{store, cfg.defaultStore()} {
+		if key, ok := s.keyFromURL(*video.VideoURL); ok {
+			return s, key, true, nil
+		}
+	}
+	return objectStore{}, "", false, nil
+}
+
+// runSetBucket registers a customer's bucket for a user, or with toDefault
+// goes back to ours. The role is assumed and the bucket checked before
+// anything is saved, so a bad trust policy shows up here and not on the
+// customer's next upload.
+func (cfg *apiConfig) runSetBucket(ctx context.Context, email string, bucket database.UserBucket, toDefault bool) error {
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("couldn't get user: %w", err)
+	}
+	if user.Email == "" {
+		return fmt.Errorf("user %s doesn't exist", email)
+	}
+	if toDefault {
+		if err := cfg.db.DeleteUserBucket(user.ID); err != nil {
+			return fmt.Errorf("couldn't remove bucket: %w", err)
+		}
+		fmt.Printf("%s now stores uploads in %s, earlier uploads stay where they are\n", email, cfg.s3Bucket)
+		return nil
+	}
+
+	bucket.UserID = user.ID
+	if err := cfg.db.SetUserBucket(bucket); err != nil {
+		return fmt.Errorf("couldn't set bucket: %w", err)
+	}
+	store, err := cfg.storeForUser(user.ID)
+	if err == nil {
+		_, err = store.client.HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(store.bucket),
+		})
+	}
+	if err != nil {
+		if delErr := cfg.db.DeleteUserBucket(user.ID); delErr != nil {
+			log.Printf("Couldn't remove unreachable bucket of %s: %v", email, delErr)
+		}
+		return fmt.Errorf("couldn't reach %s as %s: %w", bucket.Bucket, bucket.RoleARN, err)
+	}
+	fmt.Printf("%s now stores uploads in %s\n", email, bucket.Bucket)
+	return nil
+}
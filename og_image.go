@@ -0,0 +1,157 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	ogImageWidth  = 1200
+	ogImageHeight = 630
+	ogPadding     = 48
+)
+
+type ogCard struct {
+	thumbnail image.Image // optional
+	title     string
+	duration  string // optional
+}
+
+func newOGFace(size float64) (font.Face, error) {
+	f, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+}
+
+// renderOGCard draws the thumbnail cover-fitted to 1200x630 with the title
+// on a darkened band along the bottom and a duration badge in the corner.
+func renderOGCard(w io.Writer, card ogCard) error {
+	canvas := image.NewRGBA(image.Rect(0, 0, ogImageWidth, ogImageHeight))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{color.RGBA{24, 24, 27, 255}}, image.Point{}, draw.Src)
+
+	if card.thumbnail != nil {
+		draw.CatmullRom.Scale(canvas, canvas.Bounds(), card.thumbnail, coverCrop(card.thumbnail.Bounds()), draw.Over, nil)
+	}
+
+	titleFace, err := newOGFace(56)
+	if err != nil {
+		return err
+	}
+	defer titleFace.Close()
+
+	lineHeight := titleFace.Metrics().Height.Ceil()
+	lines := wrapText(titleFace, card.title, ogImageWidth-2*ogPadding, 2)
+
+	bandHeight := len(lines)*lineHeight + 2*ogPadding
+	band := image.Rect(0, ogImageHeight-bandHeight, ogImageWidth, ogImageHeight)
+	draw.Draw(canvas, band, &image.Uniform{color.RGBA{0, 0, 0, 170}}, image.Point{}, draw.Over)
+
+	drawer := &font.Drawer{Dst: canvas, Src: image.White, Face: titleFace}
+	baseline := band.Min.Y + ogPadding + titleFace.Metrics().Ascent.Ceil()
+	for _, line := range lines {
+		drawer.Dot = fixed.P(ogPadding, baseline)
+		drawer.DrawString(line)
+		baseline += lineHeight
+	}
+
+	if card.duration != "" {
+		badgeFace, err := newOGFace(32)
+		if err != nil {
+			return err
+		}
+		defer badgeFace.Close()
+
+		const badgePadding = 12
+		textWidth := font.MeasureString(badgeFace, card.duration).Ceil()
+		ascent := badgeFace.Metrics().Ascent.Ceil()
+		badge := image.Rect(
+			ogImageWidth-ogPadding-textWidth-2*badgePadding,
+			ogPadding,
+			ogImageWidth-ogPadding,
+			ogPadding+ascent+2*badgePadding,
+		)
+		draw.Draw(canvas, badge, &image.Uniform{color.RGBA{0, 0, 0, 200}}, image.Point{}, draw.Over)
+
+		badgeDrawer := &font.Drawer{Dst: canvas, Src: image.White, Face: badgeFace}
+		badgeDrawer.Dot = fixed.P(badge.Min.X+badgePadding, badge.Min.Y+badgePadding+ascent)
+		badgeDrawer.DrawString(card.duration)
+	}
+
+	return png.Encode(w, canvas)
+}
+
+// coverCrop returns the largest centered region of src with the card's
+// aspect ratio, so scaling it fills the card without distortion.
+func coverCrop(src image.Rectangle) image.Rectangle {
+	srcW, srcH := src.Dx(), src.Dy()
+	if srcW*ogImageHeight > srcH*ogImageWidth {
+		cropW := srcH * ogImageWidth / ogImageHeight
+		x := src.Min.X + (srcW-cropW)/2
+		return image.Rect(x, src.Min.Y, x+cropW, src.Max.Y)
+	}
+	cropH := srcW * ogImageHeight / ogImageWidth
+	y := src.Min.Y + (srcH-cropH)/2
+	return image.Rect(src.Min.X, y, src.Max.X, y+cropH)
+}
+
+// wrapText greedily breaks text into at most maxLines lines no wider than
+// maxWidth pixels, ellipsizing the last line when the text doesn't fit.
+func wrapText(face font.Face, text string, maxWidth, maxLines int) []string {
+	lines := []string{}
+	current := ""
+	words := strings.Fields(text)
+	for i, word := range words {
+		candidate := strings.TrimSpace(current + " " + word)
+		if font.MeasureString(face, candidate).Ceil() <= maxWidth || current == "" {
+			current = candidate
+			continue
+		}
+		lines = append(lines, current)
+		current = word
+		if len(lines) == maxLines {
+			current = strings.Join(words[i:], " ")
+			break
+		}
+	}
+	if current != "" {
+		lines = append(lines, current)
+	}
+	if len(lines) <= maxLines {
+		return lines
+	}
+
+	lines = lines[:maxLines]
+	last := []rune(lines[maxLines-1])
+	for len(last) > 0 && font.MeasureString(face, string(last)+"…").Ceil() > maxWidth {
+		last = last[:len(last)-1]
+	}
+	lines[maxLines-1] = strings.TrimSpace(string(last)) + "…"
+	return lines
+}
+
+func decodeImageFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
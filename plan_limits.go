@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+)
+
+// planLimitExceeded describes plan's limit called name being hit with used
+// already counted and pending more asked for, suggesting a plan that would
+// allow it.
+func (cfg *apiConfig) planLimitExceeded(name string, plan database.Plan, used, pending int64) limits.Exceeded {
+	exceeded := limits.ForPlan(name, plan)
+	exceeded.Used = used
+	exceeded.Pending = pending
+	plans, err := cfg.db.GetPlans()
+	if err != nil {
+		// the response is still right without a suggestion
+		log.Printf("Couldn't get plans to suggest an upgrade: %v", err)
+		return exceeded
+	}
+	return exceeded.WithUpgrade(plans)
+}
+
+// respondWithLimit answers a request that ran into a limit with the
+// limit's status and what it was, plus recovery for uploads.
+func (cfg *apiConfig) respondWithLimit(w http.ResponseWriter, exceeded limits.Exceeded, recovery *uploadRecovery) {
+	type response struct {
+		Error    string          `json:"error"`
+		Limit    limits.Exceeded `json:"limit"`
+		Recovery *uploadRecovery `json:"recovery,omitempty"`
+	}
+	exceeded.SetRetryAfter(w.Header(), cfg.now())
+	respondWithJSON(w, exceeded.Status(), response{
+		Error:    exceeded.Error(),
+		Limit:    exceeded,
+		Recovery: recovery,
+	})
+}
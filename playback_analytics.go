@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAnalyticsMinViewers = 10
+	// what's left of an address once truncated, the usual anonymization
+	// for each family
+	analyticsIPv4Bits = 24
+	analyticsIPv6Bits = 48
+)
+
+// analyticsPolicyFor returns the owner's own analytics policy, or the
+// deployment's when they have none.
+func (cfg *apiConfig) analyticsPolicyFor(userID uuid.UUID) (database.AnalyticsPolicy, error) {
+	policy, err := cfg.db.GetAnalyticsPolicy(userID)
+	if err != nil || policy.UserID == uuid.Nil {
+		return cfg.analytics, err
+	}
+	return policy, nil
+}
+
+// recordPlaybackView counts a view of video by the client of r, if its
+// owner's policy allows. Only the count it adds to is stored, never the
+// view itself, and the address is truncated first when the policy says so.
+func (cfg *apiConfig) recordPlaybackView(r *http.Request, video database.Video) {
+	policy, err := cfg.analyticsPolicyFor(video.UserID)
+	if err != nil {
+		log.Printf("Couldn't get analytics policy of %s: %v", video.UserID, err)
+		return
+	}
+	if !policy.Enabled {
+		return
+	}
+	stat := database.PlaybackStat{
+		VideoID: video.ID,
+		Day:     cfg.now().UTC().Format("2006-01-02"),
+		Network: viewerNetwork(r, policy.TruncateIPs),
+	}
+	if cfg.geoIP != nil {
+		stat.Country = cfg.geoIP.country(r)
+	}
+	if err := cfg.db.RecordPlaybackView(stat); err != nil {
+		log.Printf("Couldn't count view of video %s: %v", video.ID, err)
+	}
+}
+
+// viewerNetwork is the address r came from, or the network around it when
+// truncate is set.
+func viewerNetwork(r *http.Request, truncate bool) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap().WithZone("")
+	if !truncate {
+		return addr.String()
+	}
+	bits := analyticsIPv6Bits
+	if addr.Is4() {
+		bits = analyticsIPv4Bits
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+type analyticsGroup struct {
+	Key   string `json:"key"`
+	Views int64  `json:"views"`
+}
+
+// analyticsGroups totals views by key, leaving out groups with fewer than
+// minViewers, so no report narrows down to a handful of people. Largest
+// groups come first.
+func analyticsGroups(stats []database.PlaybackStat, minViewers int, key func(database.PlaybackStat) string) []analyticsGroup {
+	totals := map[string]int64{}
+	for _, stat := range stats {
+		totals[key(stat)] += stat.Views
+	}
+	groups := []analyticsGroup{}
+	for k, views := range totals {
+		if views >= int64(minViewers) {
+			groups = append(groups, analyticsGroup{Key: k, Views: views})
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Views != groups[j].Views {
+			return groups[i].Views > groups[j].Views
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
+
+// handlerVideoAnalytics reports the counted views of a video to its owner,
+// grouped by day, country and network. Each playback session counts as one
+// viewer.
+func (cfg *apiConfig) handlerVideoAnalytics(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Enabled    bool             `json:"enabled"`
+		MinViewers int              `json:"min_viewers"`
+		TotalViews int64            `json:"total_views"`
+		Days       []analyticsGroup `json:"days"`
+		Countries  []analyticsGroup `json:"countries"`
+		Networks   []analyticsGroup `json:"networks"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !cfg.videoAccessAllowed(w, video, userID, videoAccessOwner) {
+		return
+	}
+
+	policy, err := cfg.analyticsPolicyFor(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get analytics policy", err)
+		return
+	}
+	stats, err := cfg.db.GetPlaybackStats(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playback stats", err)
+		return
+	}
+
+	var total int64
+	for _, stat := range stats {
+		total += stat.Views
+	}
+	resp := response{
+		Enabled:    policy.Enabled,
+		MinViewers: policy.MinViewers,
+		Days:       analyticsGroups(stats, policy.MinViewers, func(s database.PlaybackStat) string { return s.Day }),
+		Countries:  analyticsGroups(stats, policy.MinViewers, func(s database.PlaybackStat) string { return s.Country }),
+		Networks:   analyticsGroups(stats, policy.MinViewers, func(s database.PlaybackStat) string { return s.Network }),
+	}
+	if total >= int64(policy.MinViewers) {
+		resp.TotalViews = total
+	}
+	sort.Slice(resp.Days, func(i, j int) bool { return resp.Days[i].Key < resp.Days[j].Key })
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// runSetAnalytics gives a user their own analytics policy, or with
+// toDefault puts them back on the deployment's.
+func (cfg *apiConfig) runSetAnalytics(email string, policy database.AnalyticsPolicy, toDefault bool) error {
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("couldn't get user: %w", err)
+	}
+	if user.Email == "" {
+		return fmt.Errorf("user %s doesn't exist", email)
+	}
+	if toDefault {
+		if err := cfg.db.DeleteAnalyticsPolicy(user.ID); err != nil {
+			return fmt.Errorf("couldn't remove analytics policy: %w", err)
+		}
+		fmt.Printf("%s is on the default analytics policy\n", email)
+		return nil
+	}
+	policy.UserID = user.ID
+	if err := cfg.db.SetAnalyticsPolicy(policy); err != nil {
+		return fmt.Errorf("couldn't set analytics policy: %w", err)
+	}
+	fmt.Printf("analytics for %s: enabled=%t min-viewers=%d truncate-ips=%t\n", email, policy.Enabled, policy.MinViewers, policy.TruncateIPs)
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultPlaybackCacheMaxBytes = 10 << 30 // 10GB
+	// how long a storage health check is trusted
+	storageHealthTTL = 15 * time.Second
+	// a bucket slower than this to answer counts as down
+	storageHealthTimeout = 2 * time.Second
+	// fallback URLs are only handed out during outages, keep them short
+	playbackCacheURLExpiry = 15 * time.Minute
+)
+
+// playbackCache keeps local copies of recently stored uploads, so playback
+// can carry on from this server while S3 can't be reached. Files are named
+// after the object they copy and the least recently played go first once
+// the cache is over maxBytes.
+type playbackCache struct {
+	dir      string
+	maxBytes int64
+	// serializes adds, so two evictions don't race
+	mu sync.Mutex
+
+	healthMu sync.Mutex
+	health   map[string]storageHealth
+}
+
+type storageHealth struct {
+	checkedAt time.Time
+	reachable bool
+}
+
+func newPlaybackCache(dir string, maxBytes int64) (*playbackCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &playbackCache{dir: dir, maxBytes: maxBytes, health: map[string]storageHealth{}}, nil
+}
+
+// playbackCacheName is the cache file name for a version of an object.
+func playbackCacheName(store objectStore, key, versionID string) string {
+	sum := sha256.Sum256([]byte(store.bucket + "\x00" + key + "\x00" + versionID))
+	return hex.EncodeToString(sum[:])
+}
+
+// add copies the file at filePath into the cache as the object it was
+// stored as. A hard link is enough when the cache is on the same disk.
+func (c *playbackCache) add(filePath string, store objectStore, key, versionID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := filepath.Join(c.dir, playbackCacheName(store, key, versionID))
+	if err := os.Link(filePath, path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil
+		}
+		if err := copyFileTo(filePath, path); err != nil {
+			return err
+		}
+	}
+	return c.evict()
+}
+
+func copyFileTo(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".partial-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// evict removes the least recently played files until the cache fits.
+func (c *playbackCache) evict() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	slices.SortFunc(files, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, info := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, info.Name())); err != nil {
+			return err
+		}
+		total -= info.Size()
+	}
+	return nil
+}
+
+// open returns the cached copy of a version of an object, marking it as
+// recently played, or nil if there isn't one.
+func (c *playbackCache) open(name string) (*os.File, error) {
+	path := filepath.Join(c.dir, name)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f, nil
+}
+
+// reachable reports whether the store answered recently, asking it about
+// key if it's been a while. Any answer from S3, even an error response for
+// the key, means it's up; timeouts, connection failures and 5xx mean it
+// isn't.
+func (c *playbackCache) reachable(ctx context.Context, store objectStore, key string) bool {
+	c.healthMu.Lock()
+	health, ok := c.health[store.bucket]
+	c.healthMu.Unlock()
+	if ok && time.Since(health.checkedAt) < storageHealthTTL {
+		return health.reachable
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, storageHealthTimeout)
+	defer cancel()
+	_, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	}, func(o *s3.Options) {
+		// a health check that retries is just a slow one
+		o.RetryMaxAttempts = 1
+	})
+	// failed sends are response errors too, with no status
+	var respErr *awshttp.ResponseError
+	reachable := err == nil || (errors.As(err, &respErr) && respErr.HTTPStatusCode() > 0 && respErr.HTTPStatusCode() < 500)
+	if !reachable {
+		log.Printf("playback cache: bucket %s is unreachable: %v", store.bucket, err)
+	}
+
+	c.healthMu.Lock()
+	c.health[store.bucket] = storageHealth{checkedAt: time.Now(), reachable: reachable}
+	c.healthMu.Unlock()
+	return reachable
+}
+
+// cachePlaybackCopy keeps the file just stored as the object for playback
+// fallback. Failing to is only logged.
+func (cfg *apiConfig) cachePlaybackCopy(filePath string, store objectStore, key string, versionID *string) {
+	if cfg.playbackCache == nil {
+		return
+	}
+	if err := cfg.playbackCache.add(filePath, store, key, aws.ToString(versionID)); err != nil {
+		log.Printf("playback cache: couldn't keep a copy of %s: %v", key, err)
+	}
+}
+
+// playbackFallbackURL returns a URL to this server's copy of the object
+// when S3 is unreachable and there is one, or "" to presign as usual.
+func (cfg *apiConfig) playbackFallbackURL(ctx context.Context, store objectStore, key, versionID string) string {
+	if cfg.playbackCache == nil || cfg.playbackCache.reachable(ctx, store, key) {
+		return ""
+	}
+	name := playbackCacheName(store, key, versionID)
+	if _, err := os.Stat(filepath.Join(cfg.playbackCache.dir, name)); err != nil {
+		return ""
+	}
+	expires := cfg.now().Add(playbackCacheURLExpiry).Unix()
+	return fmt.Sprintf("http://localhost:%s/api/playback-cache/%s?expires=%d&sig=%s", cfg.port, name, expires, cfg.playbackCacheSignature(name, expires))
+}
+
+func (cfg *apiConfig) playbackCacheSignature(name string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.urlSigningSecret))
+	mac.Write([]byte("playback-cache\x00" + name + "\x00" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handlerPlaybackCache serves a cached copy from a signed fallback URL, with
+// range requests so players can seek.
+func (cfg *apiConfig) handlerPlaybackCache(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || cfg.now().Unix() > expires || cfg.playbackCache == nil ||
+		!hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(cfg.playbackCacheSignature(name, expires))) {
+		respondWithError(w, http.StatusForbidden, "Invalid or expired playback URL", nil)
+		return
+	}
+
+	f, err := cfg.playbackCache.open(name)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open cached video", err)
+		return
+	}
+	if f == nil {
+		respondWithError(w, http.StatusNotFound, "Video is no longer cached", nil)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open cached video", err)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "private, max-age=0")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	playbackSessionTTL           = 30 * time.Minute
+	playbackURLExpiry            = 5 * time.Minute
+	playbackSessionSweepInterval = time.Hour
+
+	playbackSessionHeader = "X-Playback-Session"
+	playbackDeviceHeader  = "X-Device-ID"
+)
+
+// handlerPlaybackSessionCreate exchanges a JWT for a short-lived session
+// bound to one video and one device. Presigned media URLs are only issued
+// against a session, so a leaked JWT or URL doesn't travel far.
+func (cfg *apiConfig) handlerPlaybackSessionCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		DeviceID string `json:"device_id"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.DeviceID == "" || len(params.DeviceID) > 128 {
+		respondWithError(w, http.StatusBadRequest, "device_id is required and must be at most 128 characters", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	access, err := cfg.videoAccessFor(video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if videoHidden(video, access) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if premiereLocked(video, access, cfg.now()) {
+		respondWithError(w, http.StatusForbidden, "This video hasn't premiered yet", nil)
+		return
+	}
+
+	sessionToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create playback session", err)
+		return
+	}
+	session, err := cfg.db.CreatePlaybackSession(database.CreatePlaybackSessionParams{
+		Token:     sessionToken,
+		VideoID:   video.ID,
+		UserID:    userID,
+		DeviceID:  params.DeviceID,
+		ExpiresAt: cfg.now().UTC().Add(playbackSessionTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create playback session", err)
+		return
+	}
+	// owners watching their own videos aren't an audience
+	if video.UserID != userID {
+		cfg.recordPlaybackView(r, video)
+	}
+
+	respondWithJSON(w, http.StatusCreated, session)
+}
+
+// handlerVideoPlaybackURL issues a presigned URL for the current upload of a
+// video to the holder of a playback session for it. Viewers of a watermarked
+// video get their own rendition, and a 202 while it's being rendered.
+func (cfg *apiConfig) handlerVideoPlaybackURL(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Region    string    `json:"region"`
+		// served by this server while S3 can't be reached
+		Fallback bool `json:"fallback,omitempty"`
+		// the same video at other qualities, highest first, for players to
+		// switch between as bandwidth allows
+		Renditions []playbackRendition `json:"renditions,omitempty"`
+		Storyboard *playbackStoryboard `json:"storyboard,omitempty"`
+		// WebVTT subtitle tracks, by language
+		Captions []playbackCaption `json:"captions,omitempty"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	session, ok := cfg.playbackSessionFromRequest(w, r, videoID)
+	if !ok {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	// visibility and collaborators may have changed since the session was
+	// issued
+	access, err := cfg.videoAccessFor(video, session.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if videoHidden(video, access) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !videoPlayable(w, video) {
+		return
+	}
+	if video.ArchivedAt != nil {
+		respondWithError(w, http.StatusConflict, "Video is archived", nil)
+		return
+	}
+	store, key, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video object", nil)
+		return
+	}
+
+	versionID := aws.ToString(video.VideoVersionID)
+	if watermarkRequired(video, access) {
+		var ready bool
+		key, ready, err = cfg.watermarkedRendition(r.Context(), store, video, key, session.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't prepare video", err)
+			return
+		}
+		if !ready {
+			w.Header().Set("Retry-After", watermarkRetryAfter)
+			respondWithJSON(w, http.StatusAccepted, map[string]string{"status": "preparing"})
+			return
+		}
+		versionID = ""
+	} else if notModified(w, r, video.VideoETag) {
+		// the client already has this upload
+		return
+	}
+
+	// watermarked renditions are made per viewer and never cached
+	if !watermarkRequired(video, access) {
+		if url := cfg.playbackFallbackURL(r.Context(), store, key, versionID); url != "" {
+			respondWithJSON(w, http.StatusOK, response{
+				URL:       url,
+				ExpiresAt: cfg.now().UTC().Add(playbackCacheURLExpiry),
+				Region:    store.client.Options().Region,
+				Fallback:  true,
+			})
+			return
+		}
+	}
+
+	store, region, err := cfg.regionalStore(r.Context(), r, store, key, versionID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unknown region", err)
+		return
+	}
+
+	if !cfg.bandwidthAllowed(w, video) {
+		return
+	}
+	expiresAt := cfg.now().UTC().Add(playbackURLExpiry)
+	url, err := cfg.presignObjectURL(r.Context(), store, sessionPresigner(session), key, versionID, playbackURLExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+		return
+	}
+	renditions, err := cfg.playbackRenditions(r.Context(), store, sessionPresigner(session), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign renditions", err)
+		return
+	}
+	var storyboard *playbackStoryboard
+	if video.StoryboardKey != nil {
+		storyboard, err = cfg.presignStoryboard(r.Context(), store, sessionPresigner(session), *video.StoryboardKey)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign storyboard", err)
+			return
+		}
+	}
+	captions, err := cfg.playbackCaptions(r.Context(), sessionPresigner(session), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign captions", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		URL:        url,
+		ExpiresAt:  expiresAt,
+		Region:     region,
+		Renditions: renditions,
+		Storyboard: storyboard,
+		Captions:   captions,
+	})
+}
+
+// playbackStoryboard is where a player gets seek bar previews. Cues in the
+// index point at tiles of "sprite.jpg", which is SpriteURL.
+type playbackStoryboard struct {
+	IndexURL  string `json:"index_url"`
+	SpriteURL string `json:"sprite_url"`
+}
+
+func (cfg *apiConfig) presignStoryboard(ctx context.Context, store objectStore, presigner presignRequester, indexKey string) (*playbackStoryboard, error) {
+	indexURL, err := cfg.presignObjectURL(ctx, store, presigner, indexKey, "", playbackURLExpiry)
+	if err != nil {
+		return nil, err
+	}
+	spriteKey := path.Join(path.Dir(indexKey), storyboardSprite)
+	spriteURL, err := cfg.presignObjectURL(ctx, store, presigner, spriteKey, "", playbackURLExpiry)
+	if err != nil {
+		return nil, err
+	}
+	return &playbackStoryboard{IndexURL: indexURL, SpriteURL: spriteURL}, nil
+}
+
+type playbackRendition struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bitrate int64  `json:"bitrate"`
+}
+
+// playbackRenditions presigns the video's renditions in store, which expire
+// with its playback URL.
+func (cfg *apiConfig) playbackRenditions(ctx context.Context, store objectStore, presigner presignRequester, video database.Video) ([]playbackRendition, error) {
+	renditions, err := cfg.db.GetVideoRenditions(video.ID)
+	if err != nil {
+		return nil, err
+	}
+	playback := []playbackRendition{}
+	for _, rendition := range renditions {
+		url, err := cfg.presignObjectURL(ctx, store, presigner, rendition.Key, "", playbackURLExpiry)
+		if err != nil {
+			return nil, err
+		}
+		playback = append(playback, playbackRendition{
+			Name:    rendition.Name,
+			URL:     url,
+			Width:   rendition.Width,
+			Height:  rendition.Height,
+			Bitrate: rendition.Bitrate,
+		})
+	}
+	return playback, nil
+}
+
+// playbackSessionFromRequest checks the session and device headers against
+// the video being played, writing the error response if they don't match.
+func (cfg *apiConfig) playbackSessionFromRequest(w http.ResponseWriter, r *http.Request, videoID uuid.UUID) (database.PlaybackSession, bool) {
+	token := r.Header.Get(playbackSessionHeader)
+	deviceID := r.Header.Get(playbackDeviceHeader)
+	if token == "" || deviceID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Playback session required", nil)
+		return database.PlaybackSession{}, false
+	}
+
+	session, err := cfg.db.GetPlaybackSession(token)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playback session", err)
+		return database.PlaybackSession{}, false
+	}
+	if session.Token == "" || cfg.now().After(session.ExpiresAt) {
+		respondWithError(w, http.StatusUnauthorized, "Playback session expired", nil)
+		return database.PlaybackSession{}, false
+	}
+	if session.VideoID != videoID || session.DeviceID != deviceID {
+		respondWithError(w, http.StatusForbidden, "Playback session is not valid for this video", nil)
+		return database.PlaybackSession{}, false
+	}
+	return session, true
+}
+
+// sessionPresigner identifies the holder of a playback session by a
+// fingerprint of its token.
+func sessionPresigner(session database.PlaybackSession) presignRequester {
+	sum := sha256.Sum256([]byte(session.Token))
+	return presignRequester{
+		Requester: "session:" + hex.EncodeToString(sum[:8]),
+		UserID:    &session.UserID,
+		VideoID:   &session.VideoID,
+	}
+}
+
+func (cfg *apiConfig) runPlaybackSessionJanitor() {
+	for {
+		removed, err := cfg.db.DeleteExpiredPlaybackSessions(cfg.now().UTC())
+		if err != nil {
+			log.Printf("playback: couldn't remove expired sessions: %v", err)
+		} else if removed > 0 {
+			log.Printf("playback: removed %d expired sessions", removed)
+		}
+		time.Sleep(playbackSessionSweepInterval)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const premiereCheckInterval = 15 * time.Second
+
+type premiereCountdown struct {
+	ID               uuid.UUID `json:"id"`
+	Title            string    `json:"title"`
+	Description      string    `json:"description"`
+	ThumbnailURL     *string   `json:"thumbnail_url"`
+	UserID           uuid.UUID `json:"user_id"`
+	PremiereAt       time.Time `json:"premiere_at"`
+	SecondsRemaining int64     `json:"seconds_remaining"`
+}
+
+// premiereLocked reports whether playback of the video is still held back
+// for a viewer with access at now. Owners and collaborators can always watch.
+func premiereLocked(video database.Video, access videoAccess, now time.Time) bool {
+	if video.PremiereAt == nil || access >= videoAccessView {
+		return false
+	}
+	return now.Before(*video.PremiereAt)
+}
+
+func newPremiereCountdown(video database.Video, now time.Time) premiereCountdown {
+	remaining := video.PremiereAt.Sub(now)
+	return premiereCountdown{
+		ID:               video.ID,
+		Title:            video.Title,
+		Description:      video.Description,
+		ThumbnailURL:     video.ThumbnailURL,
+		UserID:           video.UserID,
+		PremiereAt:       *video.PremiereAt,
+		SecondsRemaining: int64(remaining.Round(time.Second) / time.Second),
+	}
+}
+
+func (cfg *apiConfig) handlerVideoPremiereSet(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		PremiereAt *time.Time `json:"premiere_at"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !cfg.videoAccessAllowed(w, video, userID, videoAccessEdit) {
+		return
+	}
+
+	if params.PremiereAt != nil {
+		if video.VideoURL == nil {
+			respondWithError(w, http.StatusConflict, "Video must be uploaded before scheduling a premiere", nil)
+			return
+		}
+		if !params.PremiereAt.After(cfg.now()) {
+			respondWithError(w, http.StatusBadRequest, "Premiere time must be in the future", nil)
+			return
+		}
+		premiereAt := params.PremiereAt.UTC().Truncate(time.Second)
+		params.PremiereAt = &premiereAt
+	}
+
+	rescheduled := !premiereTimeEqual(video.PremiereAt, params.PremiereAt)
+	video, err = cfg.updateVideo(video.ID, func(video *database.Video) {
+		video.PremiereAt = params.PremiereAt
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if rescheduled {
+		// A new premiere time is a new premiere, announce it again.
+		err = cfg.db.ClearPremiereNotified(video.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't reschedule premiere", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// runPremiereScheduler fires notifications for premieres as they start.
+// Unlocking itself needs no work, playback checks premiere_at on every read.
+func (cfg *apiConfig) runPremiereScheduler() {
+	ticker := time.NewTicker(premiereCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cfg.notifyDuePremieres(cfg.now())
+	}
+}
+
+func premiereTimeEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// notifyDuePremieres announces every premiere that has started by now and
+// hasn't been announced yet.
+func (cfg *apiConfig) notifyDuePremieres(now time.Time) {
+	videos, err := cfg.db.GetDuePremieres(now)
+	if err != nil {
+		log.Printf("premieres: couldn't get due premieres: %v", err)
+		return
+	}
+	for _, video := range videos {
+		err := cfg.db.CreateNotification(database.CreateNotificationParams{
+			UserID:  video.UserID,
+			VideoID: &video.ID,
+			Kind:    "premiere_started",
+			Message: fmt.Sprintf("Your premiere of %q is now live", video.Title),
+		})
+		if err != nil {
+			log.Printf("premieres: couldn't notify for video %s: %v", video.ID, err)
+			continue
+		}
+		err = cfg.db.MarkPremiereNotified(video.ID)
+		if err != nil {
+			log.Printf("premieres: couldn't mark video %s notified: %v", video.ID, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	presignAnomalyWindow         = time.Minute
+	presignAlertCooldown         = 10 * time.Minute
+	defaultPresignAlertPerMinute = 200
+)
+
+// presignRequester says who a presigned URL is issued to, for the audit log.
+type presignRequester struct {
+	Requester string
+	UserID    *uuid.UUID
+	VideoID   *uuid.UUID
+}
+
+// jobPresigner identifies a background job.
+func jobPresigner(job string, videoID *uuid.UUID) presignRequester {
+	return presignRequester{Requester: "job:" + job, VideoID: videoID}
+}
+
+// auditPresign records an issued URL and feeds the anomaly detector.
+func (cfg *apiConfig) auditPresign(requester presignRequester, key string, expiresAt time.Time) {
+	err := cfg.db.CreatePresignAudit(database.CreatePresignAuditParams{
+		Requester: requester.Requester,
+		UserID:    requester.UserID,
+		VideoID:   requester.VideoID,
+		ObjectKey: key,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		log.Printf("Couldn't audit presigned URL for %s: %v", key, err)
+	}
+	cfg.presignMonitor.record(requester, time.Now())
+}
+
+// presignMonitor flags requesters that ask for far more presigned URLs than
+// any player needs, which usually means a token is being used to scrape.
+type presignMonitor struct {
+	mu        sync.Mutex
+	perMinute int
+	alerts    *adminAlerts
+	recent    map[string][]time.Time
+	alerted   map[string]time.Time
+	lastSweep time.Time
+}
+
+func newPresignMonitor(perMinute int, alerts *adminAlerts) *presignMonitor {
+	return &presignMonitor{
+		perMinute: perMinute,
+		alerts:    alerts,
+		recent:    map[string][]time.Time{},
+		alerted:   map[string]time.Time{},
+	}
+}
+
+func (m *presignMonitor) record(requester presignRequester, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) > presignAlertCooldown {
+		m.sweep(now)
+	}
+
+	key := requester.Requester
+	times := append(pruneBefore(m.recent[key], now.Add(-presignAnomalyWindow)), now)
+	m.recent[key] = times
+	if len(times) <= m.perMinute || now.Sub(m.alerted[key]) < presignAlertCooldown {
+		return
+	}
+	m.alerted[key] = now
+
+	details := map[string]any{
+		"requester": key,
+		"count":     len(times),
+		"window":    presignAnomalyWindow.String(),
+		"threshold": m.perMinute,
+	}
+	if requester.UserID != nil {
+		details["user_id"] = requester.UserID.String()
+	}
+	if requester.VideoID != nil {
+		details["video_id"] = requester.VideoID.String()
+	}
+	m.alerts.send("presign_anomaly", "unusual number of presigned URLs issued", details)
+}
+
+// sweep drops requesters that have gone quiet so the maps don't grow forever.
+func (m *presignMonitor) sweep(now time.Time) {
+	for key, times := range m.recent {
+		if len(pruneBefore(times, now.Add(-presignAnomalyWindow))) == 0 {
+			delete(m.recent, key)
+		}
+	}
+	for key, at := range m.alerted {
+		if now.Sub(at) >= presignAlertCooldown {
+			delete(m.alerted, key)
+		}
+	}
+	m.lastSweep = now
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
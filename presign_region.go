@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// CloudFront adds this to requests when told to forward it, which saves a
+// lookup of our own
+const defaultGeoIPCountryHeader = "CloudFront-Viewer-Country"
+
+// regionalReplica is a bucket that S3 replication keeps a copy of ours in,
+// serving the viewers of countries.
+type regionalReplica struct {
+	region    string
+	store     objectStore
+	countries []string
+}
+
+// parseReplicas reads S3_REPLICAS, a ;-separated list of
+// region=bucket:COUNTRY,COUNTRY entries.
+func parseReplicas(spec string, client *s3.Client) ([]regionalReplica, error) {
+	replicas := []regionalReplica{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		region, rest, ok := strings.Cut(entry, "=")
+		bucket, countries, ok2 := strings.Cut(rest, ":")
+		if !ok || !ok2 || region == "" || bucket == "" || countries == "" {
+			return nil, fmt.Errorf("replica %q isn't region=bucket:COUNTRY,COUNTRY", entry)
+		}
+		replica := regionalReplica{
+			region: region,
+			store: objectStore{
+				client: s3.New(client.Options(), func(o *s3.Options) {
+					o.Region = region
+				}),
+				bucket:    bucket,
+				urlPrefix: fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region),
+			},
+		}
+		for _, country := range strings.Split(countries, ",") {
+			replica.countries = append(replica.countries, strings.ToUpper(strings.TrimSpace(country)))
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
+
+// geoIP tells which country a request comes from: from a header set by the
+// CDN in front of us if there is one, else from a network,country CSV such
+// as the one built from GeoLite2's country blocks.
+type geoIP struct {
+	header string
+	ranges geoIPRanges
+}
+
+// geoIPRanges maps networks to the country they're in. A lookup masks the
+// address to each prefix length in use, longest first, instead of walking
+// hundreds of thousands of networks.
+type geoIPRanges struct {
+	countries map[netip.Prefix]string
+	bits      []int
+}
+
+func loadGeoIPRanges(path string) (geoIPRanges, error) {
+	ranges := geoIPRanges{countries: map[netip.Prefix]string{}}
+	f, err := os.Open(path)
+	if err != nil {
+		return ranges, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		network, country, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ",")
+		if !ok || strings.HasPrefix(network, "#") {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			// header rows and the like
+			if line == 1 {
+				continue
+			}
+			return ranges, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		prefix = prefix.Masked()
+		ranges.countries[prefix] = strings.ToUpper(country)
+		if !slices.Contains(ranges.bits, prefix.Bits()) {
+			ranges.bits = append(ranges.bits, prefix.Bits())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ranges, err
+	}
+	// more specific networks first, so they win over those containing them
+	slices.SortFunc(ranges.bits, func(a, b int) int { return b - a })
+	return ranges, nil
+}
+
+func (g geoIPRanges) lookup(addr netip.Addr) string {
+	for _, bits := range g.bits {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			// an IPv6 length for an IPv4 address
+			continue
+		}
+		if country, ok := g.countries[prefix]; ok {
+			return country
+		}
+	}
+	return ""
+}
+
+// country returns the ISO code of the country r comes from, or "".
+func (g *geoIP) country(r *http.Request) string {
+	if g.header != "" {
+		if country := r.Header.Get(g.header); country != "" {
+			return strings.ToUpper(country)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	return g.ranges.lookup(addr.Unmap())
+}
+
+// presignRegionParam lets a request pick the region it's served from, to
+// test replicas from anywhere.
+const presignRegionParam = "region"
+
+// regionalStore picks the store to presign a video object from for the
+// viewer making r. Only our bucket has replicas; customer buckets and
+// objects replication hasn't copied yet are served from where they are. The
+// only error is an override naming a region we have no bucket in.
+func (cfg *apiConfig) regionalStore(ctx context.Context, r *http.Request, store objectStore, key, versionID string) (objectStore, string, error) {
+	region := store.client.Options().Region
+	if store.bucket != cfg.s3Bucket || len(cfg.s3Replicas) == 0 {
+		return store, region, nil
+	}
+
+	var replica *regionalReplica
+	if override := r.URL.Query().Get(presignRegionParam); override != "" {
+		if override == region {
+			return store, region, nil
+		}
+		i := slices.IndexFunc(cfg.s3Replicas, func(rep regionalReplica) bool { return rep.region == override })
+		if i < 0 {
+			return store, region, fmt.Errorf("no replica in region %q", override)
+		}
+		replica = &cfg.s3Replicas[i]
+	} else if country := cfg.geoIP.country(r); country != "" {
+		i := slices.IndexFunc(cfg.s3Replicas, func(rep regionalReplica) bool { return slices.Contains(rep.countries, country) })
+		if i < 0 {
+			return store, region, nil
+		}
+		replica = &cfg.s3Replicas[i]
+	} else {
+		return store, region, nil
+	}
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(replica.store.bucket),
+		Key:    aws.String(key),
+	}
+	// replication keeps version IDs
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	if _, err := replica.store.client.HeadObject(ctx, input); err != nil {
+		log.Printf("Replica %s doesn't have %s yet, serving from %s: %v", replica.region, key, region, err)
+		return store, region, nil
+	}
+	return replica.store, replica.region, nil
+}
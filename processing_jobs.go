@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/jobs"
+	"github.com/google/uuid"
+)
+
+// finished jobs are kept this long for clients to poll
+const processingJobRetention = 7 * 24 * time.Hour
+
+// preferAsync reports whether the client asked, with an RFC 7240 Prefer
+// header, not to wait for processing.
+func preferAsync(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// errUploadGone is a queued upload whose spooled file was swept away before
+// it could be processed.
+var errUploadGone = errors.New("spooled upload is gone")
+
+// processUploadPayload is a received upload waiting in the job queue for
+// ingestPipeline, as left on disk by receivePipeline.
+type processUploadPayload struct {
+	ProcessingJobID uuid.UUID `json:"processing_job_id"`
+	VideoID         uuid.UUID `json:"video_id"`
+	FilePath        string    `json:"file_path"`
+	UploadDir       string    `json:"upload_dir"`
+	UploadSHA256    string    `json:"upload_sha256"`
+	UploadSize      int64     `json:"upload_size"`
+	LogRunID        uuid.UUID `json:"log_run_id"`
+}
+
+// storeVideoUploadAsync receives the upload within the request, so a bad
+// file is still turned away straight away, then queues the rest of its
+// processing as a process-upload job. The response is 202 with a job to
+// poll at GET /api/jobs/{jobID}.
+func (cfg *apiConfig) storeVideoUploadAsync(w http.ResponseWriter, r *http.Request, in *videoIngest) {
+	if err := cfg.runIngest(r.Context(), cfg.receivePipeline(), in); err != nil {
+		in.removeTemp()
+		log.Printf("Video upload error: %v", err)
+		cfg.respondWithUploadPipelineError(w, in, err)
+		return
+	}
+	job, err := cfg.db.CreateProcessingJob(in.video.UserID, in.video.ID)
+	if err != nil {
+		in.removeTemp()
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create processing job", err)
+		return
+	}
+	queued, err := cfg.jobs.Enqueue(r.Context(), jobProcessUpload, processUploadPayload{
+		ProcessingJobID: job.ID,
+		VideoID:         in.video.ID,
+		FilePath:        in.filePath,
+		UploadDir:       in.uploadDir,
+		UploadSHA256:    in.uploadSHA256,
+		UploadSize:      in.uploadSize,
+		LogRunID:        in.logRunID,
+	})
+	if err != nil {
+		in.removeTemp()
+		cfg.setVideoStatus(in.video.ID, database.VideoStatusFailed)
+		job.Status = database.ProcessingJobStatusFailed
+		job.Error = "Couldn't queue processing"
+		job.Retryable = true
+		if err := cfg.db.UpdateProcessingJob(job); err != nil {
+			log.Printf("Couldn't update processing job %s: %v", job.ID, err)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue processing", err)
+		return
+	}
+	keepUploadSlot(r.Context()).holdForJob(queued.ID)
+
+	w.Header().Set("Location", "/api/jobs/"+job.ID.String())
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// processUploadJob ingests a queued upload and records how it went on its
+// processing job. Failures a retry can fix keep the spooled upload and the
+// job processing for the next attempt, until the last.
+func (cfg *apiConfig) processUploadJob(ctx context.Context, queued jobs.Job) error {
+	defer cfg.uploadSlots.releaseJob(queued.ID)
+	var payload processUploadPayload
+	if err := json.Unmarshal(queued.Payload, &payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	job, err := cfg.db.GetProcessingJob(payload.ProcessingJobID)
+	if err != nil {
+		return err
+	}
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+	in := &videoIngest{
+		video:        video,
+		filePath:     payload.FilePath,
+		uploadDir:    payload.UploadDir,
+		uploadSHA256: payload.UploadSHA256,
+		uploadSize:   payload.UploadSize,
+		logRunID:     payload.LogRunID,
+		// the last attempt gives up, so its failure is the video's
+		retryTransient: !queued.LastAttempt(),
+	}
+	if video.ID == uuid.Nil {
+		err = errVideoDeleted
+	} else if _, statErr := os.Stat(payload.FilePath); statErr != nil {
+		err = errUploadGone
+		cfg.setVideoStatus(video.ID, database.VideoStatusFailed)
+	} else {
+		err = cfg.runIngest(ctx, cfg.ingestPipeline(), in)
+	}
+
+	transient := transientUploadError(err)
+	if transient && !queued.LastAttempt() {
+		// processed copies are made afresh from the upload
+		for _, path := range in.temp {
+			os.Remove(path)
+		}
+		return err
+	}
+	in.removeTemp()
+	finishProcessingJob(&job, err)
+	if err := cfg.db.UpdateProcessingJob(job); err != nil {
+		log.Printf("Couldn't update processing job %s: %v", job.ID, err)
+	}
+	switch {
+	case job.Status == database.ProcessingJobStatusReady:
+		return nil
+	case transient:
+		return err
+	default:
+		return jobs.Permanent(err)
+	}
+}
+
+// transientUploadError reports whether err is storage or the scanner being
+// unreachable, which come back, so the upload is worth trying again as is.
+func transientUploadError(err error) bool {
+	return errors.Is(err, errStorageUpload) || errors.Is(err, errMalwareScan)
+}
+
+// finishProcessingJob sets how the job went from how ingestPipeline did.
+func finishProcessingJob(job *database.ProcessingJob, err error) {
+	job.Status = database.ProcessingJobStatusReady
+	switch {
+	case err == nil:
+	case errors.Is(err, errPublishQueued):
+		// the upload is safe and the video will point at it shortly
+		log.Printf("Processing job %s: %v", job.ID, err)
+	case errors.Is(err, errStorageUpload):
+		log.Printf("Processing job %s failed: %v", job.ID, err)
+		job.Status = database.ProcessingJobStatusFailed
+		job.Error = "Couldn't upload video to storage"
+		job.Retryable = true
+	case errors.Is(err, errUploadQuarantined):
+		log.Printf("Processing job %s failed: %v", job.ID, err)
+		job.Status = database.ProcessingJobStatusFailed
+		job.Error = "Upload was rejected by the malware scanner"
+	case errors.Is(err, errMalwareScan):
+		log.Printf("Processing job %s failed: %v", job.ID, err)
+		job.Status = database.ProcessingJobStatusFailed
+		job.Error = "Couldn't scan upload for malware"
+		job.Retryable = true
+	case errors.Is(err, errVideoDeleted):
+		job.Status = database.ProcessingJobStatusFailed
+		job.Error = "Video was deleted"
+	case errors.Is(err, errUploadGone):
+		log.Printf("Processing job %s failed: %v", job.ID, err)
+		job.Status = database.ProcessingJobStatusFailed
+		job.Error = "Upload expired before it could be processed, send it again"
+		job.Retryable = true
+	default:
+		log.Printf("Processing job %s failed: %v", job.ID, err)
+		job.Status = database.ProcessingJobStatusFailed
+		job.Error = "Couldn't process video"
+	}
+}
+
+// handlerJobGet reports on a processing job, with the video once it's
+// ready.
+func (cfg *apiConfig) handlerJobGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.ProcessingJob
+		Video *videoWithAssets `json:"video,omitempty"`
+	}
+
+	jobID, err := uuid.Parse(r.PathValue("jobID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid job ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	job, err := cfg.db.GetProcessingJob(jobID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get job", err)
+		return
+	}
+	if job.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Job not found", nil)
+		return
+	}
+
+	resp := response{ProcessingJob: job}
+	if job.Status == database.ProcessingJobStatusReady {
+		video, err := cfg.db.GetVideo(job.VideoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if video.ID != uuid.Nil {
+			withAssets := withAssetReadiness(cfg.withSignedThumbnail(video))
+			resp.Video = &withAssets
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
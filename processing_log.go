@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/google/uuid"
+)
+
+// processingLogRuns is how many uploads of a video keep their processing
+// log. Older ones are dropped as new ones start.
+const processingLogRuns = 5
+
+// startProcessingLog starts the processing log of an upload and returns ctx
+// with the ffmpeg and ffprobe runs made with it recorded there. The
+// pipelines record their stages on their own. Called again for the same
+// upload, as async uploads do for the part after the request, it carries on
+// the same log.
+func (cfg *apiConfig) startProcessingLog(ctx context.Context, in *videoIngest) context.Context {
+	if in.logRunID == uuid.Nil {
+		in.logRunID = uuid.New()
+		if err := cfg.db.PruneProcessingLog(in.video.ID, processingLogRuns-1); err != nil {
+			log.Printf("Couldn't prune processing log of video %s: %v", in.video.ID, err)
+		}
+	}
+	videoID, runID := in.video.ID, in.logRunID
+	return ffmpeg.WithRecorder(ctx, func(rec ffmpeg.Record) {
+		entry := database.ProcessingLogEntry{
+			VideoID:    videoID,
+			RunID:      runID,
+			StartedAt:  rec.Started,
+			DurationMS: rec.Took.Milliseconds(),
+			Kind:       database.ProcessingLogKindCommand,
+			Name:       rec.Command,
+			Args:       processingLogArgs(rec.Args),
+			Stdout:     rec.Stdout,
+			Stderr:     rec.Stderr,
+		}
+		if rec.Err != nil {
+			// the stderr is already in the entry
+			var ffmpegErr *ffmpeg.Error
+			if errors.As(rec.Err, &ffmpegErr) {
+				entry.Error = ffmpegErr.Err.Error()
+			} else {
+				entry.Error = rec.Err.Error()
+			}
+		}
+		cfg.addProcessingLogEntry(entry)
+	})
+}
+
+// logProcessingStage is the pipeline.Observer that records stage timings in
+// the processing log, for uploads that have one.
+func (cfg *apiConfig) logProcessingStage(in *videoIngest, stage string, took time.Duration, err error) {
+	if in.logRunID == uuid.Nil {
+		return
+	}
+	entry := database.ProcessingLogEntry{
+		VideoID:    in.video.ID,
+		RunID:      in.logRunID,
+		StartedAt:  time.Now().Add(-took),
+		DurationMS: took.Milliseconds(),
+		Kind:       database.ProcessingLogKindStage,
+		Name:       stage,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	cfg.addProcessingLogEntry(entry)
+}
+
+// addProcessingLogEntry only logs failures, the log is a diagnostic aid and
+// mustn't fail the upload.
+func (cfg *apiConfig) addProcessingLogEntry(entry database.ProcessingLogEntry) {
+	if err := cfg.db.CreateProcessingLogEntry(entry); err != nil {
+		log.Printf("Couldn't add to processing log of video %s: %v", entry.VideoID, err)
+	}
+}
+
+// processingLogArgs joins a command line for display. Inputs read over HTTP
+// are presigned URLs, whose signature is left out.
+func processingLogArgs(args []string) string {
+	shown := make([]string, 0, len(args))
+	for _, arg := range args {
+		if u, err := url.Parse(arg); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.RawQuery != "" {
+			u.RawQuery = ""
+			arg = u.String() + "?..."
+		}
+		shown = append(shown, arg)
+	}
+	return strings.Join(shown, " ")
+}
+
+// handlerProcessingLogRetrieve shows the owner how the video's latest
+// uploads were processed: every stage with its timing and error, and every
+// ffmpeg and ffprobe run with what it printed.
+func (cfg *apiConfig) handlerProcessingLogRetrieve(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	entries, err := cfg.db.GetProcessingLog(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing log", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// publishGate is a check a video has to pass before it can be made public.
+// check returns why it doesn't, or "" if it does.
+type publishGate struct {
+	name  string
+	check func(cfg *apiConfig, ctx context.Context, video database.Video) (string, error)
+}
+
+// publishGates are the gates PUBLISH_GATES can turn on. Moderation and
+// caption gates need a moderation status and caption tracks, which videos
+// don't have yet.
+var publishGates = map[string]publishGate{
+	"qc": {name: "qc", check: checkPublishQC},
+}
+
+// parsePublishGates reads a comma separated list of gate names.
+func parsePublishGates(spec string) ([]publishGate, error) {
+	var gates []publishGate
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		gate, ok := publishGates[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown publish gate %q", name)
+		}
+		gates = append(gates, gate)
+	}
+	return gates, nil
+}
+
+// unmetPublishGate is a gate a video didn't pass, and why.
+type unmetPublishGate struct {
+	Gate    string `json:"gate"`
+	Message string `json:"message"`
+}
+
+// unmetPublishGates runs every configured gate, so the owner learns about
+// all that's missing at once.
+func (cfg *apiConfig) unmetPublishGates(ctx context.Context, video database.Video) ([]unmetPublishGate, error) {
+	unmet := []unmetPublishGate{}
+	for _, gate := range cfg.publishGates {
+		message, err := gate.check(cfg, ctx, video)
+		if err != nil {
+			return nil, fmt.Errorf("%s gate: %w", gate.name, err)
+		}
+		if message != "" {
+			unmet = append(unmet, unmetPublishGate{Gate: gate.name, Message: message})
+		}
+	}
+	return unmet, nil
+}
+
+func respondWithUnmetPublishGates(w http.ResponseWriter, unmet []unmetPublishGate) {
+	type response struct {
+		Error string             `json:"error"`
+		Unmet []unmetPublishGate `json:"unmet"`
+	}
+	messages := make([]string, 0, len(unmet))
+	for _, gate := range unmet {
+		messages = append(messages, gate.Message)
+	}
+	respondWithJSON(w, http.StatusConflict, response{
+		Error: "Video can't be made public yet: " + strings.Join(messages, "; "),
+		Unmet: unmet,
+	})
+}
+
+// checkPublishQC wants a stored upload that probes as a playable video:
+// a video stream with dimensions and a duration.
+func checkPublishQC(cfg *apiConfig, ctx context.Context, video database.Video) (string, error) {
+	if video.ArchivedAt != nil {
+		return "Video is archived", nil
+	}
+	store, key, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "Video has no upload yet", nil
+	}
+	probe, err := cfg.probeStoredVideo(ctx, store, jobPresigner("publish-qc", &video.ID), key)
+	if err != nil {
+		log.Printf("publish gates: couldn't probe video %s: %v", video.ID, err)
+		return "Video upload couldn't be read as a video", nil
+	}
+	if probe.Width == 0 || probe.Height == 0 || probe.Duration <= 0 {
+		return "Video upload has no playable video stream", nil
+	}
+	return "", nil
+}
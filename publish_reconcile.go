@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	reconcileInterval   = 30 * time.Second
+	maxReconcileBackoff = time.Hour
+	// about a day of attempts before the object is given up on
+	maxReconcileAttempts = 30
+)
+
+// errPublishQueued is returned when an upload reached S3 but the video
+// record couldn't be pointed at it. The write is retried in the background,
+// so the upload doesn't need sending again.
+var errPublishQueued = errors.New("upload stored, video update queued")
+
+// publishTask is a stored object waiting for its video record to be pointed
+// at it. Tasks are kept as files next to the database rather than in it, as
+// the database just failed a write.
+type publishTask struct {
+	ID              uuid.UUID                 `json:"id"`
+	VideoID         uuid.UUID                 `json:"video_id"`
+	UserID          uuid.UUID                 `json:"user_id"`
+	Bucket          string                    `json:"bucket"`
+	Key             string                    `json:"key"`
+	ObjectURL       string                    `json:"object_url"`
+	VersionID       *string                   `json:"version_id"`
+	ETag            *string                   `json:"etag"`
+	Size            int64                     `json:"size"`
+	UploadSHA256    string                    `json:"upload_sha256"`
+	UploadSize      int64                     `json:"upload_size"`
+	HLSMasterKey    *string                   `json:"hls_master_key"`
+	DASHManifestKey *string                   `json:"dash_manifest_key"`
+	StoryboardKey   *string                   `json:"storyboard_key"`
+	Renditions      []database.VideoRendition `json:"renditions"`
+	Duration        float64                   `json:"duration"`
+	Metadata        *database.VideoMetadata   `json:"metadata"`
+
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error"`
+}
+
+// publishVideoObject points the video record at a freshly stored object and
+// counts the upload of uploadSize bytes towards the owner's upload caps. The
+// object's own size is what counts towards their storage quota. If the
+// record can't be written the write is queued and errPublishQueued returned.
+func (cfg *apiConfig) publishVideoObject(video database.Video, store objectStore, key string, stored storedObject, uploadSHA256 string, uploadSize int64) (database.Video, error) {
+	task := publishTask{
+		ID:              uuid.New(),
+		VideoID:         video.ID,
+		UserID:          video.UserID,
+		Bucket:          store.bucket,
+		Key:             key,
+		ObjectURL:       store.objectURL(key),
+		VersionID:       stored.versionID,
+		ETag:            stored.etag,
+		Size:            stored.size,
+		UploadSHA256:    uploadSHA256,
+		UploadSize:      uploadSize,
+		HLSMasterKey:    stored.hlsMaster,
+		DASHManifestKey: stored.dashManifest,
+		StoryboardKey:   stored.storyboard,
+		Renditions:      stored.renditions,
+		Metadata:        stored.metadata,
+	}
+	if stored.metadata != nil {
+		task.Duration = stored.metadata.Duration
+	}
+	published, err := cfg.applyPublishTask(task)
+	if err == nil || errors.Is(err, errVideoDeleted) {
+		return published, err
+	}
+
+	task.LastError = err.Error()
+	task.NextAttemptAt = cfg.now().Add(reconcileInterval)
+	if qerr := cfg.savePublishTask(task); qerr != nil {
+		log.Printf("reconcile: couldn't queue update of video %s to %s: %v", video.ID, key, qerr)
+		return video, fmt.Errorf("couldn't update video: %w", err)
+	}
+	log.Printf("reconcile: queued update of video %s to %s after: %v", video.ID, key, err)
+	return video, errPublishQueued
+}
+
+// respondWithPublishQueued tells the client its upload is safe and the video
+// will point at it shortly, so it shouldn't send it again.
+func respondWithPublishQueued(w http.ResponseWriter) {
+	respondWithJSON(w, http.StatusAccepted, map[string]string{
+		"status":  "updating",
+		"message": "Upload stored, the video will be updated shortly",
+	})
+}
+
+func (cfg *apiConfig) applyPublishTask(task publishTask) (database.Video, error) {
+	video, err := cfg.updateVideo(task.VideoID, func(video *database.Video) {
+		video.VideoURL = aws.String(task.ObjectURL)
+		video.Status = database.VideoStatusReady
+		video.VideoVersionID = task.VersionID
+		video.VideoETag = objectFingerprint(task.ETag)
+		video.VideoSize = task.Size
+		video.HLSMasterKey = task.HLSMasterKey
+		video.DASHManifestKey = task.DASHManifestKey
+		video.StoryboardKey = task.StoryboardKey
+		video.Duration = nil
+		if task.Duration > 0 {
+			video.Duration = &task.Duration
+		}
+		video.ArchivedAt = nil
+		video.UploadAbandonedAt = nil
+		video.QuarantinedAt = nil
+		video.QuarantineReason = nil
+		video.UploadSHA256 = nil
+		if task.UploadSHA256 != "" {
+			video.UploadSHA256 = &task.UploadSHA256
+		}
+	})
+	if err != nil {
+		return video, err
+	}
+
+	// keep a history of uploads so an accidental overwrite can be rolled back
+	if _, err := cfg.db.CreateVideoVersion(video.ID, task.Key, task.VersionID); err != nil {
+		log.Printf("Couldn't record version of video %s: %v", video.ID, err)
+	}
+	// renditions were made from the upload this replaced
+	if err := cfg.db.DeleteVideoRenditions(video.ID); err != nil {
+		log.Printf("Couldn't forget renditions of video %s: %v", video.ID, err)
+	}
+	for _, rendition := range task.Renditions {
+		rendition.VideoID = video.ID
+		if err := cfg.db.SaveVideoRendition(rendition); err != nil {
+			log.Printf("Couldn't record %s rendition of video %s: %v", rendition.Name, video.ID, err)
+		}
+	}
+	cfg.recordVideoMetadata(video.ID, task.Key, task.Metadata)
+	cfg.recordUpload(video.UserID, task.UploadSize, cfg.now())
+	cfg.queueDropReplacedUploads(video.ID)
+	cfg.queueVideoWebhooks(video)
+	return video, nil
+}
+
+// savePublishTask writes the task to a temp file and renames it into place,
+// so a crash never leaves half a task behind.
+func (cfg *apiConfig) savePublishTask(task publishTask) error {
+	if err := os.MkdirAll(cfg.reconcileDir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(cfg.reconcileDir, ".task-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(cfg.reconcileDir, task.ID.String()+".json"))
+}
+
+func (cfg *apiConfig) runPublishReconciler() {
+	for {
+		cfg.reconcilePublishes()
+		time.Sleep(reconcileInterval)
+	}
+}
+
+// reconcilePublishes retries every queued video update that's due. Updates
+// that keep failing are given up on and their object deleted, unless a video
+// has been pointed at it some other way since.
+func (cfg *apiConfig) reconcilePublishes() {
+	entries, err := os.ReadDir(cfg.reconcileDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("reconcile: couldn't read %s: %v", cfg.reconcileDir, err)
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(cfg.reconcileDir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("reconcile: couldn't read %s: %v", path, err)
+			continue
+		}
+		var task publishTask
+		if err := json.Unmarshal(data, &task); err != nil {
+			log.Printf("reconcile: skipping unreadable task %s: %v", path, err)
+			continue
+		}
+		if cfg.now().Before(task.NextAttemptAt) {
+			continue
+		}
+
+		_, err = cfg.applyPublishTask(task)
+		done := err == nil
+		switch {
+		case err == nil:
+			log.Printf("reconcile: updated video %s to %s", task.VideoID, task.Key)
+		case errors.Is(err, errVideoDeleted):
+			// nobody wants the upload any more
+			done = cfg.dropPublishedObject(task)
+		}
+		if done {
+			if err := os.Remove(path); err != nil {
+				log.Printf("reconcile: couldn't remove %s: %v", path, err)
+			}
+			continue
+		}
+
+		task.Attempts++
+		task.LastError = err.Error()
+		if task.Attempts >= maxReconcileAttempts {
+			if task.Attempts == maxReconcileAttempts {
+				log.Printf("reconcile: giving up on video %s after %d attempts: %v", task.VideoID, task.Attempts, err)
+				cfg.adminAlerts.send("publish_abandoned", fmt.Sprintf("Gave up pointing video %s at its upload", task.VideoID), map[string]any{
+					"video_id": task.VideoID,
+					"key":      task.Key,
+					"error":    task.LastError,
+				})
+			}
+			if cfg.dropPublishedObject(task) {
+				if err := os.Remove(path); err != nil {
+					log.Printf("reconcile: couldn't remove %s: %v", path, err)
+				}
+				continue
+			}
+		}
+		task.NextAttemptAt = cfg.now().Add(min(reconcileInterval<<min(task.Attempts, 8), maxReconcileBackoff))
+		// replaces the task's file
+		if err := cfg.savePublishTask(task); err != nil {
+			log.Printf("reconcile: couldn't save task %s: %v", task.ID, err)
+		}
+	}
+}
+
+// dropPublishedObject deletes a task's object if nothing points at it,
+// reporting whether the task is done with. A duplicate upload reuses another
+// video's object, which must be left alone.
+func (cfg *apiConfig) dropPublishedObject(task publishTask) bool {
+	videos, err := cfg.db.GetVideosByVideoURL(task.ObjectURL)
+	if err != nil {
+		log.Printf("reconcile: couldn't check who uses %s, keeping it: %v", task.Key, err)
+		return false
+	}
+	if len(videos) > 0 {
+		return true
+	}
+	store := cfg.defaultStore()
+	if task.Bucket != store.bucket {
+		store, err = cfg.storeForUser(task.UserID)
+		if err != nil || store.bucket != task.Bucket {
+			log.Printf("reconcile: bucket %s of %s is no longer reachable: %v", task.Bucket, task.Key, err)
+			return true
+		}
+	}
+	deleteStagedObject(store, streamedObject{Key: task.Key, VersionID: task.VersionID})
+	log.Printf("reconcile: deleted orphaned upload %s of video %s", task.Key, task.VideoID)
+	return true
+}
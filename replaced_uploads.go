@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// dropReplacedUploads deletes the objects of a video's earlier uploads once
+// a new one is published, so re-uploads don't leave orphans in the bucket.
+// In a versioned bucket the delete only hides the key: the earlier uploads
+// live on as noncurrent versions, which rollback still reaches by version
+// ID and a lifecycle rule can expire. Otherwise they're gone, and so are
+// their versions. Renditions go with their upload. Objects another video
+// uses are left alone. It runs as a drop-replaced-uploads job, and fails if
+// any upload was kept for an error, to be tried again.
+func (cfg *apiConfig) dropReplacedUploads(ctx context.Context, video database.Video) error {
+	store, currentKey, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		return fmt.Errorf("couldn't find the upload of video %s: %w", video.ID, err)
+	}
+	if !ok {
+		return nil
+	}
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't get versions of video %s: %w", video.ID, err)
+	}
+	versioned := video.VideoVersionID != nil
+
+	kept := 0
+	dropped := map[string]bool{currentKey: true}
+	for _, version := range versions {
+		if dropped[version.Key] {
+			continue
+		}
+		dropped[version.Key] = true
+
+		inUse, err := cfg.replacedUploadInUse(video, store, version.Key)
+		if err != nil {
+			log.Printf("Couldn't check who uses %s, keeping it: %v", version.Key, err)
+			kept++
+			continue
+		}
+		if inUse {
+			continue
+		}
+		if versioned {
+			// already hidden by an earlier upload
+			_, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(store.bucket),
+				Key:    aws.String(version.Key),
+			})
+			var notFound *types.NotFound
+			if errors.As(err, &notFound) {
+				continue
+			}
+		}
+
+		_, err = store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(version.Key),
+		})
+		if err != nil {
+			log.Printf("Couldn't delete replaced upload %s of video %s: %v", version.Key, video.ID, err)
+			kept++
+			continue
+		}
+		dropRenditions(ctx, store, version.Key)
+		if !versioned {
+			if err := cfg.db.DeleteVideoVersionsByKey(video.ID, version.Key); err != nil {
+				log.Printf("Couldn't forget deleted upload %s of video %s: %v", version.Key, video.ID, err)
+			}
+		}
+		log.Printf("deleted replaced upload %s of video %s", version.Key, video.ID)
+	}
+	if kept > 0 {
+		return fmt.Errorf("%d replaced uploads of video %s couldn't be deleted", kept, video.ID)
+	}
+	return nil
+}
+
+// replacedUploadInUse reports whether another video plays the object at key
+// or has it in its history, as byte-identical uploads share objects.
+func (cfg *apiConfig) replacedUploadInUse(video database.Video, store objectStore, key string) (bool, error) {
+	sharers, err := cfg.db.GetVideosByVideoURL(store.objectURL(key))
+	if err != nil {
+		return false, err
+	}
+	for _, sharer := range sharers {
+		if sharer.ID != video.ID {
+			return true, nil
+		}
+	}
+	return cfg.db.VideoVersionKeyShared(video.ID, key)
+}
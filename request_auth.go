@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// optionalUserID returns the authenticated user for endpoints that are also
+// open to anonymous viewers, or uuid.Nil when there is no valid token.
+func (cfg *apiConfig) optionalUserID(r *http.Request) uuid.UUID {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return uuid.Nil
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		return uuid.Nil
+	}
+	return userID
+}
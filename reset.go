@@ -1,6 +1,10 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
 
 func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
 	if cfg.platform != "dev" {
@@ -17,3 +21,18 @@ func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Database reset to initial state"))
 }
+
+// handlerMetrics reports how long each upload pipeline stage has taken and
+// how often it failed since the server started.
+func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	if cfg.platform != "dev" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Metrics are only available in dev environment."))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]any{
+		"pipeline_stages": cfg.pipelineMetrics.Snapshot(),
+		"ffmpeg":          ffmpeg.Stats(),
+	})
+}
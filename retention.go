@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const retentionCheckInterval = time.Hour
+
+// errRetentionShared is returned for a video whose upload another video
+// shares, when the rule doesn't cover that video too.
+var errRetentionShared = errors.New("upload is shared with a video the rule doesn't cover")
+
+// runRetentionScheduler applies the retention rules every hour.
+func (cfg *apiConfig) runRetentionScheduler() {
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := cfg.applyRetentionRules(context.Background(), cfg.now(), nil); err != nil {
+			log.Printf("retention: %v", err)
+		}
+	}
+}
+
+// applyRetentionRules runs every rule once and returns how many videos were
+// handled. A video that fails is logged and picked up again next time. With
+// a plan nothing is changed, the videos are only recorded in it.
+func (cfg *apiConfig) applyRetentionRules(ctx context.Context, now time.Time, plan *dryRun) (int, error) {
+	rules, err := cfg.db.GetRetentionRules()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get retention rules: %w", err)
+	}
+
+	handled := 0
+	for _, rule := range rules {
+		videos, err := cfg.db.GetRetentionCandidates(rule, now)
+		if err != nil {
+			return handled, fmt.Errorf("couldn't get videos for rule %q: %w", rule.Name, err)
+		}
+		covered := map[uuid.UUID]bool{}
+		for _, video := range videos {
+			covered[video.ID] = true
+		}
+		// videos archived along with one sharing their upload
+		done := map[uuid.UUID]bool{}
+		for _, video := range videos {
+			if done[video.ID] {
+				continue
+			}
+			// customers' own buckets follow their own lifecycle rules
+			if _, ok := cfg.videoKeyFromURL(aws.ToString(video.VideoURL)); video.VideoURL != nil && !ok {
+				continue
+			}
+			if plan != nil {
+				affected, err := cfg.planRetentionRule(plan, rule, video, covered)
+				if errors.Is(err, errRetentionShared) {
+					continue
+				}
+				if err != nil {
+					return handled, err
+				}
+				for _, id := range affected {
+					done[id] = true
+				}
+				handled += len(affected)
+				continue
+			}
+			affected, err := cfg.applyRetentionRule(ctx, rule, video, covered)
+			if errors.Is(err, errRetentionShared) {
+				log.Printf("retention: rule %q left video %s alone: %v", rule.Name, video.ID, err)
+				continue
+			}
+			if err != nil {
+				log.Printf("retention: rule %q couldn't %s video %s: %v", rule.Name, rule.Action, video.ID, err)
+				continue
+			}
+			for _, id := range affected {
+				log.Printf("retention: rule %q applied %s to video %s", rule.Name, rule.Action, id)
+				done[id] = true
+			}
+			handled += len(affected)
+		}
+	}
+	return handled, nil
+}
+
+// applyRetentionRule applies rule to video, returning the IDs of the videos
+// it changed. Archiving moves the upload, so every video sharing it is
+// archived too, and only when the rule covers them all.
+func (cfg *apiConfig) applyRetentionRule(ctx context.Context, rule database.RetentionRule, video database.Video, covered map[uuid.UUID]bool) ([]uuid.UUID, error) {
+	switch rule.Action {
+	case database.RetentionActionArchive:
+		sharers, err := cfg.retentionSharers(video, covered)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.archiveVideo(ctx, video, sharers); err != nil {
+			return nil, err
+		}
+		archived := []uuid.UUID{}
+		for _, sharer := range sharers {
+			archived = append(archived, sharer.ID)
+			err := cfg.db.CreateNotification(database.CreateNotificationParams{
+				UserID:  sharer.UserID,
+				VideoID: &sharer.ID,
+				Kind:    "video_archived",
+				Message: fmt.Sprintf("%q was moved to archive storage and needs to be restored before it can play", sharer.Title),
+			})
+			if err != nil {
+				return archived, err
+			}
+		}
+		return archived, nil
+	case database.RetentionActionDelete:
+		shared, err := cfg.videoObjectShared(video)
+		if err != nil {
+			return nil, err
+		}
+		store, key, ok, err := cfg.storeForVideo(video)
+		if err != nil {
+			return nil, err
+		}
+		// deduplicated uploads share an object, which stays while in use
+		if ok && !shared {
+			_, err := store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(store.bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("couldn't delete object: %w", err)
+			}
+			dropRenditions(ctx, store, key)
+		}
+		if err := cfg.db.DeleteVideo(video.ID); err != nil {
+			return nil, err
+		}
+		err = cfg.db.CreateNotification(database.CreateNotificationParams{
+			UserID:  video.UserID,
+			Kind:    "video_purged",
+			Message: fmt.Sprintf("%q was deleted by a retention policy", video.Title),
+		})
+		return []uuid.UUID{video.ID}, err
+	}
+	return nil, fmt.Errorf("unknown action %q", rule.Action)
+}
+
+// planRetentionRule records in plan what applyRetentionRule would do.
+func (cfg *apiConfig) planRetentionRule(plan *dryRun, rule database.RetentionRule, video database.Video, covered map[uuid.UUID]bool) ([]uuid.UUID, error) {
+	store, key, inBucket, err := cfg.storeForVideo(video)
+	if err != nil {
+		return nil, err
+	}
+	object := "s3://" + store.bucket + "/" + key
+	switch rule.Action {
+	case database.RetentionActionArchive:
+		sharers, err := cfg.retentionSharers(video, covered)
+		if err != nil {
+			return nil, err
+		}
+		plan.would("archive", object, video.VideoSize)
+		archived := []uuid.UUID{}
+		for _, sharer := range sharers {
+			archived = append(archived, sharer.ID)
+		}
+		return archived, nil
+	case database.RetentionActionDelete:
+		shared, err := cfg.videoObjectShared(video)
+		if err != nil {
+			return nil, err
+		}
+		if inBucket && !shared {
+			plan.would("delete object", object, video.VideoSize)
+		}
+		plan.would("delete video", fmt.Sprintf("%s %q", video.ID, video.Title), 0)
+		return []uuid.UUID{video.ID}, nil
+	}
+	return nil, fmt.Errorf("unknown action %q", rule.Action)
+}
+
+// retentionSharers returns the unarchived videos whose upload is video's,
+// video among them, or errRetentionShared if one of them isn't covered by
+// the rule: another owner's video, or one exempt from retention, mustn't be
+// archived by a rule that doesn't apply to it.
+func (cfg *apiConfig) retentionSharers(video database.Video, covered map[uuid.UUID]bool) ([]database.Video, error) {
+	sharers, err := cfg.db.GetVideosByVideoURL(aws.ToString(video.VideoURL))
+	if err != nil {
+		return nil, err
+	}
+	unarchived := []database.Video{}
+	for _, sharer := range sharers {
+		if sharer.ArchivedAt != nil {
+			continue
+		}
+		if !covered[sharer.ID] {
+			return nil, fmt.Errorf("%w: %s", errRetentionShared, sharer.ID)
+		}
+		unarchived = append(unarchived, sharer)
+	}
+	return unarchived, nil
+}
+
+// archiveVideo moves the current upload of a video to Glacier by copying
+// the object onto itself with the new storage class, and marks the sharers,
+// the videos using it, archived. With versioning on the copy is a new
+// version, so the old standard class one is removed and the recorded
+// version IDs are moved over.
+func (cfg *apiConfig) archiveVideo(ctx context.Context, video database.Video, sharers []database.Video) error {
+	store, key, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("video URL isn't in the bucket")
+	}
+
+	head, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't get object: %w", err)
+	}
+
+	if head.StorageClass != types.StorageClassGlacier && head.StorageClass != types.StorageClassDeepArchive {
+		m := bucketMigration{
+			src:          store.client,
+			dst:          store.client,
+			srcBucket:    store.bucket,
+			dstBucket:    store.bucket,
+			storageClass: types.StorageClassGlacier,
+		}
+		if err := m.copyObject(ctx, key, key, aws.ToInt64(head.ContentLength)); err != nil {
+			return fmt.Errorf("couldn't copy object to glacier: %w", err)
+		}
+
+		archived, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't verify archived object: %w", err)
+		}
+		if head.VersionId != nil && aws.ToString(archived.VersionId) != aws.ToString(head.VersionId) {
+			_, err = store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket:    aws.String(store.bucket),
+				Key:       aws.String(key),
+				VersionId: head.VersionId,
+			})
+			if err != nil {
+				return fmt.Errorf("couldn't remove standard class version: %w", err)
+			}
+			if err := cfg.db.SetVideoVersionS3ID(key, archived.VersionId); err != nil {
+				return err
+			}
+			video.VideoVersionID = archived.VersionId
+		}
+	}
+
+	now := cfg.now().UTC()
+	for _, sharer := range sharers {
+		_, err = cfg.updateVideo(sharer.ID, func(v *database.Video) {
+			v.VideoVersionID = video.VideoVersionID
+			v.ArchivedAt = &now
+		})
+		if err != nil && !errors.Is(err, errVideoDeleted) {
+			return err
+		}
+	}
+	return nil
+}
+
+// videoObjectShared reports whether another video points at the same
+// object as video.
+func (cfg *apiConfig) videoObjectShared(video database.Video) (bool, error) {
+	if video.VideoURL == nil {
+		return false, nil
+	}
+	sharers, err := cfg.db.GetVideosByVideoURL(*video.VideoURL)
+	if err != nil {
+		return false, err
+	}
+	for _, sharer := range sharers {
+		if sharer.ID != video.ID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// runRetentionCommand manages retention rules and exemptions from the CLI.
+func (cfg *apiConfig) runRetentionCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("retention requires one of list, add, remove, exempt, run")
+	}
+
+	switch args[0] {
+	case "list":
+		rules, err := cfg.db.GetRetentionRules()
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			visibility := string(rule.Visibility)
+			if visibility == "" {
+				visibility = "any"
+			}
+			fmt.Printf("%s  %-20s  %s %s videos older than %d days: %s\n",
+				rule.ID, rule.Name, visibility, rule.UploadState, rule.MinAgeDays, rule.Action)
+		}
+		exempt, err := cfg.db.GetRetentionExemptVideos()
+		if err != nil {
+			return err
+		}
+		for _, video := range exempt {
+			fmt.Printf("exempt: %s %q\n", video.ID, video.Title)
+		}
+		return nil
+	case "add":
+		fs := flag.NewFlagSet("retention add", flag.ExitOnError)
+		name := fs.String("name", "", "name of the rule")
+		visibility := fs.String("visibility", "", "private, unlisted or public, matches all when empty")
+		state := fs.String("state", string(database.RetentionUploadComplete), "complete, or failed for videos whose upload never finished")
+		days := fs.Int("older-than-days", 0, "minimum age of a video in days")
+		action := fs.String("action", "", "archive (move to Glacier) or delete")
+		fs.Parse(args[1:])
+
+		params := database.CreateRetentionRuleParams{
+			Name:        *name,
+			Visibility:  database.VideoVisibility(*visibility),
+			UploadState: database.RetentionUploadState(*state),
+			MinAgeDays:  *days,
+			Action:      database.RetentionAction(*action),
+		}
+		if err := validateRetentionRule(params); err != nil {
+			return err
+		}
+		rule, err := cfg.db.CreateRetentionRule(params)
+		if err != nil {
+			return fmt.Errorf("couldn't create rule: %w", err)
+		}
+		fmt.Printf("created rule %s\n", rule.ID)
+		return nil
+	case "remove":
+		fs := flag.NewFlagSet("retention remove", flag.ExitOnError)
+		id := fs.String("id", "", "rule to remove")
+		fs.Parse(args[1:])
+		ruleID, err := uuid.Parse(*id)
+		if err != nil {
+			return fmt.Errorf("retention remove requires a rule -id: %w", err)
+		}
+		found, err := cfg.db.DeleteRetentionRule(ruleID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("rule %s doesn't exist", ruleID)
+		}
+		return nil
+	case "exempt":
+		fs := flag.NewFlagSet("retention exempt", flag.ExitOnError)
+		id := fs.String("video", "", "video to exempt")
+		off := fs.Bool("off", false, "let retention rules apply to the video again")
+		fs.Parse(args[1:])
+		videoID, err := uuid.Parse(*id)
+		if err != nil {
+			return fmt.Errorf("retention exempt requires a -video ID: %w", err)
+		}
+		return cfg.db.SetVideoRetentionExempt(videoID, !*off)
+	case "run":
+		fs := flag.NewFlagSet("retention run", flag.ExitOnError)
+		dry := fs.Bool("dry-run", false, "only list what the rules would archive or delete")
+		fs.Parse(args[1:])
+		if *dry {
+			plan := newDryRun(os.Stdout)
+			handled, err := cfg.applyRetentionRules(ctx, cfg.now(), plan)
+			plan.summary()
+			fmt.Printf("%d videos would be handled\n", handled)
+			return err
+		}
+		handled, err := cfg.applyRetentionRules(ctx, cfg.now(), nil)
+		fmt.Printf("%d videos handled\n", handled)
+		return err
+	}
+	return fmt.Errorf("unknown retention command %q", args[0])
+}
+
+func validateRetentionRule(params database.CreateRetentionRuleParams) error {
+	if params.Name == "" {
+		return errors.New("a rule needs a -name")
+	}
+	switch params.Visibility {
+	case "", database.VideoVisibilityPrivate, database.VideoVisibilityUnlisted, database.VideoVisibilityPublic:
+	default:
+		return fmt.Errorf("unknown visibility %q", params.Visibility)
+	}
+	if params.MinAgeDays < 1 {
+		return errors.New("-older-than-days must be at least 1")
+	}
+	switch {
+	case params.UploadState == database.RetentionUploadComplete &&
+		(params.Action == database.RetentionActionArchive || params.Action == database.RetentionActionDelete):
+	case params.UploadState == database.RetentionUploadFailed && params.Action == database.RetentionActionDelete:
+	case params.UploadState == database.RetentionUploadFailed && params.Action == database.RetentionActionArchive:
+		return errors.New("failed uploads have nothing to archive, use -action delete")
+	default:
+		return fmt.Errorf("unknown state %q or action %q", params.UploadState, params.Action)
+	}
+	return nil
+}
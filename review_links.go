@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// longest a review link can be asked to last; links without an expiry last
+// until they're revoked
+const maxReviewLinkTTL = 90 * 24 * time.Hour
+
+// reviewToken is what goes in a review link: the link's ID and a signature
+// binding it to the video and reviewer, made like an embed token's.
+func (cfg *apiConfig) reviewToken(link database.ReviewLink) string {
+	return link.ID.String() + "." + cfg.reviewSignature(link)
+}
+
+func (cfg *apiConfig) reviewSignature(link database.ReviewLink) string {
+	reviewer := ""
+	if link.ReviewerID != nil {
+		reviewer = link.ReviewerID.String()
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.urlSigningSecret))
+	mac.Write([]byte("review\x00" + link.ID.String() + "\x00" + link.VideoID.String() + "\x00" + reviewer))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cfg apiConfig) reviewURL(videoID uuid.UUID, token string) string {
+	return fmt.Sprintf("http://localhost:%s/api/review/%s/playback-url?token=%s", cfg.port, videoID, url.QueryEscape(token))
+}
+
+type reviewLinkResponse struct {
+	database.ReviewLink
+	Token     string `json:"token"`
+	ReviewURL string `json:"review_url"`
+}
+
+func (cfg *apiConfig) newReviewLinkResponse(link database.ReviewLink) reviewLinkResponse {
+	signed := cfg.reviewToken(link)
+	return reviewLinkResponse{
+		ReviewLink: link,
+		Token:      signed,
+		ReviewURL:  cfg.reviewURL(link.VideoID, signed),
+	}
+}
+
+// handlerReviewLinkCreate makes a link for watching the video before it's
+// published, for the owner alone or for one reviewer by email.
+func (cfg *apiConfig) handlerReviewLinkCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ReviewerEmail string `json:"reviewer_email"`
+		ExpiresIn     string `json:"expires_in"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	create := database.CreateReviewLinkParams{VideoID: video.ID}
+	if params.ExpiresIn != "" {
+		ttl, err := time.ParseDuration(params.ExpiresIn)
+		if err != nil || ttl <= 0 || ttl > maxReviewLinkTTL {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("expires_in must be a duration up to %s, like 72h", maxReviewLinkTTL), err)
+			return
+		}
+		expiresAt := cfg.now().UTC().Add(ttl)
+		create.ExpiresAt = &expiresAt
+	}
+	if params.ReviewerEmail != "" {
+		reviewer, ok := cfg.collaboratorFromEmail(w, video, params.ReviewerEmail)
+		if !ok {
+			return
+		}
+		create.ReviewerID = &reviewer.ID
+	}
+
+	link, err := cfg.db.CreateReviewLink(create)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create review link", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, cfg.newReviewLinkResponse(link))
+}
+
+func (cfg *apiConfig) handlerReviewLinksRetrieve(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := cfg.db.GetReviewLinks(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get review links", err)
+		return
+	}
+	resp := make([]reviewLinkResponse, 0, len(links))
+	for _, link := range links {
+		resp = append(resp, cfg.newReviewLinkResponse(link))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerReviewLinkDelete(w http.ResponseWriter, r *http.Request) {
+	linkID, err := uuid.Parse(r.PathValue("linkID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid link ID", err)
+		return
+	}
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err = cfg.db.DeleteReviewLink(video.ID, linkID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke review link", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reviewFromRequest checks the review token in the query against the video
+// in the path and the signed-in user, writing the error response if they
+// don't match. A link only works for the user it was made for, so one that's
+// forwarded is no use to whoever it reaches.
+func (cfg *apiConfig) reviewFromRequest(w http.ResponseWriter, r *http.Request) (database.Video, database.ReviewLink, uuid.UUID, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+	bearer, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+	userID, err := auth.ValidateJWT(bearer, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+	linkID, signature, _ := strings.Cut(r.URL.Query().Get("token"), ".")
+	id, err := uuid.Parse(linkID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Review token required", nil)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+
+	link, err := cfg.db.GetReviewLink(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get review link", err)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+	// a revoked link has no row, so it can't match
+	if link.VideoID != videoID || !hmac.Equal([]byte(signature), []byte(cfg.reviewSignature(link))) {
+		respondWithError(w, http.StatusForbidden, "Review token is not valid for this video", nil)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+	if link.ExpiresAt != nil && cfg.now().After(*link.ExpiresAt) {
+		respondWithError(w, http.StatusForbidden, "Review link has expired", nil)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+	// the owner can use any of their links, so they can check what a
+	// reviewer will see
+	if userID != video.UserID && (link.ReviewerID == nil || *link.ReviewerID != userID) {
+		respondWithError(w, http.StatusForbidden, "This review link is for someone else", nil)
+		return database.Video{}, database.ReviewLink{}, uuid.Nil, false
+	}
+	return video, link, userID, true
+}
+
+// reviewPresigner identifies a review link and who used it.
+func reviewPresigner(link database.ReviewLink, userID uuid.UUID) presignRequester {
+	return presignRequester{Requester: "review:" + link.ID.String(), UserID: &userID, VideoID: &link.VideoID}
+}
+
+// handlerReviewPlaybackURL presigns the latest upload of a video for a
+// review link, whatever its visibility or premiere. While a new upload is
+// processing, that's the one it replaces; a video that has never had one
+// gets a 404 until it does.
+func (cfg *apiConfig) handlerReviewPlaybackURL(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL        string                   `json:"url"`
+		ExpiresAt  time.Time                `json:"expires_at"`
+		Visibility database.VideoVisibility `json:"visibility"`
+		PremiereAt *time.Time               `json:"premiere_at,omitempty"`
+		Renditions []playbackRendition      `json:"renditions,omitempty"`
+		Storyboard *playbackStoryboard      `json:"storyboard,omitempty"`
+		Captions   []playbackCaption        `json:"captions,omitempty"`
+	}
+
+	video, link, userID, ok := cfg.reviewFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if !videoPlayable(w, video) {
+		return
+	}
+	if video.ArchivedAt != nil {
+		respondWithError(w, http.StatusConflict, "Video is archived", nil)
+		return
+	}
+	store, key, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Video has no upload yet", nil)
+		return
+	}
+
+	versionID := aws.ToString(video.VideoVersionID)
+	// reviewers are watched like viewers: they get their own watermarked
+	// rendition when the video asks for one
+	access := videoAccessView
+	if userID == video.UserID {
+		access = videoAccessOwner
+	}
+	if watermarkRequired(video, access) {
+		var ready bool
+		key, ready, err = cfg.watermarkedRendition(r.Context(), store, video, key, userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't prepare video", err)
+			return
+		}
+		if !ready {
+			w.Header().Set("Retry-After", watermarkRetryAfter)
+			respondWithJSON(w, http.StatusAccepted, map[string]string{"status": "preparing"})
+			return
+		}
+		versionID = ""
+	}
+
+	if !cfg.bandwidthAllowed(w, video) {
+		return
+	}
+	presigner := reviewPresigner(link, userID)
+	expiresAt := cfg.now().UTC().Add(playbackURLExpiry)
+	videoURL, err := cfg.presignObjectURL(r.Context(), store, presigner, key, versionID, playbackURLExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+		return
+	}
+	var renditions []playbackRendition
+	if !watermarkRequired(video, access) {
+		renditions, err = cfg.playbackRenditions(r.Context(), store, presigner, video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign renditions", err)
+			return
+		}
+	}
+	var storyboard *playbackStoryboard
+	if video.StoryboardKey != nil {
+		storyboard, err = cfg.presignStoryboard(r.Context(), store, presigner, *video.StoryboardKey)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign storyboard", err)
+			return
+		}
+	}
+	captions, err := cfg.playbackCaptions(r.Context(), presigner, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign captions", err)
+		return
+	}
+
+	if err := cfg.db.RecordReviewLinkView(link.ID, cfg.now()); err != nil {
+		log.Printf("review: couldn't record view through link %s: %v", link.ID, err)
+	}
+	log.Printf("review: video %s watched by %s through link %s", video.ID, userID, link.ID)
+	respondWithJSON(w, http.StatusOK, response{
+		URL:        videoURL,
+		ExpiresAt:  expiresAt,
+		Visibility: video.Visibility,
+		PremiereAt: video.PremiereAt,
+		Renditions: renditions,
+		Storyboard: storyboard,
+		Captions:   captions,
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// videoKeyFromURL recovers the S3 key from a stored video URL, which is
+// always the CloudFront distribution followed by the key.
+func (cfg *apiConfig) videoKeyFromURL(videoURL string) (string, bool) {
+	prefix := cfg.s3CfDistribution + "/"
+	if !strings.HasPrefix(videoURL, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(videoURL, prefix), true
+}
+
+// downloadObjectToTemp copies an object in store into a new temp file in
+// dir and returns its path. The caller is responsible for removing it.
+func (cfg *apiConfig) downloadObjectToTemp(ctx context.Context, store objectStore, dir, key, pattern string) (string, error) {
+	out, err := store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't get object %s: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, out.Body); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("couldn't download object %s: %w", key, err)
+	}
+	return f.Name(), nil
+}
+
+func (cfg *apiConfig) uploadFileToS3(ctx context.Context, store objectStore, key, contentType, filePath string) error {
+	_, err := cfg.putFile(ctx, store, &s3.PutObjectInput{
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	}, filePath)
+	return err
+}
+
+// presignObjectURL returns a time-limited GET URL for an object straight from
+// the store's bucket. versionID pins a specific object version and may be
+// empty. Every URL handed out is audited against requester.
+func (cfg *apiConfig) presignObjectURL(ctx context.Context, store objectStore, requester presignRequester, key, versionID string, expires time.Duration) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	req, err := s3.NewPresignClient(store.client).PresignGetObject(ctx, input, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", fmt.Errorf("couldn't presign object %s: %w", key, err)
+	}
+	cfg.auditPresign(requester, key, time.Now().Add(expires))
+	return req.URL, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3RetryPolicy retries S3 writes that failed in a way worth retrying, on top
+// of the SDK's own few quick attempts, so a network blip late in a 1GB
+// upload doesn't throw the whole file away. Writes go to a key fixed before
+// the first attempt, so repeating one is harmless.
+type s3RetryPolicy struct {
+	// total tries, the first one included
+	Attempts int
+	// the wait before the nth retry is a random duration up to
+	// BaseDelay*2^(n-1), capped at MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var defaultS3RetryPolicy = s3RetryPolicy{
+	Attempts:  4,
+	BaseDelay: time.Second,
+	MaxDelay:  30 * time.Second,
+}
+
+var s3Retryables = retry.IsErrorRetryables(retry.DefaultRetryables)
+
+func (p s3RetryPolicy) do(ctx context.Context, op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || ctx.Err() != nil || s3Retryables.IsErrorRetryable(err) != aws.TrueTernary {
+			return err
+		}
+		delay := p.backoff(attempt)
+		log.Printf("s3: %s failed on attempt %d of %d, retrying in %s: %v", op, attempt, p.Attempts, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backoff is full jitter, so uploads that failed together don't all come
+// back at once.
+func (p s3RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := min(p.BaseDelay<<min(attempt-1, 16), p.MaxDelay)
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling) + 1
+}
+
+// putFile uploads the file at filePath to input's key, rewinding it for
+// every attempt.
+func (cfg *apiConfig) putFile(ctx context.Context, store objectStore, input *s3.PutObjectInput, filePath string) (*s3.PutObjectOutput, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out *s3.PutObjectOutput
+	err = cfg.s3Retry.do(ctx, "PutObject "+aws.ToString(input.Key), func() error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		input.Bucket = aws.String(store.bucket)
+		input.Body = f
+		out, err = store.client.PutObject(ctx, input)
+		return err
+	})
+	return out, err
+}
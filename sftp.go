@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/jobs"
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const sftpUserIDExtension = "tubely-user-id"
+
+// startSFTPServer accepts SFTP connections authenticated with the same
+// email/password as the API. Each user gets a flat drop directory; every
+// video written there is ingested as a new video once the upload completes.
+func (cfg *apiConfig) startSFTPServer(addr, root, hostKeyPath string) error {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return fmt.Errorf("couldn't create sftp root: %w", err)
+	}
+
+	signer, err := loadSFTPHostKey(hostKeyPath)
+	if err != nil {
+		return err
+	}
+
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			user, err := cfg.db.GetUserByEmail(conn.User())
+			if err != nil || user.ID == uuid.Nil {
+				return nil, errors.New("incorrect email or password")
+			}
+			if err := auth.CheckPasswordHash(string(password), user.Password); err != nil {
+				return nil, errors.New("incorrect email or password")
+			}
+			return &ssh.Permissions{
+				Extensions: map[string]string{sftpUserIDExtension: user.ID.String()},
+			}, nil
+		},
+	}
+	sshConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("couldn't listen for sftp: %w", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("sftp: accept error: %v", err)
+				continue
+			}
+			go cfg.handleSFTPConn(conn, sshConfig, root)
+		}
+	}()
+
+	log.Printf("SFTP ingest listening on %s", addr)
+	return nil
+}
+
+func loadSFTPHostKey(hostKeyPath string) (ssh.Signer, error) {
+	if hostKeyPath != "" {
+		dat, err := os.ReadFile(hostKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read sftp host key: %w", err)
+		}
+		return ssh.ParsePrivateKey(dat)
+	}
+
+	log.Println("sftp: SFTP_HOST_KEY not set, generating an ephemeral host key")
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+func (cfg *apiConfig) handleSFTPConn(conn net.Conn, sshConfig *ssh.ServerConfig, root string) {
+	defer conn.Close()
+
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
+	if err != nil {
+		log.Printf("sftp: handshake failed: %v", err)
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	userID, err := uuid.Parse(serverConn.Permissions.Extensions[sftpUserIDExtension])
+	if err != nil {
+		log.Printf("sftp: invalid user id on connection: %v", err)
+		return
+	}
+
+	userDir := filepath.Join(root, userID.String())
+	err = os.MkdirAll(userDir, 0755)
+	if err != nil {
+		log.Printf("sftp: couldn't create user directory: %v", err)
+		return
+	}
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("sftp: couldn't accept channel: %v", err)
+			return
+		}
+
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}(requests)
+
+		handler := &sftpDropBox{cfg: cfg, userID: userID, dir: userDir}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet:  handler,
+			FilePut:  handler,
+			FileCmd:  handler,
+			FileList: handler,
+		})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Printf("sftp: session ended with error: %v", err)
+		}
+		server.Close()
+	}
+}
+
+// sftpDropBox is a write-only view of a user's ingest directory.
+type sftpDropBox struct {
+	cfg    *apiConfig
+	userID uuid.UUID
+	dir    string
+}
+
+func (d *sftpDropBox) localPath(requestPath string) (string, error) {
+	name := path.Base(path.Clean("/" + requestPath))
+	if name == "/" || name == "." || strings.HasPrefix(name, ".") {
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	return filepath.Join(d.dir, name), nil
+}
+
+func (d *sftpDropBox) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return nil, sftp.ErrSSHFxPermissionDenied
+}
+
+func (d *sftpDropBox) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if !isVideoFilename(r.Filepath) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	localPath, err := d.localPath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	// each upload gets its own file, so two of the same name don't write
+	// over one another
+	f, err := os.CreateTemp(d.dir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &sftpUpload{File: f, dropBox: d, name: filepath.Base(localPath)}, nil
+}
+
+func (d *sftpDropBox) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return nil
+	case "Remove":
+		localPath, err := d.localPath(r.Filepath)
+		if err != nil {
+			return err
+		}
+		return os.Remove(localPath)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (d *sftpDropBox) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(d.dir)
+		if err != nil {
+			return nil, err
+		}
+		infos := []os.FileInfo{}
+		for _, entry := range entries {
+			// uploads in progress and waiting to be ingested
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return sftpListerAt(infos), nil
+	case "Stat":
+		if path.Clean("/"+r.Filepath) == "/" {
+			info, err := os.Stat(d.dir)
+			if err != nil {
+				return nil, err
+			}
+			return sftpListerAt{info}, nil
+		}
+		localPath, err := d.localPath(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type sftpListerAt []os.FileInfo
+
+func (l sftpListerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpUpload hands the finished file to the ingest pipeline on Close.
+type sftpUpload struct {
+	*os.File
+	dropBox *sftpDropBox
+	// the name the client wrote, which becomes the video's title
+	name   string
+	failed bool
+}
+
+func (u *sftpUpload) TransferError(err error) {
+	u.failed = true
+}
+
+func (u *sftpUpload) Close() error {
+	err := u.File.Close()
+	if err != nil {
+		return err
+	}
+	if u.failed {
+		return os.Remove(u.Name())
+	}
+	err = u.dropBox.queueIngest(u.Name(), u.name)
+	if err != nil {
+		os.Remove(u.Name())
+		return err
+	}
+	return nil
+}
+
+type ingestSFTPUploadPayload struct {
+	UserID uuid.UUID `json:"user_id"`
+	// the upload's own directory, holding only the file named Name
+	Dir  string `json:"dir"`
+	Name string `json:"name"`
+}
+
+// queueIngest moves a finished upload under its own directory with the
+// name it was written as, and queues it to be ingested.
+func (d *sftpDropBox) queueIngest(tempPath, name string) error {
+	dir, err := os.MkdirTemp(d.dir, ".ingest-*")
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempPath, filepath.Join(dir, name))
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	payload := ingestSFTPUploadPayload{UserID: d.userID, Dir: dir, Name: name}
+	_, err = d.cfg.jobs.Enqueue(context.Background(), jobIngestSFTPUpload, payload)
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("couldn't queue ingest: %w", err)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) ingestSFTPUploadJob(ctx context.Context, job jobs.Job) error {
+	var payload ingestSFTPUploadPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	defer os.RemoveAll(payload.Dir)
+
+	localPath := filepath.Join(payload.Dir, payload.Name)
+	video, err := cfg.ingestNewVideoFile(ctx, payload.UserID, localPath)
+	if err != nil {
+		return jobs.Permanent(fmt.Errorf("couldn't ingest %s: %w", payload.Name, err))
+	}
+	log.Printf("sftp: ingested %s as video %s for user %s", payload.Name, video.ID, payload.UserID)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"unsafe"
+)
+
+// direct I/O needs buffers, offsets and lengths aligned to the device's
+// logical block size; 4KB covers everything we're likely to run on
+const (
+	directIOAlign      = 4 << 10
+	directIOBufferSize = 1 << 20
+)
+
+// spoolFile is the writer behind spoolToTempFile. It reserves the expected
+// size up front when given one so a large upload lands in few extents, and
+// with direct I/O it writes whole aligned blocks past the page cache so many
+// concurrent uploads don't push everything else out of memory. Only the
+// unaligned tail goes through the page cache.
+type spoolFile struct {
+	f           *os.File
+	direct      bool
+	buf         []byte
+	buffered    int
+	written     int64
+	preallocate bool
+}
+
+// newSpoolFile wraps f. Direct I/O is silently skipped where the OS or
+// filesystem doesn't support it, e.g. tmpfs.
+func newSpoolFile(f *os.File, sizeHint int64, directIO bool) *spoolFile {
+	s := &spoolFile{f: f}
+	if sizeHint > 0 && preallocateFile(f, sizeHint) == nil {
+		s.preallocate = true
+	}
+	if directIO && setDirectIO(f, true) == nil {
+		s.direct = true
+		s.buf = alignedBuffer(directIOBufferSize)
+	}
+	return s
+}
+
+func (s *spoolFile) Write(p []byte) (int, error) {
+	if !s.direct {
+		n, err := s.f.Write(p)
+		s.written += int64(n)
+		return n, err
+	}
+
+	total := len(p)
+	for len(p) > 0 {
+		n := copy(s.buf[s.buffered:], p)
+		s.buffered += n
+		p = p[n:]
+		if s.buffered == len(s.buf) {
+			if err := s.flush(len(s.buf)); err != nil {
+				return total - len(p), err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (s *spoolFile) flush(n int) error {
+	written, err := s.f.Write(s.buf[:n])
+	s.written += int64(written)
+	s.buffered = copy(s.buf, s.buf[written:s.buffered])
+	return err
+}
+
+// Close writes out what's buffered and releases any space reserved past the
+// end of the file.
+func (s *spoolFile) Close() error {
+	if s.direct && s.buffered > 0 {
+		aligned := s.buffered &^ (directIOAlign - 1)
+		err := s.flush(aligned)
+		if err == nil {
+			err = setDirectIO(s.f, false)
+		}
+		if err == nil {
+			err = s.flush(s.buffered)
+		}
+		if err != nil {
+			s.f.Close()
+			return err
+		}
+	}
+	if s.preallocate {
+		if err := s.f.Truncate(s.written); err != nil {
+			s.f.Close()
+			return err
+		}
+	}
+	return s.f.Close()
+}
+
+// alignedBuffer returns a buffer of size bytes starting on a directIOAlign
+// boundary.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlign)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlign - 1)); rem != 0 {
+		offset = directIOAlign - rem
+	}
+	return buf[offset : offset+size]
+}
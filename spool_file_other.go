@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+const directIOSupported = false
+
+// preallocateFile is a no-op outside Linux.
+func preallocateFile(f *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
+
+func setDirectIO(f *os.File, on bool) error {
+	return errors.ErrUnsupported
+}
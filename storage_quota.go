@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+	"github.com/google/uuid"
+)
+
+// storageUsage is what a user keeps stored against their plan's storage
+// quota. Only current uploads count; videos stored before sizes were
+// recorded count as empty until they're uploaded again.
+type storageUsage struct {
+	Videos     int   `json:"videos"`
+	UsedBytes  int64 `json:"used_bytes"`
+	QuotaBytes int64 `json:"quota_bytes"`
+	// total length of the videos, leaving out uploads from before durations
+	// were recorded
+	DurationSeconds float64 `json:"duration_seconds"`
+	// nil when the plan has no quota
+	RemainingBytes *int64 `json:"remaining_bytes"`
+	Plan           string `json:"plan"`
+}
+
+func (cfg *apiConfig) storageUsage(userID uuid.UUID, plan database.Plan) (storageUsage, error) {
+	stored, err := cfg.db.GetUserStorage(userID)
+	if err != nil {
+		return storageUsage{}, fmt.Errorf("couldn't get storage used: %w", err)
+	}
+	usage := storageUsage{
+		Videos:          stored.Videos,
+		UsedBytes:       stored.Bytes,
+		QuotaBytes:      plan.StorageBytes,
+		DurationSeconds: stored.Seconds,
+		Plan:            plan.Name,
+	}
+	if plan.StorageBytes > 0 {
+		remaining := max(plan.StorageBytes-stored.Bytes, 0)
+		usage.RemainingBytes = &remaining
+	}
+	return usage, nil
+}
+
+// checkStorageQuota returns a limits.Exceeded if pending more bytes
+// would take the user over plan's storage quota. A video being replaced
+// still counts until its new upload is published.
+func (cfg *apiConfig) checkStorageQuota(userID uuid.UUID, plan database.Plan, pending int64) error {
+	if plan.StorageBytes == 0 {
+		return nil
+	}
+	usage, err := cfg.storageUsage(userID, plan)
+	if err != nil {
+		return err
+	}
+	if usage.UsedBytes+pending > plan.StorageBytes {
+		return cfg.planLimitExceeded(limits.StorageBytes, plan, usage.UsedBytes, pending)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"log"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+// maxGIFPixels caps the canvas of a GIF thumbnail. A few kilobytes of GIF
+// can claim a canvas that takes gigabytes to draw.
+const maxGIFPixels = 4096 * 4096
+
+// gif block introducers, from the GIF89a spec
+const (
+	gifExtension       = 0x21
+	gifImageDescriptor = 0x2C
+)
+
+// gifFirstFramePNG writes the first frame of a GIF to a new PNG temp file in
+// dir and reports whether the GIF has more frames. The frame is drawn onto
+// the full canvas since GIF frames can be smaller than the image. Only the
+// first frame is decoded; the rest are skipped over unread.
+func gifFirstFramePNG(gifPath, dir string) (string, bool, error) {
+	f, err := os.Open(gifPath)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	config, err := gif.DecodeConfig(f)
+	if err != nil {
+		return "", false, err
+	}
+	if config.Width*config.Height > maxGIFPixels {
+		return "", false, fmt.Errorf("GIF is %dx%d, larger than %d pixels", config.Width, config.Height, maxGIFPixels)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", false, err
+	}
+	// the decoder reads a bufio.Reader as it is, so it's left right after
+	// the first frame
+	r := bufio.NewReader(f)
+	first, err := gif.Decode(r)
+	if err != nil {
+		return "", false, err
+	}
+	frame := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+	draw.Draw(frame, first.Bounds(), first, first.Bounds().Min, draw.Over)
+
+	out, err := os.CreateTemp(dir, ".thumbnail-*.png")
+	if err != nil {
+		return "", false, err
+	}
+	defer out.Close()
+	if err := png.Encode(out, frame); err != nil {
+		os.Remove(out.Name())
+		return "", false, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", false, err
+	}
+	return out.Name(), gifHasMoreFrames(r), nil
+}
+
+// gifHasMoreFrames reports whether another image follows in a GIF read up to
+// the end of a frame, skipping over extensions. A truncated file has none.
+func gifHasMoreFrames(r *bufio.Reader) bool {
+	for {
+		block, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch block {
+		case gifImageDescriptor:
+			return true
+		case gifExtension:
+			// the label, then data sub-blocks up to an empty one
+			if _, err := r.ReadByte(); err != nil {
+				return false
+			}
+			for {
+				size, err := r.ReadByte()
+				if err != nil {
+					return false
+				}
+				if size == 0 {
+					break
+				}
+				if _, err := r.Discard(int(size)); err != nil {
+					return false
+				}
+			}
+		default:
+			// the trailer, or something that isn't a GIF block
+			return false
+		}
+	}
+}
+
+// gifToWebP converts an animated GIF to a looping WebP in a new temp file in
+// dir. WebP animations are a fraction of the size of the GIF.
+func gifToWebP(gifPath, dir string) (string, error) {
+	out, err := os.CreateTemp(dir, ".preview-*.webp")
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+
+	_, err = ffmpeg.FFmpeg().
+		Option("-y").
+		Input(gifPath).
+		Option("-c:v", "libwebp").
+		Option("-q:v", "75").
+		Option("-loop", "0").
+		Option("-f", "webp").
+		Output(out.Name()).
+		Run(context.Background())
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// saveGIFPreview stores the WebP preview of an animated GIF thumbnail and
+// returns its URL. The preview is optional, so failures are only logged.
+func (cfg *apiConfig) saveGIFPreview(gifPath string) *string {
+	webpPath, err := gifToWebP(gifPath, cfg.assetsRoot)
+	if err != nil {
+		log.Printf("Couldn't convert GIF thumbnail to WebP: %v", err)
+		return nil
+	}
+	defer os.Remove(webpPath)
+
+	assetPath, err := cfg.saveAssetFile(webpPath, "image/webp")
+	if err != nil {
+		log.Printf("Couldn't save WebP preview: %v", err)
+		return nil
+	}
+	previewURL := cfg.getAssetURL(assetPath)
+	return &previewURL
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/blurhash"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnailPipelineRevision goes up whenever the way variants or blurhashes
+// are made changes, so regenerate-thumbnails redoes every thumbnail even
+// though the settings look the same.
+const thumbnailPipelineRevision = 1
+
+const (
+	thumbnailBlurhashX = 4
+	thumbnailBlurhashY = 3
+
+	defaultThumbnailRegenerateConcurrency = 4
+)
+
+// thumbnailFormats are the formats variants can be encoded in.
+var thumbnailFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+}
+
+// thumbnailPipeline is what every thumbnail is turned into: a variant at
+// each width no wider than the thumbnail in each format, and a blurhash.
+type thumbnailPipeline struct {
+	widths  []int
+	formats []string
+}
+
+// version names the settings, stored with each thumbnail's variants so
+// regenerate-thumbnails can tell which were made with others.
+func (p thumbnailPipeline) version() string {
+	widths := make([]string, len(p.widths))
+	for i, width := range p.widths {
+		widths[i] = strconv.Itoa(width)
+	}
+	return fmt.Sprintf("%d;widths=%s;formats=%s;blurhash=%dx%d",
+		thumbnailPipelineRevision,
+		strings.Join(widths, ","),
+		strings.Join(p.formats, ","),
+		thumbnailBlurhashX, thumbnailBlurhashY,
+	)
+}
+
+// thumbnailAssetPath is the asset a thumbnail URL points at, if it's one of
+// ours.
+func (cfg *apiConfig) thumbnailAssetPath(thumbnailURL *string) (string, bool) {
+	if thumbnailURL == nil {
+		return "", false
+	}
+	return strings.CutPrefix(*thumbnailURL, cfg.getAssetURL(""))
+}
+
+// deriveThumbnail makes the variants and blurhash of the video's thumbnail
+// and records them, replacing the ones made before. Nothing is recorded if
+// the thumbnail changes in the meantime.
+func (cfg *apiConfig) deriveThumbnail(ctx context.Context, video database.Video) (database.Video, error) {
+	assetPath, ok := cfg.thumbnailAssetPath(video.ThumbnailURL)
+	if !ok {
+		return video, fmt.Errorf("video %s has no thumbnail in the assets dir", video.ID)
+	}
+	source := *video.ThumbnailURL
+	sourcePath, err := cfg.getAssetDiskPath(assetPath)
+	if err != nil {
+		return video, err
+	}
+	img, err := decodeImageFile(sourcePath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't decode thumbnail: %w", err)
+	}
+	hash, err := blurhash.Encode(img, thumbnailBlurhashX, thumbnailBlurhashY)
+	if err != nil {
+		return video, err
+	}
+
+	var variants []database.ThumbnailVariant
+	discard := func(variants []database.ThumbnailVariant) {
+		for _, variant := range variants {
+			cfg.removeAssetURL(variant.URL)
+		}
+	}
+	bounds := img.Bounds()
+	for _, width := range cfg.thumbnailPipeline.widths {
+		if width > bounds.Dx() {
+			continue
+		}
+		height := max(1, (bounds.Dy()*width+bounds.Dx()/2)/bounds.Dx())
+		for _, format := range cfg.thumbnailPipeline.formats {
+			variantPath, err := scaleThumbnail(ctx, sourcePath, width, height, format, cfg.assetsRoot)
+			if err != nil {
+				discard(variants)
+				return video, fmt.Errorf("couldn't make %dw %s variant: %w", width, format, err)
+			}
+			variantAsset, err := cfg.saveAssetFile(variantPath, thumbnailFormats[format])
+			if err != nil {
+				os.Remove(variantPath)
+				discard(variants)
+				return video, fmt.Errorf("couldn't save %dw %s variant: %w", width, format, err)
+			}
+			variants = append(variants, database.ThumbnailVariant{
+				Width:  width,
+				Height: height,
+				Format: format,
+				URL:    cfg.getAssetURL(variantAsset),
+			})
+		}
+	}
+
+	version := cfg.thumbnailPipeline.version()
+	var replaced []database.ThumbnailVariant
+	var replaceErr error
+	stale := false
+	video, err = cfg.updateVideo(video.ID, func(video *database.Video) {
+		// a new thumbnail may have landed since
+		if aws.ToString(video.ThumbnailURL) != source {
+			stale = true
+			return
+		}
+		replaced, replaceErr = cfg.db.ReplaceThumbnailVariants(video.ID, variants)
+		if replaceErr != nil {
+			return
+		}
+		video.ThumbnailBlurhash = &hash
+		video.ThumbnailVersion = &version
+	})
+	if err == nil {
+		err = replaceErr
+	}
+	if err != nil || stale {
+		discard(variants)
+		return video, err
+	}
+	discard(replaced)
+	return video, nil
+}
+
+// refreshThumbnail gives a thumbnail that was just stored its variants and
+// blurhash. They're a nicety, so failures only get logged and
+// regenerate-thumbnails catches up.
+func (cfg *apiConfig) refreshThumbnail(ctx context.Context, video database.Video) database.Video {
+	derived, err := cfg.deriveThumbnail(ctx, video)
+	if err != nil {
+		log.Printf("Couldn't derive thumbnail variants for video %s: %v", video.ID, err)
+		return video
+	}
+	return derived
+}
+
+func (cfg *apiConfig) removeAssetURL(assetURL string) {
+	assetPath, ok := strings.CutPrefix(assetURL, cfg.getAssetURL(""))
+	if !ok {
+		return
+	}
+	if diskPath, err := cfg.getAssetDiskPath(assetPath); err == nil {
+		os.Remove(diskPath)
+	}
+}
+
+// scaleThumbnail writes the image at sourcePath scaled to width by height
+// and encoded as format to a new temp file in dir.
+func scaleThumbnail(ctx context.Context, sourcePath string, width, height int, format, dir string) (string, error) {
+	out, err := os.CreateTemp(dir, ".thumbnail-*"+mediaTypeToExt(thumbnailFormats[format]))
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+
+	cmd := ffmpeg.FFmpeg().
+		Option("-y").
+		Input(sourcePath).
+		Option("-vf", fmt.Sprintf("scale=%d:%d", width, height)).
+		Option("-frames:v", "1")
+	if format == "webp" {
+		cmd = cmd.Option("-c:v", "libwebp").Option("-q:v", "80")
+	} else {
+		cmd = cmd.Option("-q:v", "3")
+	}
+	if _, err := cmd.Output(out.Name()).Run(ctx); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// handlerVideoThumbnailsRetrieve lists the variants of a video's thumbnail,
+// for players to pick a size and format from, with its blurhash. Variants
+// are only listed once they match the current thumbnail.
+func (cfg *apiConfig) handlerVideoThumbnailsRetrieve(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Blurhash *string                     `json:"blurhash"`
+		Version  *string                     `json:"version"`
+		Current  bool                        `json:"current"`
+		Variants []database.ThumbnailVariant `json:"variants"`
+	}
+
+	video, _, ok := cfg.visibleVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	resp := response{
+		Blurhash: video.ThumbnailBlurhash,
+		Version:  video.ThumbnailVersion,
+		Current:  aws.ToString(video.ThumbnailVersion) == cfg.thumbnailPipeline.version(),
+		Variants: []database.ThumbnailVariant{},
+	}
+	if video.ThumbnailVersion != nil {
+		variants, err := cfg.db.GetThumbnailVariants(video.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail variants", err)
+			return
+		}
+		for i := range variants {
+			if video.Visibility == database.VideoVisibilityPrivate {
+				variants[i].URL = *cfg.signedAssetURL(&variants[i].URL)
+			}
+		}
+		resp.Variants = variants
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// runRegenerateThumbnails redoes the variants and blurhash of every
+// thumbnail made with other pipeline settings, or of every thumbnail with
+// force, concurrency at a time, printing each as it finishes. Frames picked
+// from uploads are kept; only what's made from them is redone. With a plan
+// the thumbnails are only listed.
+func (cfg *apiConfig) runRegenerateThumbnails(ctx context.Context, concurrency int, force bool, plan *dryRun) error {
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return fmt.Errorf("couldn't get videos: %w", err)
+	}
+	version := cfg.thumbnailPipeline.version()
+	todo := []database.Video{}
+	current, skipped := 0, 0
+	for _, video := range videos {
+		if _, ok := cfg.thumbnailAssetPath(video.ThumbnailURL); !ok {
+			skipped++
+			continue
+		}
+		if !force && aws.ToString(video.ThumbnailVersion) == version {
+			current++
+			continue
+		}
+		todo = append(todo, video)
+	}
+	if plan != nil {
+		for _, video := range todo {
+			plan.would("regenerate thumbnail of video", video.ID.String(), 0)
+		}
+		plan.summary()
+		fmt.Printf("thumbnails: %d already current, %d without one\n", current, skipped)
+		return nil
+	}
+
+	var mu sync.Mutex
+	done, failed := 0, 0
+	queue := make(chan database.Video)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for video := range queue {
+				_, err := cfg.deriveThumbnail(ctx, video)
+				mu.Lock()
+				done++
+				if err != nil {
+					failed++
+					fmt.Printf("[%d/%d] %s: %v\n", done, len(todo), video.ID, err)
+				} else {
+					fmt.Printf("[%d/%d] %s: regenerated\n", done, len(todo), video.ID)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, video := range todo {
+		queue <- video
+	}
+	close(queue)
+	wg.Wait()
+
+	fmt.Printf("thumbnails: %d regenerated, %d failed, %d already current, %d without one\n", len(todo)-failed, failed, current, skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d thumbnails couldn't be regenerated, run again to retry them", failed)
+	}
+	return nil
+}
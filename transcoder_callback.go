@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/webhook"
+	"github.com/google/uuid"
+)
+
+const (
+	transcoderJobComplete = "complete"
+	transcoderJobFailed   = "failed"
+)
+
+var errTranscoderOutputMissing = errors.New("transcoder output not found")
+
+// transcoderCallback is what an external transcoder posts when a job for a
+// video finishes.
+type transcoderCallback struct {
+	JobID   string    `json:"job_id"`
+	VideoID uuid.UUID `json:"video_id"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error"`
+	// the upload the job read; results for an upload the video has since
+	// replaced are dropped, as are results for a video with no upload
+	SourceKey       string                    `json:"source_key"`
+	HLSMasterKey    string                    `json:"hls_master_key"`
+	DASHManifestKey string                    `json:"dash_manifest_key"`
+	Renditions      []transcoderRenditionInfo `json:"renditions"`
+}
+
+type transcoderRenditionInfo struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bitrate int64  `json:"bitrate"`
+}
+
+func (c transcoderCallback) validate() error {
+	if c.JobID == "" || c.VideoID == uuid.Nil {
+		return errors.New("job_id and video_id are required")
+	}
+	if c.Status != transcoderJobComplete && c.Status != transcoderJobFailed {
+		return fmt.Errorf("status must be %q or %q", transcoderJobComplete, transcoderJobFailed)
+	}
+	names := map[string]bool{}
+	for _, rendition := range c.Renditions {
+		if rendition.Name == "" || rendition.Key == "" {
+			return errors.New("renditions need a name and a key")
+		}
+		if names[rendition.Name] {
+			return fmt.Errorf("rendition %q is listed twice", rendition.Name)
+		}
+		names[rendition.Name] = true
+	}
+	return nil
+}
+
+// handlerTranscoderCallback takes the results of an external transcoder
+// job, such as MediaConvert or a GPU farm, signed like our own webhooks with
+// TRANSCODER_CALLBACK_SECRET. Each job is applied once: transcoders retry
+// callbacks, and a repeat gets the same 200 without touching the video.
+func (cfg *apiConfig) handlerTranscoderCallback(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Status string `json:"status"`
+	}
+
+	body, err := webhook.VerifyRequest(r, cfg.transcoderCallbackSecret, 0)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid callback signature", err)
+		return
+	}
+	var callback transcoderCallback
+	if err := json.Unmarshal(body, &callback); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode callback", err)
+		return
+	}
+	if err := callback.validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(callback.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	created, err := cfg.db.CreateTranscoderJob(database.TranscoderJob{
+		ID:      callback.JobID,
+		VideoID: video.ID,
+		Status:  callback.Status,
+		Error:   callback.Error,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record transcoder job", err)
+		return
+	}
+	if !created {
+		respondWithJSON(w, http.StatusOK, response{Status: "duplicate"})
+		return
+	}
+
+	status, err := cfg.applyTranscoderCallback(r.Context(), video, callback)
+	if err != nil {
+		// let the transcoder's retry have another go
+		if derr := cfg.db.DeleteTranscoderJob(callback.JobID); derr != nil {
+			log.Printf("Couldn't forget transcoder job %s: %v", callback.JobID, derr)
+		}
+		if errors.Is(err, errTranscoderOutputMissing) {
+			respondWithError(w, http.StatusUnprocessableEntity, err.Error(), err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't apply transcoder results", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{Status: status})
+}
+
+// applyTranscoderCallback updates the video with a job's results, returning
+// what became of them.
+func (cfg *apiConfig) applyTranscoderCallback(ctx context.Context, video database.Video, callback transcoderCallback) (string, error) {
+	store, key, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get video storage: %w", err)
+	}
+	if !ok || (callback.SourceKey != "" && callback.SourceKey != key) {
+		log.Printf("transcoder: job %s for video %s read %s, which it no longer plays", callback.JobID, video.ID, callback.SourceKey)
+		return "stale", nil
+	}
+
+	if callback.Status == transcoderJobFailed {
+		log.Printf("transcoder: job %s for video %s failed: %s", callback.JobID, video.ID, callback.Error)
+		err := cfg.db.CreateNotification(database.CreateNotificationParams{
+			UserID:  video.UserID,
+			VideoID: &video.ID,
+			Kind:    "transcode_failed",
+			Message: fmt.Sprintf("%q couldn't be transcoded, it still plays as uploaded", video.Title),
+		})
+		if err != nil {
+			return "", fmt.Errorf("couldn't notify owner: %w", err)
+		}
+		return "applied", nil
+	}
+
+	// the transcoder writes to the video's bucket; only point at what's there
+	keys := []string{}
+	if callback.HLSMasterKey != "" {
+		keys = append(keys, callback.HLSMasterKey)
+	}
+	if callback.DASHManifestKey != "" {
+		keys = append(keys, callback.DASHManifestKey)
+	}
+	for _, rendition := range callback.Renditions {
+		keys = append(keys, rendition.Key)
+	}
+	for _, output := range keys {
+		_, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(output),
+		})
+		if err != nil {
+			log.Printf("transcoder: job %s output %s: %v", callback.JobID, output, err)
+			return "", fmt.Errorf("%w: %s", errTranscoderOutputMissing, output)
+		}
+	}
+
+	for _, rendition := range callback.Renditions {
+		err := cfg.db.SaveVideoRendition(database.VideoRendition{
+			VideoID: video.ID,
+			Name:    rendition.Name,
+			Key:     rendition.Key,
+			Width:   rendition.Width,
+			Height:  rendition.Height,
+			Bitrate: rendition.Bitrate,
+		})
+		if err != nil {
+			return "", fmt.Errorf("couldn't save rendition: %w", err)
+		}
+	}
+	if callback.HLSMasterKey != "" || callback.DASHManifestKey != "" {
+		_, err := cfg.updateVideo(video.ID, func(video *database.Video) {
+			if callback.HLSMasterKey != "" {
+				video.HLSMasterKey = &callback.HLSMasterKey
+			}
+			if callback.DASHManifestKey != "" {
+				video.DASHManifestKey = &callback.DASHManifestKey
+			}
+		})
+		if err != nil {
+			return "", fmt.Errorf("couldn't update video: %w", err)
+		}
+	}
+	log.Printf("transcoder: job %s added %d renditions to video %s", callback.JobID, len(callback.Renditions), video.ID)
+	return "applied", nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// abandonUpload tells the owner an upload of the video was given up on. A
+// video with nothing to play is marked abandoned and failed so clients stop
+// showing it as uploading; one with an earlier upload just keeps playing
+// that.
+func (cfg *apiConfig) abandonUpload(videoID uuid.UUID) {
+	now := cfg.now().UTC()
+	failed := false
+	video, err := cfg.updateVideo(videoID, func(video *database.Video) {
+		if video.VideoURL == nil {
+			video.UploadAbandonedAt = &now
+			failed = video.Status != database.VideoStatusFailed
+			video.Status = database.VideoStatusFailed
+		}
+	})
+	if errors.Is(err, errVideoDeleted) {
+		return
+	}
+	if err != nil {
+		log.Printf("Couldn't mark upload of video %s abandoned: %v", videoID, err)
+		return
+	}
+	if failed {
+		cfg.queueVideoWebhooks(video)
+	}
+
+	err = cfg.db.CreateNotification(database.CreateNotificationParams{
+		UserID:  video.UserID,
+		VideoID: &video.ID,
+		Kind:    "upload_abandoned",
+		Message: fmt.Sprintf("The upload of %q wasn't finished in time and was discarded", video.Title),
+	})
+	if err != nil {
+		log.Printf("Couldn't notify owner of video %s: %v", videoID, err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+)
+
+// base64 bodies are held in memory while decoding, so they get a cap of
+// their own well below what form uploads allow
+const maxBase64VideoSize = 100 << 20 // 100MB
+
+// base64 and JSON framing on top of the decoded bytes
+const base64BodyOverhead = 4 << 10
+
+type base64Upload struct {
+	// raw standard base64 or a data URL (data:<type>;base64,<data>)
+	Data        string `json:"data"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+}
+
+// decode splits off a data URL header, whose media type wins over
+// ContentType, and returns a streaming decoder with the decoded size.
+func (u base64Upload) decode() (string, *strings.Reader, int64, error) {
+	contentType, data := u.ContentType, u.Data
+	if rest, ok := strings.CutPrefix(data, "data:"); ok {
+		header, payload, ok := strings.Cut(rest, ",")
+		if !ok {
+			return "", nil, 0, errors.New("data URL has no payload")
+		}
+		mediaType, ok := strings.CutSuffix(header, ";base64")
+		if !ok {
+			return "", nil, 0, errors.New("data URL is not base64 encoded")
+		}
+		if mediaType != "" {
+			contentType = mediaType
+		}
+		data = payload
+	}
+	data = strings.TrimSpace(data)
+	// the decoder skips line breaks, so don't count them
+	encodedLen := len(data) - strings.Count(data, "\n") - strings.Count(data, "\r")
+	padding := len(data) - len(strings.TrimRight(data, "="))
+	size := int64(encodedLen/4*3 - padding)
+	return contentType, strings.NewReader(data), size, nil
+}
+
+func base64BodyLimit(decodedSize int64) int64 {
+	return int64(base64.StdEncoding.EncodedLen(int(decodedSize))) + base64BodyOverhead
+}
+
+// handlerUploadThumbnailBase64 takes a thumbnail as base64 in a JSON body,
+// for integrations that can't build multipart forms.
+func (cfg *apiConfig) handlerUploadThumbnailBase64(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, base64BodyLimit(maxThumbnailSize))
+	params := base64Upload{}
+	if !decodeBase64Upload(w, r, &params) {
+		return
+	}
+	_, data, size, err := params.decode()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid data URL", err)
+		return
+	}
+	if size > maxThumbnailSize {
+		cfg.respondWithLimit(w, limits.Exceeded{
+			Kind:  limits.Size,
+			Name:  "max_thumbnail_size",
+			Unit:  "bytes",
+			Used:  size,
+			Limit: maxThumbnailSize,
+		}, nil)
+		return
+	}
+
+	// the type is sniffed from the decoded bytes like any other upload
+	cfg.storeThumbnail(w, r, video, base64.NewDecoder(base64.StdEncoding, data))
+}
+
+// handlerUploadVideoBase64 takes a video as base64 in a JSON body and sends
+// it through the same checks and ingest as a form upload.
+func (cfg *apiConfig) handlerUploadVideoBase64(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, base64BodyLimit(min(cfg.maxVideoSize(plan), maxBase64VideoSize)))
+	params := base64Upload{}
+	if !decodeBase64Upload(w, r, &params) {
+		return
+	}
+	contentType, data, size, err := params.decode()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid data URL", err)
+		return
+	}
+	if size > maxBase64VideoSize {
+		// the form upload takes it
+		cfg.respondWithLimit(w, limits.Exceeded{
+			Kind:  limits.Size,
+			Name:  "max_base64_video_size",
+			Unit:  "bytes",
+			Used:  size,
+			Limit: maxBase64VideoSize,
+		}, nil)
+		return
+	}
+	if params.Filename == "" {
+		params.Filename = "upload.mp4"
+	}
+
+	if violations := cfg.checkVideoUpload(plan, params.Filename, contentType, size, 0); len(violations) > 0 {
+		respondWithUploadViolations(w, violations, nil, uploadRecovery{})
+		return
+	}
+
+	cfg.storeVideoUpload(w, r, video, plan, contentType, base64.NewDecoder(base64.StdEncoding, data), size)
+}
+
+func decodeBase64Upload(w http.ResponseWriter, r *http.Request, params *base64Upload) bool {
+	err := json.NewDecoder(r.Body).Decode(params)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Payload is too large", err)
+		return false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return false
+	}
+	if params.Data == "" {
+		respondWithError(w, http.StatusBadRequest, "data is required", nil)
+		return false
+	}
+	return true
+}
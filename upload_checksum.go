@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// clients may send the hex SHA-256 of the file they're uploading so damage
+// in transit is caught before anything is stored
+const contentSHA256Header = "X-Content-Sha256"
+
+// expectedSHA256 returns the lowercased checksum from the request, or "" if
+// none was sent. A malformed one writes the error response and returns false.
+func expectedSHA256(w http.ResponseWriter, r *http.Request) (string, bool) {
+	checksum := strings.ToLower(strings.TrimSpace(r.Header.Get(contentSHA256Header)))
+	if checksum == "" {
+		return "", true
+	}
+	if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != sha256.Size {
+		respondWithError(w, http.StatusBadRequest, contentSHA256Header+" must be a hex encoded SHA-256", err)
+		return "", false
+	}
+	return checksum, true
+}
+
+// checksumMismatch reports whether the received bytes hashed to something
+// other than what the client sent, writing the error response if so. The
+// upload can be retried since the damage most likely happened in transit.
+func checksumMismatch(w http.ResponseWriter, expected, actual string, size int64) bool {
+	if expected == "" || expected == actual {
+		return false
+	}
+	respondWithUploadError(w, http.StatusBadRequest, "Checksum mismatch", fmt.Errorf("expected sha256 %s, got %s", expected, actual), uploadRecovery{
+		BytesReceived: size,
+		Retryable:     true,
+	})
+	return true
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// S3 takes at most this many parts per upload
+const maxChunkedUploadParts = 10000
+
+// uploads not completed within this long are abandoned and their parts
+// dropped from S3
+const chunkedUploadDeadline = 24 * time.Hour
+
+// chunkedPartSize is the part size for an upload of size bytes: the
+// streaming part size, grown in whole MB when the file would need more
+// parts than S3 allows.
+func chunkedPartSize(size int64) int64 {
+	partSize := int64(streamPartSize)
+	if size > partSize*maxChunkedUploadParts {
+		partSize = (size/maxChunkedUploadParts + 1<<20) &^ (1<<20 - 1)
+	}
+	return partSize
+}
+
+func chunkedPartCount(upload database.ChunkedUpload) int32 {
+	return int32((upload.Size + upload.PartSize - 1) / upload.PartSize)
+}
+
+// chunkedPartLength is how many bytes the given part has to be. Only the
+// last part may be short.
+func chunkedPartLength(upload database.ChunkedUpload, partNumber int32) int64 {
+	return min(upload.PartSize, upload.Size-int64(partNumber-1)*upload.PartSize)
+}
+
+// handlerChunkedUploadInit starts an S3 multipart upload for a video. The
+// client then PUTs the parts, in any order and in parallel, retrying any
+// that fail, and completes the upload once all of them are in.
+func (cfg *apiConfig) handlerChunkedUploadInit(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+	type response struct {
+		UploadID  uuid.UUID `json:"upload_id"`
+		PartSize  int64     `json:"part_size"`
+		PartCount int32     `json:"part_count"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Size <= 0 {
+		respondWithError(w, http.StatusBadRequest, "size is required", nil)
+		return
+	}
+	if params.Filename == "" {
+		params.Filename = "upload.mp4"
+	}
+	if params.ContentType == "" {
+		params.ContentType = "video/mp4"
+	}
+
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	if violations := cfg.checkVideoUpload(plan, params.Filename, params.ContentType, params.Size, 0); len(violations) > 0 {
+		respondWithUploadViolations(w, violations, nil, uploadRecovery{})
+		return
+	}
+	if !cfg.uploadQuotaAllowed(w, video.UserID, plan, params.Size) {
+		return
+	}
+	// parts go straight to S3, so there's no local copy to transcode
+	if params.ContentType != "video/mp4" {
+		respondWithError(w, http.StatusBadRequest, "Only mp4 can be uploaded in parts, send other formats with the form upload", nil)
+		return
+	}
+
+	store, err := cfg.storeForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	key, err := joinKey(streamStagingPrefix, getAssetPath("video/mp4"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create object key", err)
+		return
+	}
+	multipart, err := store.client.CreateMultipartUpload(r.Context(), &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(store.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("video/mp4"),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't start upload", err)
+		return
+	}
+
+	upload, err := cfg.db.CreateChunkedUpload(database.CreateChunkedUploadParams{
+		VideoID:    video.ID,
+		UserID:     video.UserID,
+		S3UploadID: aws.ToString(multipart.UploadId),
+		Key:        key,
+		Size:       params.Size,
+		PartSize:   chunkedPartSize(params.Size),
+		ExpiresAt:  cfg.now().Add(chunkedUploadDeadline),
+	})
+	if err != nil {
+		abortChunkedUpload(store, key, multipart.UploadId)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadID:  upload.ID,
+		PartSize:  upload.PartSize,
+		PartCount: chunkedPartCount(upload),
+		ExpiresAt: upload.ExpiresAt,
+	})
+}
+
+// handlerChunkedUploadPart uploads one part. Sending a part again replaces
+// it, which is how clients retry a chunk.
+func (cfg *apiConfig) handlerChunkedUploadPart(w http.ResponseWriter, r *http.Request) {
+	_, upload, store, ok := cfg.chunkedUploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	partNumber, err := strconv.ParseInt(r.PathValue("partNumber"), 10, 32)
+	if err != nil || partNumber < 1 || int32(partNumber) > chunkedPartCount(upload) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Part number must be between 1 and %d", chunkedPartCount(upload)), err)
+		return
+	}
+	length := chunkedPartLength(upload, int32(partNumber))
+	if r.ContentLength != length {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Part %d must be %d bytes", partNumber, length), nil)
+		return
+	}
+
+	// parts are buffered like streamed ones so the SDK can sign and retry
+	// them
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(http.MaxBytesReader(w, r.Body, length), buf); err != nil {
+		respondWithUploadError(w, http.StatusBadRequest, "Couldn't read part", err, uploadRecovery{
+			Retryable: true,
+		})
+		return
+	}
+
+	out, err := store.client.UploadPart(r.Context(), &s3.UploadPartInput{
+		Bucket:     aws.String(store.bucket),
+		Key:        aws.String(upload.Key),
+		UploadId:   aws.String(upload.S3UploadID),
+		PartNumber: aws.Int32(int32(partNumber)),
+		Body:       bytes.NewReader(buf),
+	})
+	if err != nil {
+		respondWithUploadError(w, http.StatusBadGateway, "Couldn't upload part to storage", err, uploadRecovery{
+			Retryable: true,
+		})
+		return
+	}
+
+	part := database.ChunkedUploadPart{
+		PartNumber: int32(partNumber),
+		ETag:       aws.ToString(out.ETag),
+		Size:       length,
+	}
+	if err := cfg.db.PutChunkedUploadPart(upload.ID, part); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save part", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, part)
+}
+
+// handlerChunkedUploadComplete assembles the parts and files the result
+// like a streamed upload: it's probed, checked against the plan and moved
+// under its aspect ratio.
+func (cfg *apiConfig) handlerChunkedUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Error        string  `json:"error"`
+		MissingParts []int32 `json:"missing_parts"`
+	}
+
+	video, upload, store, ok := cfg.chunkedUploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	parts, err := cfg.db.GetChunkedUploadParts(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get parts", err)
+		return
+	}
+	received := map[int32]string{}
+	for _, part := range parts {
+		received[part.PartNumber] = part.ETag
+	}
+	completed := []types.CompletedPart{}
+	missing := []int32{}
+	for partNumber := int32(1); partNumber <= chunkedPartCount(upload); partNumber++ {
+		etag, ok := received[partNumber]
+		if !ok {
+			missing = append(missing, partNumber)
+			continue
+		}
+		completed = append(completed, types.CompletedPart{
+			ETag:       aws.String(etag),
+			PartNumber: aws.Int32(partNumber),
+		})
+	}
+	if len(missing) > 0 {
+		respondWithJSON(w, http.StatusConflict, response{
+			Error:        "Upload is missing parts",
+			MissingParts: missing,
+		})
+		return
+	}
+
+	out, err := store.client.CompleteMultipartUpload(r.Context(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(store.bucket),
+		Key:             aws.String(upload.Key),
+		UploadId:        aws.String(upload.S3UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		respondWithUploadError(w, http.StatusBadGateway, "Couldn't complete upload", err, uploadRecovery{
+			BytesReceived: upload.Size,
+			Retryable:     true,
+		})
+		return
+	}
+	if err := cfg.db.DeleteChunkedUpload(upload.ID); err != nil {
+		log.Printf("Couldn't remove chunked upload %s: %v", upload.ID, err)
+	}
+
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	video, err = cfg.fileStreamedVideo(r.Context(), store, video, plan, streamedObject{
+		Key:       upload.Key,
+		Size:      upload.Size,
+		VersionID: out.VersionId,
+	})
+	if err != nil {
+		log.Printf("Chunked video error: %v", err)
+		respondWithStreamedVideoError(w, err, upload.Size)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, withAssetReadiness(video))
+}
+
+// handlerChunkedUploadAbort drops an upload and the parts S3 is holding.
+func (cfg *apiConfig) handlerChunkedUploadAbort(w http.ResponseWriter, r *http.Request) {
+	_, upload, store, ok := cfg.chunkedUploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := abortChunkedUpload(store, upload.Key, aws.String(upload.S3UploadID)); err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't abort upload", err)
+		return
+	}
+	if err := cfg.db.DeleteChunkedUpload(upload.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// chunkedUploadFromRequest loads the owned video, the upload in the path
+// and the store it's going to, writing the error response if that fails.
+func (cfg *apiConfig) chunkedUploadFromRequest(w http.ResponseWriter, r *http.Request) (database.Video, database.ChunkedUpload, objectStore, bool) {
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return database.Video{}, database.ChunkedUpload{}, objectStore{}, false
+	}
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID", err)
+		return database.Video{}, database.ChunkedUpload{}, objectStore{}, false
+	}
+	upload, err := cfg.db.GetChunkedUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.Video{}, database.ChunkedUpload{}, objectStore{}, false
+	}
+	if upload.ID == uuid.Nil || upload.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.Video{}, database.ChunkedUpload{}, objectStore{}, false
+	}
+	// the janitor may not have got to it yet
+	if cfg.now().After(upload.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload deadline has passed", nil)
+		return database.Video{}, database.ChunkedUpload{}, objectStore{}, false
+	}
+	store, err := cfg.storeForUser(upload.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return database.Video{}, database.ChunkedUpload{}, objectStore{}, false
+	}
+	return video, upload, store, true
+}
+
+// abandonExpiredChunkedUploads aborts uploads that missed their deadline.
+func (cfg *apiConfig) abandonExpiredChunkedUploads(now time.Time) {
+	uploads, err := cfg.db.GetExpiredChunkedUploads(now)
+	if err != nil {
+		log.Printf("chunked: couldn't get expired uploads: %v", err)
+		return
+	}
+	for _, upload := range uploads {
+		store, err := cfg.storeForUser(upload.UserID)
+		if err != nil {
+			log.Printf("chunked: %v", err)
+			continue
+		}
+		if err := abortChunkedUpload(store, upload.Key, aws.String(upload.S3UploadID)); err != nil {
+			// S3 may already have dropped it with a lifecycle rule
+			log.Printf("chunked: couldn't abort upload %s: %v", upload.ID, err)
+		}
+		if err := cfg.db.DeleteChunkedUpload(upload.ID); err != nil {
+			log.Printf("chunked: couldn't delete expired upload %s: %v", upload.ID, err)
+			continue
+		}
+		cfg.abandonUpload(upload.VideoID)
+		log.Printf("chunked: abandoned upload %s", upload.ID)
+	}
+}
+
+func abortChunkedUpload(store objectStore, key string, uploadID *string) error {
+	_, err := store.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(store.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	return err
+}
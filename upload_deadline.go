@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultUploadStallTimeout = 30 * time.Second
+	// slow 3G manages a few times this
+	defaultUploadMinRate = 8 << 10
+)
+
+// uploadDeadline cuts upload connections that stop sending. Instead of one
+// timeout for the whole body, which would have to fit the slowest link we
+// want to serve, each stall window has to bring in at least minRate bytes a
+// second for the read deadline to move on by another window.
+type uploadDeadline struct {
+	window time.Duration
+	// bytes a second
+	minRate int64
+}
+
+// keepUploadAlive applies cfg.uploadDeadline to the body of the request.
+func (cfg *apiConfig) keepUploadAlive(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy := cfg.uploadDeadline
+		if policy.window <= 0 || r.Body == nil || r.Body == http.NoBody {
+			next(w, r)
+			return
+		}
+		rc := http.NewResponseController(w)
+		// deadlines are on the wall clock, whatever cfg.now says
+		if err := rc.SetReadDeadline(time.Now().Add(policy.window)); err != nil {
+			if !errors.Is(err, http.ErrNotSupported) {
+				log.Printf("Couldn't set upload read deadline: %v", err)
+			}
+			next(w, r)
+			return
+		}
+		body := &deadlineBody{
+			ReadCloser: r.Body,
+			rc:         rc,
+			window:     policy.window,
+			minBytes:   max(1, int64(policy.window.Seconds()*float64(policy.minRate))),
+		}
+		// processing can outlast the last window, and a read deadline that
+		// passes while the handler runs cancels its context
+		defer body.clear()
+		r.Body = body
+		next(w, r)
+	}
+}
+
+type deadlineBody struct {
+	io.ReadCloser
+	rc       *http.ResponseController
+	window   time.Duration
+	minBytes int64
+	// bytes received since the deadline last moved
+	received int64
+	cleared  bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.cleared {
+		return n, err
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			b.clear()
+		}
+		return n, err
+	}
+	b.received += int64(n)
+	if b.received >= b.minBytes {
+		b.received = 0
+		if derr := b.rc.SetReadDeadline(time.Now().Add(b.window)); derr != nil {
+			log.Printf("Couldn't extend upload read deadline: %v", derr)
+		}
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	b.clear()
+	return b.ReadCloser.Close()
+}
+
+func (b *deadlineBody) clear() {
+	if b.cleared {
+		return
+	}
+	b.cleared = true
+	if err := b.rc.SetReadDeadline(time.Time{}); err != nil {
+		log.Printf("Couldn't clear upload read deadline: %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// how long the client has to start the PUT; S3 only checks the signature
+	// when a request begins, so a slow upload can run past it
+	directUploadURLExpiry = 15 * time.Minute
+	// uploads not confirmed within this long are abandoned and the object
+	// dropped from S3
+	directUploadDeadline = 24 * time.Hour
+)
+
+// handlerDirectUploadInit hands out a presigned PUT URL so the client can
+// send the file straight to S3 without it passing through us. The size,
+// content type and, if given, SHA-256 are signed into the URL, so S3 refuses
+// anything else. Once the PUT succeeds the client confirms the upload, which
+// files it like a streamed one.
+func (cfg *apiConfig) handlerDirectUploadInit(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+		SHA256      string `json:"sha256"`
+	}
+	type response struct {
+		UploadID  uuid.UUID   `json:"upload_id"`
+		URL       string      `json:"url"`
+		Method    string      `json:"method"`
+		Headers   http.Header `json:"headers"`
+		ExpiresAt time.Time   `json:"expires_at"`
+		ConfirmBy time.Time   `json:"confirm_by"`
+	}
+
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Size <= 0 {
+		respondWithError(w, http.StatusBadRequest, "size is required", nil)
+		return
+	}
+	if params.Filename == "" {
+		params.Filename = "upload.mp4"
+	}
+	if params.ContentType == "" {
+		params.ContentType = "video/mp4"
+	}
+	var checksum []byte
+	if params.SHA256 != "" {
+		var err error
+		checksum, err = hex.DecodeString(params.SHA256)
+		if err != nil || len(checksum) != 32 {
+			respondWithError(w, http.StatusBadRequest, "sha256 must be a hex encoded SHA-256", err)
+			return
+		}
+	}
+
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	if violations := cfg.checkVideoUpload(plan, params.Filename, params.ContentType, params.Size, 0); len(violations) > 0 {
+		respondWithUploadViolations(w, violations, nil, uploadRecovery{})
+		return
+	}
+	if !cfg.uploadQuotaAllowed(w, video.UserID, plan, params.Size) {
+		return
+	}
+	// the file goes straight to S3, so there's no local copy to transcode
+	if params.ContentType != "video/mp4" {
+		respondWithError(w, http.StatusBadRequest, "Only mp4 can be uploaded directly, send other formats with the form upload", nil)
+		return
+	}
+
+	store, err := cfg.storeForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	key, err := joinKey(streamStagingPrefix, getAssetPath("video/mp4"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create object key", err)
+		return
+	}
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(store.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String("video/mp4"),
+		ContentLength: aws.Int64(params.Size),
+	}
+	if checksum != nil {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(checksum))
+	}
+	presigned, err := s3.NewPresignClient(store.client).PresignPutObject(r.Context(), input, s3.WithPresignExpires(directUploadURLExpiry))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+	now := cfg.now()
+	cfg.auditPresign(presignRequester{
+		Requester: "direct-upload",
+		UserID:    &video.UserID,
+		VideoID:   &video.ID,
+	}, key, now.Add(directUploadURLExpiry))
+
+	upload, err := cfg.db.CreateDirectUpload(database.CreateDirectUploadParams{
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		Key:       key,
+		Size:      params.Size,
+		SHA256:    params.SHA256,
+		ExpiresAt: now.Add(directUploadDeadline),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	// Host is implied by the URL and browsers refuse to set it
+	headers := presigned.SignedHeader.Clone()
+	headers.Del("Host")
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadID:  upload.ID,
+		URL:       presigned.URL,
+		Method:    presigned.Method,
+		Headers:   headers,
+		ExpiresAt: now.Add(directUploadURLExpiry),
+		ConfirmBy: upload.ExpiresAt,
+	})
+}
+
+// handlerDirectUploadConfirm files an object the client PUT with a direct
+// upload URL or POSTed with a form policy: it's probed, checked against the
+// plan and moved under its aspect ratio.
+func (cfg *apiConfig) handlerDirectUploadConfirm(w http.ResponseWriter, r *http.Request) {
+	video, upload, store, ok := cfg.directUploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	staged, err := stagedDirectUpload(r.Context(), store, upload)
+	if errors.Is(err, errNothingUploaded) {
+		respondWithError(w, http.StatusConflict, "Nothing has been uploaded yet", err)
+		return
+	}
+	if err != nil {
+		respondWithUploadError(w, http.StatusBadGateway, "Couldn't check upload", err, uploadRecovery{Retryable: true})
+		return
+	}
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	if upload.Form {
+		// the policy capped the size, but not the name or the quota since
+		// then
+		violations := cfg.checkVideoUpload(plan, path.Base(staged.Key), "video/mp4", staged.Size, 0)
+		if len(violations) > 0 {
+			deleteStagedObject(store, staged)
+			respondWithUploadViolations(w, violations, nil, uploadRecovery{BytesReceived: staged.Size})
+			return
+		}
+		if !cfg.uploadQuotaAllowed(w, video.UserID, plan, staged.Size) {
+			deleteStagedObject(store, staged)
+			return
+		}
+	} else if staged.Size != upload.Size {
+		// the signature pins the length, but S3 compatible stores don't all
+		// enforce it
+		deleteStagedObject(store, staged)
+		respondWithUploadError(w, http.StatusBadRequest, "Uploaded file isn't the declared size", nil, uploadRecovery{
+			BytesReceived: staged.Size,
+			Retryable:     true,
+		})
+		return
+	}
+	if err := cfg.db.DeleteDirectUpload(upload.ID); err != nil {
+		log.Printf("Couldn't remove direct upload %s: %v", upload.ID, err)
+	}
+
+	video, err = cfg.fileStreamedVideo(r.Context(), store, video, plan, staged)
+	if err != nil {
+		log.Printf("Direct upload error: %v", err)
+		respondWithStreamedVideoError(w, err, staged.Size)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, withAssetReadiness(video))
+}
+
+// handlerDirectUploadAbort drops an upload and anything already PUT for it.
+func (cfg *apiConfig) handlerDirectUploadAbort(w http.ResponseWriter, r *http.Request) {
+	_, upload, store, ok := cfg.directUploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	deleteDirectUploadObjects(store, upload)
+	if err := cfg.db.DeleteDirectUpload(upload.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// directUploadFromRequest loads the owned video, the upload in the path and
+// the store it's going to, writing the error response if that fails.
+func (cfg *apiConfig) directUploadFromRequest(w http.ResponseWriter, r *http.Request) (database.Video, database.DirectUpload, objectStore, bool) {
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return database.Video{}, database.DirectUpload{}, objectStore{}, false
+	}
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID", err)
+		return database.Video{}, database.DirectUpload{}, objectStore{}, false
+	}
+	upload, err := cfg.db.GetDirectUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.Video{}, database.DirectUpload{}, objectStore{}, false
+	}
+	if upload.ID == uuid.Nil || upload.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.Video{}, database.DirectUpload{}, objectStore{}, false
+	}
+	// the janitor may not have got to it yet
+	if cfg.now().After(upload.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload deadline has passed", nil)
+		return database.Video{}, database.DirectUpload{}, objectStore{}, false
+	}
+	store, err := cfg.storeForUser(upload.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return database.Video{}, database.DirectUpload{}, objectStore{}, false
+	}
+	return video, upload, store, true
+}
+
+// abandonExpiredDirectUploads drops objects that were never confirmed.
+func (cfg *apiConfig) abandonExpiredDirectUploads(now time.Time) {
+	uploads, err := cfg.db.GetExpiredDirectUploads(now)
+	if err != nil {
+		log.Printf("direct: couldn't get expired uploads: %v", err)
+		return
+	}
+	for _, upload := range uploads {
+		store, err := cfg.storeForUser(upload.UserID)
+		if err != nil {
+			log.Printf("direct: %v", err)
+			continue
+		}
+		// also fine if the client never sent anything
+		deleteDirectUploadObjects(store, upload)
+		if err := cfg.db.DeleteDirectUpload(upload.ID); err != nil {
+			log.Printf("direct: couldn't delete expired upload %s: %v", upload.ID, err)
+			continue
+		}
+		cfg.abandonUpload(upload.VideoID)
+		log.Printf("direct: abandoned upload %s", upload.ID)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// uploadRecovery tells a client what happened to a failed upload and whether
+// sending it again could work. ResumeToken is only set by upload paths that
+// can pick up where they left off.
+type uploadRecovery struct {
+	BytesReceived int64   `json:"bytes_received"`
+	Retryable     bool    `json:"retryable"`
+	ResumeToken   *string `json:"resume_token,omitempty"`
+}
+
+func respondWithUploadError(w http.ResponseWriter, code int, msg string, err error, recovery uploadRecovery) {
+	if err != nil {
+		log.Println(err)
+	}
+	if code > 499 {
+		log.Printf("Responding with 5XX error: %s", msg)
+	}
+	type errorResponse struct {
+		Error    string         `json:"error"`
+		Recovery uploadRecovery `json:"recovery"`
+	}
+	respondWithJSON(w, code, errorResponse{
+		Error:    msg,
+		Recovery: recovery,
+	})
+}
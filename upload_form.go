@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// errNothingUploaded is returned when a direct upload is confirmed before
+// anything was sent.
+var errNothingUploaded = errors.New("nothing has been uploaded yet")
+
+// handlerFormUploadInit signs an S3 POST policy so a plain HTML form can
+// send the file straight to the bucket. Unlike a presigned PUT the browser
+// doesn't need to know the size up front: the policy pins the object under a
+// prefix only this upload uses, caps its length at what the plan and storage
+// quota allow and requires an mp4 content type. The object is named after the
+// file the browser picked. Confirming and aborting go through the direct
+// upload endpoints.
+func (cfg *apiConfig) handlerFormUploadInit(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+	}
+	type response struct {
+		UploadID  uuid.UUID         `json:"upload_id"`
+		URL       string            `json:"url"`
+		Fields    map[string]string `json:"fields"`
+		MaxSize   int64             `json:"max_size"`
+		ExpiresAt time.Time         `json:"expires_at"`
+		ConfirmBy time.Time         `json:"confirm_by"`
+	}
+
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+			return
+		}
+	}
+	// the file goes straight to S3, so there's no local copy to transcode
+	if params.ContentType != "" && params.ContentType != "video/mp4" {
+		respondWithError(w, http.StatusBadRequest, "Only mp4 can be uploaded directly, send other formats with the form upload", nil)
+		return
+	}
+
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	// the size isn't known yet, but there has to be room for something
+	if !cfg.uploadQuotaAllowed(w, video.UserID, plan, 1) {
+		return
+	}
+	maxSize := cfg.maxVideoSize(plan)
+	storage, err := cfg.storageUsage(video.UserID, plan)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage usage", err)
+		return
+	}
+	if storage.RemainingBytes != nil {
+		maxSize = min(maxSize, *storage.RemainingBytes)
+	}
+
+	store, err := cfg.storeForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	prefix, err := joinKey(streamStagingPrefix, uuid.NewString())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create object key", err)
+		return
+	}
+	prefix += "/"
+	presigned, err := s3.NewPresignClient(store.client).PresignPostObject(r.Context(), &s3.PutObjectInput{
+		Bucket: aws.String(store.bucket),
+		// S3 fills in the name of the file the browser sends
+		Key: aws.String(prefix + "${filename}"),
+	}, func(o *s3.PresignPostOptions) {
+		o.Expires = directUploadURLExpiry
+		o.Conditions = []any{
+			[]any{"starts-with", "$key", prefix},
+			[]any{"content-length-range", 1, maxSize},
+			map[string]string{"Content-Type": "video/mp4"},
+		}
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+	presigned.Values["Content-Type"] = "video/mp4"
+	now := cfg.now()
+	cfg.auditPresign(presignRequester{
+		Requester: "form-upload",
+		UserID:    &video.UserID,
+		VideoID:   &video.ID,
+	}, prefix, now.Add(directUploadURLExpiry))
+
+	upload, err := cfg.db.CreateDirectUpload(database.CreateDirectUploadParams{
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		Key:       prefix,
+		Form:      true,
+		ExpiresAt: now.Add(directUploadDeadline),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadID:  upload.ID,
+		URL:       presigned.URL,
+		Fields:    presigned.Values,
+		MaxSize:   maxSize,
+		ExpiresAt: now.Add(directUploadURLExpiry),
+		ConfirmBy: upload.ExpiresAt,
+	})
+}
+
+// stagedDirectUpload finds the object sent for a direct upload, returning
+// errNothingUploaded if there isn't one yet. A form upload may have been
+// sent more than once under different names; the latest wins and the rest
+// are dropped.
+func stagedDirectUpload(ctx context.Context, store objectStore, upload database.DirectUpload) (streamedObject, error) {
+	if !upload.Form {
+		head, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(upload.Key),
+		})
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return streamedObject{}, errNothingUploaded
+		}
+		if err != nil {
+			return streamedObject{}, err
+		}
+		return streamedObject{
+			Key:       upload.Key,
+			Size:      aws.ToInt64(head.ContentLength),
+			SHA256:    upload.SHA256,
+			VersionID: head.VersionId,
+		}, nil
+	}
+
+	objects, err := listStagedObjects(ctx, store, upload.Key)
+	if err != nil {
+		return streamedObject{}, err
+	}
+	var latest *streamedObject
+	var latestModified time.Time
+	for i, obj := range objects {
+		if latest == nil || obj.modified.After(latestModified) {
+			latest, latestModified = &objects[i].streamedObject, obj.modified
+		}
+	}
+	if latest == nil {
+		return streamedObject{}, errNothingUploaded
+	}
+	for _, obj := range objects {
+		if obj.Key != latest.Key {
+			deleteStagedObject(store, obj.streamedObject)
+		}
+	}
+	return *latest, nil
+}
+
+type stagedObject struct {
+	streamedObject
+	modified time.Time
+}
+
+func listStagedObjects(ctx context.Context, store objectStore, prefix string) ([]stagedObject, error) {
+	objects := []stagedObject{}
+	paginator := s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(store.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, stagedObject{
+				streamedObject: streamedObject{Key: aws.ToString(obj.Key), Size: aws.ToInt64(obj.Size)},
+				modified:       aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// deleteDirectUploadObjects drops whatever was sent for a direct upload.
+func deleteDirectUploadObjects(store objectStore, upload database.DirectUpload) {
+	if !upload.Form {
+		deleteStagedObject(store, streamedObject{Key: upload.Key})
+		return
+	}
+	objects, err := listStagedObjects(context.Background(), store, upload.Key)
+	if err != nil {
+		log.Printf("Couldn't list staged uploads under %s: %v", upload.Key, err)
+		return
+	}
+	for _, obj := range objects {
+		deleteStagedObject(store, obj.streamedObject)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+)
+
+const maxThumbnailSize = 10 << 20 // 10MB
+
+var (
+	videoMediaTypes     = []string{"video/mp4", "video/quicktime", "video/webm", "video/x-matroska"}
+	thumbnailMediaTypes = []string{"image/jpeg", "image/png", "image/webp", "image/gif"}
+)
+
+// uploadViolation names one limit a proposed upload would break.
+type uploadViolation struct {
+	Field   string `json:"field"`
+	Limit   any    `json:"limit"`
+	Message string `json:"message"`
+	// set when the limit comes from the user's plan, so clients can offer
+	// an upgrade
+	Plan string `json:"plan,omitempty"`
+	// set for size and length limits, as opposed to what's accepted at all
+	Exceeded *limits.Exceeded `json:"exceeded,omitempty"`
+}
+
+func (v uploadViolation) Error() string {
+	return v.Message
+}
+
+// maxVideoSize is the largest video plan may upload. A deployment-wide
+// MAX_UPLOAD_SIZE wins when it's smaller.
+func (cfg *apiConfig) maxVideoSize(plan database.Plan) int64 {
+	if cfg.maxUploadSize > 0 && cfg.maxUploadSize < plan.MaxVideoSize {
+		return cfg.maxUploadSize
+	}
+	return plan.MaxVideoSize
+}
+
+// videoSizeViolation describes a video of size bytes going over its limit,
+// with size zero when it isn't known beyond being too big. The plan is only
+// named when the limit is the plan's, as upgrading won't lift the
+// deployment's.
+func (cfg *apiConfig) videoSizeViolation(plan database.Plan, size int64) uploadViolation {
+	limit := cfg.maxVideoSize(plan)
+	exceeded := limits.Exceeded{
+		Kind:  limits.Size,
+		Name:  "max_upload_size",
+		Unit:  "bytes",
+		Used:  size,
+		Limit: limit,
+	}
+	if limit == plan.MaxVideoSize {
+		exceeded = cfg.planLimitExceeded(limits.MaxVideoSize, plan, size, 0)
+	}
+	return limitViolation("size", exceeded)
+}
+
+// videoDurationViolation describes a video of duration seconds going over
+// plan's limit.
+func (cfg *apiConfig) videoDurationViolation(plan database.Plan, duration float64) uploadViolation {
+	return limitViolation("duration", cfg.planLimitExceeded(limits.MaxVideoDuration, plan, int64(math.Ceil(duration)), 0))
+}
+
+func limitViolation(field string, exceeded limits.Exceeded) uploadViolation {
+	return uploadViolation{
+		Field:    field,
+		Limit:    exceeded.Limit,
+		Message:  exceeded.Error(),
+		Plan:     exceeded.Plan,
+		Exceeded: &exceeded,
+	}
+}
+
+// respondWithUploadViolations writes the limits an upload broke, with the
+// status of the first size or length limit among them, like any other
+// limits.Exceeded, and 400 if there's none.
+func respondWithUploadViolations(w http.ResponseWriter, violations []uploadViolation, err error, recovery uploadRecovery) {
+	type response struct {
+		Error      string            `json:"error"`
+		Violations []uploadViolation `json:"violations"`
+		Limit      *limits.Exceeded  `json:"limit,omitempty"`
+		Recovery   uploadRecovery    `json:"recovery"`
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	resp := response{
+		Error:      violations[0].Message,
+		Violations: violations,
+		Recovery:   recovery,
+	}
+	code := http.StatusBadRequest
+	for _, v := range violations {
+		if v.Exceeded != nil {
+			code = v.Exceeded.Status()
+			resp.Limit = v.Exceeded
+			break
+		}
+	}
+	respondWithJSON(w, code, resp)
+}
+
+// checkVideoUpload checks upload metadata against the limits the upload
+// handler enforces for plan. Zero size or duration means the client didn't
+// say, and is left for the upload itself to check.
+func (cfg *apiConfig) checkVideoUpload(plan database.Plan, filename, contentType string, size int64, duration float64) []uploadViolation {
+	violations := []uploadViolation{}
+	if !slices.Contains(videoMediaTypes, contentType) {
+		violations = append(violations, uploadViolation{
+			Field:   "content_type",
+			Limit:   videoMediaTypes,
+			Message: fmt.Sprintf("content type %q is not supported", contentType),
+		})
+	}
+	if !isVideoFilename(filename) {
+		violations = append(violations, uploadViolation{
+			Field:   "filename",
+			Limit:   videoExtensions,
+			Message: fmt.Sprintf("file extension %q is not supported", strings.ToLower(filepath.Ext(filename))),
+		})
+	}
+	if size < 0 || size > cfg.maxVideoSize(plan) {
+		violations = append(violations, cfg.videoSizeViolation(plan, size))
+	}
+	if duration < 0 || duration > float64(plan.MaxVideoDuration) {
+		violations = append(violations, cfg.videoDurationViolation(plan, duration))
+	}
+	return violations
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const uploadProgressInterval = 250 * time.Millisecond
+
+// uploadProgresses counts the body bytes of in-flight video uploads so the
+// progress endpoint can report on them.
+type uploadProgresses struct {
+	mu      sync.Mutex
+	uploads map[uuid.UUID]*uploadProgress
+}
+
+type uploadProgress struct {
+	total    int64
+	received atomic.Int64
+	done     chan struct{}
+}
+
+type uploadProgressEvent struct {
+	BytesReceived int64    `json:"bytes_received"`
+	TotalBytes    int64    `json:"total_bytes"`
+	Percent       *float64 `json:"percent"`
+}
+
+// track counts what's read from body for videoID until finish is called.
+// total is the request's Content-Length, or -1 if unknown. A newer upload
+// for the same video takes over its progress.
+func (p *uploadProgresses) track(videoID uuid.UUID, total int64, body io.ReadCloser) (io.ReadCloser, func()) {
+	progress := &uploadProgress{total: total, done: make(chan struct{})}
+	p.mu.Lock()
+	p.uploads[videoID] = progress
+	p.mu.Unlock()
+
+	finish := func() {
+		p.mu.Lock()
+		if p.uploads[videoID] == progress {
+			delete(p.uploads, videoID)
+		}
+		p.mu.Unlock()
+		close(progress.done)
+	}
+	return progressBody{ReadCloser: body, progress: progress}, finish
+}
+
+func (p *uploadProgresses) get(videoID uuid.UUID) *uploadProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.uploads[videoID]
+}
+
+type progressBody struct {
+	io.ReadCloser
+	progress *uploadProgress
+}
+
+func (b progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.progress.received.Add(int64(n))
+	return n, err
+}
+
+func (p *uploadProgress) event() uploadProgressEvent {
+	event := uploadProgressEvent{
+		BytesReceived: p.received.Load(),
+		TotalBytes:    p.total,
+	}
+	if p.total > 0 {
+		percent := math.Round(float64(event.BytesReceived)/float64(p.total)*1000) / 10
+		event.Percent = &percent
+	}
+	return event
+}
+
+// handlerUploadProgress streams Server-Sent Events for the next or current
+// upload of a video: "progress" events while the body is read and a final
+// "done" once the upload request has finished, whatever its outcome. The
+// upload's own response says whether it worked.
+func (cfg *apiConfig) handlerUploadProgress(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoFromRequest(w, r, videoAccessView)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming is not supported", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": waiting for upload\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(uploadProgressInterval)
+	defer ticker.Stop()
+
+	// frontends usually connect just before they start sending
+	progress := cfg.uploadProgresses.get(video.ID)
+	for progress == nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			progress = cfg.uploadProgresses.get(video.ID)
+		}
+	}
+
+	last := int64(-1)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-progress.done:
+			writeUploadProgressEvent(w, "done", progress.event())
+			flusher.Flush()
+			return
+		case <-ticker.C:
+			event := progress.event()
+			if event.BytesReceived == last {
+				continue
+			}
+			last = event.BytesReceived
+			writeUploadProgressEvent(w, "progress", event)
+			flusher.Flush()
+		}
+	}
+}
+
+func writeUploadProgressEvent(w io.Writer, name string, event uploadProgressEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+}
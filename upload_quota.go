@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+	"github.com/google/uuid"
+)
+
+// counters older than this can't be part of any current window
+const uploadCounterRetention = 62 * 24 * time.Hour
+
+// uploadUsage is a number of uploads and their total size.
+type uploadUsage struct {
+	Uploads int
+	Bytes   int64
+}
+
+// uploadWindow returns when the window of period containing now started and
+// when the next one starts. Windows are UTC calendar days and months, so
+// caps reset at a time clients can show.
+func uploadWindow(period database.UploadPeriod, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	if period == database.UploadPeriodMonth {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// checkUploadQuota returns a limits.Exceeded if pending, on top of what the
+// user already uploaded, would go over one of plan's caps or wouldn't fit in
+// their storage. Uploads are counted once they're published, so a few racing
+// ones can overshoot.
+func (cfg *apiConfig) checkUploadQuota(userID uuid.UUID, plan database.Plan, pending uploadUsage, now time.Time) error {
+	caps := []struct {
+		period  database.UploadPeriod
+		uploads int
+		bytes   int64
+		// the plan's names for the caps
+		uploadsLimit, bytesLimit string
+	}{
+		{database.UploadPeriodDay, plan.DailyUploads, plan.DailyUploadBytes, limits.DailyUploads, limits.DailyUploadBytes},
+		{database.UploadPeriodMonth, plan.MonthlyUploads, plan.MonthlyUploadBytes, limits.MonthlyUploads, limits.MonthlyUploadBytes},
+	}
+	for _, c := range caps {
+		if c.uploads == 0 && c.bytes == 0 {
+			continue
+		}
+		start, end := uploadWindow(c.period, now)
+		counter, err := cfg.db.GetUploadCounter(userID, c.period, start)
+		if err != nil {
+			return fmt.Errorf("couldn't get upload counter: %w", err)
+		}
+		var exceeded limits.Exceeded
+		switch {
+		case c.uploads > 0 && counter.Uploads+pending.Uploads > c.uploads:
+			exceeded = cfg.planLimitExceeded(c.uploadsLimit, plan, int64(counter.Uploads), int64(pending.Uploads))
+		case c.bytes > 0 && counter.Bytes+pending.Bytes > c.bytes:
+			exceeded = cfg.planLimitExceeded(c.bytesLimit, plan, counter.Bytes, pending.Bytes)
+		default:
+			continue
+		}
+		exceeded.ResetsAt = &end
+		return exceeded
+	}
+	return cfg.checkStorageQuota(userID, plan, pending.Bytes)
+}
+
+// uploadQuotaAllowed checks one upload of size bytes, zero if not known yet,
+// writing the error response if it's over a cap.
+func (cfg *apiConfig) uploadQuotaAllowed(w http.ResponseWriter, userID uuid.UUID, plan database.Plan, size int64) bool {
+	err := cfg.checkUploadQuota(userID, plan, uploadUsage{Uploads: 1, Bytes: size}, cfg.now())
+	var exceeded limits.Exceeded
+	if errors.As(err, &exceeded) {
+		cfg.respondWithLimit(w, exceeded, nil)
+		return false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check upload quota", err)
+		return false
+	}
+	return true
+}
+
+// recordUpload counts a published upload against every window it falls in.
+// The upload already happened, so failures are only logged.
+func (cfg *apiConfig) recordUpload(userID uuid.UUID, size int64, now time.Time) {
+	for _, period := range []database.UploadPeriod{database.UploadPeriodDay, database.UploadPeriodMonth} {
+		start, _ := uploadWindow(period, now)
+		if err := cfg.db.AddUploadCounter(userID, period, start, size); err != nil {
+			log.Printf("Couldn't count upload of %d bytes for user %s: %v", size, userID, err)
+		}
+	}
+}
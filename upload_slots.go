@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultMaxConcurrentUploads = 3
+	// how long a client over its limit should wait before trying again
+	uploadSlotRetryAfter = 30 * time.Second
+)
+
+// uploadSlots caps how many uploads each user has in flight, so one user
+// can't fill the spool disk or keep every ffmpeg busy with dozens of
+// parallel uploads.
+type uploadSlots struct {
+	mu     sync.Mutex
+	max    int
+	active map[uuid.UUID]int
+	// slots of uploads handed to the job queue, by job
+	queued map[uuid.UUID]*uploadSlot
+}
+
+func newUploadSlots(max int) *uploadSlots {
+	return &uploadSlots{max: max, active: map[uuid.UUID]int{}, queued: map[uuid.UUID]*uploadSlot{}}
+}
+
+// acquire takes one of the user's slots, or returns nil if they're all in
+// use.
+func (s *uploadSlots) acquire(userID uuid.UUID) *uploadSlot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[userID] >= s.max {
+		return nil
+	}
+	s.active[userID]++
+	return &uploadSlot{slots: s, userID: userID}
+}
+
+// uploadSlot is one upload in flight. It's released when the request is
+// done, unless a handler keeps it for work that carries on after the
+// response, which then releases it.
+type uploadSlot struct {
+	slots  *uploadSlots
+	userID uuid.UUID
+	once   sync.Once
+	kept   bool
+}
+
+// holdForJob keeps the slot until releaseJob is called with jobID, for an
+// upload whose processing was queued.
+func (s *uploadSlot) holdForJob(jobID uuid.UUID) {
+	if s == nil {
+		return
+	}
+	s.slots.mu.Lock()
+	defer s.slots.mu.Unlock()
+	s.slots.queued[jobID] = s
+}
+
+// releaseJob releases the slot held for the job, if there is one. Jobs
+// picked up after a restart have none.
+func (s *uploadSlots) releaseJob(jobID uuid.UUID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	slot := s.queued[jobID]
+	delete(s.queued, jobID)
+	s.mu.Unlock()
+	slot.release()
+}
+
+func (s *uploadSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.slots.mu.Lock()
+		defer s.slots.mu.Unlock()
+		s.slots.active[s.userID]--
+		if s.slots.active[s.userID] <= 0 {
+			delete(s.slots.active, s.userID)
+		}
+	})
+}
+
+type uploadSlotKey struct{}
+
+// keepUploadSlot hands the request's upload slot to the caller, to release
+// once its background work is done. It returns nil, which is fine to
+// release, for requests that didn't take one.
+func keepUploadSlot(ctx context.Context) *uploadSlot {
+	slot, _ := ctx.Value(uploadSlotKey{}).(*uploadSlot)
+	if slot != nil {
+		slot.kept = true
+	}
+	return slot
+}
+
+// limitUploads wraps the upload endpoints that spool or process video,
+// turning a user away with 429 while they already have as many uploads in
+// flight as cfg.uploadSlots allows. Unauthenticated requests are left to the
+// handler to reject.
+func (cfg *apiConfig) limitUploads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := cfg.optionalUserID(r)
+		if cfg.uploadSlots == nil || userID == uuid.Nil {
+			next(w, r)
+			return
+		}
+		slot := cfg.uploadSlots.acquire(userID)
+		if slot == nil {
+			cfg.respondWithLimit(w, limits.Exceeded{
+				Kind:       limits.Rate,
+				Name:       "concurrent_uploads",
+				Unit:       "uploads",
+				Used:       int64(cfg.uploadSlots.max),
+				Pending:    1,
+				Limit:      int64(cfg.uploadSlots.max),
+				RetryAfter: uploadSlotRetryAfter,
+			}, nil)
+			return
+		}
+		defer func() {
+			if !slot.kept {
+				slot.release()
+			}
+		}()
+		next(w, r.WithContext(context.WithValue(r.Context(), uploadSlotKey{}, slot)))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// how much of an upload is read to tell its container
+const sniffLen = 512
+
+const mpegTSPacketLen = 188
+
+// sniffVideoContainer tells the container of a video from its first bytes
+// and returns its media type, or "" if it isn't one we know. FLV and MPEG-TS
+// are only known for live recordings, which are transcoded; HTTP uploads
+// don't take them.
+// http.DetectContentType calls QuickTime files octet-stream and every
+// Matroska file webm, so it isn't enough here.
+func sniffVideoContainer(head []byte) string {
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		if string(head[8:12]) == "qt  " {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	}
+	// QuickTime files from before ftyp start straight with an atom
+	if len(head) >= 8 {
+		switch string(head[4:8]) {
+		case "moov", "mdat", "wide", "free":
+			return "video/quicktime"
+		}
+	}
+	// EBML header, with the doc type telling WebM from Matroska
+	if bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}) {
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	}
+	// what nginx-rtmp records to
+	if bytes.HasPrefix(head, []byte("FLV\x01")) {
+		return "video/x-flv"
+	}
+	// what HLS archives are stitched into: 188 byte packets, each starting
+	// with a sync byte
+	if len(head) > 2*mpegTSPacketLen && head[0] == 0x47 && head[mpegTSPacketLen] == 0x47 && head[2*mpegTSPacketLen] == 0x47 {
+		return "video/mp2t"
+	}
+	return ""
+}
+
+// videoContainer sniffs the container of a local video file.
+func videoContainer(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	return sniffVideoContainer(head[:n]), nil
+}
+
+// containerFamilies groups media types that clients use interchangeably
+// for the same container: plenty of tools label an mp4 as QuickTime and a
+// WebM as Matroska, and the reverse.
+var containerFamilies = map[string]string{
+	"video/mp4":        "isobmff",
+	"video/quicktime":  "isobmff",
+	"video/webm":       "ebml",
+	"video/x-matroska": "ebml",
+}
+
+// checkVideoContainer compares what the client said it was sending with
+// what the bytes turned out to be. An empty declared type only checks that
+// the container is one we take.
+func checkVideoContainer(declared, sniffed string) []uploadViolation {
+	if !slices.Contains(videoMediaTypes, sniffed) {
+		return []uploadViolation{{
+			Field:   "content",
+			Limit:   videoMediaTypes,
+			Message: "file isn't a supported video",
+		}}
+	}
+	if declared != "" && containerFamilies[declared] != containerFamilies[sniffed] {
+		return []uploadViolation{{
+			Field:   "content",
+			Limit:   declared,
+			Message: fmt.Sprintf("file was sent as %s but is %s", declared, sniffed),
+		}}
+	}
+	return nil
+}
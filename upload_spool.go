@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	uploadDirPrefix        = "tubely-upload-"
+	staleUploadDirMaxAge   = 24 * time.Hour
+	uploadDirSweepInterval = time.Hour
+)
+
+type spooledFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// newUploadDir creates a private working directory in the spool volume for
+// one upload. Everything derived from the upload (the spooled body, ffmpeg
+// output) goes in here so a single os.RemoveAll cleans it all up.
+func (cfg *apiConfig) newUploadDir() (string, error) {
+	return os.MkdirTemp(cfg.spoolDir, uploadDirPrefix+"*")
+}
+
+// spoolToTempFile copies r into a new temp file in dir, hashing and counting
+// the bytes on the way through so callers never need a second read of a
+// large upload. sizeHint, when known, is the most the upload can be and is
+// reserved up front. The caller removes the file. On a failed copy the
+// returned Size still says how many bytes made it to disk.
+func (cfg *apiConfig) spoolToTempFile(dir string, r io.Reader, pattern string, sizeHint int64) (spooledFile, error) {
+	tmp, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return spooledFile{}, err
+	}
+	f := newSpoolFile(tmp, sizeHint, cfg.spoolDirectIO)
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hasher), r)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp.Name())
+		return spooledFile{Size: size}, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return spooledFile{}, err
+	}
+
+	return spooledFile{
+		Path:   tmp.Name(),
+		Size:   size,
+		SHA256: hex.EncodeToString(hasher.Sum(nil)),
+	}, nil
+}
+
+// runUploadDirJanitor removes upload directories left behind by requests
+// that never got to clean up, e.g. because the server was killed mid-upload.
+func (cfg *apiConfig) runUploadDirJanitor() {
+	for {
+		cfg.removeStaleUploadDirs(staleUploadDirMaxAge)
+		cfg.removeStaleTusUploads(staleUploadDirMaxAge)
+		cfg.abandonExpiredChunkedUploads(cfg.now())
+		cfg.abandonExpiredDirectUploads(cfg.now())
+		cfg.abortStaleMultipartUploads(context.Background(), staleMultipartUploadMaxAge, nil)
+		cfg.dropExpiredVideoArchives(cfg.now())
+		if err := cfg.db.DeleteUploadCountersBefore(cfg.now().Add(-uploadCounterRetention)); err != nil {
+			log.Printf("Couldn't remove old upload counters: %v", err)
+		}
+		if err := cfg.db.DeleteBandwidthBefore(cfg.now().Add(-uploadCounterRetention)); err != nil {
+			log.Printf("Couldn't remove old bandwidth counters: %v", err)
+		}
+		if err := cfg.db.DeleteProcessingJobsBefore(cfg.now().Add(-processingJobRetention)); err != nil {
+			log.Printf("Couldn't remove old processing jobs: %v", err)
+		}
+		if err := cfg.db.DeleteIdempotencyKeysBefore(cfg.now().Add(-idempotencyKeyTTL)); err != nil {
+			log.Printf("Couldn't remove expired idempotency keys: %v", err)
+		}
+		time.Sleep(uploadDirSweepInterval)
+	}
+}
+
+func (cfg *apiConfig) removeStaleUploadDirs(maxAge time.Duration) {
+	entries, err := os.ReadDir(cfg.spoolDir)
+	if err != nil {
+		log.Printf("spool: couldn't read %s: %v", cfg.spoolDir, err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), uploadDirPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		dir := filepath.Join(cfg.spoolDir, entry.Name())
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("spool: couldn't remove stale upload dir %s: %v", dir, err)
+			continue
+		}
+		log.Printf("spool: removed stale upload dir %s", dir)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// one buffer of this size is held per streaming upload; S3 needs at least
+// 5MB for every part but the last
+const streamPartSize = 16 << 20
+
+// streamed uploads land here until they've been probed and filed under
+// their aspect ratio
+const streamStagingPrefix = "incoming"
+
+type streamedObject struct {
+	Key       string
+	Size      int64
+	SHA256    string
+	VersionID *string
+}
+
+// handlerUploadVideoStream takes the same form as handlerUploadVideo but
+// pipes the file straight into an S3 multipart upload instead of spooling it
+// to disk, so large uploads need neither local disk nor a second read. The
+// file is probed over a presigned URL afterwards. Fast start remuxing needs
+// the whole file locally, so streamed files are stored as they were sent.
+func (cfg *apiConfig) handlerUploadVideoStream(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+	checksum, ok := expectedSHA256(w, r)
+	if !ok {
+		return
+	}
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	if !cfg.uploadQuotaAllowed(w, video.UserID, plan, max(r.ContentLength, 0)) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoSize(plan))
+	body, finish := cfg.uploadProgresses.track(video.ID, r.ContentLength, r.Body)
+	defer finish()
+	r.Body = body
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Expected multipart form", err)
+		return
+	}
+	var file io.Reader
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+			return
+		}
+		if part.FormName() == "video" {
+			file = part
+			break
+		}
+	}
+
+	// the bytes go to S3 as they arrive, so check the type up front
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read file", err)
+		return
+	}
+	head = head[:n]
+	// nothing is stored locally to transcode, so only mp4 is taken here
+	if container := sniffVideoContainer(head); container != "video/mp4" {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+		return
+	}
+
+	store, err := cfg.storeForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	stagingKey, err := joinKey(streamStagingPrefix, getAssetPath("video/mp4"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create object key", err)
+		return
+	}
+	staged, err := cfg.streamToS3(r.Context(), store, stagingKey, "video/mp4", io.MultiReader(bytes.NewReader(head), file))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithUploadViolations(w, []uploadViolation{cfg.videoSizeViolation(plan, 0)}, err, uploadRecovery{
+				BytesReceived: staged.Size,
+			})
+			return
+		}
+		respondWithUploadError(w, http.StatusBadGateway, "Couldn't upload video to storage", err, uploadRecovery{
+			BytesReceived: staged.Size,
+			Retryable:     true,
+		})
+		return
+	}
+	log.Printf("streamed %d bytes for video %s, sha256 %s", staged.Size, video.ID, staged.SHA256)
+	if checksumMismatch(w, checksum, staged.SHA256, staged.Size) {
+		// nothing but the staging area has seen it
+		deleteStagedObject(store, staged)
+		return
+	}
+	// without a Content-Length the size is only known now
+	if !cfg.uploadQuotaAllowed(w, video.UserID, plan, staged.Size) {
+		deleteStagedObject(store, staged)
+		return
+	}
+
+	video, err = cfg.fileStreamedVideo(r.Context(), store, video, plan, staged)
+	if err != nil {
+		log.Printf("Streamed video error: %v", err)
+		respondWithStreamedVideoError(w, err, staged.Size)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, withAssetReadiness(video))
+}
+
+func respondWithStreamedVideoError(w http.ResponseWriter, err error, size int64) {
+	recovery := uploadRecovery{BytesReceived: size}
+	var violation uploadViolation
+	switch {
+	case errors.Is(err, errPublishQueued):
+		respondWithPublishQueued(w)
+	case errors.As(err, &violation):
+		respondWithUploadViolations(w, []uploadViolation{violation}, err, recovery)
+	case errors.Is(err, errStorageUpload):
+		recovery.Retryable = true
+		respondWithUploadError(w, http.StatusBadGateway, "Couldn't upload video to storage", err, recovery)
+	case errors.Is(err, errUploadQuarantined):
+		respondWithUploadError(w, http.StatusUnprocessableEntity, "Upload was rejected by the malware scanner", err, recovery)
+	case errors.Is(err, errMalwareScan):
+		recovery.Retryable = true
+		respondWithUploadError(w, http.StatusServiceUnavailable, "Couldn't scan upload for malware", err, recovery)
+	default:
+		respondWithUploadError(w, http.StatusInternalServerError, "Couldn't process video", err, recovery)
+	}
+}
+
+// fileStreamedVideo probes a staged upload, checks it against plan and moves
+// it to its final key, keeping the video's status in step. The staged
+// object is always removed.
+func (cfg *apiConfig) fileStreamedVideo(ctx context.Context, store objectStore, video database.Video, plan database.Plan, staged streamedObject) (database.Video, error) {
+	defer deleteStagedObject(store, staged)
+	video.Status = cfg.setVideoStatus(video.ID, database.VideoStatusProcessing)
+	filed, err := cfg.fileStagedVideo(ctx, store, video, plan, staged)
+	if err != nil && video.Status == database.VideoStatusProcessing && !errors.Is(err, errPublishQueued) {
+		filed.Status = cfg.setVideoStatus(video.ID, database.VideoStatusFailed)
+	}
+	return filed, err
+}
+
+func (cfg *apiConfig) fileStagedVideo(ctx context.Context, store objectStore, video database.Video, plan database.Plan, staged streamedObject) (database.Video, error) {
+
+	// parts of a chunked upload were never looked at on the way in
+	obj, err := store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(store.bucket),
+		Key:       aws.String(staged.Key),
+		VersionId: staged.VersionID,
+		Range:     aws.String(fmt.Sprintf("bytes=0-%d", sniffLen-1)),
+	})
+	if err != nil {
+		return video, fmt.Errorf("%w: %w", errStorageUpload, err)
+	}
+	head, err := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		return video, fmt.Errorf("%w: %w", errStorageUpload, err)
+	}
+	if container := sniffVideoContainer(head); container != "video/mp4" {
+		return video, uploadViolation{
+			Field:   "content",
+			Limit:   []string{"video/mp4"},
+			Message: "file isn't an mp4 video",
+		}
+	}
+
+	probe, err := cfg.probeStoredVideo(ctx, store, jobPresigner("stream-upload", &video.ID), staged.Key)
+	if err != nil {
+		return video, fmt.Errorf("couldn't probe video: %w", err)
+	}
+	if probe.Duration > float64(plan.MaxVideoDuration) {
+		return video, cfg.videoDurationViolation(plan, probe.Duration)
+	}
+
+	// branding and loudness normalization work on a local file, so uploads
+	// they apply to are pulled back and processed like any other
+	process, err := cfg.stagedUploadNeedsProcessing(video, probe)
+	if err != nil {
+		return video, err
+	}
+	if process {
+		return cfg.ingestStagedObject(ctx, store, video, staged)
+	}
+
+	if cfg.scanner != nil {
+		video, err = cfg.scanStagedObject(ctx, store, video, staged)
+		if err != nil {
+			return video, err
+		}
+	}
+
+	if key, head, ok := cfg.findDuplicateUpload(ctx, store, staged.SHA256); ok {
+		log.Printf("video %s is a duplicate upload, reusing %s", video.ID, key)
+		stored := headObject(head)
+		stored.metadata = &probe
+		return cfg.publishVideoObject(video, store, key, stored, staged.SHA256, staged.Size)
+	}
+
+	key, err := joinKey(aspectRatioDirectory(aspectRatioOf(probe.Width, probe.Height)), getAssetPath("video/mp4"))
+	if err != nil {
+		return video, err
+	}
+	m := bucketMigration{
+		src:       store.client,
+		dst:       store.client,
+		srcBucket: store.bucket,
+		dstBucket: store.bucket,
+	}
+	if err := m.copyObject(ctx, staged.Key, key, staged.Size); err != nil {
+		return video, fmt.Errorf("%w: %w", errStorageUpload, err)
+	}
+	out, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return video, fmt.Errorf("%w: %w", errStorageUpload, err)
+	}
+
+	stored := headObject(out)
+	stored.metadata = &probe
+	return cfg.publishVideoObject(video, store, key, stored, staged.SHA256, staged.Size)
+}
+
+// stagedUploadNeedsProcessing reports whether a staged upload has to be
+// changed before it's stored, rather than being copied into place as is.
+func (cfg *apiConfig) stagedUploadNeedsProcessing(video database.Video, probe database.VideoMetadata) (bool, error) {
+	if cfg.loudnormTarget != 0 && probe.AudioCodec != "" {
+		return true, nil
+	}
+	b, err := cfg.brandingFor(video.UserID)
+	if err != nil {
+		return false, err
+	}
+	return b != nil, nil
+}
+
+// ingestStagedObject pulls a staged upload into the spool and runs it
+// through the ingest pipeline, which also scans it.
+func (cfg *apiConfig) ingestStagedObject(ctx context.Context, store objectStore, video database.Video, staged streamedObject) (database.Video, error) {
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		return video, err
+	}
+	defer os.RemoveAll(uploadDir)
+	path := filepath.Join(uploadDir, "staged.mp4")
+	if err := downloadStagedObject(ctx, store, staged, path); err != nil {
+		return video, fmt.Errorf("%w: %w", errStorageUpload, err)
+	}
+	return cfg.ingestVideoFile(ctx, video, path, staged.SHA256)
+}
+
+// scanStagedObject pulls a staged upload into the spool to run it past the
+// malware scanner, which only sees it once it's local.
+func (cfg *apiConfig) scanStagedObject(ctx context.Context, store objectStore, video database.Video, staged streamedObject) (database.Video, error) {
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		return video, err
+	}
+	defer os.RemoveAll(uploadDir)
+	path := filepath.Join(uploadDir, "staged.mp4")
+	if err := downloadStagedObject(ctx, store, staged, path); err != nil {
+		return video, fmt.Errorf("%w: %w", errStorageUpload, err)
+	}
+	return cfg.scanUpload(ctx, video, path, staged.SHA256)
+}
+
+// downloadStagedObject writes the staged upload to path.
+func downloadStagedObject(ctx context.Context, store objectStore, staged streamedObject, path string) error {
+	obj, err := store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(store.bucket),
+		Key:       aws.String(staged.Key),
+		VersionId: staged.VersionID,
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, obj.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func deleteStagedObject(store objectStore, staged streamedObject) {
+	_, err := store.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket:    aws.String(store.bucket),
+		Key:       aws.String(staged.Key),
+		VersionId: staged.VersionID,
+	})
+	if err != nil {
+		log.Printf("Couldn't remove staged upload %s: %v", staged.Key, err)
+	}
+}
+
+// streamToS3 uploads everything r yields to key in store, one part at a
+// time. Files smaller than a part go up in a single PutObject. On error the
+// returned Size says how much was read, and any multipart upload is aborted.
+func (cfg *apiConfig) streamToS3(ctx context.Context, store objectStore, key, contentType string, r io.Reader) (streamedObject, error) {
+	hasher := sha256.New()
+	obj := streamedObject{Key: key}
+	buf := make([]byte, streamPartSize)
+
+	n, err := io.ReadFull(r, buf)
+	obj.Size += int64(n)
+	hasher.Write(buf[:n])
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		var out *s3.PutObjectOutput
+		err := cfg.s3Retry.do(ctx, "PutObject "+key, func() (err error) {
+			out, err = store.client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:      aws.String(store.bucket),
+				Key:         aws.String(key),
+				Body:        bytes.NewReader(buf[:n]),
+				ContentType: aws.String(contentType),
+			})
+			return err
+		})
+		if err != nil {
+			return obj, err
+		}
+		return finishStream(obj, hasher, out.VersionId), nil
+	}
+	if err != nil {
+		return obj, err
+	}
+
+	upload, err := store.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(store.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return obj, err
+	}
+	abort := func(err error) (streamedObject, error) {
+		// the request context may be the reason we're aborting
+		store.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(store.bucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		return obj, err
+	}
+
+	parts := []types.CompletedPart{}
+	for partNumber := int32(1); n > 0; partNumber++ {
+		part, err := store.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(store.bucket),
+			Key:        aws.String(key),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(partNumber),
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       part.ETag,
+			PartNumber: aws.Int32(partNumber),
+		})
+
+		n, err = io.ReadFull(r, buf)
+		obj.Size += int64(n)
+		hasher.Write(buf[:n])
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return abort(err)
+		}
+	}
+
+	out, err := store.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(store.bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return finishStream(obj, hasher, out.VersionId), nil
+}
+
+func finishStream(obj streamedObject, hasher hash.Hash, versionID *string) streamedObject {
+	obj.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	obj.VersionID = versionID
+	return obj
+}
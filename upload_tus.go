@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// tus 1.0.0 (https://tus.io/protocols/resumable-upload) with the creation
+// and termination extensions. Offsets live in the tus_uploads table and the
+// bytes in a file per upload under the spool dir; once the last byte is in,
+// the file goes through the same ingest as a form upload.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusDirName    = "tubely-tus"
+)
+
+func (cfg *apiConfig) tusUploadPath(id uuid.UUID) string {
+	return filepath.Join(cfg.spoolDir, tusDirName, id.String())
+}
+
+// tusHeaders sets the headers every tus response carries and rejects
+// requests speaking another version of the protocol.
+func tusHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w, r)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	plan, err := cfg.db.GetPlan(database.PlanFree)
+	if userID := cfg.optionalUserID(r); userID != uuid.Nil {
+		plan, err = cfg.db.GetUserPlan(userID)
+	}
+	if err == nil {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.maxVideoSize(plan), 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerTusCreate starts an upload for the video named in the video_id
+// metadata entry.
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Length is required", err)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", err)
+		return
+	}
+	videoID, err := uuid.Parse(metadata["video_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload-Metadata must include video_id", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !cfg.videoAccessAllowed(w, video, userID, videoAccessEdit) {
+		return
+	}
+
+	// collaborators upload on the owner's plan
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = "upload.mp4"
+	}
+	contentType := metadata["filetype"]
+	if contentType == "" {
+		contentType = "video/mp4"
+	}
+	if violations := cfg.checkVideoUpload(plan, filename, contentType, length, 0); len(violations) > 0 {
+		respondWithUploadViolations(w, violations, nil, uploadRecovery{})
+		return
+	}
+	if !cfg.uploadQuotaAllowed(w, video.UserID, plan, length) {
+		return
+	}
+
+	upload, err := cfg.db.CreateTusUpload(database.CreateTusUploadParams{
+		UserID:   userID,
+		VideoID:  video.ID,
+		Length:   length,
+		Filename: filename,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.tusUploadPath(upload.ID)), 0o700); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload directory", err)
+		return
+	}
+	f, err := os.OpenFile(cfg.tusUploadPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Location", "/api/tus/"+upload.ID.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusUploadFromRequest loads the upload in the path for its owner, writing
+// the error response if that fails.
+func (cfg *apiConfig) tusUploadFromRequest(w http.ResponseWriter, r *http.Request) (database.TusUpload, bool) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return database.TusUpload{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.TusUpload{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.TusUpload{}, false
+	}
+
+	upload, err := cfg.db.GetTusUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.TusUpload{}, false
+	}
+	// tus clients start over on 404 and 410, so an expired upload says 404 too
+	if upload.ID == uuid.Nil || upload.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.TusUpload{}, false
+	}
+	return upload, true
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	upload, ok := cfg.tusUploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerTusPatch appends to an upload. Whatever arrives before a dropped
+// connection is kept, so the client resumes from the last byte written.
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload-Offset is required", err)
+		return
+	}
+
+	upload, ok := cfg.tusUploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// upload IDs never collide with video IDs, so the video locks double as
+	// upload locks and two PATCHes can't interleave their writes
+	unlock := cfg.videoLocks.lock(upload.ID)
+	defer unlock()
+	upload, err = cfg.db.GetTusUpload(upload.ID)
+	if err != nil || upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match", nil)
+		return
+	}
+
+	f, err := os.OpenFile(cfg.tusUploadPath(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload file", err)
+		return
+	}
+	defer f.Close()
+	// drop anything written past the recorded offset by a failed request
+	if err := f.Truncate(upload.Offset); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload file", err)
+		return
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload file", err)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, upload.Length-upload.Offset)
+	n, copyErr := io.Copy(f, body)
+	if err := f.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	upload.Offset += n
+	if err := cfg.db.SetTusUploadOffset(upload.ID, upload.Offset); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload offset", err)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	if upload.Offset == upload.Length {
+		// the client is done as soon as it sees 204, processing goes on
+		// in the background like a batch upload
+		if err := cfg.db.DeleteTusUpload(upload.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't finish upload", err)
+			return
+		}
+		slot := keepUploadSlot(r.Context())
+		go func() {
+			defer slot.release()
+			cfg.ingestTusUpload(upload)
+		}()
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(copyErr, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Body goes past Upload-Length", copyErr)
+		return
+	}
+	if copyErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read body", copyErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	upload, ok := cfg.tusUploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := cfg.videoLocks.lock(upload.ID)
+	defer unlock()
+	if err := cfg.db.DeleteTusUpload(upload.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	os.Remove(cfg.tusUploadPath(upload.ID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ingestTusUpload checks a finished upload against the owner's plan and
+// ingests it, telling the owner if it can't be used.
+func (cfg *apiConfig) ingestTusUpload(upload database.TusUpload) {
+	path := cfg.tusUploadPath(upload.ID)
+	defer os.Remove(path)
+
+	err := cfg.checkAndIngestTusUpload(upload, path)
+	if err == nil {
+		return
+	}
+	log.Printf("tus: couldn't ingest upload %s for video %s: %v", upload.ID, upload.VideoID, err)
+	message := fmt.Sprintf("Your upload of %s couldn't be processed", upload.Filename)
+	var violation uploadViolation
+	if errors.As(err, &violation) {
+		message += ": " + violation.Message
+	}
+	err = cfg.db.CreateNotification(database.CreateNotificationParams{
+		UserID:  upload.UserID,
+		VideoID: &upload.VideoID,
+		Kind:    "upload_failed",
+		Message: message,
+	})
+	if err != nil {
+		log.Printf("tus: couldn't notify about upload %s: %v", upload.ID, err)
+	}
+}
+
+func (cfg *apiConfig) checkAndIngestTusUpload(upload database.TusUpload, path string) error {
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return errVideoDeleted
+	}
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		return err
+	}
+	container, err := videoContainer(path)
+	if err != nil {
+		return err
+	}
+	if violations := checkVideoContainer("", container); len(violations) > 0 {
+		return violations[0]
+	}
+	duration, err := getVideoDuration(context.Background(), path)
+	if err != nil {
+		return fmt.Errorf("couldn't read video duration: %w", err)
+	}
+	if violations := cfg.checkVideoUpload(plan, upload.Filename, "video/mp4", upload.Length, duration); len(violations) > 0 {
+		return violations[0]
+	}
+	_, err = cfg.ingestVideoFile(context.Background(), video, path, "")
+	return err
+}
+
+// removeStaleTusUploads drops uploads nobody has resumed in maxAge.
+func (cfg *apiConfig) removeStaleTusUploads(maxAge time.Duration) {
+	uploads, err := cfg.db.GetStaleTusUploads(cfg.now().Add(-maxAge))
+	if err != nil {
+		log.Printf("tus: couldn't get stale uploads: %v", err)
+		return
+	}
+	for _, upload := range uploads {
+		if err := cfg.db.DeleteTusUpload(upload.ID); err != nil {
+			log.Printf("tus: couldn't delete stale upload %s: %v", upload.ID, err)
+			continue
+		}
+		os.Remove(cfg.tusUploadPath(upload.ID))
+		cfg.abandonUpload(upload.VideoID)
+		log.Printf("tus: removed stale upload %s", upload.ID)
+	}
+}
+
+// parseTusMetadata decodes Upload-Metadata, comma separated pairs of a key
+// and a base64 value. The value may be left out.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
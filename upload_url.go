@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long a remote server gets to send the whole file
+	urlIngestTimeout = 30 * time.Minute
+	// how long it gets to start answering
+	urlIngestHeaderTimeout = 30 * time.Second
+)
+
+var errPrivateAddress = errors.New("refusing to fetch from a private address")
+
+// genericMediaTypes say nothing about the file, so the bytes decide.
+var genericMediaTypes = []string{"", "application/octet-stream", "binary/octet-stream"}
+
+// newIngestClient returns the client remote videos are fetched with. Unless
+// allowPrivate, it won't connect to loopback, private or link-local
+// addresses, redirects included, so a URL can't reach the metadata service
+// or anything else on our network.
+func newIngestClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			ip = ip.Unmap()
+			if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+				return fmt.Errorf("%w %s", errPrivateAddress, ip)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			// a proxy would be dialed instead of the source, dodging the check
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: urlIngestHeaderTimeout,
+		},
+	}
+}
+
+// handlerUploadVideoURL downloads a video from a URL and sends it through
+// the same checks and ingest as a form upload, for moving content over from
+// other platforms. The source's Content-Type and Content-Length are checked
+// before anything is downloaded, and the download is cut off at the plan's
+// size limit when the length isn't given.
+func (cfg *apiConfig) handlerUploadVideoURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL string `json:"url"`
+	}
+
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	source, err := url.Parse(params.URL)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		respondWithError(w, http.StatusBadRequest, "url must be an http or https URL", err)
+		return
+	}
+	plan, err := cfg.db.GetUserPlan(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	if !cfg.uploadQuotaAllowed(w, video.UserID, plan, 0) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), urlIngestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid url", err)
+		return
+	}
+	resp, err := cfg.ingestClient.Do(req)
+	if errors.Is(err, errPrivateAddress) {
+		respondWithError(w, http.StatusBadRequest, "url must point to a public address", err)
+		return
+	}
+	if err != nil {
+		respondWithUploadError(w, http.StatusBadGateway, "Couldn't fetch url", err, uploadRecovery{Retryable: true})
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respondWithUploadError(w, http.StatusBadGateway, fmt.Sprintf("Fetching url returned %s", resp.Status), nil, uploadRecovery{
+			Retryable: resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+		})
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if slices.Contains(genericMediaTypes, contentType) {
+		contentType = ""
+	} else if !slices.Contains(videoMediaTypes, contentType) {
+		respondWithUploadViolations(w, []uploadViolation{{
+			Field:   "content_type",
+			Limit:   videoMediaTypes,
+			Message: fmt.Sprintf("url serves %q, not a supported video", contentType),
+		}}, nil, uploadRecovery{})
+		return
+	}
+	if resp.ContentLength > cfg.maxVideoSize(plan) {
+		respondWithUploadViolations(w, []uploadViolation{cfg.videoSizeViolation(plan, resp.ContentLength)}, nil, uploadRecovery{})
+		return
+	}
+
+	// nil as it isn't our request's body, so there's no connection to close
+	body := http.MaxBytesReader(nil, resp.Body, cfg.maxVideoSize(plan))
+	body, finish := cfg.uploadProgresses.track(video.ID, resp.ContentLength, body)
+	defer finish()
+	cfg.storeVideoUpload(w, r, video, plan, contentType, body, max(resp.ContentLength, 0))
+}
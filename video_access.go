@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoAccess is what a user may do with a video. Each level includes the
+// ones below it.
+type videoAccess int
+
+const (
+	videoAccessNone videoAccess = iota
+	// a viewer collaborator: watch it even while private or before its
+	// premiere
+	videoAccessView
+	// an editor collaborator: upload to it and change its settings
+	videoAccessEdit
+	// the owner: also delete, share or transfer it
+	videoAccessOwner
+)
+
+var videoRoleAccess = map[database.VideoRole]videoAccess{
+	database.VideoRoleViewer: videoAccessView,
+	database.VideoRoleEditor: videoAccessEdit,
+}
+
+// ownerAccess is userID's access to video without looking up collaborators,
+// for listings where only the owner gets more than the public.
+func ownerAccess(video database.Video, userID uuid.UUID) videoAccess {
+	if userID != uuid.Nil && video.UserID == userID {
+		return videoAccessOwner
+	}
+	return videoAccessNone
+}
+
+// videoAccessFor is userID's access to video, as its owner or a
+// collaborator. userID is uuid.Nil for anonymous viewers.
+func (cfg *apiConfig) videoAccessFor(video database.Video, userID uuid.UUID) (videoAccess, error) {
+	if access := ownerAccess(video, userID); access != videoAccessNone || userID == uuid.Nil {
+		return access, nil
+	}
+	role, err := cfg.db.GetVideoRole(video.ID, userID)
+	if err != nil {
+		return videoAccessNone, err
+	}
+	return videoRoleAccess[role], nil
+}
+
+// ownedVideoFromRequest loads the video named in the path and checks that the
+// authenticated user owns it, writing the error response if not.
+func (cfg *apiConfig) ownedVideoFromRequest(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	return cfg.videoFromRequest(w, r, videoAccessOwner)
+}
+
+// videoFromRequest loads the video named in the path and checks that the
+// authenticated user has at least need access to it, writing the error
+// response if not.
+func (cfg *apiConfig) videoFromRequest(w http.ResponseWriter, r *http.Request, need videoAccess) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if !cfg.videoAccessAllowed(w, video, userID, need) {
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+// visibleVideoFromRequest loads the video named in the path for anyone who
+// may see it, signed in or not, writing the error response if they may
+// not.
+func (cfg *apiConfig) visibleVideoFromRequest(w http.ResponseWriter, r *http.Request) (database.Video, videoAccess, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return database.Video{}, videoAccessNone, false
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, videoAccessNone, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, videoAccessNone, false
+	}
+	access, err := cfg.videoAccessFor(video, cfg.optionalUserID(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return database.Video{}, videoAccessNone, false
+	}
+	if videoHidden(video, access) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, videoAccessNone, false
+	}
+	return video, access, true
+}
+
+// videoAccessAllowed checks that userID has at least need access to video,
+// writing the error response if not.
+func (cfg *apiConfig) videoAccessAllowed(w http.ResponseWriter, video database.Video, userID uuid.UUID, need videoAccess) bool {
+	access, err := cfg.videoAccessFor(video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return false
+	}
+	switch {
+	case access >= need:
+		return true
+	case access == videoAccessNone:
+		respondWithError(w, http.StatusForbidden, "You can't access this video", nil)
+	case need == videoAccessOwner:
+		respondWithError(w, http.StatusForbidden, "Only the video's owner can do this", nil)
+	default:
+		respondWithError(w, http.StatusForbidden, "You can't change this video", nil)
+	}
+	return false
+}
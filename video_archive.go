@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxArchiveVideos = 100
+	// selections bigger than this are zipped in the background instead of
+	// holding a request open for the whole download
+	archiveStreamLimit = 2 << 30 // 2GB
+	// background archives stay in the bucket this long
+	archiveExpiry = 24 * time.Hour
+	archivePrefix = "archives"
+)
+
+// archiveVideo is one video going into an archive, and where to read it.
+type archiveVideo struct {
+	video database.Video
+	store objectStore
+	key   string
+	// the file name inside the zip
+	name string
+}
+
+// handlerVideoArchiveCreate zips several of the caller's videos. Small
+// selections are streamed back straight away, read from S3 and written out
+// as they go without compression, since video doesn't compress. Bigger ones
+// are written to S3 in the background: the response is 202 with an archive
+// to poll at GET /api/archives/{archiveID} for an expiring download link.
+// One still pending when the server stops is never finished, and is dropped
+// when it expires.
+func (cfg *apiConfig) handlerVideoArchiveCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoIDs []uuid.UUID `json:"video_ids"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if len(params.VideoIDs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "video_ids is required", nil)
+		return
+	}
+	if len(params.VideoIDs) > maxArchiveVideos {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("An archive can hold at most %d videos", maxArchiveVideos), nil)
+		return
+	}
+
+	videos := []archiveVideo{}
+	seen := map[uuid.UUID]bool{}
+	names := map[string]bool{}
+	var total int64
+	for _, id := range params.VideoIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		video, err := cfg.db.GetVideo(id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if video.ID == uuid.Nil {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("Video %s not found", id), nil)
+			return
+		}
+		access, err := cfg.videoAccessFor(video, userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+			return
+		}
+		// an archive holds the originals, which viewers may not be entitled
+		// to: they could be held back for a premiere or only be served with
+		// the viewer's identity burned in
+		if access < videoAccessEdit {
+			respondWithError(w, http.StatusForbidden, fmt.Sprintf("You can't download video %s", id), nil)
+			return
+		}
+		if video.ArchivedAt != nil {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf("Video %s is archived", id), nil)
+			return
+		}
+		store, key, ok, err := cfg.storeForVideo(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+			return
+		}
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Video %s has no upload", id), nil)
+			return
+		}
+		size := video.VideoSize
+		// sizes weren't recorded for older uploads
+		if size == 0 {
+			head, err := store.client.HeadObject(r.Context(), &s3.HeadObjectInput{
+				Bucket:    aws.String(store.bucket),
+				Key:       aws.String(key),
+				VersionId: video.VideoVersionID,
+			})
+			if err != nil {
+				respondWithError(w, http.StatusBadGateway, "Couldn't check video "+id.String(), err)
+				return
+			}
+			size = aws.ToInt64(head.ContentLength)
+		}
+		total += size
+		videos = append(videos, archiveVideo{
+			video: video,
+			store: store,
+			key:   key,
+			name:  archiveEntryName(video, key, names),
+		})
+	}
+
+	if total <= archiveStreamLimit {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "tubely-videos.zip"}))
+		w.WriteHeader(http.StatusOK)
+		// headers are gone, so all a failure can do is cut the zip short
+		if err := writeVideoArchive(r.Context(), w, videos); err != nil {
+			log.Printf("archive: couldn't stream videos for user %s: %v", userID, err)
+		}
+		return
+	}
+
+	store, err := cfg.storeForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	key, err := joinKey(archivePrefix, uuid.NewString()+".zip")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create object key", err)
+		return
+	}
+	archive, err := cfg.db.CreateVideoArchive(database.CreateVideoArchiveParams{
+		UserID:     userID,
+		Key:        key,
+		VideoCount: len(videos),
+		ExpiresAt:  cfg.now().Add(archiveExpiry),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create archive", err)
+		return
+	}
+	go cfg.buildVideoArchive(archive, store, videos)
+
+	respondWithJSON(w, http.StatusAccepted, archive)
+}
+
+// buildVideoArchive writes the zip to the archive's key, piping it into a
+// multipart upload so it never touches local disk.
+func (cfg *apiConfig) buildVideoArchive(archive database.VideoArchive, store objectStore, videos []archiveVideo) {
+	ctx := context.Background()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeVideoArchive(ctx, pw, videos))
+	}()
+	obj, err := cfg.streamToS3(ctx, store, archive.Key, "application/zip", pr)
+	// unblock the writer if the upload gave up early
+	pr.CloseWithError(err)
+
+	archive.Status = database.VideoArchiveStatusReady
+	archive.Size = obj.Size
+	if err != nil {
+		log.Printf("archive: couldn't build %s: %v", archive.ID, err)
+		archive.Status = database.VideoArchiveStatusFailed
+		archive.Error = "Couldn't build archive"
+	}
+	if err := cfg.db.UpdateVideoArchive(archive); err != nil {
+		log.Printf("archive: couldn't update %s: %v", archive.ID, err)
+	}
+}
+
+// writeVideoArchive streams each video from S3 into a zip on w.
+func writeVideoArchive(ctx context.Context, w io.Writer, videos []archiveVideo) error {
+	zw := zip.NewWriter(w)
+	for _, v := range videos {
+		obj, err := v.store.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:    aws.String(v.store.bucket),
+			Key:       aws.String(v.key),
+			VersionId: v.video.VideoVersionID,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't get video %s: %w", v.video.ID, err)
+		}
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     v.name,
+			Method:   zip.Store,
+			Modified: v.video.UpdatedAt,
+		})
+		if err == nil {
+			_, err = io.Copy(entry, obj.Body)
+		}
+		obj.Body.Close()
+		if err != nil {
+			return fmt.Errorf("couldn't archive video %s: %w", v.video.ID, err)
+		}
+	}
+	return zw.Close()
+}
+
+// archiveEntryName names a video's file in the zip after its title, made
+// safe for file systems and unique among names already used.
+func archiveEntryName(video database.Video, key string, used map[string]bool) string {
+	base := strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\' || r == ':' || unicode.IsControl(r):
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(video.Title))
+	base = strings.Trim(base, ".")
+	if len(base) > 100 {
+		base = strings.ToValidUTF8(base[:100], "")
+	}
+	if base == "" {
+		base = video.ID.String()
+	}
+
+	ext := path.Ext(key)
+	name := base + ext
+	for n := 2; used[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
+
+// handlerVideoArchiveGet reports on a background archive, with a download
+// link that lasts as long as the archive once it's ready.
+func (cfg *apiConfig) handlerVideoArchiveGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.VideoArchive
+		URL *string `json:"url"`
+	}
+
+	archiveID, err := uuid.Parse(r.PathValue("archiveID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid archive ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	archive, err := cfg.db.GetVideoArchive(archiveID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get archive", err)
+		return
+	}
+	// the janitor may not have got to it yet
+	if archive.UserID != userID || cfg.now().After(archive.ExpiresAt) {
+		respondWithError(w, http.StatusNotFound, "Archive not found", nil)
+		return
+	}
+
+	resp := response{VideoArchive: archive}
+	if archive.Status == database.VideoArchiveStatusReady {
+		store, err := cfg.storeForUser(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+			return
+		}
+		url, err := cfg.presignObjectURL(r.Context(), store, presignRequester{
+			Requester: "archive",
+			UserID:    &userID,
+		}, archive.Key, "", archive.ExpiresAt.Sub(cfg.now()))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign archive", err)
+			return
+		}
+		resp.URL = &url
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// dropExpiredVideoArchives deletes archives past their expiry, and their
+// zips.
+func (cfg *apiConfig) dropExpiredVideoArchives(now time.Time) {
+	archives, err := cfg.db.GetExpiredVideoArchives(now)
+	if err != nil {
+		log.Printf("archive: couldn't get expired archives: %v", err)
+		return
+	}
+	for _, archive := range archives {
+		store, err := cfg.storeForUser(archive.UserID)
+		if err != nil {
+			log.Printf("archive: %v", err)
+			continue
+		}
+		// also fine if it was never written
+		deleteStagedObject(store, streamedObject{Key: archive.Key})
+		if err := cfg.db.DeleteVideoArchive(archive.ID); err != nil {
+			log.Printf("archive: couldn't delete expired archive %s: %v", archive.ID, err)
+			continue
+		}
+		log.Printf("archive: dropped expired archive %s", archive.ID)
+	}
+}
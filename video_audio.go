@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/google/uuid"
+)
+
+// audioFormat is a kind of audio-only file a video's sound can be
+// extracted to.
+type audioFormat struct {
+	ext         string
+	contentType string
+}
+
+var audioFormats = map[string]audioFormat{
+	"aac": {ext: ".m4a", contentType: "audio/mp4"},
+	"mp3": {ext: ".mp3", contentType: "audio/mpeg"},
+}
+
+// audioPrefix is where audio extracted from the mp4 at key is stored, next
+// to its other renditions.
+func audioPrefix(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "/audio/"
+}
+
+// audioKey is the key of the mp4 at key's audio in the format, e.g.
+// landscape/<name>/audio/audio.m4a.
+func audioKey(key string, format audioFormat) string {
+	return audioPrefix(key) + "audio" + format.ext
+}
+
+// handlerVideoAudioCreate hands out a presigned URL for the sound of a
+// video's current upload on its own, for listening to talks like podcasts.
+// Like the playback URL, it takes a playback session for the video. The
+// track is extracted the first time each format is asked for and kept with
+// the upload's renditions after that.
+func (cfg *apiConfig) handlerVideoAudioCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Format string `json:"format"`
+	}
+	type response struct {
+		URL         string    `json:"url"`
+		ExpiresAt   time.Time `json:"expires_at"`
+		Format      string    `json:"format"`
+		ContentType string    `json:"content_type"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	session, ok := cfg.playbackSessionFromRequest(w, r, videoID)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	// the body is optional
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Format == "" {
+		params.Format = "aac"
+	}
+	format, ok := audioFormats[params.Format]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "format must be aac or mp3", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	// visibility and collaborators may have changed since the session was
+	// issued
+	access, err := cfg.videoAccessFor(video, session.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if videoHidden(video, access) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if premiereLocked(video, access, cfg.now()) {
+		respondWithError(w, http.StatusForbidden, "This video hasn't premiered yet", nil)
+		return
+	}
+	// the sound alone would get round the viewer's identity burned into the
+	// picture
+	if watermarkRequired(video, access) {
+		respondWithError(w, http.StatusForbidden, "Audio isn't available for watermarked videos", nil)
+		return
+	}
+	if !videoPlayable(w, video) {
+		return
+	}
+	if video.ArchivedAt != nil {
+		respondWithError(w, http.StatusConflict, "Video is archived", nil)
+		return
+	}
+	store, srcKey, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video object", nil)
+		return
+	}
+
+	metadata, err := cfg.db.GetVideoMetadata(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return
+	}
+	// videos uploaded before metadata was kept are tried anyway
+	if metadata.Key == srcKey && metadata.AudioCodec == "" {
+		respondWithError(w, http.StatusUnprocessableEntity, "Video has no sound", nil)
+		return
+	}
+
+	key := audioKey(srcKey, format)
+	if storedRendition(r.Context(), store, key) == nil {
+		if err := cfg.extractAudio(r.Context(), store, video, srcKey, key, format, metadata.AudioCodec); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't extract audio", err)
+			return
+		}
+	}
+
+	expiresAt := cfg.now().UTC().Add(playbackURLExpiry)
+	url, err := cfg.presignObjectURL(r.Context(), store, sessionPresigner(session), key, "", playbackURLExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign audio", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		URL:         url,
+		ExpiresAt:   expiresAt,
+		Format:      params.Format,
+		ContentType: format.contentType,
+	})
+}
+
+// extractAudio stores the first audio stream of the upload at srcKey at key
+// in the format. AAC tracks are copied into an m4a as they are; anything
+// else is encoded. ffmpeg reads the source over a presigned URL, so only
+// the output touches the spool.
+func (cfg *apiConfig) extractAudio(ctx context.Context, store objectStore, video database.Video, srcKey, key string, format audioFormat, codec string) error {
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(uploadDir)
+	outputPath := filepath.Join(uploadDir, "audio"+format.ext)
+
+	srcURL, err := cfg.presignObjectURL(ctx, store, jobPresigner("audio", &video.ID), srcKey, aws.ToString(video.VideoVersionID), probeURLExpiry)
+	if err != nil {
+		return err
+	}
+	cmd := ffmpeg.FFmpeg().
+		Input(srcURL).
+		Option("-map", "0:a:0")
+	switch {
+	case format.ext == ".mp3":
+		cmd = cmd.
+			Option("-c:a", "libmp3lame").
+			Option("-q:a", "2").
+			Option("-f", "mp3")
+	case codec == "aac":
+		cmd = cmd.
+			Option("-c:a", "copy").
+			Option("-movflags", "+faststart").
+			Option("-f", "mp4")
+	default:
+		cmd = cmd.
+			Option("-c:a", "aac").
+			Option("-movflags", "+faststart").
+			Option("-f", "mp4")
+	}
+	if _, err := cmd.Output(outputPath).Run(ctx); err != nil {
+		return fmt.Errorf("couldn't extract audio: %w", err)
+	}
+
+	return cfg.uploadFileToS3(ctx, store, key, format.contentType, outputPath)
+}
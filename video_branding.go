@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/google/uuid"
+)
+
+// brandingPositions are the corners a branding image can sit in, as
+// overlay's x and y, kept 2% of the way in from the edges.
+var brandingPositions = map[string][2]string{
+	"top-left":     {"W*0.02", "H*0.02"},
+	"top-right":    {"W-w-W*0.02", "H*0.02"},
+	"bottom-left":  {"W*0.02", "H-h-H*0.02"},
+	"bottom-right": {"W-w-W*0.02", "H-h-H*0.02"},
+}
+
+const (
+	defaultBrandingPosition = "bottom-right"
+	// branding images are scaled to a tenth of the video's height, so they
+	// look the same on every rendition
+	brandingScale = "0.1"
+)
+
+// branding is an image composited onto uploads before they're stored.
+type branding struct {
+	imagePath string
+	position  string
+}
+
+func validBrandingPosition(position string) bool {
+	_, ok := brandingPositions[position]
+	return ok
+}
+
+// brandingFor is the branding the user's uploads get: their channel's, or
+// else the deployment's. It's nil for none.
+func (cfg *apiConfig) brandingFor(userID uuid.UUID) (*branding, error) {
+	channel, err := cfg.db.GetChannel(userID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get channel: %w", err)
+	}
+	if channel.BrandingURL == nil {
+		return cfg.branding, nil
+	}
+	assetPath, ok := strings.CutPrefix(*channel.BrandingURL, cfg.getAssetURL(""))
+	if !ok {
+		return nil, fmt.Errorf("branding %s isn't an asset", *channel.BrandingURL)
+	}
+	imagePath, err := cfg.getAssetDiskPath(assetPath)
+	if err != nil {
+		return nil, err
+	}
+	return &branding{imagePath: imagePath, position: channel.BrandingPosition}, nil
+}
+
+// brandStage composites the owner's branding onto the upload. The result
+// isn't the file that was uploaded any more, so it's kept from being reused
+// for other uploads of that file.
+func (cfg *apiConfig) brandStage(ctx context.Context, in *videoIngest) error {
+	b, err := cfg.brandingFor(in.video.UserID)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return nil
+	}
+	log.Printf("adding branding to video %s", in.video.ID)
+	branded, err := overlayBranding(ctx, in.filePath, *b)
+	if err != nil {
+		return fmt.Errorf("couldn't add branding: %w", err)
+	}
+	in.filePath = branded
+	in.temp = append(in.temp, branded)
+	in.uploadSHA256 = ""
+	return nil
+}
+
+// overlayBranding scales the branding image to the video and draws it over
+// every frame in its corner, re-encoding the picture and copying the sound.
+func overlayBranding(ctx context.Context, inputFilePath string, b branding) (string, error) {
+	outputFilePath := fmt.Sprintf("%s.branded", inputFilePath)
+
+	position, ok := brandingPositions[b.position]
+	if !ok {
+		position = brandingPositions[defaultBrandingPosition]
+	}
+	filter := fmt.Sprintf(
+		"[1:v][0:v]scale2ref=w=oh*mdar:h=ih*%s[logo][video];[video][logo]overlay=%s:%s,format=yuv420p[v]",
+		brandingScale, position[0], position[1],
+	)
+	_, err := ffmpeg.FFmpeg().
+		Input(inputFilePath).
+		Input(b.imagePath).
+		Option("-filter_complex", filter).
+		Option("-map", "[v]").
+		Option("-map", "0:a?").
+		Option("-c:v", "libx264").
+		Option("-preset", "veryfast").
+		Option("-crf", "23").
+		Option("-c:a", "copy").
+		Option("-movflags", "+faststart").
+		Option("-f", "mp4").
+		Output(outputFilePath).
+		Run(ctx)
+	if err != nil {
+		os.Remove(outputFilePath)
+		return "", fmt.Errorf("error adding branding: %w", err)
+	}
+
+	fileInfo, err := os.Stat(outputFilePath)
+	if err != nil {
+		return "", fmt.Errorf("could not stat branded file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(outputFilePath)
+		return "", fmt.Errorf("branded file is empty")
+	}
+
+	return outputFilePath, nil
+}
+
+// handlerChannelBrandingUpload sets the image composited onto the user's
+// uploads from now on, and its corner, in place of the deployment's.
+func (cfg *apiConfig) handlerChannelBrandingUpload(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	const maxMemory = 10 << 20 // 10MB using bit shifting
+	r.Body = http.MaxBytesReader(w, r.Body, maxMemory)
+	r.ParseMultipartForm(maxMemory)
+
+	position := r.FormValue("position")
+	if position == "" {
+		position = defaultBrandingPosition
+	}
+	if !validBrandingPosition(position) {
+		respondWithError(w, http.StatusBadRequest, "position must be top-left, top-right, bottom-left or bottom-right", nil)
+		return
+	}
+
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+		return
+	}
+	// PNGs can be transparent around the logo
+	if mediaType != "image/png" && mediaType != "image/jpeg" {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+		return
+	}
+
+	brandingFile, err := os.CreateTemp(cfg.assetsRoot, ".branding-*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create branding file", err)
+		return
+	}
+	defer os.Remove(brandingFile.Name())
+	defer brandingFile.Close()
+
+	if _, err := io.Copy(brandingFile, file); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write branding file", err)
+		return
+	}
+	if err := brandingFile.Close(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write branding file", err)
+		return
+	}
+	assetPath, err := cfg.saveAssetFile(brandingFile.Name(), mediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save branding file", err)
+		return
+	}
+
+	channel, err := cfg.db.GetChannel(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get channel", err)
+		return
+	}
+	brandingURL := cfg.getAssetURL(assetPath)
+	channel.BrandingURL = &brandingURL
+	channel.BrandingPosition = position
+
+	channel, err = cfg.db.UpsertChannel(channel)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update channel", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, channel)
+}
+
+// handlerChannelBrandingDelete puts the user's uploads back on the
+// deployment's branding. Videos already processed keep theirs.
+func (cfg *apiConfig) handlerChannelBrandingDelete(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	channel, err := cfg.db.GetChannel(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get channel", err)
+		return
+	}
+	channel.BrandingURL = nil
+	channel.BrandingPosition = ""
+
+	channel, err = cfg.db.UpsertChannel(channel)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update channel", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, channel)
+}
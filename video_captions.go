@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/captions"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	maxCaptionSize   = 2 << 20 // 2MB
+	maxCaptionLabel  = 100
+	captionPrefix    = "captions"
+	captionMediaType = "text/vtt"
+)
+
+// a BCP 47 language tag as players take them: a two or three letter
+// language with optional subtags, e.g. "en", "pt-BR" or "zh-Hant"
+var captionLanguage = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// handlerVideoCaptionUpload sets the video's caption track in the language
+// in the path from an SRT or WebVTT file in the captions form field. SRT is
+// converted, so every stored track is WebVTT. An optional label form field
+// names the track in players' menus.
+func (cfg *apiConfig) handlerVideoCaptionUpload(w http.ResponseWriter, r *http.Request) {
+	language := r.PathValue("language")
+	if !captionLanguage.MatchString(language) {
+		respondWithError(w, http.StatusBadRequest, "Language must be a language tag like en or pt-BR", nil)
+		return
+	}
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptionSize)
+	r.ParseMultipartForm(maxCaptionSize)
+
+	label := r.FormValue("label")
+	if label == "" {
+		label = language
+	}
+	if len(label) > maxCaptionLabel {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Label must be at most %d characters", maxCaptionLabel), nil)
+		return
+	}
+
+	file, _, err := r.FormFile("captions")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read captions", err)
+		return
+	}
+	vtt, err := captions.ToWebVTT(data)
+	if errors.Is(err, captions.ErrEmpty) {
+		respondWithError(w, http.StatusBadRequest, "Captions file has no cues", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Captions must be SRT or WebVTT", err)
+		return
+	}
+
+	store, err := cfg.storeForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	key, err := joinKey(captionPrefix, video.ID.String(), language+".vtt")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid language", err)
+		return
+	}
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload directory", err)
+		return
+	}
+	defer os.RemoveAll(uploadDir)
+	vttPath := filepath.Join(uploadDir, "captions.vtt")
+	if err := os.WriteFile(vttPath, vtt, 0o644); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write captions", err)
+		return
+	}
+	if err := cfg.uploadFileToS3(r.Context(), store, key, captionMediaType, vttPath); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't upload captions to S3", err)
+		return
+	}
+
+	previous, err := cfg.db.GetVideoCaption(video.ID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	caption, err := cfg.db.SaveVideoCaption(database.VideoCaption{
+		VideoID:  video.ID,
+		Language: language,
+		Label:    label,
+		Key:      key,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save captions", err)
+		return
+	}
+	// a generated track this replaces is kept under a key of its own
+	if previous.Key != "" && previous.Key != key {
+		_, err = store.client.DeleteObject(r.Context(), &s3.DeleteObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(previous.Key),
+		})
+		if err != nil {
+			log.Printf("Couldn't delete captions %s: %v", previous.Key, err)
+		}
+	}
+	respondWithJSON(w, http.StatusOK, caption)
+}
+
+// handlerVideoCaptionsRetrieve lists the video's caption tracks for anyone
+// who can see it. The tracks themselves come with a playback URL.
+func (cfg *apiConfig) handlerVideoCaptionsRetrieve(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := cfg.visibleVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+	tracks, err := cfg.db.GetVideoCaptions(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, tracks)
+}
+
+func (cfg *apiConfig) handlerVideoCaptionDelete(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoFromRequest(w, r, videoAccessEdit)
+	if !ok {
+		return
+	}
+	caption, err := cfg.db.GetVideoCaption(video.ID, r.PathValue("language"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	if caption.Key == "" {
+		respondWithError(w, http.StatusNotFound, "Video has no captions in that language", nil)
+		return
+	}
+	store, err := cfg.storeForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	if err := cfg.db.DeleteVideoCaption(video.ID, caption.Language); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete captions", err)
+		return
+	}
+	_, err = store.client.DeleteObject(r.Context(), &s3.DeleteObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(caption.Key),
+	})
+	if err != nil {
+		log.Printf("Couldn't delete captions %s: %v", caption.Key, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type playbackCaption struct {
+	Language string `json:"language"`
+	Label    string `json:"label"`
+	URL      string `json:"url"`
+}
+
+// playbackCaptions presigns the video's caption tracks, which expire with
+// its playback URL.
+func (cfg *apiConfig) playbackCaptions(ctx context.Context, presigner presignRequester, video database.Video) ([]playbackCaption, error) {
+	tracks, err := cfg.db.GetVideoCaptions(video.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, nil
+	}
+	store, err := cfg.storeForUser(video.UserID)
+	if err != nil {
+		return nil, err
+	}
+	playback := []playbackCaption{}
+	for _, track := range tracks {
+		url, err := cfg.presignObjectURL(ctx, store, presigner, track.Key, "", playbackURLExpiry)
+		if err != nil {
+			return nil, err
+		}
+		playback = append(playback, playbackCaption{
+			Language: track.Language,
+			Label:    track.Label,
+			URL:      url,
+		})
+	}
+	return playback, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+	"github.com/google/uuid"
+)
+
+// clips shorter than this are most likely a mistake in the timestamps
+const minClipSeconds = 0.5
+
+// handlerVideoClipCreate cuts the stretch of the video's upload between
+// start and end, in seconds, into a video of its own that points back at
+// it. The clip is re-encoded so it starts on the frame asked for rather
+// than the keyframe before, and then processed like any other upload.
+func (cfg *apiConfig) handlerVideoClipCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Start *float64 `json:"start"`
+		End   *float64 `json:"end"`
+		// the new video's title, "<title> (clip)" if empty
+		Title string `json:"title"`
+	}
+
+	source, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Start == nil || params.End == nil {
+		respondWithError(w, http.StatusBadRequest, "start and end are required", nil)
+		return
+	}
+	start, end := *params.Start, *params.End
+	if start < 0 || end-start < minClipSeconds {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("end must be at least %g seconds after start, which can't be negative", minClipSeconds), nil)
+		return
+	}
+	if source.Duration != nil && end > *source.Duration {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("end is past the end of the video, at %.3f seconds", *source.Duration), nil)
+		return
+	}
+	if !videoPlayable(w, source) {
+		return
+	}
+	if source.ArchivedAt != nil {
+		respondWithError(w, http.StatusConflict, "Video is archived", nil)
+		return
+	}
+	store, key, ok, err := cfg.storeForVideo(source)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video object", nil)
+		return
+	}
+
+	plan, err := cfg.db.GetUserPlan(source.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+		return
+	}
+	err = cfg.checkUploadQuota(source.UserID, plan, uploadUsage{Uploads: 1}, cfg.now())
+	var exceeded limits.Exceeded
+	if errors.As(err, &exceeded) {
+		cfg.respondWithLimit(w, exceeded, nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check upload quota", err)
+		return
+	}
+
+	workDir, err := cfg.newUploadDir()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create working directory", err)
+		return
+	}
+	defer os.RemoveAll(workDir)
+	clipPath := filepath.Join(workDir, "clip.mp4")
+	if err := cfg.cutClip(r.Context(), store, source, key, start, end, clipPath); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't cut clip", err)
+		return
+	}
+	// a clip is stored like an upload of it, so it counts the same
+	err = cfg.checkIngestFile(r.Context(), source.UserID, clipPath)
+	var violation uploadViolation
+	if errors.As(err, &violation) && violation.Exceeded != nil {
+		err = *violation.Exceeded
+	}
+	if errors.As(err, &exceeded) {
+		cfg.respondWithLimit(w, exceeded, nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check clip against plan", err)
+		return
+	}
+
+	title := params.Title
+	if title == "" {
+		title = source.Title + " (clip)"
+	}
+	clip, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       title,
+		Description: source.Description,
+		UserID:      source.UserID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
+		return
+	}
+	clip, err = cfg.updateVideo(clip.ID, func(video *database.Video) {
+		video.ParentVideoID = &source.ID
+		video.ClipStart = &start
+		video.ClipEnd = &end
+	})
+	if err != nil {
+		cfg.dropClip(clip.ID)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't link clip to video", err)
+		return
+	}
+
+	clip, err = cfg.ingestVideoFile(r.Context(), clip, clipPath, "")
+	if errors.Is(err, errPublishQueued) {
+		respondWithPublishQueued(w)
+		return
+	}
+	if err != nil {
+		cfg.dropClip(clip.ID)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't process clip", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, clip)
+}
+
+// dropClip deletes the record of a clip that couldn't be made, so it isn't
+// left behind as a video stuck uploading.
+func (cfg *apiConfig) dropClip(id uuid.UUID) {
+	if err := cfg.db.DeleteVideo(id); err != nil {
+		log.Printf("Couldn't delete failed clip %s: %v", id, err)
+	}
+}
+
+// handlerVideoClipsRetrieve lists the clips cut from the video, newest
+// first.
+func (cfg *apiConfig) handlerVideoClipsRetrieve(w http.ResponseWriter, r *http.Request) {
+	source, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+	clips, err := cfg.db.GetVideoClips(source.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve clips", err)
+		return
+	}
+	for i := range clips {
+		clips[i] = cfg.withSignedThumbnail(clips[i])
+	}
+	respondWithJSON(w, http.StatusOK, clips)
+}
+
+// cutClip writes the stretch of the upload at key between start and end to
+// outputPath as an mp4. ffmpeg seeks over a presigned URL, so only the part
+// of the source it needs is fetched.
+func (cfg *apiConfig) cutClip(ctx context.Context, store objectStore, video database.Video, key string, start, end float64, outputPath string) error {
+	srcURL, err := cfg.presignObjectURL(ctx, store, jobPresigner("clip", &video.ID), key, aws.ToString(video.VideoVersionID), probeURLExpiry)
+	if err != nil {
+		return err
+	}
+	_, err = ffmpeg.FFmpeg().
+		Option("-ss", strconv.FormatFloat(start, 'f', 3, 64)).
+		Input(srcURL).
+		Option("-t", strconv.FormatFloat(end-start, 'f', 3, 64)).
+		Option("-c:v", "libx264").
+		Option("-preset", "veryfast").
+		Option("-crf", "23").
+		Option("-vf", "format=yuv420p").
+		Option("-c:a", "aac").
+		Option("-movflags", "+faststart").
+		Option("-f", "mp4").
+		Output(outputPath).
+		Run(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't cut clip: %w", err)
+	}
+	return nil
+}
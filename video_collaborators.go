@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+	"github.com/google/uuid"
+)
+
+// collaboratorFromEmail looks up the user a video is being shared with or
+// handed to, writing the error response if there's no such user or it's the
+// owner themself.
+func (cfg *apiConfig) collaboratorFromEmail(w http.ResponseWriter, video database.Video, email string) (database.User, bool) {
+	if email == "" {
+		respondWithError(w, http.StatusBadRequest, "email is required", nil)
+		return database.User{}, false
+	}
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return database.User{}, false
+	}
+	if user.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "No user with that email", nil)
+		return database.User{}, false
+	}
+	if user.ID == video.UserID {
+		respondWithError(w, http.StatusBadRequest, "That user already owns the video", nil)
+		return database.User{}, false
+	}
+	return user, true
+}
+
+// handlerVideoCollaboratorSet shares a video with another user as a viewer
+// or editor, or changes the role of one it's already shared with.
+func (cfg *apiConfig) handlerVideoCollaboratorSet(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string             `json:"email"`
+		Role  database.VideoRole `json:"role"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if _, ok := videoRoleAccess[params.Role]; !ok {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("role must be %q or %q", database.VideoRoleViewer, database.VideoRoleEditor), nil)
+		return
+	}
+
+	user, ok := cfg.collaboratorFromEmail(w, video, params.Email)
+	if !ok {
+		return
+	}
+	err = cfg.db.SetVideoCollaborator(video.ID, user.ID, params.Role)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't add collaborator", err)
+		return
+	}
+
+	collaborators, err := cfg.db.GetVideoCollaborators(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get collaborators", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, collaborators)
+}
+
+func (cfg *apiConfig) handlerVideoCollaboratorsRetrieve(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.videoFromRequest(w, r, videoAccessView)
+	if !ok {
+		return
+	}
+
+	collaborators, err := cfg.db.GetVideoCollaborators(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get collaborators", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, collaborators)
+}
+
+// handlerVideoCollaboratorDelete stops sharing a video with a user. The
+// owner can remove anyone; a collaborator can only leave.
+func (cfg *apiConfig) handlerVideoCollaboratorDelete(w http.ResponseWriter, r *http.Request) {
+	collaboratorID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	need := videoAccessOwner
+	if collaboratorID == userID {
+		need = videoAccessView
+	}
+	video, ok := cfg.videoFromRequest(w, r, need)
+	if !ok {
+		return
+	}
+
+	err = cfg.db.DeleteVideoCollaborator(video.ID, collaboratorID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove collaborator", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerVideoTransfer hands a video over to another user, who gets a
+// notification. With keep_access the previous owner stays on as an editor.
+// The upload has to fit in the new owner's storage quota, and a video kept
+// in the owner's own bucket can't be moved since the new owner couldn't
+// reach it.
+func (cfg *apiConfig) handlerVideoTransfer(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email      string `json:"email"`
+		KeepAccess bool   `json:"keep_access"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	newOwner, ok := cfg.collaboratorFromEmail(w, video, params.Email)
+	if !ok {
+		return
+	}
+
+	store, _, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video storage", err)
+		return
+	}
+	if ok && store.bucket != cfg.defaultStore().bucket {
+		respondWithError(w, http.StatusConflict, "Videos stored in your own bucket can't be transferred", nil)
+		return
+	}
+
+	if video.VideoURL != nil {
+		plan, err := cfg.db.GetUserPlan(newOwner.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get plan", err)
+			return
+		}
+		err = cfg.checkStorageQuota(newOwner.ID, plan, video.VideoSize)
+		var exceeded limits.Exceeded
+		if errors.As(err, &exceeded) {
+			cfg.respondWithLimit(w, exceeded, nil)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+			return
+		}
+	}
+
+	var previousOwnerRole database.VideoRole
+	if params.KeepAccess {
+		previousOwnerRole = database.VideoRoleEditor
+	}
+	err = cfg.db.TransferVideo(video.ID, newOwner.ID, previousOwnerRole)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't transfer video", err)
+		return
+	}
+
+	err = cfg.db.CreateNotification(database.CreateNotificationParams{
+		UserID:  newOwner.ID,
+		VideoID: &video.ID,
+		Kind:    "video_transferred",
+		Message: fmt.Sprintf("%q has been transferred to you", video.Title),
+	})
+	if err != nil {
+		log.Printf("Couldn't notify %s of transferred video %s: %v", newOwner.ID, video.ID, err)
+	}
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video)
+}
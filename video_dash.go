@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+const dashManifest = "manifest.mpd"
+
+// dashPrefix is where the DASH rendition of the mp4 at key is stored, next
+// to its HLS rendition.
+func dashPrefix(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "/dash/"
+}
+
+func dashManifestKey(key string) string {
+	return dashPrefix(key) + dashManifest
+}
+
+// dashStage cuts the stored mp4 into DASH segments and stores them with
+// their manifest under dashPrefix, for persist to record the manifest on
+// the video.
+func (cfg *apiConfig) dashStage(ctx context.Context, in *videoIngest) error {
+	if !cfg.dashEnabled {
+		return nil
+	}
+	dir, err := cfg.newUploadDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := segmentDASH(ctx, in.filePath, dir); err != nil {
+		return fmt.Errorf("couldn't segment video for DASH: %w", err)
+	}
+
+	prefix := dashPrefix(in.key)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		contentType := "video/iso.segment"
+		switch path.Ext(entry.Name()) {
+		case ".mpd":
+			contentType = "application/dash+xml"
+		case ".mp4":
+			contentType = "video/mp4"
+		}
+		err := cfg.uploadFileToS3(ctx, in.store, prefix+entry.Name(), contentType, filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errStorageUpload, err)
+		}
+	}
+	manifest := dashManifestKey(in.key)
+	in.stored.dashManifest = &manifest
+	return nil
+}
+
+// segmentDASH encodes the video at filePath into fragmented H.264 and AAC
+// segments in dir, one initialization segment per stream, with the
+// manifest. Segments are as long as HLS ones, so one keyframe cadence
+// serves both.
+func segmentDASH(ctx context.Context, filePath, dir string) error {
+	_, err := ffmpeg.FFmpeg().
+		Input(filePath).
+		Option("-c:v", "libx264").
+		Option("-preset", "veryfast").
+		Option("-crf", "23").
+		Option("-vf", "format=yuv420p").
+		Option("-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds)).
+		Option("-c:a", "aac").
+		Option("-f", "dash").
+		Option("-seg_duration", fmt.Sprint(hlsSegmentSeconds)).
+		Option("-use_template", "1").
+		Option("-use_timeline", "1").
+		Option("-init_seg_name", "init_$RepresentationID$.mp4").
+		Option("-media_seg_name", "segment_$RepresentationID$_$Number%05d$.m4s").
+		Output(filepath.Join(dir, dashManifest)).
+		Run(ctx)
+	return err
+}
+
+// storedDASHManifest returns the manifest key of the DASH rendition stored
+// for the mp4 at key, or nil if it doesn't have one.
+func (cfg *apiConfig) storedDASHManifest(ctx context.Context, store objectStore, key string) *string {
+	if !cfg.dashEnabled {
+		return nil
+	}
+	return storedRendition(ctx, store, dashManifestKey(key))
+}
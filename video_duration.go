@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+// getVideoDuration returns the container duration in seconds. input can be a
+// local path or an http(s) URL; for fast start files ffprobe only needs the
+// first few range reads.
+func getVideoDuration(ctx context.Context, input string) (float64, error) {
+	stdout, err := ffmpeg.FFprobe().
+		Option("-v", "error").
+		Option("-print_format", "json").
+		Option("-show_entries", "format=duration").
+		Input(input).
+		Run(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var output struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(stdout, &output); err != nil {
+		return 0, fmt.Errorf("json unmarshal error: %v, output: %s", err, stdout)
+	}
+
+	duration, err := strconv.ParseFloat(output.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %w", output.Format.Duration, err)
+	}
+	return duration, nil
+}
+
+func formatDuration(seconds float64) string {
+	total := int(seconds + 0.5)
+	h, m, s := total/3600, total/60%60, total%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+const (
+	// segment length players fetch at a time; keyframes are forced on it so
+	// every segment starts cleanly
+	hlsSegmentSeconds = 6
+	hlsMasterPlaylist = "master.m3u8"
+	hlsStreamPlaylist = "stream.m3u8"
+)
+
+// hlsPrefix is where the HLS rendition of the mp4 at key is stored: next to
+// it, under the key without its extension.
+func hlsPrefix(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "/hls/"
+}
+
+func hlsMasterKey(key string) string {
+	return hlsPrefix(key) + hlsMasterPlaylist
+}
+
+// hlsStage cuts the stored mp4 into HLS segments and stores them with their
+// playlists under hlsPrefix, for persist to record the master playlist on
+// the video.
+func (cfg *apiConfig) hlsStage(ctx context.Context, in *videoIngest) error {
+	if !cfg.hlsEnabled {
+		return nil
+	}
+	dir, err := cfg.newUploadDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := segmentHLS(ctx, in.filePath, dir); err != nil {
+		return fmt.Errorf("couldn't segment video for HLS: %w", err)
+	}
+	if err := writeHLSMaster(ctx, in.filePath, dir); err != nil {
+		return fmt.Errorf("couldn't write HLS master playlist: %w", err)
+	}
+
+	prefix := hlsPrefix(in.key)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		contentType := "video/mp2t"
+		if path.Ext(entry.Name()) == ".m3u8" {
+			contentType = "application/vnd.apple.mpegurl"
+		}
+		err := cfg.uploadFileToS3(ctx, in.store, prefix+entry.Name(), contentType, filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errStorageUpload, err)
+		}
+	}
+	master := hlsMasterKey(in.key)
+	in.stored.hlsMaster = &master
+	return nil
+}
+
+// segmentHLS encodes the video at filePath into H.264 and AAC segments in
+// dir, with the stream's media playlist.
+func segmentHLS(ctx context.Context, filePath, dir string) error {
+	_, err := ffmpeg.FFmpeg().
+		Input(filePath).
+		Option("-c:v", "libx264").
+		Option("-preset", "veryfast").
+		Option("-crf", "23").
+		Option("-vf", "format=yuv420p").
+		Option("-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds)).
+		Option("-c:a", "aac").
+		Option("-f", "hls").
+		Option("-hls_time", fmt.Sprint(hlsSegmentSeconds)).
+		Option("-hls_playlist_type", "vod").
+		Option("-hls_segment_filename", filepath.Join(dir, "segment_%05d.ts")).
+		Output(filepath.Join(dir, hlsStreamPlaylist)).
+		Run(ctx)
+	return err
+}
+
+// writeHLSMaster writes the master playlist for the stream in dir. Its
+// bandwidth is the peak players should expect, estimated from the size of
+// the segments over the length of the video.
+func writeHLSMaster(ctx context.Context, filePath, dir string) error {
+	width, height, err := getVideoDimensions(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	duration, err := getVideoDuration(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+	}
+	bandwidth := int64(1)
+	if duration > 0 {
+		bandwidth = max(1, int64(float64(size*8)/duration))
+	}
+
+	master := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s\n",
+		bandwidth, width, height, hlsStreamPlaylist)
+	return os.WriteFile(filepath.Join(dir, hlsMasterPlaylist), []byte(master), 0o644)
+}
+
+// storedHLSMaster returns the master playlist key of the HLS rendition
+// stored for the mp4 at key, or nil if it doesn't have one.
+func (cfg *apiConfig) storedHLSMaster(ctx context.Context, store objectStore, key string) *string {
+	if !cfg.hlsEnabled {
+		return nil
+	}
+	return storedRendition(ctx, store, hlsMasterKey(key))
+}
+
+// storedRendition returns entry, the playlist or manifest of a rendition, if
+// it's in the store.
+func storedRendition(ctx context.Context, store objectStore, entry string) *string {
+	_, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(entry),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if !errors.As(err, &notFound) {
+			log.Printf("Couldn't check for rendition %s: %v", entry, err)
+		}
+		return nil
+	}
+	return &entry
+}
+
+// dropRenditions deletes the resolution ladder, the HLS and DASH renditions,
+// the storyboard and any extracted audio stored for the mp4 at key.
+func dropRenditions(ctx context.Context, store objectStore, key string) {
+	for _, prefix := range []string{ladderPrefix(key), hlsPrefix(key), dashPrefix(key), storyboardPrefix(key), audioPrefix(key)} {
+		objects, err := listStagedObjects(ctx, store, prefix)
+		if err != nil {
+			log.Printf("Couldn't list rendition %s: %v", prefix, err)
+			continue
+		}
+		for _, obj := range objects {
+			_, err := store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(store.bucket),
+				Key:    aws.String(obj.Key),
+			})
+			if err != nil {
+				log.Printf("Couldn't delete %s: %v", obj.Key, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// errStorageUpload marks ingest failures on the S3 side, which are worth
+// retrying, as opposed to problems with the file itself.
+var errStorageUpload = errors.New("couldn't upload file to S3")
+
+// ingestNewVideoFile creates a video record for a file dropped in by one of
+// the non-HTTP ingest paths and runs it through ingestVideoFile. The title is
+// taken from the file name.
+func (cfg *apiConfig) ingestNewVideoFile(ctx context.Context, userID uuid.UUID, filePath string) (database.Video, error) {
+	if err := cfg.checkIngestFile(ctx, userID, filePath); err != nil {
+		return database.Video{}, err
+	}
+
+	title := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:  title,
+		UserID: userID,
+	})
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't create video: %w", err)
+	}
+
+	return cfg.ingestVideoFile(ctx, video, filePath, "")
+}
+
+// checkIngestFile holds a local file about to become one of userID's videos
+// to what an HTTP upload of it would have to pass: a known container, the
+// plan's size and duration limits, and the upload caps and storage quota.
+func (cfg *apiConfig) checkIngestFile(ctx context.Context, userID uuid.UUID, filePath string) error {
+	container, err := videoContainer(filePath)
+	if err != nil {
+		return err
+	}
+	if container == "" {
+		return errors.New("unsupported video format")
+	}
+
+	plan, err := cfg.db.GetUserPlan(userID)
+	if err != nil {
+		return fmt.Errorf("couldn't get plan: %w", err)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.Size() > cfg.maxVideoSize(plan) {
+		return cfg.videoSizeViolation(plan, info.Size())
+	}
+	probe, err := probeVideo(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	if probe.Duration > float64(plan.MaxVideoDuration) {
+		return cfg.videoDurationViolation(plan, probe.Duration)
+	}
+	return cfg.checkUploadQuota(userID, plan, uploadUsage{Uploads: 1, Bytes: info.Size()}, cfg.now())
+}
+
+// ingestVideoFile runs a local video through ingestPipeline, ending with the
+// video record pointed at its object in S3.
+// uploadSHA256 is the checksum of the file as received, if the caller hashed
+// it.
+func (cfg *apiConfig) ingestVideoFile(ctx context.Context, video database.Video, filePath, uploadSHA256 string) (database.Video, error) {
+	in := &videoIngest{
+		video:        video,
+		filePath:     filePath,
+		uploadSHA256: uploadSHA256,
+	}
+	defer in.removeTemp()
+	in.video.Status = cfg.setVideoStatus(video.ID, database.VideoStatusProcessing)
+	err := cfg.runIngest(ctx, cfg.ingestPipeline(), in)
+	return in.video, err
+}
+
+// findDuplicateUpload looks for an object in store made from a
+// byte-identical upload. Processing is deterministic, so the existing object
+// is what this upload would become. Lookup failures just mean the file is
+// stored again.
+func (cfg *apiConfig) findDuplicateUpload(ctx context.Context, store objectStore, uploadSHA256 string) (string, *s3.HeadObjectOutput, bool) {
+	if uploadSHA256 == "" {
+		return "", nil, false
+	}
+	existing, err := cfg.db.GetVideoByUploadSHA256(uploadSHA256)
+	if err != nil {
+		log.Printf("Couldn't look up duplicate uploads: %v", err)
+		return "", nil, false
+	}
+	if existing.ID == uuid.Nil {
+		return "", nil, false
+	}
+	key, ok := store.keyFromURL(aws.ToString(existing.VideoURL))
+	if !ok {
+		return "", nil, false
+	}
+	// make sure it wasn't removed behind our back
+	head, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(store.bucket),
+		Key:       aws.String(key),
+		VersionId: existing.VideoVersionID,
+	})
+	if err != nil {
+		log.Printf("Duplicate upload object %s is gone: %v", key, err)
+		return "", nil, false
+	}
+	return key, head, true
+}
+
+// storedObject is what S3 told us about an object a video is pointed at.
+type storedObject struct {
+	versionID *string
+	etag      *string
+	size      int64
+	// master playlist of the HLS rendition stored next to it, if any
+	hlsMaster *string
+	// manifest of the DASH rendition stored next to it, if any
+	dashManifest *string
+	// WebVTT index of its storyboard, if any
+	storyboard *string
+	// its resolution ladder, if one was made
+	renditions []database.VideoRendition
+	// what ffprobe read of it, nil when it wasn't probed
+	metadata *database.VideoMetadata
+}
+
+func headObject(head *s3.HeadObjectOutput) storedObject {
+	return storedObject{
+		versionID: head.VersionId,
+		etag:      head.ETag,
+		size:      aws.ToInt64(head.ContentLength),
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+// ladderPrefix is where the resolution ladder of the mp4 at key is stored,
+// next to its HLS and DASH renditions.
+func ladderPrefix(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "/renditions/"
+}
+
+func ladderName(height int) string {
+	return fmt.Sprintf("%dp", height)
+}
+
+// ladderKey is the key of the rung of the mp4 at key with the given height,
+// e.g. landscape/<name>/renditions/720p.mp4.
+func ladderKey(key string, height int) string {
+	return ladderPrefix(key) + ladderName(height) + ".mp4"
+}
+
+// ladderMaxRate caps a rung's bitrate at 3 bits a pixel each second, around
+// 6Mbps for 1080p and 1.2Mbps for 480p, so each rung suits a real step down
+// in bandwidth.
+func ladderMaxRate(width, height int) int {
+	return width * height * 3
+}
+
+// ladderStage encodes the stored mp4 at each height of cfg.ladder no taller
+// than it, up to the plan's max_renditions of them tallest first, and stores
+// the results under ladderPrefix, for persist to record as the video's
+// renditions.
+func (cfg *apiConfig) ladderStage(ctx context.Context, in *videoIngest) error {
+	if len(cfg.ladder) == 0 {
+		return nil
+	}
+	probe, err := in.probed(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't probe video: %w", err)
+	}
+	width, height, duration := probe.Width, probe.Height, probe.Duration
+	plan, err := cfg.db.GetUserPlan(in.video.UserID)
+	if err != nil {
+		return fmt.Errorf("couldn't get plan: %w", err)
+	}
+	dir, err := cfg.newUploadDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, rungHeight := range cfg.ladder {
+		if len(in.stored.renditions) >= plan.MaxRenditions {
+			break
+		}
+		if rungHeight > height {
+			continue
+		}
+		// libx264 wants even dimensions
+		rungWidth := (width*rungHeight/height + 1) &^ 1
+		rungPath := filepath.Join(dir, ladderName(rungHeight)+".mp4")
+		if err := encodeLadderRung(ctx, in.filePath, rungPath, rungWidth, rungHeight); err != nil {
+			return fmt.Errorf("couldn't encode %s rendition: %w", ladderName(rungHeight), err)
+		}
+		info, err := os.Stat(rungPath)
+		if err != nil {
+			return err
+		}
+		key := ladderKey(in.key, rungHeight)
+		if err := cfg.uploadFileToS3(ctx, in.store, key, "video/mp4", rungPath); err != nil {
+			return fmt.Errorf("%w: %w", errStorageUpload, err)
+		}
+		bitrate := int64(0)
+		if duration > 0 {
+			bitrate = int64(float64(info.Size()*8) / duration)
+		}
+		in.stored.renditions = append(in.stored.renditions, database.VideoRendition{
+			Name:    ladderName(rungHeight),
+			Key:     key,
+			Width:   rungWidth,
+			Height:  rungHeight,
+			Bitrate: bitrate,
+		})
+	}
+	return nil
+}
+
+// encodeLadderRung scales the video at filePath down to width x height,
+// ready to play while it downloads.
+func encodeLadderRung(ctx context.Context, filePath, outputPath string, width, height int) error {
+	maxRate := ladderMaxRate(width, height)
+	_, err := ffmpeg.FFmpeg().
+		Input(filePath).
+		Option("-c:v", "libx264").
+		Option("-preset", "veryfast").
+		Option("-crf", "23").
+		Option("-maxrate", fmt.Sprint(maxRate)).
+		Option("-bufsize", fmt.Sprint(2*maxRate)).
+		Option("-vf", fmt.Sprintf("scale=%d:%d,format=yuv420p", width, height)).
+		Option("-c:a", "aac").
+		Option("-movflags", "+faststart").
+		Output(outputPath).
+		Run(ctx)
+	return err
+}
+
+// storedLadder returns the renditions recorded for the ladder of the mp4 at
+// key, for a video that reuses it.
+func (cfg *apiConfig) storedLadder(key string) []database.VideoRendition {
+	renditions, err := cfg.db.GetVideoRenditionsUnder(ladderPrefix(key))
+	if err != nil {
+		log.Printf("Couldn't get renditions of %s: %v", key, err)
+		return nil
+	}
+	return renditions
+}
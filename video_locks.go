@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var errVideoDeleted = errors.New("video was deleted")
+
+// videoLocks hands out one mutex per video, so the slow upload paths can't
+// overwrite each other's columns with the stale copy of the record they
+// loaded when the request started.
+type videoLocks struct {
+	mu    sync.Mutex
+	locks map[uuid.UUID]*videoLock
+}
+
+type videoLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (l *videoLocks) lock(id uuid.UUID) (unlock func()) {
+	l.mu.Lock()
+	vl, ok := l.locks[id]
+	if !ok {
+		vl = &videoLock{}
+		l.locks[id] = vl
+	}
+	vl.refs++
+	l.mu.Unlock()
+
+	vl.Lock()
+	return func() {
+		vl.Unlock()
+		l.mu.Lock()
+		vl.refs--
+		if vl.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// updateVideo reloads a video and saves change to it while holding the
+// video's lock. change should only touch the fields its caller owns, so a
+// thumbnail and a video uploaded side by side both end up on the record.
+func (cfg *apiConfig) updateVideo(id uuid.UUID, change func(video *database.Video)) (database.Video, error) {
+	unlock := cfg.videoLocks.lock(id)
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(id)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if video.ID == uuid.Nil {
+		return database.Video{}, errVideoDeleted
+	}
+	change(&video)
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		return database.Video{}, err
+	}
+	return video, nil
+}
+
+// assetReadiness says which of a video's uploads have landed.
+type assetReadiness struct {
+	Thumbnail bool `json:"thumbnail"`
+	Video     bool `json:"video"`
+	Ready     bool `json:"ready"`
+}
+
+type videoWithAssets struct {
+	database.Video
+	Assets assetReadiness `json:"assets"`
+}
+
+// withAssetReadiness is the response to an upload, telling clients that
+// upload in parallel whether the other half has arrived yet.
+func withAssetReadiness(video database.Video) videoWithAssets {
+	readiness := assetReadiness{
+		Thumbnail: video.ThumbnailURL != nil,
+		Video:     video.VideoURL != nil,
+	}
+	readiness.Ready = readiness.Thumbnail && readiness.Video
+	return videoWithAssets{Video: video, Assets: readiness}
+}
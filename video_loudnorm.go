@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+const (
+	// the range ffmpeg's loudnorm filter takes for integrated loudness
+	minLoudnormTarget = -70
+	maxLoudnormTarget = -5
+	// EBU R128's true peak ceiling and loudness range, left alone
+	loudnormTruePeak = -1.5
+	loudnormRange    = 11
+	// loudnorm resamples to 192kHz, so the output is set back to this when
+	// the upload's rate isn't known
+	defaultAudioSampleRate = 48000
+)
+
+// loudnormStage normalizes the upload's audio to cfg.loudnormTarget LUFS,
+// so every published video plays at the same volume. The video stream is
+// copied as it is. Uploads without sound are left alone.
+func (cfg *apiConfig) loudnormStage(ctx context.Context, in *videoIngest) error {
+	if cfg.loudnormTarget == 0 {
+		return nil
+	}
+	probe, err := in.probed(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't probe video: %w", err)
+	}
+	if probe.AudioCodec == "" {
+		return nil
+	}
+	sampleRate := probe.AudioSampleRate
+	if sampleRate == 0 {
+		sampleRate = defaultAudioSampleRate
+	}
+	log.Printf("normalizing audio of video %s to %g LUFS", in.video.ID, cfg.loudnormTarget)
+	normalized, err := normalizeLoudness(ctx, in.filePath, cfg.loudnormTarget, sampleRate)
+	if err != nil {
+		return fmt.Errorf("couldn't normalize audio: %w", err)
+	}
+	in.filePath = normalized
+	in.temp = append(in.temp, normalized)
+	return nil
+}
+
+// normalizeLoudness runs ffmpeg's single pass loudnorm filter over the
+// audio of a video, re-encoding it to AAC at sampleRate.
+func normalizeLoudness(ctx context.Context, inputFilePath string, target float64, sampleRate int) (string, error) {
+	outputFilePath := fmt.Sprintf("%s.loudnorm", inputFilePath)
+
+	_, err := ffmpeg.FFmpeg().
+		Input(inputFilePath).
+		Option("-c:v", "copy").
+		Option("-af", fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%d", target, loudnormTruePeak, loudnormRange)).
+		Option("-ar", strconv.Itoa(sampleRate)).
+		Option("-c:a", "aac").
+		Option("-movflags", "+faststart").
+		Option("-f", "mp4").
+		Output(outputFilePath).
+		Run(ctx)
+	if err != nil {
+		os.Remove(outputFilePath)
+		return "", fmt.Errorf("error normalizing audio: %w", err)
+	}
+
+	fileInfo, err := os.Stat(outputFilePath)
+	if err != nil {
+		return "", fmt.Errorf("could not stat normalized file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(outputFilePath)
+		return "", fmt.Errorf("normalized file is empty")
+	}
+
+	return outputFilePath, nil
+}
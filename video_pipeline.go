@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/limits"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/pipeline"
+	"github.com/google/uuid"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+const (
+	// ffmpeg spreads one encode over every core already, so a few at a time
+	// keep the machine busy without thrashing it
+	defaultFFmpegConcurrency = 4
+	// long enough for a full-length upload through the slowest stage
+	defaultFFmpegTimeout = time.Hour
+	// ffprobe only reads headers
+	defaultFFprobeTimeout = time.Minute
+)
+
+// videoIngest is the state a video upload carries through its pipeline.
+type videoIngest struct {
+	video database.Video
+	plan  database.Plan
+
+	// what an HTTP upload was sent as, for the receiving stages
+	contentType string
+	body        io.Reader
+	sizeHint    int64
+	checksum    string
+	uploadDir   string
+	// how much of the body made it in, for the client to know where it
+	// stands after a failure
+	received int64
+
+	// the file being ingested, replaced by processed copies as it goes
+	filePath     string
+	uploadSHA256 string
+	uploadSize   int64
+	// processed copies to remove once the pipeline is done
+	temp []string
+	// groups the upload's processing log entries, set by startProcessingLog
+	logRunID uuid.UUID
+	// set when the job queue will try again after a storage or scanner
+	// failure, so the video isn't marked failed in the meantime
+	retryTransient bool
+	// what ffprobe read of filePath, once a stage needed it
+	probe      *database.VideoMetadata
+	probedPath string
+
+	store  objectStore
+	key    string
+	stored storedObject
+
+	response videoWithAssets
+}
+
+// removeTemp deletes whatever the pipeline wrote locally, for the caller to
+// defer.
+func (in *videoIngest) removeTemp() {
+	for _, path := range in.temp {
+		os.Remove(path)
+	}
+	if in.uploadDir != "" {
+		os.RemoveAll(in.uploadDir)
+	}
+}
+
+// ingestPipeline takes a local video file to a published object: scan it for
+// malware, reuse a byte-identical upload if there is one, otherwise
+// transcode to mp4, remux for fast start, store it in S3 (with a resolution
+// ladder, HLS and DASH renditions and a storyboard when enabled), point the
+// video record at it and give the video a thumbnail and hover preview if it
+// has none.
+func (cfg *apiConfig) ingestPipeline() pipeline.Pipeline[videoIngest] {
+	return pipeline.New(cfg.pipelineMetrics, cfg.ingestStages()...).
+		Observe(cfg.logProcessingStage).
+		Observe(cfg.trackVideoStatus)
+}
+
+func (cfg *apiConfig) ingestStages() []pipeline.Stage[videoIngest] {
+	return []pipeline.Stage[videoIngest]{
+		{Name: "scan", Run: cfg.scanStage},
+		{Name: "dedupe", Run: cfg.dedupeStage},
+		{Name: "transcode", Run: transcodeStage},
+		{Name: "loudnorm", Run: cfg.loudnormStage},
+		{Name: "brand", Run: cfg.brandStage},
+		{Name: "faststart", Run: fastStartStage},
+		{Name: "store", Run: cfg.storeStage},
+		{Name: "ladder", Run: cfg.ladderStage},
+		{Name: "hls", Run: cfg.hlsStage},
+		{Name: "dash", Run: cfg.dashStage},
+		{Name: "storyboard", Run: cfg.storyboardStage},
+		{Name: "persist", Run: cfg.persistStage},
+		{Name: "thumbnail", Run: cfg.thumbnailStage},
+		{Name: "preview", Run: cfg.previewStage},
+		{Name: "transcribe", Run: cfg.transcribeStage},
+	}
+}
+
+// uploadPipeline is ingestPipeline for a video sent in an HTTP request: the
+// body is checked and spooled to disk and the plan's limits applied first,
+// and the response is built at the end.
+func (cfg *apiConfig) uploadPipeline() pipeline.Pipeline[videoIngest] {
+	return cfg.receivePipeline().
+		Then(cfg.ingestStages()...).
+		Then(pipeline.Stage[videoIngest]{Name: "sign", Run: cfg.signStage})
+}
+
+// receivePipeline is the part of uploadPipeline that needs the request,
+// leaving a checked file on disk for ingestPipeline.
+func (cfg *apiConfig) receivePipeline() pipeline.Pipeline[videoIngest] {
+	return pipeline.New(cfg.pipelineMetrics,
+		pipeline.Stage[videoIngest]{Name: "validate", Run: cfg.validateStage},
+		pipeline.Stage[videoIngest]{Name: "spool", Run: cfg.spoolStage},
+		pipeline.Stage[videoIngest]{Name: "probe", Run: cfg.probeStage},
+	).Observe(cfg.logProcessingStage).
+		Observe(cfg.trackVideoStatus)
+}
+
+// validateStage checks the container before spooling what may be a
+// gigabyte of something else to disk, and that the plan allows another
+// upload at all.
+func (cfg *apiConfig) validateStage(ctx context.Context, in *videoIngest) error {
+	if err := cfg.checkUploadQuota(in.video.UserID, in.plan, uploadUsage{Uploads: 1}, cfg.now()); err != nil {
+		return err
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(in.body, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	head = head[:n]
+	in.received = int64(n)
+	if violations := checkVideoContainer(in.contentType, sniffVideoContainer(head)); len(violations) > 0 {
+		return violations[0]
+	}
+	in.body = io.MultiReader(bytes.NewReader(head), in.body)
+	return nil
+}
+
+// spoolStage saves the body to disk, hashing it on the way, and checks it
+// against the client's checksum and the plan's upload caps.
+func (cfg *apiConfig) spoolStage(ctx context.Context, in *videoIngest) error {
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		return err
+	}
+	in.uploadDir = uploadDir
+
+	spool, err := cfg.spoolToTempFile(uploadDir, in.body, "upload-*.mp4", in.sizeHint)
+	in.received = spool.Size
+	if err != nil {
+		return err
+	}
+	log.Printf("received %d bytes for video %s, sha256 %s", spool.Size, in.video.ID, spool.SHA256)
+	if in.checksum != "" && in.checksum != spool.SHA256 {
+		return fmt.Errorf("%w: expected sha256 %s, got %s", errChecksumMismatch, in.checksum, spool.SHA256)
+	}
+	if err := cfg.checkUploadQuota(in.video.UserID, in.plan, uploadUsage{Uploads: 1, Bytes: spool.Size}, cfg.now()); err != nil {
+		return err
+	}
+	in.filePath = spool.Path
+	in.uploadSHA256 = spool.SHA256
+	return nil
+}
+
+// probed is what ffprobe reads of the file being ingested, probed once for
+// each copy the pipeline makes so stages can decide on it without probing
+// again.
+func (in *videoIngest) probed(ctx context.Context) (database.VideoMetadata, error) {
+	if in.probe != nil && in.probedPath == in.filePath {
+		return *in.probe, nil
+	}
+	metadata, err := probeVideo(ctx, in.filePath)
+	if err != nil {
+		return metadata, err
+	}
+	in.probe, in.probedPath = &metadata, in.filePath
+	return metadata, nil
+}
+
+// probeStage holds the video to the plan's duration limit.
+func (cfg *apiConfig) probeStage(ctx context.Context, in *videoIngest) error {
+	probe, err := in.probed(ctx)
+	if err != nil {
+		return err
+	}
+	if probe.Duration > float64(in.plan.MaxVideoDuration) {
+		return cfg.videoDurationViolation(in.plan, probe.Duration)
+	}
+	return nil
+}
+
+// dedupeStage points the video at an existing object when a byte-identical
+// file was uploaded before, skipping straight to persist.
+func (cfg *apiConfig) dedupeStage(ctx context.Context, in *videoIngest) error {
+	store, err := cfg.storeForUser(in.video.UserID)
+	if err != nil {
+		return err
+	}
+	in.store = store
+	info, err := os.Stat(in.filePath)
+	if err != nil {
+		return err
+	}
+	in.uploadSize = info.Size()
+
+	b, err := cfg.brandingFor(in.video.UserID)
+	if err != nil {
+		return err
+	}
+	// branded uploads aren't stored as anyone else's upload of the file was
+	if b != nil {
+		return nil
+	}
+	if key, head, ok := cfg.findDuplicateUpload(ctx, store, in.uploadSHA256); ok {
+		log.Printf("video %s is a duplicate upload, reusing %s", in.video.ID, key)
+		in.key, in.stored = key, headObject(head)
+		in.stored.hlsMaster = cfg.storedHLSMaster(ctx, store, key)
+		in.stored.dashManifest = cfg.storedDASHManifest(ctx, store, key)
+		in.stored.renditions = cfg.storedLadder(key)
+		in.stored.storyboard = cfg.storedStoryboard(ctx, store, key)
+		in.stored.metadata = cfg.storedMetadataFor(ctx, store, jobPresigner("dedupe", &in.video.ID), key)
+		return pipeline.SkipTo("persist")
+	}
+	return nil
+}
+
+// transcodeStage converts anything that isn't mp4.
+func transcodeStage(ctx context.Context, in *videoIngest) error {
+	container, err := videoContainer(in.filePath)
+	if err != nil {
+		return fmt.Errorf("couldn't read video: %w", err)
+	}
+	switch container {
+	case "video/mp4":
+		return nil
+	case "":
+		return errors.New("unsupported video format")
+	}
+	log.Printf("transcoding %s upload for video %s", container, in.video.ID)
+	transcoded, err := transcodeToMP4(ctx, in.filePath)
+	if err != nil {
+		return fmt.Errorf("couldn't transcode video: %w", err)
+	}
+	in.filePath = transcoded
+	in.temp = append(in.temp, transcoded)
+	return nil
+}
+
+// fastStartStage moves the moov atom to the front so playback can start
+// before the whole file is fetched. Already optimized files are left as
+// they are.
+func fastStartStage(ctx context.Context, in *videoIngest) error {
+	fastStart, err := isFastStart(in.filePath)
+	if err != nil {
+		log.Printf("Couldn't inspect %s for fast start, remuxing: %v", in.filePath, err)
+	}
+	if fastStart {
+		return nil
+	}
+	processed, err := processVideoForFastStart(ctx, in.filePath)
+	if err != nil {
+		return fmt.Errorf("couldn't process video for fast start: %w", err)
+	}
+	in.filePath = processed
+	in.temp = append(in.temp, processed)
+	return nil
+}
+
+// storeStage uploads the processed file under a key sorted by aspect ratio.
+func (cfg *apiConfig) storeStage(ctx context.Context, in *videoIngest) error {
+	probe, err := in.probed(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't probe video: %w", err)
+	}
+	key, err := joinKey(aspectRatioDirectory(aspectRatioOf(probe.Width, probe.Height)), getAssetPath("video/mp4"))
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(in.filePath)
+	if err != nil {
+		return fmt.Errorf("couldn't stat processed file: %w", err)
+	}
+
+	out, err := cfg.putFile(ctx, in.store, &s3.PutObjectInput{
+		Key:         aws.String(key),
+		ContentType: aws.String("video/mp4"),
+	}, in.filePath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errStorageUpload, err)
+	}
+	cfg.cachePlaybackCopy(in.filePath, in.store, key, out.VersionId)
+	in.key = key
+	in.stored = storedObject{
+		versionID: out.VersionId,
+		etag:      out.ETag,
+		size:      info.Size(),
+	}
+	return nil
+}
+
+// persistStage points the video at what was stored, with what ffprobe read
+// of it. A duplicate upload brings the metadata of the object it reuses; a
+// failure only leaves the metadata unknown.
+func (cfg *apiConfig) persistStage(ctx context.Context, in *videoIngest) error {
+	if in.stored.metadata == nil {
+		probe, err := in.probed(ctx)
+		if err != nil {
+			log.Printf("Couldn't probe video %s: %v", in.video.ID, err)
+		} else {
+			in.stored.metadata = &probe
+		}
+	}
+	video, err := cfg.publishVideoObject(in.video, in.store, in.key, in.stored, in.uploadSHA256, in.uploadSize)
+	in.video = video
+	return err
+}
+
+// signStage builds the response, with signed asset URLs if the video is
+// private.
+func (cfg *apiConfig) signStage(ctx context.Context, in *videoIngest) error {
+	in.response = withAssetReadiness(cfg.withSignedThumbnail(in.video))
+	return nil
+}
+
+// respondWithUploadPipelineError maps a failed upload pipeline to the
+// response its cause calls for.
+func (cfg *apiConfig) respondWithUploadPipelineError(w http.ResponseWriter, in *videoIngest, err error) {
+	recovery := uploadRecovery{BytesReceived: in.received}
+	var (
+		exceeded    limits.Exceeded
+		maxBytesErr *http.MaxBytesError
+		corruptErr  base64.CorruptInputError
+		violation   uploadViolation
+	)
+	switch {
+	case errors.Is(err, errPublishQueued):
+		respondWithPublishQueued(w)
+	case errors.As(err, &exceeded):
+		cfg.respondWithLimit(w, exceeded, &recovery)
+	case errors.As(err, &maxBytesErr):
+		respondWithUploadViolations(w, []uploadViolation{cfg.videoSizeViolation(in.plan, 0)}, err, recovery)
+	case errors.As(err, &corruptErr):
+		respondWithUploadError(w, http.StatusBadRequest, "Invalid base64 payload", err, recovery)
+	case errors.As(err, &violation):
+		respondWithUploadViolations(w, []uploadViolation{violation}, err, recovery)
+	case errors.Is(err, errChecksumMismatch):
+		recovery.Retryable = true
+		respondWithUploadError(w, http.StatusBadRequest, "Checksum mismatch", err, recovery)
+	case errors.Is(err, errStorageUpload):
+		recovery.Retryable = true
+		respondWithUploadError(w, http.StatusBadGateway, "Couldn't upload video to storage", err, recovery)
+	case errors.Is(err, errUploadQuarantined):
+		respondWithUploadError(w, http.StatusUnprocessableEntity, "Upload was rejected by the malware scanner", err, recovery)
+	case errors.Is(err, errMalwareScan):
+		recovery.Retryable = true
+		respondWithUploadError(w, http.StatusServiceUnavailable, "Couldn't scan upload for malware", err, recovery)
+	default:
+		switch pipeline.FailedStage(err) {
+		case "validate":
+			// most likely the connection dropped mid-body
+			recovery.Retryable = true
+			respondWithUploadError(w, http.StatusBadRequest, "Couldn't read file", err, recovery)
+		case "spool":
+			recovery.Retryable = true
+			respondWithUploadError(w, http.StatusInternalServerError, "Could not write file to disk", err, recovery)
+		case "probe":
+			respondWithUploadError(w, http.StatusBadRequest, "Couldn't read video duration", err, recovery)
+		default:
+			respondWithUploadError(w, http.StatusInternalServerError, "Couldn't process video", err, recovery)
+		}
+	}
+}
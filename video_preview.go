@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+const (
+	hoverPreviewSeconds = 4
+	hoverPreviewWidth   = 320
+	hoverPreviewFPS     = 10
+)
+
+// previewStage cuts a short, small looping WebP from the upload for
+// listings to play on hover, as the video's thumbnail preview. A preview
+// made from the owner's animated GIF thumbnail is kept. Like the thumbnail,
+// it's a nicety, so failures only get logged.
+func (cfg *apiConfig) previewStage(ctx context.Context, in *videoIngest) error {
+	if in.video.ThumbnailPreviewURL != nil && !in.video.ThumbnailPreviewGenerated {
+		return nil
+	}
+	video, err := cfg.generateHoverPreview(ctx, in.video, in.filePath)
+	if err != nil {
+		log.Printf("Couldn't generate hover preview for video %s: %v", in.video.ID, err)
+		return nil
+	}
+	in.video = video
+	return nil
+}
+
+func (cfg *apiConfig) generateHoverPreview(ctx context.Context, video database.Video, filePath string) (database.Video, error) {
+	duration, err := getVideoDuration(ctx, filePath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't get video duration: %w", err)
+	}
+	// from where the thumbnail is taken, unless that runs off the end
+	start := math.Max(0, math.Min(duration*generatedThumbnailPosition, duration-hoverPreviewSeconds))
+	previewPath, err := cutHoverPreview(ctx, filePath, start, cfg.assetsRoot)
+	if err != nil {
+		return video, fmt.Errorf("couldn't cut preview: %w", err)
+	}
+	defer os.Remove(previewPath)
+	assetPath, err := cfg.saveAssetFile(previewPath, "image/webp")
+	if err != nil {
+		return video, fmt.Errorf("couldn't save preview: %w", err)
+	}
+
+	previewURL := cfg.getAssetURL(assetPath)
+	kept := false
+	video, err = cfg.updateVideo(video.ID, func(video *database.Video) {
+		// the owner may have sent a GIF thumbnail while the upload was
+		// processing
+		if video.ThumbnailPreviewURL != nil && !video.ThumbnailPreviewGenerated {
+			kept = true
+			return
+		}
+		video.ThumbnailPreviewURL = &previewURL
+		video.ThumbnailPreviewGenerated = true
+	})
+	if err != nil || kept {
+		if diskPath, perr := cfg.getAssetDiskPath(assetPath); perr == nil {
+			os.Remove(diskPath)
+		}
+	}
+	return video, err
+}
+
+// cutHoverPreview writes hoverPreviewSeconds of the video at filePath from
+// start, scaled down and without sound, to a new looping WebP temp file in
+// dir.
+func cutHoverPreview(ctx context.Context, filePath string, start float64, dir string) (string, error) {
+	out, err := os.CreateTemp(dir, ".preview-*.webp")
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+
+	_, err = ffmpeg.FFmpeg().
+		Option("-y").
+		Option("-ss", fmt.Sprintf("%.3f", start)).
+		Option("-t", fmt.Sprint(hoverPreviewSeconds)).
+		Input(filePath).
+		Option("-vf", fmt.Sprintf("fps=%d,scale=%d:-2", hoverPreviewFPS, hoverPreviewWidth)).
+		Option("-an").
+		Option("-c:v", "libwebp").
+		Option("-q:v", "60").
+		Option("-loop", "0").
+		Option("-f", "webp").
+		Output(out.Name()).
+		Run(ctx)
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
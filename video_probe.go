@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/google/uuid"
+)
+
+const probeURLExpiry = 10 * time.Minute
+
+// probeVideo reads the container and the first video and audio streams in
+// one ffprobe run, with the video's dimensions as displayed. input can be a
+// local path or an http(s) URL.
+func probeVideo(ctx context.Context, input string) (database.VideoMetadata, error) {
+	stdout, err := ffmpeg.FFprobe().
+		Option("-v", "error").
+		Option("-print_format", "json").
+		Option("-show_entries", "stream=codec_type,codec_name,width,height,avg_frame_rate,bit_rate,pix_fmt,channels,sample_rate:stream_tags=rotate:stream_side_data=rotation:format=format_name,duration,bit_rate").
+		Input(input).
+		Run(ctx)
+	if err != nil {
+		return database.VideoMetadata{}, err
+	}
+
+	var output struct {
+		Streams []struct {
+			CodecType    string `json:"codec_type"`
+			CodecName    string `json:"codec_name"`
+			Width        int    `json:"width"`
+			Height       int    `json:"height"`
+			AvgFrameRate string `json:"avg_frame_rate"`
+			BitRate      string `json:"bit_rate"`
+			PixFmt       string `json:"pix_fmt"`
+			Channels     int    `json:"channels"`
+			SampleRate   string `json:"sample_rate"`
+			Tags         struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideDataList []struct {
+				Rotation *float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			BitRate    string `json:"bit_rate"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(stdout, &output); err != nil {
+		return database.VideoMetadata{}, fmt.Errorf("json unmarshal error: %v, output: %s", err, stdout)
+	}
+
+	duration, err := strconv.ParseFloat(output.Format.Duration, 64)
+	if err != nil {
+		return database.VideoMetadata{}, fmt.Errorf("couldn't parse duration %q: %w", output.Format.Duration, err)
+	}
+	metadata := database.VideoMetadata{
+		Container: output.Format.FormatName,
+		Duration:  duration,
+		Bitrate:   parseProbeInt(output.Format.BitRate),
+	}
+	hasVideo, hasAudio := false, false
+	for _, stream := range output.Streams {
+		switch {
+		case stream.CodecType == "video" && !hasVideo:
+			hasVideo = true
+			metadata.VideoCodec = stream.CodecName
+			metadata.Width = stream.Width
+			metadata.Height = stream.Height
+			// phones store what they shot in the sensor's orientation and
+			// say how to turn it, in an older rotate tag or a display
+			// matrix, whose rotation is counterclockwise
+			rotation := 0
+			if v, err := strconv.Atoi(stream.Tags.Rotate); err == nil {
+				rotation = v
+			}
+			for _, sideData := range stream.SideDataList {
+				if sideData.Rotation != nil {
+					rotation = -int(math.Round(*sideData.Rotation))
+				}
+			}
+			metadata.Rotation = ((rotation % 360) + 360) % 360 / 90 * 90
+			if metadata.Rotation == 90 || metadata.Rotation == 270 {
+				metadata.Width, metadata.Height = metadata.Height, metadata.Width
+			}
+			metadata.FPS = parseFrameRate(stream.AvgFrameRate)
+			metadata.VideoBitrate = parseProbeInt(stream.BitRate)
+			metadata.PixelFormat = stream.PixFmt
+		case stream.CodecType == "audio" && !hasAudio:
+			hasAudio = true
+			metadata.AudioCodec = stream.CodecName
+			metadata.AudioChannels = stream.Channels
+			metadata.AudioSampleRate = int(parseProbeInt(stream.SampleRate))
+			metadata.AudioBitrate = parseProbeInt(stream.BitRate)
+		}
+	}
+	if !hasVideo {
+		return database.VideoMetadata{}, fmt.Errorf("no video stream found")
+	}
+	return metadata, nil
+}
+
+// parseProbeInt reads one of the numbers ffprobe reports as a string,
+// zero if it's missing or "N/A".
+func parseProbeInt(s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// parseFrameRate reads a rate like "30000/1001".
+func parseFrameRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// probeStoredVideo probes an object in the bucket without downloading it.
+// ffprobe reads the presigned URL with range requests, and since stored
+// videos are fast start it only needs the header and moov atom.
+func (cfg *apiConfig) probeStoredVideo(ctx context.Context, store objectStore, requester presignRequester, key string) (database.VideoMetadata, error) {
+	return cfg.probeStoredVersion(ctx, store, requester, key, "")
+}
+
+func (cfg *apiConfig) probeStoredVersion(ctx context.Context, store objectStore, requester presignRequester, key, versionID string) (database.VideoMetadata, error) {
+	url, err := cfg.presignObjectURL(ctx, store, requester, key, versionID, probeURLExpiry)
+	if err != nil {
+		return database.VideoMetadata{}, err
+	}
+	return probeVideo(ctx, url)
+}
+
+// storedMetadata probes an upload in the bucket, for when there's no local
+// copy. It returns nil if it can't.
+func (cfg *apiConfig) storedMetadata(ctx context.Context, store objectStore, requester presignRequester, key, versionID string) *database.VideoMetadata {
+	metadata, err := cfg.probeStoredVersion(ctx, store, requester, key, versionID)
+	if err != nil {
+		log.Printf("Couldn't probe %s: %v", key, err)
+		return nil
+	}
+	return &metadata
+}
+
+// storedMetadataFor is the metadata of an upload another video already
+// uses, as recorded for it, probing the object if it wasn't.
+func (cfg *apiConfig) storedMetadataFor(ctx context.Context, store objectStore, requester presignRequester, key string) *database.VideoMetadata {
+	metadata, err := cfg.db.GetVideoMetadataForKey(key)
+	if err != nil {
+		log.Printf("Couldn't get metadata of %s: %v", key, err)
+	}
+	if metadata.Key != "" {
+		return &metadata
+	}
+	return cfg.storedMetadata(ctx, store, requester, key, "")
+}
+
+// recordVideoMetadata stores what was probed of the upload at key as the
+// video's metadata, or forgets the metadata of the upload it replaced if
+// nothing was.
+func (cfg *apiConfig) recordVideoMetadata(videoID uuid.UUID, key string, metadata *database.VideoMetadata) {
+	if metadata == nil {
+		if err := cfg.db.DeleteVideoMetadata(videoID); err != nil {
+			log.Printf("Couldn't forget metadata of video %s: %v", videoID, err)
+		}
+		return
+	}
+	record := *metadata
+	record.VideoID, record.Key, record.ProbedAt = videoID, key, cfg.now()
+	if err := cfg.db.SaveVideoMetadata(record); err != nil {
+		log.Printf("Couldn't record metadata of video %s: %v", videoID, err)
+	}
+}
+
+// runProbe prints duration, dimensions and codecs of every stored video,
+// recording the metadata of videos uploaded before it was.
+func (cfg *apiConfig) runProbe(ctx context.Context) error {
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return fmt.Errorf("couldn't get videos: %w", err)
+	}
+	for _, video := range videos {
+		if video.VideoURL == nil {
+			continue
+		}
+		store, key, ok, err := cfg.storeForVideo(video)
+		if err != nil {
+			log.Printf("probe: couldn't get storage of video %s: %v", video.ID, err)
+			continue
+		}
+		if !ok {
+			log.Printf("probe: video %s is not stored in a known bucket, skipping", video.ID)
+			continue
+		}
+		probe, err := cfg.probeStoredVideo(ctx, store, jobPresigner("probe", &video.ID), key)
+		if err != nil {
+			log.Printf("probe: couldn't probe video %s: %v", video.ID, err)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%dx%d\t%s/%s\t%s\n", video.ID, formatDuration(probe.Duration), probe.Width, probe.Height, probe.VideoCodec, probe.AudioCodec, key)
+		recorded, err := cfg.db.GetVideoMetadata(video.ID)
+		if err != nil {
+			log.Printf("probe: couldn't get metadata of video %s: %v", video.ID, err)
+			continue
+		}
+		if video.Duration != nil && recorded.Key == key {
+			continue
+		}
+		_, err = cfg.updateVideo(video.ID, func(v *database.Video) {
+			// a new upload may have landed since
+			if aws.ToString(v.VideoURL) != *video.VideoURL {
+				return
+			}
+			if v.Duration == nil {
+				v.Duration = &probe.Duration
+			}
+			if recorded.Key != key {
+				cfg.recordVideoMetadata(v.ID, key, &probe)
+			}
+		})
+		if err != nil {
+			log.Printf("probe: couldn't record metadata of video %s: %v", video.ID, err)
+		}
+	}
+	return nil
+}
+
+// handlerVideoMetadataGet reports what ffprobe read of the video's current
+// upload, for anyone who can see the video.
+func (cfg *apiConfig) handlerVideoMetadataGet(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := cfg.visibleVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+	metadata, err := cfg.db.GetVideoMetadata(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return
+	}
+	if metadata.VideoID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video has no metadata yet", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, metadata)
+}
@@ -1,22 +1,27 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
 )
 
-func processVideoForFastStart(inputFilePath string) (string, error) {
+func processVideoForFastStart(ctx context.Context, inputFilePath string) (string, error) {
 	processedFilePath := fmt.Sprintf("%s.processing", inputFilePath)
 
-	cmd := exec.Command("ffmpeg", "-i", inputFilePath, "-c", "copy", "-movflags", "+faststart", "-f", "mp4", processedFilePath)
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("error processing video: %s, %v", stderr.String(), err)
+	_, err := ffmpeg.FFmpeg().
+		Input(inputFilePath).
+		Option("-c", "copy").
+		Option("-movflags", "+faststart").
+		Option("-f", "mp4").
+		Output(processedFilePath).
+		Run(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error processing video: %w", err)
 	}
 
 	fileInfo, err := os.Stat(processedFilePath)
@@ -29,3 +34,64 @@ func processVideoForFastStart(inputFilePath string) (string, error) {
 
 	return processedFilePath, nil
 }
+
+// isFastStart walks the top-level MP4 boxes and reports whether the moov
+// atom comes before mdat, i.e. the file is already playable while it
+// downloads. Anything that doesn't start with an ftyp box (flv, mpeg-ts)
+// reports false so it still goes through ffmpeg.
+func isFastStart(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	var offset int64
+	header := make([]byte, 16)
+	for offset < info.Size() {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(header[0:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+
+		if offset == 0 && boxType != "ftyp" {
+			return false, nil
+		}
+
+		switch boxSize {
+		case 0:
+			// box extends to the end of the file
+			boxSize = info.Size() - offset
+		case 1:
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return false, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if boxSize < headerSize {
+			return false, fmt.Errorf("invalid %q box size %d at offset %d", boxType, boxSize, offset)
+		}
+
+		switch boxType {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+		offset += boxSize
+	}
+
+	return false, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/pipeline"
+	"github.com/google/uuid"
+)
+
+// how long a player should wait before asking again for a video that's
+// still processing
+const videoProcessingRetryAfter = "10"
+
+// setVideoStatus moves a video that doesn't play yet to status and returns
+// the status it ended up with. A ready video stays ready, as its earlier
+// upload plays until a new one is published. Failures are only logged; the
+// status is a convenience for clients and playback checks the upload too.
+func (cfg *apiConfig) setVideoStatus(videoID uuid.UUID, status database.VideoStatus) database.VideoStatus {
+	changed := false
+	video, err := cfg.updateVideo(videoID, func(video *database.Video) {
+		if video.Status != database.VideoStatusReady && video.Status != status {
+			video.Status = status
+			changed = true
+		}
+	})
+	if errors.Is(err, errVideoDeleted) {
+		return status
+	}
+	if err != nil {
+		log.Printf("Couldn't set status of video %s to %s: %v", videoID, status, err)
+		return status
+	}
+	if changed && status == database.VideoStatusFailed {
+		cfg.queueVideoWebhooks(video)
+	}
+	return video.Status
+}
+
+// trackVideoStatus is the pipeline.Observer that keeps the video's status
+// in step with its upload: uploading once the request is accepted,
+// processing once the body is on disk, and failed if a stage after that
+// fails. A failure the job queue will retry, or a publish that's only been
+// queued, leaves it processing.
+func (cfg *apiConfig) trackVideoStatus(in *videoIngest, stage string, took time.Duration, err error) {
+	var status database.VideoStatus
+	switch {
+	case err != nil:
+		if in.video.Status != database.VideoStatusProcessing || errors.Is(err, errPublishQueued) {
+			return
+		}
+		if in.retryTransient && transientUploadError(err) {
+			return
+		}
+		status = database.VideoStatusFailed
+	case stage == "validate":
+		status = database.VideoStatusUploading
+	case stage == "spool":
+		status = database.VideoStatusProcessing
+	default:
+		return
+	}
+	if in.video.Status == status {
+		return
+	}
+	in.video.Status = cfg.setVideoStatus(in.video.ID, status)
+}
+
+// runIngest runs one of the upload pipelines over in with its processing
+// log. A run cut short between stages, as when the client goes away, isn't
+// seen by the pipeline's observers, so the video's status is settled here.
+func (cfg *apiConfig) runIngest(ctx context.Context, p pipeline.Pipeline[videoIngest], in *videoIngest) error {
+	err := p.Run(cfg.startProcessingLog(ctx, in), in)
+	if err != nil {
+		cfg.trackVideoStatus(in, pipeline.FailedStage(err), 0, err)
+	}
+	return err
+}
+
+// videoPlayable reports whether the video's upload can be handed out for
+// playback, writing the error response if it can't.
+func videoPlayable(w http.ResponseWriter, video database.Video) bool {
+	switch {
+	case video.Status == database.VideoStatusReady && video.VideoURL != nil:
+		return true
+	case video.Status == database.VideoStatusProcessing:
+		w.Header().Set("Retry-After", videoProcessingRetryAfter)
+		respondWithError(w, http.StatusConflict, "Video is still processing", nil)
+	case video.Status == database.VideoStatusFailed:
+		respondWithError(w, http.StatusConflict, "Video's upload couldn't be processed", nil)
+	default:
+		respondWithError(w, http.StatusNotFound, "Video has no upload yet", nil)
+	}
+	return false
+}
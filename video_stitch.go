@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+const stitchProgressLogInterval = 10 * time.Second
+
+// stitchVideos concatenates the inputs in order. Clips rarely share the main
+// video's resolution or codec settings, so every input is scaled and padded
+// to width x height and the result is re-encoded. Every input needs an audio
+// track for the concat filter.
+func stitchVideos(ctx context.Context, dir string, inputPaths []string, width, height int) (string, error) {
+	outputFile, err := os.CreateTemp(dir, "stitch-*.mp4")
+	if err != nil {
+		return "", err
+	}
+	outputPath := outputFile.Name()
+	outputFile.Close()
+
+	cmd := ffmpeg.FFmpeg().Option("-y")
+	for _, inputPath := range inputPaths {
+		cmd.Input(inputPath)
+	}
+
+	var filter strings.Builder
+	var concatInputs strings.Builder
+	for i := range inputPaths {
+		fmt.Fprintf(&filter,
+			"[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=30[v%d];",
+			i, width, height, width, height, i)
+		fmt.Fprintf(&filter, "[%d:a]aresample=48000[a%d];", i, i)
+		fmt.Fprintf(&concatInputs, "[v%d][a%d]", i, i)
+	}
+	fmt.Fprintf(&filter, "%sconcat=n=%d:v=1:a=1[v][a]", concatInputs.String(), len(inputPaths))
+
+	cmd.Option("-filter_complex", filter.String()).
+		Option("-map", "[v]").Option("-map", "[a]").
+		Option("-c:v", "libx264").Option("-preset", "veryfast").Option("-crf", "20").
+		Option("-c:a", "aac").
+		Option("-movflags", "+faststart").
+		Option("-f", "mp4").
+		Output(outputPath)
+
+	lastLog := time.Now()
+	err = cmd.RunWithProgress(ctx, func(p ffmpeg.Progress) {
+		if p.Done || time.Since(lastLog) >= stitchProgressLogInterval {
+			log.Printf("stitch: %s encoded at %.1fx", formatDuration(p.OutTime.Seconds()), p.Speed)
+			lastLog = time.Now()
+		}
+	})
+	if err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("error stitching video: %w", err)
+	}
+
+	return outputPath, nil
+}
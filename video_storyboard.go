@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+const (
+	storyboardIndex  = "storyboard.vtt"
+	storyboardSprite = "sprite.jpg"
+	// one sprite image holds every tile, so the player fetches it once
+	storyboardColumns   = 10
+	storyboardMaxTiles  = 100
+	storyboardTileWidth = 160
+)
+
+// storyboardPrefix is where the storyboard of the mp4 at key is stored,
+// next to its other renditions.
+func storyboardPrefix(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "/storyboard/"
+}
+
+func storyboardIndexKey(key string) string {
+	return storyboardPrefix(key) + storyboardIndex
+}
+
+// storyboardStage tiles frames of the stored mp4 into one sprite with a
+// WebVTT index of which tile covers which stretch of the video, and stores
+// both under storyboardPrefix for persist to record the index on the video.
+func (cfg *apiConfig) storyboardStage(ctx context.Context, in *videoIngest) error {
+	if !cfg.storyboardsEnabled {
+		return nil
+	}
+	probe, err := in.probed(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't probe video: %w", err)
+	}
+	width, height, duration := probe.Width, probe.Height, probe.Duration
+	if duration <= 0 || width <= 0 || height <= 0 {
+		return nil
+	}
+	dir, err := cfg.newUploadDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	board := newStoryboard(duration, width, height)
+	if err := board.renderSprite(ctx, in.filePath, filepath.Join(dir, storyboardSprite)); err != nil {
+		return fmt.Errorf("couldn't render storyboard: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, storyboardIndex), []byte(board.index()), 0o644); err != nil {
+		return err
+	}
+
+	prefix := storyboardPrefix(in.key)
+	files := []struct{ name, contentType string }{
+		{storyboardSprite, "image/jpeg"},
+		{storyboardIndex, "text/vtt"},
+	}
+	for _, file := range files {
+		err := cfg.uploadFileToS3(ctx, in.store, prefix+file.name, file.contentType, filepath.Join(dir, file.name))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errStorageUpload, err)
+		}
+	}
+	index := storyboardIndexKey(in.key)
+	in.stored.storyboard = &index
+	return nil
+}
+
+// storyboard is the layout of a sprite: a tile every interval seconds,
+// storyboardColumns to a row.
+type storyboard struct {
+	duration   float64
+	interval   float64
+	tiles      int
+	tileWidth  int
+	tileHeight int
+}
+
+func newStoryboard(duration float64, width, height int) storyboard {
+	// a tile a second for short videos, spread out to fit longer ones
+	interval := math.Max(1, math.Ceil(duration/storyboardMaxTiles))
+	return storyboard{
+		duration:   duration,
+		interval:   interval,
+		tiles:      int(math.Ceil(duration / interval)),
+		tileWidth:  storyboardTileWidth,
+		tileHeight: (storyboardTileWidth*height/width + 1) &^ 1,
+	}
+}
+
+func (b storyboard) rows() int {
+	return (b.tiles + storyboardColumns - 1) / storyboardColumns
+}
+
+func (b storyboard) renderSprite(ctx context.Context, filePath, outputPath string) error {
+	_, err := ffmpeg.FFmpeg().
+		Option("-y").
+		Input(filePath).
+		Option("-vf", fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d",
+			b.interval, b.tileWidth, b.tileHeight, storyboardColumns, b.rows())).
+		Option("-frames:v", "1").
+		Option("-q:v", "4").
+		Output(outputPath).
+		Run(ctx)
+	return err
+}
+
+// index is the WebVTT file pointing each stretch of the video at its tile,
+// as a media fragment of the sprite.
+func (b storyboard) index() string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n")
+	for i := range b.tiles {
+		start := float64(i) * b.interval
+		end := math.Min(start+b.interval, b.duration)
+		x := (i % storyboardColumns) * b.tileWidth
+		y := (i / storyboardColumns) * b.tileHeight
+		fmt.Fprintf(&sb, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), storyboardSprite, x, y, b.tileWidth, b.tileHeight)
+	}
+	return sb.String()
+}
+
+func vttTimestamp(seconds float64) string {
+	d := time.Duration(math.Round(seconds*1000)) * time.Millisecond
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
+
+// storedStoryboard returns the index key of the storyboard stored for the
+// mp4 at key, or nil if it doesn't have one.
+func (cfg *apiConfig) storedStoryboard(ctx context.Context, store objectStore, key string) *string {
+	if !cfg.storyboardsEnabled {
+		return nil
+	}
+	return storedRendition(ctx, store, storyboardIndexKey(key))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+// how far into the video the generated thumbnail is taken from, past most
+// fade-ins and title cards
+const generatedThumbnailPosition = 0.1
+
+// thumbnailStage gives a video without a thumbnail a frame of its upload as
+// one. A thumbnail generated from an earlier upload is replaced, one the
+// owner sent is kept. The thumbnail is a nicety, so failures only get
+// logged.
+func (cfg *apiConfig) thumbnailStage(ctx context.Context, in *videoIngest) error {
+	if in.video.ThumbnailURL != nil && !in.video.ThumbnailGenerated {
+		return nil
+	}
+	video, err := cfg.generateThumbnail(ctx, in.video, in.filePath)
+	if err != nil {
+		log.Printf("Couldn't generate thumbnail for video %s: %v", in.video.ID, err)
+		return nil
+	}
+	in.video = video
+	return nil
+}
+
+func (cfg *apiConfig) generateThumbnail(ctx context.Context, video database.Video, filePath string) (database.Video, error) {
+	duration, err := getVideoDuration(ctx, filePath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't get video duration: %w", err)
+	}
+	framePath, err := extractFrame(ctx, filePath, duration*generatedThumbnailPosition, cfg.assetsRoot)
+	if err != nil {
+		return video, fmt.Errorf("couldn't extract frame: %w", err)
+	}
+	defer os.Remove(framePath)
+	etag, err := fileSHA256(framePath)
+	if err != nil {
+		return video, err
+	}
+	assetPath, err := cfg.saveAssetFile(framePath, "image/jpeg")
+	if err != nil {
+		return video, fmt.Errorf("couldn't save thumbnail: %w", err)
+	}
+
+	thumbnailURL := cfg.getAssetURL(assetPath)
+	kept := false
+	video, err = cfg.updateVideo(video.ID, func(video *database.Video) {
+		// the owner may have sent one while the upload was processing
+		if video.ThumbnailURL != nil && !video.ThumbnailGenerated {
+			kept = true
+			return
+		}
+		video.ThumbnailURL = &thumbnailURL
+		video.ThumbnailETag = &etag
+		video.ThumbnailGenerated = true
+		video.ThumbnailBlurhash = nil
+		video.ThumbnailVersion = nil
+	})
+	if err != nil || kept {
+		if diskPath, perr := cfg.getAssetDiskPath(assetPath); perr == nil {
+			os.Remove(diskPath)
+		}
+		return video, err
+	}
+	return cfg.refreshThumbnail(ctx, video), nil
+}
+
+// extractFrame writes the frame at seconds into the video at filePath to a
+// new JPEG temp file in dir.
+func extractFrame(ctx context.Context, filePath string, seconds float64, dir string) (string, error) {
+	out, err := os.CreateTemp(dir, ".thumbnail-*.jpg")
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+
+	_, err = ffmpeg.FFmpeg().
+		Option("-y").
+		// seeking before the input jumps to the nearest keyframe instead of
+		// decoding up to it
+		Option("-ss", fmt.Sprintf("%.3f", seconds)).
+		Input(filePath).
+		Option("-frames:v", "1").
+		Option("-q:v", "2").
+		Output(out.Name()).
+		Run(ctx)
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
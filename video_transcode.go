@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+// videoExtensions are the file extensions of videoMediaTypes. Only mp4 is
+// stored as sent, the rest are transcoded on ingest.
+var videoExtensions = []string{".mp4", ".mov", ".webm", ".mkv"}
+
+func isVideoFilename(name string) bool {
+	return slices.Contains(videoExtensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// transcodeToMP4 re-encodes a video to H.264 and AAC in a fast start mp4,
+// which plays in every browser. Screen recorders like to write 4:4:4 chroma,
+// which most hardware decoders can't handle, so the pixel format is set too.
+func transcodeToMP4(ctx context.Context, inputFilePath string) (string, error) {
+	outputFilePath := fmt.Sprintf("%s.transcoding", inputFilePath)
+
+	_, err := ffmpeg.FFmpeg().
+		Input(inputFilePath).
+		Option("-c:v", "libx264").
+		Option("-preset", "veryfast").
+		Option("-crf", "23").
+		Option("-vf", "format=yuv420p").
+		Option("-c:a", "aac").
+		Option("-movflags", "+faststart").
+		Option("-f", "mp4").
+		Output(outputFilePath).
+		Run(ctx)
+	if err != nil {
+		os.Remove(outputFilePath)
+		return "", fmt.Errorf("error transcoding video: %w", err)
+	}
+
+	fileInfo, err := os.Stat(outputFilePath)
+	if err != nil {
+		return "", fmt.Errorf("could not stat transcoded file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(outputFilePath)
+		return "", fmt.Errorf("transcoded file is empty")
+	}
+
+	return outputFilePath, nil
+}
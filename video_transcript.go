@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/jobs"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/transcribe"
+	"github.com/google/uuid"
+)
+
+const (
+	// speech needs little: mono at 16kHz and 32kbps keeps about 100 minutes
+	// under the Whisper API's file limit
+	transcriptionSampleRate = "16000"
+	transcriptionBitrate    = "32k"
+	// a transcriber that's down gets about 15 minutes to come back
+	transcribeVideoAttempts = 6
+)
+
+type transcribeVideoPayload struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// the upload to transcribe, so a job for one that's since been replaced
+	// does nothing
+	Key string `json:"key"`
+}
+
+// transcribeStage queues the stored upload to be transcribed when a
+// transcriber is configured. Transcribing takes about as long as a
+// transcode, so it's left to the job queue rather than holding up the
+// upload; failing to queue only loses the transcript.
+func (cfg *apiConfig) transcribeStage(ctx context.Context, in *videoIngest) error {
+	if cfg.transcriber == nil || in.key == "" {
+		return nil
+	}
+	if in.stored.metadata != nil && in.stored.metadata.AudioCodec == "" {
+		return nil
+	}
+	_, err := cfg.jobs.Enqueue(ctx, jobTranscribeVideo, transcribeVideoPayload{
+		VideoID: in.video.ID,
+		Key:     in.key,
+	})
+	if err != nil {
+		log.Printf("Couldn't queue transcription of video %s: %v", in.video.ID, err)
+	}
+	return nil
+}
+
+// transcribeVideoJob transcribes the sound of a video's upload, keeping the
+// text on the video for search and the timed segments as a generated
+// caption track. A track the owner uploaded in the same language is left
+// alone.
+func (cfg *apiConfig) transcribeVideoJob(ctx context.Context, job jobs.Job) error {
+	var payload transcribeVideoPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	if cfg.transcriber == nil {
+		return nil
+	}
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return nil
+	}
+	store, key, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		return err
+	}
+	if !ok || key != payload.Key {
+		return nil
+	}
+
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(uploadDir)
+	audioPath := filepath.Join(uploadDir, "speech.mp3")
+	srcURL, err := cfg.presignObjectURL(ctx, store, jobPresigner("transcribe", &video.ID), key, aws.ToString(video.VideoVersionID), probeURLExpiry)
+	if err != nil {
+		return err
+	}
+	_, err = ffmpeg.FFmpeg().
+		Input(srcURL).
+		Option("-map", "0:a:0").
+		Option("-ac", "1").
+		Option("-ar", transcriptionSampleRate).
+		Option("-c:a", "libmp3lame").
+		Option("-b:a", transcriptionBitrate).
+		Option("-f", "mp3").
+		Output(audioPath).
+		Run(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't extract audio: %w", err)
+	}
+
+	transcript, err := cfg.transcriber.Transcribe(ctx, audioPath)
+	if errors.Is(err, transcribe.ErrTooLarge) {
+		return jobs.Permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	stale := false
+	_, err = cfg.updateVideo(video.ID, func(current *database.Video) {
+		if current.VideoURL == nil || *current.VideoURL != *video.VideoURL {
+			stale = true
+			return
+		}
+		current.Transcript = &transcript.Text
+	})
+	if errors.Is(err, errVideoDeleted) || stale {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if transcript.Language == "" {
+		return nil
+	}
+	return cfg.saveGeneratedCaptions(ctx, video, transcript)
+}
+
+// saveGeneratedCaptions stores the transcript's segments as the video's
+// caption track in its language, replacing a generated one but never one
+// the owner uploaded. Generated tracks have keys of their own, so one
+// uploaded meanwhile isn't overwritten either.
+func (cfg *apiConfig) saveGeneratedCaptions(ctx context.Context, video database.Video, transcript transcribe.Transcript) error {
+	if len(transcript.Segments) == 0 {
+		return nil
+	}
+	existing, err := cfg.db.GetVideoCaption(video.ID, transcript.Language)
+	if err != nil {
+		return err
+	}
+	if existing.Key != "" && !existing.Generated {
+		return nil
+	}
+
+	store, err := cfg.storeForUser(video.UserID)
+	if err != nil {
+		return err
+	}
+	key, err := joinKey(captionPrefix, video.ID.String(), transcript.Language+".generated.vtt")
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(uploadDir)
+	vttPath := filepath.Join(uploadDir, "captions.vtt")
+	if err := os.WriteFile(vttPath, transcript.WebVTT(), 0o644); err != nil {
+		return err
+	}
+	if err := cfg.uploadFileToS3(ctx, store, key, captionMediaType, vttPath); err != nil {
+		return err
+	}
+	_, err = cfg.db.SaveVideoCaption(database.VideoCaption{
+		VideoID:   video.ID,
+		Language:  transcript.Language,
+		Label:     transcript.Language + " (auto-generated)",
+		Key:       key,
+		Generated: true,
+	})
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const signedAssetURLExpiry = time.Hour
+
+// videoHidden reports whether a viewer with access may not see the video at
+// all.
+func videoHidden(video database.Video, access videoAccess) bool {
+	return video.Visibility == database.VideoVisibilityPrivate && access < videoAccessView
+}
+
+func (cfg *apiConfig) handlerVideoVisibilitySet(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Visibility database.VideoVisibility `json:"visibility"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	switch params.Visibility {
+	case database.VideoVisibilityPrivate, database.VideoVisibilityUnlisted, database.VideoVisibilityPublic:
+	default:
+		respondWithError(w, http.StatusBadRequest, "Visibility must be private, unlisted or public", nil)
+		return
+	}
+	if params.Visibility == database.VideoVisibilityPublic && video.Visibility != database.VideoVisibilityPublic {
+		unmet, err := cfg.unmetPublishGates(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check publish requirements", err)
+			return
+		}
+		if len(unmet) > 0 {
+			respondWithUnmetPublishGates(w, unmet)
+			return
+		}
+	}
+
+	video, err = cfg.updateVideo(video.ID, func(video *database.Video) {
+		video.Visibility = params.Visibility
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedThumbnail(video))
+}
+
+// withSignedThumbnail swaps the thumbnail and preview of a private video for
+// signed, expiring URLs so only whoever was handed the video can load them.
+// The stored URLs are left alone.
+func (cfg *apiConfig) withSignedThumbnail(video database.Video) database.Video {
+	if video.Visibility != database.VideoVisibilityPrivate {
+		return video
+	}
+	video.ThumbnailURL = cfg.signedAssetURL(video.ThumbnailURL)
+	video.ThumbnailPreviewURL = cfg.signedAssetURL(video.ThumbnailPreviewURL)
+	return video
+}
+
+func (cfg *apiConfig) signedAssetURL(assetURL *string) *string {
+	if assetURL == nil {
+		return nil
+	}
+	assetPath, ok := strings.CutPrefix(*assetURL, cfg.getAssetURL(""))
+	if !ok {
+		return assetURL
+	}
+	expires := cfg.now().Add(signedAssetURLExpiry).Unix()
+	signed := cfg.getAssetURL(assetPath) + "?expires=" + strconv.FormatInt(expires, 10) + "&sig=" + cfg.assetSignature(assetPath, expires)
+	return &signed
+}
+
+func (cfg *apiConfig) assetSignature(assetPath string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.urlSigningSecret))
+	mac.Write([]byte("asset\x00" + assetPath + "\x00" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// privateAssetMiddleware refuses thumbnails of private videos unless the
+// request carries a valid signature from withSignedThumbnail. Every other
+// asset is served as before. Thumbnails get their ETag, which the file
+// server checks If-None-Match against, and may be kept if revalidated.
+func (cfg *apiConfig) privateAssetMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assetPath := strings.TrimPrefix(r.URL.Path, "/assets/")
+		video, err := cfg.db.GetVideoByThumbnailURL(cfg.getAssetURL(assetPath))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check asset access", err)
+			return
+		}
+		if video.Visibility == database.VideoVisibilityPrivate && !cfg.validAssetSignature(r, assetPath) {
+			respondWithError(w, http.StatusNotFound, "Not found", nil)
+			return
+		}
+		if video.ThumbnailETag != nil && video.ThumbnailURL != nil && *video.ThumbnailURL == cfg.getAssetURL(assetPath) {
+			w.Header().Set("ETag", quotedETag(*video.ThumbnailETag))
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (cfg *apiConfig) validAssetSignature(r *http.Request, assetPath string) bool {
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || cfg.now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(cfg.assetSignature(assetPath, expires)))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/uuid"
+)
+
+// files are only ingested once nothing has written to them for this long,
+// so exports that are still being copied in aren't picked up half-written
+const watchFolderSettleTime = 5 * time.Second
+
+// startWatchFolder ingests every video file that appears in dir as a video owned by
+// userID. Successfully ingested files are removed; failures are moved to a
+// "failed" subdirectory so they aren't retried in a loop.
+func (cfg *apiConfig) startWatchFolder(dir string, userID uuid.UUID) error {
+	failedDir := filepath.Join(dir, "failed")
+	err := os.MkdirAll(failedDir, 0755)
+	if err != nil {
+		return fmt.Errorf("couldn't create watch folder: %w", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("couldn't create watcher: %w", err)
+	}
+	err = watcher.Add(dir)
+	if err != nil {
+		watcher.Close()
+		return fmt.Errorf("couldn't watch %s: %w", dir, err)
+	}
+
+	var mu sync.Mutex
+	timers := map[string]*time.Timer{}
+
+	schedule := func(filePath string) {
+		if !isVideoFilename(filePath) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if timer, ok := timers[filePath]; ok {
+			timer.Reset(watchFolderSettleTime)
+			return
+		}
+		timers[filePath] = time.AfterFunc(watchFolderSettleTime, func() {
+			mu.Lock()
+			delete(timers, filePath)
+			mu.Unlock()
+			cfg.ingestWatchedFile(filePath, failedDir, userID)
+		})
+	}
+
+	// pick up anything that was dropped in while the server was down
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		watcher.Close()
+		return fmt.Errorf("couldn't read watch folder: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			schedule(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+					schedule(event.Name)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("watch folder: %v", err)
+			}
+		}
+	}()
+
+	log.Printf("Watching %s for new videos", dir)
+	return nil
+}
+
+func (cfg *apiConfig) ingestWatchedFile(filePath, failedDir string, userID uuid.UUID) {
+	if _, err := os.Stat(filePath); err != nil {
+		return
+	}
+
+	video, err := cfg.ingestNewVideoFile(context.Background(), userID, filePath)
+	if err != nil {
+		log.Printf("watch folder: couldn't ingest %s: %v", filePath, err)
+		if err := os.Rename(filePath, filepath.Join(failedDir, filepath.Base(filePath))); err != nil {
+			log.Printf("watch folder: couldn't move %s to failed: %v", filePath, err)
+		}
+		return
+	}
+
+	os.Remove(filePath)
+	log.Printf("watch folder: ingested %s as video %s", filePath, video.ID)
+}
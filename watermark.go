@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/google/uuid"
+)
+
+// per-viewer renditions are cached here, one per viewer and source upload
+const watermarkPrefix = "watermarks"
+
+// how long clients should wait before asking again while a rendition renders
+const watermarkRetryAfter = "15"
+
+// watermarkRenders keeps one render per rendition in flight.
+type watermarkRenders struct {
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+func (w *watermarkRenders) start(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.inFlight[key] {
+		return false
+	}
+	w.inFlight[key] = true
+	return true
+}
+
+func (w *watermarkRenders) finish(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.inFlight, key)
+}
+
+// watermarkRequired reports whether a viewer with access may only be served
+// a rendition with their identity burned in. Owners and editors always get
+// the original.
+func watermarkRequired(video database.Video, access videoAccess) bool {
+	return video.WatermarkViewers && access < videoAccessEdit
+}
+
+// watermarkKey is where the rendition of the upload at srcKey for viewerID
+// lives. A new upload has a new key, so stale renditions are never served.
+func watermarkKey(videoID, viewerID uuid.UUID, srcKey string) string {
+	return path.Join(watermarkPrefix, videoID.String(), viewerID.String(), path.Base(srcKey))
+}
+
+func (cfg *apiConfig) handlerVideoWatermarkSet(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Enabled bool `json:"enabled"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err = cfg.updateVideo(video.ID, func(video *database.Video) {
+		video.WatermarkViewers = params.Enabled
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedThumbnail(video))
+}
+
+// watermarkedRendition returns the key of the viewer's rendition of the
+// upload at srcKey, or false if it isn't ready yet, in which case a render
+// has been started.
+func (cfg *apiConfig) watermarkedRendition(ctx context.Context, store objectStore, video database.Video, srcKey string, viewerID uuid.UUID) (string, bool, error) {
+	key := watermarkKey(video.ID, viewerID, srcKey)
+	_, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return key, true, nil
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return "", false, err
+	}
+
+	if cfg.watermarkRenders.start(store.bucket + "/" + key) {
+		go func() {
+			defer cfg.watermarkRenders.finish(store.bucket + "/" + key)
+			if err := cfg.renderWatermark(context.Background(), store, video, srcKey, key, viewerID); err != nil {
+				log.Printf("watermark: couldn't render %s: %v", key, err)
+			}
+		}()
+	}
+	return key, false, nil
+}
+
+// renderWatermark burns the viewer's email and ID into the upload at srcKey
+// and stores the result at key, next to the source. ffmpeg reads the source
+// over a presigned URL, so only the output touches the spool.
+func (cfg *apiConfig) renderWatermark(ctx context.Context, store objectStore, video database.Video, srcKey, key string, viewerID uuid.UUID) error {
+	viewer, err := cfg.db.GetUser(viewerID)
+	if err != nil {
+		return fmt.Errorf("couldn't get viewer: %w", err)
+	}
+	if viewer == nil {
+		return errors.New("viewer doesn't exist")
+	}
+
+	uploadDir, err := cfg.newUploadDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(uploadDir)
+
+	// drawtext reads the text from a file so nothing in it needs escaping
+	textPath := filepath.Join(uploadDir, "watermark.txt")
+	if err := os.WriteFile(textPath, []byte(viewer.Email+"  "+viewer.ID.String()), 0o600); err != nil {
+		return err
+	}
+	outputPath := filepath.Join(uploadDir, "watermarked.mp4")
+
+	srcURL, err := cfg.presignObjectURL(ctx, store, jobPresigner("watermark", &video.ID), srcKey, aws.ToString(video.VideoVersionID), probeURLExpiry)
+	if err != nil {
+		return err
+	}
+	_, err = ffmpeg.FFmpeg().
+		Input(srcURL).
+		Option("-vf", watermarkFilter(textPath)).
+		Option("-c:v", "libx264").
+		Option("-preset", "veryfast").
+		Option("-crf", "23").
+		Option("-c:a", "copy").
+		Option("-movflags", "+faststart").
+		Option("-f", "mp4").
+		Output(outputPath).
+		Run(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't render watermark: %w", err)
+	}
+
+	return cfg.uploadFileToS3(ctx, store, key, "video/mp4", outputPath)
+}
+
+// watermarkFilter draws the text faintly across the lower third, where
+// cropping it out would ruin the picture, and again small in the corner.
+func watermarkFilter(textPath string) string {
+	// filter arguments are split on ':' and unescaped on '\'
+	escaped := strings.NewReplacer(`\`, `\\`, `:`, `\:`, `'`, `\'`).Replace(textPath)
+	return fmt.Sprintf(
+		"drawtext=textfile='%[1]s':fontcolor=white@0.25:fontsize=h/18:x=(w-text_w)/2:y=h*2/3,"+
+			"drawtext=textfile='%[1]s':fontcolor=white@0.5:fontsize=h/40:x=w-text_w-10:y=10",
+		escaped,
+	)
+}
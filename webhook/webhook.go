@@ -0,0 +1,146 @@
+// Package webhook signs Tubely webhook deliveries and lets receivers verify
+// them.
+//
+// Every delivery carries a Unix timestamp, a delivery ID and an HMAC-SHA256
+// signature of "<timestamp>.<delivery ID>.<body>" keyed with the endpoint's
+// secret; the ID is empty when none is sent. Receivers should call
+// VerifyRequest (or Verify) before trusting a payload; deliveries whose
+// timestamp is outside the tolerance window are rejected so a captured
+// request can't be replayed later, and a ReplayGuard catches one replayed
+// within the window, since its ID can't be changed without the secret.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderTimestamp = "Tubely-Timestamp"
+	HeaderSignature = "Tubely-Signature"
+	HeaderDelivery  = "Tubely-Delivery"
+
+	signaturePrefix = "sha256="
+
+	// DefaultTolerance is how far a delivery's timestamp may drift from the
+	// receiver's clock before it is rejected.
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrMissingSignature = errors.New("webhook: missing signature headers")
+	ErrInvalidSignature = errors.New("webhook: signature mismatch")
+	ErrExpired          = errors.New("webhook: timestamp outside tolerance")
+	ErrReplayed         = errors.New("webhook: delivery already received")
+)
+
+// Sign returns the signature header value for body sent at timestamp as
+// deliveryID.
+func Sign(secret string, timestamp time.Time, deliveryID string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s.", timestamp.Unix(), deliveryID)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the timestamp, signature and delivery ID headers on req.
+// body must be the exact bytes sent as the request body.
+func SignRequest(req *http.Request, secret, deliveryID string, body []byte) {
+	now := time.Now()
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HeaderSignature, Sign(secret, now, deliveryID, body))
+	if deliveryID != "" {
+		req.Header.Set(HeaderDelivery, deliveryID)
+	}
+}
+
+// Verify checks the signature headers against body. tolerance bounds the
+// accepted clock difference, zero means DefaultTolerance.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+
+	timestampHeader := header.Get(HeaderTimestamp)
+	signature := header.Get(HeaderSignature)
+	if timestampHeader == "" || !strings.HasPrefix(signature, signaturePrefix) {
+		return ErrMissingSignature
+	}
+
+	unix, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return ErrMissingSignature
+	}
+	timestamp := time.Unix(unix, 0)
+	if age := time.Since(timestamp); age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+
+	expected := Sign(secret, timestamp, header.Get(HeaderDelivery), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyRequest reads and verifies the body of an incoming delivery,
+// returning the body so it can be decoded afterwards.
+func VerifyRequest(r *http.Request, secret string, tolerance time.Duration) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: couldn't read body: %w", err)
+	}
+	if err := Verify(secret, r.Header, body, tolerance); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// ReplayGuard remembers delivery IDs for the tolerance window so a delivery
+// replayed while its timestamp is still fresh is also rejected. IDs are
+// only trustworthy once Verify has passed. It is safe for concurrent use.
+type ReplayGuard struct {
+	mu        sync.Mutex
+	tolerance time.Duration
+	seen      map[string]time.Time
+}
+
+func NewReplayGuard(tolerance time.Duration) *ReplayGuard {
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	return &ReplayGuard{tolerance: tolerance, seen: map[string]time.Time{}}
+}
+
+// Check records deliveryID and reports ErrReplayed if it was seen within
+// twice the tolerance window, which covers the full range of timestamps
+// Verify accepts.
+func (g *ReplayGuard) Check(deliveryID string) error {
+	if deliveryID == "" {
+		return ErrMissingSignature
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for id, seenAt := range g.seen {
+		if now.Sub(seenAt) > 2*g.tolerance {
+			delete(g.seen, id)
+		}
+	}
+	if _, ok := g.seen[deliveryID]; ok {
+		return ErrReplayed
+	}
+	g.seen[deliveryID] = now
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/jobs"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/webhook"
+	"github.com/google/uuid"
+)
+
+const (
+	// how long a receiver gets to answer one delivery
+	webhookTimeout = 10 * time.Second
+	// with the queue's backoff, a receiver can be down for about an hour
+	// before a delivery is given up on
+	webhookDeliveryAttempts = 8
+	maxWebhooksPerUser      = 10
+)
+
+// webhookEvent is the body of a delivery, sent when one of the user's
+// videos reaches ready or failed.
+type webhookEvent struct {
+	ID         uuid.UUID            `json:"id"`
+	Event      string               `json:"event"`
+	OccurredAt time.Time            `json:"occurred_at"`
+	VideoID    uuid.UUID            `json:"video_id"`
+	Status     database.VideoStatus `json:"status"`
+	Duration   *float64             `json:"duration"`
+	// the stored upload and what was made from it, as keys in the video's
+	// bucket
+	Key             string             `json:"key,omitempty"`
+	HLSMasterKey    *string            `json:"hls_master_key"`
+	DASHManifestKey *string            `json:"dash_manifest_key"`
+	Renditions      []webhookRendition `json:"renditions"`
+}
+
+type webhookRendition struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bitrate int64  `json:"bitrate"`
+}
+
+// deliverWebhookPayload is one delivery waiting in the job queue. The body
+// is built when the event happens, so retries send the same thing.
+type deliverWebhookPayload struct {
+	WebhookID  uuid.UUID       `json:"webhook_id"`
+	DeliveryID uuid.UUID       `json:"delivery_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// newWebhookClient returns the client deliveries are sent with. Like URL
+// ingests, it won't reach private addresses unless allowPrivate, and it
+// doesn't follow redirects, which would turn the POST into a GET.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	client := newIngestClient(allowPrivate)
+	client.Timeout = webhookTimeout
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}
+
+// queueVideoWebhooks queues a delivery of the video's status to each of its
+// owner's webhooks. Failing to queue only loses the deliveries.
+func (cfg *apiConfig) queueVideoWebhooks(video database.Video) {
+	hooks, err := cfg.db.GetWebhooks(video.UserID)
+	if err != nil {
+		log.Printf("Couldn't get webhooks for video %s: %v", video.ID, err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	event, err := cfg.newWebhookEvent(video)
+	if err != nil {
+		log.Printf("Couldn't build webhook event for video %s: %v", video.ID, err)
+		return
+	}
+	for _, hook := range hooks {
+		// each delivery has its own ID, for receivers to spot retries by
+		event.ID = uuid.New()
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Couldn't encode webhook event for video %s: %v", video.ID, err)
+			return
+		}
+		_, err = cfg.jobs.Enqueue(context.Background(), jobDeliverWebhook, deliverWebhookPayload{
+			WebhookID:  hook.ID,
+			DeliveryID: event.ID,
+			Body:       body,
+		})
+		if err != nil {
+			log.Printf("Couldn't queue webhook %s for video %s: %v", hook.ID, video.ID, err)
+		}
+	}
+}
+
+func (cfg *apiConfig) newWebhookEvent(video database.Video) (webhookEvent, error) {
+	event := webhookEvent{
+		Event:           "video." + string(video.Status),
+		OccurredAt:      cfg.now().UTC(),
+		VideoID:         video.ID,
+		Status:          video.Status,
+		Duration:        video.Duration,
+		HLSMasterKey:    video.HLSMasterKey,
+		DASHManifestKey: video.DASHManifestKey,
+		Renditions:      []webhookRendition{},
+	}
+	if video.Status != database.VideoStatusReady {
+		return event, nil
+	}
+	_, key, ok, err := cfg.storeForVideo(video)
+	if err != nil {
+		return event, err
+	}
+	if ok {
+		event.Key = key
+	}
+	renditions, err := cfg.db.GetVideoRenditions(video.ID)
+	if err != nil {
+		return event, err
+	}
+	for _, rendition := range renditions {
+		event.Renditions = append(event.Renditions, webhookRendition{
+			Name:    rendition.Name,
+			Key:     rendition.Key,
+			Width:   rendition.Width,
+			Height:  rendition.Height,
+			Bitrate: rendition.Bitrate,
+		})
+	}
+	return event, nil
+}
+
+// deliverWebhookJob POSTs a queued delivery, signed with the webhook's
+// secret. Network errors, 429s and 5xxs are retried; any other answer that
+// isn't a 2xx means the receiver doesn't want it.
+func (cfg *apiConfig) deliverWebhookJob(ctx context.Context, job jobs.Job) error {
+	var payload deliverWebhookPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	hook, err := cfg.db.GetWebhook(payload.WebhookID)
+	if err != nil {
+		return err
+	}
+	// deleted since
+	if hook.ID == uuid.Nil {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(payload.Body))
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	webhook.SignRequest(req, hook.Secret, payload.DeliveryID.String(), payload.Body)
+	resp, err := cfg.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook %s answered %s", hook.ID, resp.Status)
+	default:
+		return jobs.Permanent(fmt.Errorf("webhook %s answered %s", hook.ID, resp.Status))
+	}
+}
+
+// handlerWebhookCreate registers a URL to be told when the user's videos
+// finish processing. The response has the secret deliveries are signed
+// with, which isn't shown again.
+func (cfg *apiConfig) handlerWebhookCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL string `json:"url"`
+	}
+	type response struct {
+		database.Webhook
+		Secret string `json:"secret"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	target, err := url.Parse(params.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		respondWithError(w, http.StatusBadRequest, "url must be an http or https URL", err)
+		return
+	}
+
+	hooks, err := cfg.db.GetWebhooks(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get webhooks", err)
+		return
+	}
+	if len(hooks) >= maxWebhooksPerUser {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Users can have at most %d webhooks", maxWebhooksPerUser), nil)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate webhook secret", err)
+		return
+	}
+	hook, err := cfg.db.CreateWebhook(userID, target.String(), hex.EncodeToString(secret))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create webhook", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, response{Webhook: hook, Secret: hook.Secret})
+}
+
+func (cfg *apiConfig) handlerWebhooksRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	hooks, err := cfg.db.GetWebhooks(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get webhooks", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, hooks)
+}
+
+func (cfg *apiConfig) handlerWebhookDelete(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := uuid.Parse(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwt)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	if err := cfg.db.DeleteWebhook(userID, webhookID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete webhook", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}